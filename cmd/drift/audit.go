@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/metalgrid/drift/internal/audit"
+	"github.com/metalgrid/drift/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+const auditUsage = `usage: drift audit [-peer <name>] [-type <type>] [-since <duration>] [-json]
+
+Print the security audit log: handshakes, trust decisions and rejections, oldest first.
+
+  -peer <name>        only events about the peer with this name
+  -type <type>        only events of this type: handshake, key_pinned, key_changed, pairing,
+                        policy, blocked, refused or integrity
+  -since <duration>   only events of the last duration, such as 24h
+  -json               print the events as JSON lines, as stored`
+
+// runAudit queries the audit log.
+func runAudit(args []string) {
+	cfg, err := config.Load(config.DefaultPath())
+	if err != nil {
+		cfg = config.DefaultConfig()
+	}
+
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, auditUsage) }
+	peer := flags.String("peer", "", "")
+	eventType := flags.String("type", "", "")
+	since := flags.Duration("since", 0, "")
+	asJSON := flags.Bool("json", false, "")
+	_ = flags.Parse(args)
+	if flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	filter := audit.Filter{Peer: *peer, Type: audit.Type(*eventType)}
+	if *since > 0 {
+		filter.Since = time.Now().Add(-*since)
+	}
+	events, err := audit.Read(cfg.AuditLog, filter)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed reading audit log")
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range events {
+			_ = enc.Encode(e)
+		}
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tTYPE\tPEER\tKEY\tADDRESS\tRESULT\tDETAIL")
+	for _, e := range events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Local().Format(time.DateTime), e.Type,
+			orDash(printable(e.Peer)), orDash(shortKey(e.Key)), orDash(printable(e.Address)), orDash(printable(e.Result)), orDash(printable(e.Detail)))
+	}
+	_ = w.Flush()
+}
+
+// printable quotes text that came from peers, such as instance names, filenames and
+// their error messages, if it holds anything but printable characters, so that control
+// characters cannot fake or hide rows on the terminal.
+func printable(s string) string {
+	for _, r := range s {
+		if !strconv.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+// shortKey abbreviates a hex key to its first 16 digits, which tell peers apart.
+func shortKey(key string) string {
+	if len(key) > 16 {
+		return key[:16] + "…"
+	}
+	return key
+}
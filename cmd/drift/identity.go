@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/metalgrid/drift/internal/config"
+	"github.com/metalgrid/drift/internal/keyring"
+	"github.com/metalgrid/drift/internal/secret"
+	"github.com/rs/zerolog/log"
+	"rsc.io/qr"
+)
+
+const identityUsage = `usage: drift identity [show | qr | rotate | export [file]]
+
+  show           print this device's public key, its fingerprint and where its identity key is stored,
+                 which is the Secret Service keyring when there is one
+  qr             print the fingerprint as a QR code, for a peer to scan
+  rotate         replace the identity key, keeping the previous one with an .old suffix
+  export [file]  write the identity key to file, or to standard output`
+
+// runIdentity manages the identity key configured for this device.
+func runIdentity(args []string) {
+	cfg, err := config.Load(config.DefaultPath())
+	if err != nil {
+		cfg = config.DefaultConfig()
+	}
+
+	command := "show"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	store := keyring.IdentityStore(cfg.IdentityKey)
+	switch command {
+	case "show":
+		id, created, err := store.LoadOrCreate()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed loading identity key")
+		}
+		if created {
+			fmt.Fprintln(os.Stderr, "Created a new identity key.")
+		}
+		fmt.Printf("Public key:  %x\n", *id.PublicKey)
+		fmt.Printf("Fingerprint: %s\n", secret.Fingerprint(id.PublicKey))
+		fmt.Printf("Key file:    %s\n", cfg.IdentityKey)
+		if store.Keyring != nil {
+			fmt.Println("Stored in:   the Secret Service keyring, which the key file refers to")
+		}
+	case "qr":
+		id, err := store.Load()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed loading identity key")
+		}
+		fingerprint := secret.Fingerprint(id.PublicKey)
+		code, err := qr.Encode(fingerprint, qr.M)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed encoding fingerprint")
+		}
+		printQR(os.Stdout, code)
+		fmt.Println(fingerprint)
+	case "rotate":
+		id, err := store.Rotate()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed rotating identity key")
+		}
+		fmt.Printf("New public key: %x\n", *id.PublicKey)
+		fmt.Println("Restart drift to start using it. Peers will see this device as a new one.")
+	case "export":
+		id, err := store.Load()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed loading identity key")
+		}
+		if len(args) < 2 {
+			_, _ = os.Stdout.Write(id.MarshalPEM())
+			return
+		}
+		if err := os.WriteFile(args[1], id.MarshalPEM(), 0600); err != nil {
+			log.Fatal().Err(err).Msg("failed exporting identity key")
+		}
+	default:
+		fmt.Fprintln(os.Stderr, identityUsage)
+		os.Exit(2)
+	}
+}
+
+// printQR prints a QR code with block characters, two rows of modules per line. It
+// draws the light modules and the quiet zone around the code, so that the dark modules
+// take the background of the terminal, which is assumed to be dark.
+func printQR(w io.Writer, code *qr.Code) {
+	const quietZone = 2
+	dark := func(x, y int) bool {
+		x, y = x-quietZone, y-quietZone
+		if x < 0 || y < 0 || x >= code.Size || y >= code.Size {
+			return false
+		}
+		return code.Black(x, y)
+	}
+	size := code.Size + 2*quietZone
+	var b strings.Builder
+	for y := 0; y < size; y += 2 {
+		for x := range size {
+			upper, lower := !dark(x, y), !dark(x, y+1)
+			switch {
+			case upper && lower:
+				b.WriteString("█")
+			case upper:
+				b.WriteString("▀")
+			case lower:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\n")
+	}
+	_, _ = io.WriteString(w, b.String())
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/metalgrid/drift/internal/config"
+	"github.com/metalgrid/drift/internal/trust"
+	"github.com/rs/zerolog/log"
+)
+
+const peersUsage = `usage: drift peers [list | forget <name> | policy <name> <policy> | block <name|key> | unblock <name|key> | blocked]
+
+  list                    print the known peers and the keys pinned for them
+  forget <name>           remove the pinned key of a peer, trusting its next key on first use
+  policy <name> <policy>  answer offers from a peer without asking, where policy is one of
+                            ask               ask about every offer (the default)
+                            accept            accept every offer
+                            accept-under <N>  accept offers up to N MiB and ask about larger ones
+                            decline           decline every offer
+  block <name|key>        refuse connections from a peer, by its name and pinned key, or by a key
+  unblock <name|key>      remove the blocklist entries for a name or key
+  blocked                 print the blocklist`
+
+// runPeers manages the keys pinned for known peers and the blocklist.
+func runPeers(args []string) {
+	cfg, err := config.Load(config.DefaultPath())
+	if err != nil {
+		cfg = config.DefaultConfig()
+	}
+	known := trust.NewStore(cfg.KnownPeers)
+	blocked := trust.NewBlocklist(cfg.BlockedPeers)
+
+	command := "list"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch {
+	case command == "list":
+		peers, err := known.List()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed reading known peers")
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tKEY\tFIRST SEEN\tLAST SEEN\tVERIFIED\tPOLICY")
+		for _, p := range peers {
+			verified := "no"
+			if p.Verified {
+				verified = "yes"
+			}
+			var policy trust.Policy
+			if p.Policy != nil {
+				policy = *p.Policy
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", printable(p.Instance), p.Key,
+				p.FirstSeen.Local().Format(time.DateTime), p.LastSeen.Local().Format(time.DateTime), verified, policy)
+		}
+		_ = w.Flush()
+	case command == "forget" && len(args) == 2:
+		if err := known.Forget(args[1]); err != nil {
+			log.Fatal().Err(err).Msg("failed forgetting peer")
+		}
+		fmt.Printf("Forgot %s. Its next key will be trusted on first use.\n", args[1])
+	case command == "policy" && len(args) >= 3:
+		policy, err := trust.ParsePolicy(args[2:]...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, peersUsage)
+			os.Exit(2)
+		}
+		if err := known.SetPolicy(args[1], policy); err != nil {
+			log.Fatal().Err(err).Msg("failed setting peer policy")
+		}
+		fmt.Printf("Offers from %s: %s.\n", args[1], policy)
+	case command == "block" && len(args) == 2:
+		if err := blockPeer(known, blocked, args[1]); err != nil {
+			log.Fatal().Err(err).Msg("failed blocking peer")
+		}
+		fmt.Printf("Blocked %s. Its connections will be refused.\n", args[1])
+	case command == "unblock" && len(args) == 2:
+		if err := blocked.Unblock(args[1]); err != nil {
+			log.Fatal().Err(err).Msg("failed unblocking peer")
+		}
+		fmt.Printf("Unblocked %s.\n", args[1])
+	case command == "blocked":
+		list, err := blocked.List()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed reading blocklist")
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tKEY\tSINCE")
+		for _, b := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", orDash(printable(b.Instance)), orDash(b.Key), b.Since.Local().Format(time.DateTime))
+		}
+		_ = w.Flush()
+	default:
+		fmt.Fprintln(os.Stderr, peersUsage)
+		os.Exit(2)
+	}
+}
+
+// blockPeer blocks a hex-encoded identity key, or a peer name together with the key
+// pinned for it, if any.
+func blockPeer(known *trust.Store, blocked *trust.Blocklist, name string) error {
+	if key, err := hex.DecodeString(name); err == nil && len(key) == 32 {
+		return blocked.Block("", key)
+	}
+	var key []byte
+	if pinned, err := known.Get(name); err == nil {
+		key, _ = hex.DecodeString(pinned.Key)
+	}
+	return blocked.Block(name, key)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
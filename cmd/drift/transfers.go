@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/rs/zerolog/log"
+)
+
+const transfersUsage = `usage: drift transfers [list | get <id> | cancel <id>]
+
+Query the transfers of the running drift, which it serves on the session bus.
+
+  list         print the transfers in flight and recently finished, oldest first
+  get <id>     print a transfer in detail
+  cancel <id>  stop a transfer in flight, on both sides`
+
+// The name, object and interface of the D-Bus service of the running drift.
+const (
+	driftBusName = "com.github.metalgrid.Drift"
+	driftObjPath = dbus.ObjectPath("/com/github/metalgrid/Drift")
+	driftIface   = "com.github.metalgrid.Drift"
+)
+
+// busTransfer is a transfer as the D-Bus service returns it, with the signature (ssssssxx).
+type busTransfer struct {
+	ID          string
+	Direction   string
+	Peer        string
+	Description string
+	State       string
+	Error       string
+	Bytes       int64
+	TotalBytes  int64
+}
+
+var errNotRunning = errors.New("drift is not running")
+
+// runTransfers lists and cancels the transfers of the running drift.
+func runTransfers(args []string) {
+	command := "list"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch {
+	case command == "list" && len(args) <= 1:
+		var transfers []busTransfer
+		if err := callDrift("ListTransfers", &transfers); err != nil {
+			log.Fatal().Err(err).Msg("failed listing transfers")
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tDIRECTION\tPEER\tDESCRIPTION\tSTATE\tPROGRESS")
+		for _, t := range transfers {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.Direction, printable(t.Peer), printable(t.Description), t.State, progress(t))
+		}
+		_ = w.Flush()
+	case command == "get" && len(args) == 2:
+		var t busTransfer
+		if err := callDrift("GetTransfer", &t, args[1]); err != nil {
+			log.Fatal().Err(err).Msg("failed getting transfer")
+		}
+		fmt.Printf("ID:          %s\n", t.ID)
+		fmt.Printf("Direction:   %s\n", t.Direction)
+		fmt.Printf("Peer:        %s\n", printable(t.Peer))
+		fmt.Printf("Description: %s\n", printable(t.Description))
+		fmt.Printf("State:       %s\n", t.State)
+		fmt.Printf("Progress:    %s\n", progress(t))
+		if t.Error != "" {
+			fmt.Printf("Error:       %s\n", printable(t.Error))
+		}
+	case command == "cancel" && len(args) == 2:
+		if err := callDrift("Cancel", nil, args[1]); err != nil {
+			log.Fatal().Err(err).Msg("failed cancelling transfer")
+		}
+		fmt.Printf("Cancelling %s.\n", args[1])
+	default:
+		fmt.Fprintln(os.Stderr, transfersUsage)
+		os.Exit(2)
+	}
+}
+
+// callDrift calls a method of the running drift and stores its reply in reply, unless nil.
+func callDrift(method string, reply any, args ...any) error {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return fmt.Errorf("%w: %w", errNotRunning, err)
+	}
+	var running bool
+	if err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, driftBusName).Store(&running); err != nil {
+		return err
+	}
+	if !running {
+		return errNotRunning
+	}
+
+	call := conn.Object(driftBusName, driftObjPath).Call(driftIface+"."+method, 0, args...)
+	var dbusErr dbus.Error
+	switch {
+	case errors.As(call.Err, &dbusErr) && dbusErr.Name == driftIface+".NoSuchTransfer":
+		return fmt.Errorf("no such transfer: %s", args[0])
+	case errors.As(call.Err, &dbusErr) && dbusErr.Name == driftIface+".TransferFinished":
+		return fmt.Errorf("transfer already finished: %s", args[0])
+	case call.Err != nil:
+		return call.Err
+	case reply == nil:
+		return nil
+	}
+	return call.Store(reply)
+}
+
+// progress describes how much of a transfer is done.
+func progress(t busTransfer) string {
+	if t.TotalBytes <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d%% of %s", t.Bytes*100/t.TotalBytes, formatBytes(t.TotalBytes))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
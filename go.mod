@@ -1,8 +1,9 @@
 module github.com/metalgrid/drift
 
-go 1.23.3
+go 1.24
 
 require (
+	filippo.io/edwards25519 v1.1.0
 	github.com/BurntSushi/toml v1.6.0
 	github.com/adrg/xdg v0.5.3
 	github.com/betamos/zeroconf v0.1.5
@@ -12,6 +13,8 @@ require (
 	github.com/rs/zerolog v1.33.0
 	github.com/tailscale/walk v0.0.0-20241202161857-349077283e47
 	golang.org/x/crypto v0.29.0
+	golang.org/x/sys v0.27.0
+	rsc.io/qr v0.2.0
 )
 
 require (
@@ -26,7 +29,6 @@ require (
 	golang.org/x/mod v0.22.0 // indirect
 	golang.org/x/net v0.31.0 // indirect
 	golang.org/x/sync v0.9.0 // indirect
-	golang.org/x/sys v0.27.0 // indirect
 	golang.org/x/tools v0.27.0 // indirect
 	gopkg.in/Knetic/govaluate.v3 v3.0.0 // indirect
 )
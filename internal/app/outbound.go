@@ -0,0 +1,189 @@
+package app
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/metalgrid/drift/internal/audit"
+	"github.com/metalgrid/drift/internal/platform"
+	"github.com/metalgrid/drift/internal/secret"
+	"github.com/metalgrid/drift/internal/transfer"
+	"github.com/metalgrid/drift/internal/transport"
+	"github.com/metalgrid/drift/internal/trust"
+	"github.com/metalgrid/drift/internal/zeroconf"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	maxResumeAttempts = 5
+	resumeBackoff     = 2 * time.Second
+)
+
+// errKeyChanged refuses to send to a peer that authenticated with another key than the
+// one pinned for it on first contact.
+var errKeyChanged = errors.New("the peer's identity key has changed since first contact")
+
+// dialPeer connects to a discovered peer and completes the secure and HELLO handshakes.
+func dialPeer(ctx context.Context, peers *zeroconf.Peers, known *trust.Store, secure *secret.Config, instance string) (*transport.Conn, error) {
+	peer := peers.GetByInstance(instance)
+	if peer == nil {
+		return nil, fmt.Errorf("user %s not found", instance)
+	}
+
+	if err := transport.CheckAdvertisedVersion(peer.GetRecord("v")); err != nil {
+		return nil, err
+	}
+
+	if len(peer.Addresses) == 0 {
+		return nil, fmt.Errorf("peer %s has no known address", peer.GetInstance())
+	}
+
+	target := net.JoinHostPort(peer.Addresses[0].String(), strconv.Itoa(peer.Port))
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to peer: %w", err)
+	}
+
+	pk, err := hex.DecodeString(peer.GetRecord("pk"))
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("unable to retrieve peer's public key: %w", err)
+	}
+
+	var peerpk [32]byte
+	copy(peerpk[:], pk)
+
+	sc, remote, err := secret.ClientHandshake(conn, secure, &peerpk, secure.KeyExchangeFor(peer.GetRecord("kex")))
+	if err != nil {
+		audit.Record(audit.Event{Type: audit.Handshake, Peer: peer.GetInstance(), Key: hex.EncodeToString(pk), Address: target, Result: "failed", Detail: err.Error()})
+		_ = conn.Close()
+		return nil, fmt.Errorf("unable to secure connection with peer: %w", err)
+	}
+	audit.Record(audit.Event{Type: audit.Handshake, Peer: peer.GetInstance(), Key: hex.EncodeToString(remote[:]), Address: target, Result: "ok", Detail: "outbound"})
+	authenticated := authenticatedPeer(known, sc, peer.GetInstance(), remote)
+	if authenticated.KeyChanged {
+		_ = sc.Close()
+		return nil, fmt.Errorf("%w: to trust the new key, run: drift peers forget %q", errKeyChanged, peer.GetInstance())
+	}
+
+	tc, err := transport.InitiateHandshake(sc)
+	if err != nil {
+		audit.Record(audit.Event{Type: audit.Handshake, Peer: peer.GetInstance(), Key: hex.EncodeToString(remote[:]), Address: target, Result: "failed", Detail: err.Error()})
+		_ = sc.Close()
+		return nil, err
+	}
+	tc.SetPeer(authenticated)
+	tc.SetIdentity(secure.Identity)
+	return tc, nil
+}
+
+// sendRequest offers the files of a request to a peer. If the connection breaks off
+// after the peer accepted and both sides support resuming, the peer is redialed and the
+// same transfer is offered again, so that the receiver continues where it left off.
+// The transfer is tracked by transfers from the start, and cancelling it there cancels ctx.
+func sendRequest(ctx context.Context, peers *zeroconf.Peers, gw platform.Gateway, transfers *transfer.Manager, known *trust.Store, secure *secret.Config, request platform.Request) {
+	if len(request.Files) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	id := transfers.Add(transfer.Outbound, request.To, describeRequest(request.Files), cancel)
+
+	outbound := transport.NewOutboundTransferState()
+	outbound.Track(id)
+	for attempt := 1; ; attempt++ {
+		tc, err := dialPeer(ctx, peers, known, secure, request.To)
+		if err != nil {
+			if attempt == 1 || attempt > maxResumeAttempts || ctx.Err() != nil || errors.Is(err, errKeyChanged) {
+				gw.Notify(fmt.Sprintf("Unable to send to %s: %s", request.To, err))
+				finishTransfer(ctx, transfers, id, err)
+				return
+			}
+			log.Warn().Str("peer", request.To).Int("attempt", attempt).Err(err).Msg("failed redialing peer")
+			if !sleep(ctx, time.Duration(attempt)*resumeBackoff) {
+				finishTransfer(ctx, transfers, id, ctx.Err())
+				return
+			}
+			continue
+		}
+
+		go transport.HandleConnection(ctx, tc, gw, transfers, outbound)
+		if len(request.Files) > 1 {
+			err = transport.SendBatch(request.Files, tc, outbound)
+			if err != nil {
+				gw.Notify(fmt.Sprintf("Unable to send batch offer: %s", err))
+			}
+		} else {
+			err = transport.SendFile(request.Files[0], tc, outbound)
+			if err != nil {
+				gw.Notify(fmt.Sprintf("Unable to send file offer: %s", err))
+			}
+		}
+		if err != nil {
+			_ = tc.Close()
+			finishTransfer(ctx, transfers, id, err)
+			return
+		}
+		_ = transfers.SetState(id, transfer.AwaitingAnswer, nil)
+
+		err = outbound.Wait(ctx)
+		_ = tc.Close()
+		if errors.Is(err, transport.ErrBusy) {
+			gw.Notify(fmt.Sprintf("%s is busy, try again later", request.To))
+		}
+		if !errors.Is(err, transport.ErrInterrupted) || !tc.Supports(transport.FeatureResume) {
+			finishTransfer(ctx, transfers, id, err)
+			return
+		}
+		if attempt >= maxResumeAttempts {
+			gw.Notify(fmt.Sprintf("Giving up on transfer to %s after %d attempts", request.To, attempt))
+			finishTransfer(ctx, transfers, id, err)
+			return
+		}
+
+		gw.Notify(fmt.Sprintf("Connection to %s lost, resuming transfer", request.To))
+		if !sleep(ctx, time.Duration(attempt)*resumeBackoff) {
+			finishTransfer(ctx, transfers, id, ctx.Err())
+			return
+		}
+	}
+}
+
+// describeRequest names what a request sends, for listing its transfer.
+func describeRequest(files []string) string {
+	if len(files) == 1 {
+		return filepath.Base(files[0])
+	}
+	return fmt.Sprintf("%d files", len(files))
+}
+
+// finishTransfer records how an outbound transfer ended.
+func finishTransfer(ctx context.Context, transfers *transfer.Manager, id string, err error) {
+	state := transfer.Completed
+	switch {
+	case err == nil:
+	case errors.Is(err, transport.ErrCancelled) || ctx.Err() != nil:
+		state = transfer.Cancelled
+	default:
+		state = transfer.Failed
+	}
+	_ = transfers.SetState(id, state, err)
+}
+
+// sleep waits for d and reports false if ctx was cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
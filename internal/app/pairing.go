@@ -0,0 +1,69 @@
+package app
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/metalgrid/drift/internal/audit"
+	"github.com/metalgrid/drift/internal/platform"
+	"github.com/metalgrid/drift/internal/secret"
+	"github.com/metalgrid/drift/internal/transport"
+	"github.com/metalgrid/drift/internal/trust"
+	"github.com/metalgrid/drift/internal/zeroconf"
+	"github.com/rs/zerolog/log"
+)
+
+type pairingAnswer struct {
+	confirmed bool
+	err       error
+}
+
+// pairPeer verifies a peer's key with its user. Both users are shown the short
+// authentication string of the connection at the same time; each one that confirms it
+// marks the other device as verified on their side.
+func pairPeer(ctx context.Context, peers *zeroconf.Peers, gw platform.Gateway, known *trust.Store, secure *secret.Config, instance string) {
+	pg, ok := gw.(platform.PairingGateway)
+	if !ok {
+		gw.Notify("Verifying peers is not supported on this platform")
+		return
+	}
+
+	tc, err := dialPeer(ctx, peers, known, secure, instance)
+	if err != nil {
+		gw.Notify(fmt.Sprintf("Unable to verify %s: %s", instance, err))
+		return
+	}
+	defer tc.Close()
+	peer := tc.Peer()
+	if !tc.Supports(transport.FeaturePairing) {
+		gw.Notify(fmt.Sprintf("Unable to verify %s: %s", peer.Name, transport.ErrPairingUnsupported))
+		return
+	}
+
+	answer := make(chan pairingAnswer, 1)
+	go func() {
+		confirmed, err := transport.RequestPairing(tc)
+		answer <- pairingAnswer{confirmed, err}
+	}()
+
+	if !pg.ConfirmPairing(peer) {
+		audit.Record(audit.Event{Type: audit.Pairing, Peer: peer.Name, Key: hex.EncodeToString(peer.Key), Result: "declined", Detail: "requested by this device"})
+		gw.Notify(fmt.Sprintf("%s was not verified", peer.Name))
+		return
+	}
+	audit.Record(audit.Event{Type: audit.Pairing, Peer: peer.Name, Key: hex.EncodeToString(peer.Key), Result: "confirmed", Detail: "requested by this device"})
+	remote := <-answer
+	switch {
+	case errors.Is(remote.err, transport.ErrBusy):
+		gw.Notify(fmt.Sprintf("%s is verified on this device, but it is busy and could not confirm. Try again later", peer.Name))
+	case remote.err != nil:
+		log.Warn().Str("peer", peer.Name).Err(remote.err).Msg("pairing request failed")
+		gw.Notify(fmt.Sprintf("%s is verified on this device, but its answer was lost: %s", peer.Name, remote.err))
+	case !remote.confirmed:
+		gw.Notify(fmt.Sprintf("%s is verified on this device, but its user did not confirm", peer.Name))
+	default:
+		gw.Notify(fmt.Sprintf("%s and this device verified each other", peer.Name))
+	}
+}
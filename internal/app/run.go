@@ -3,20 +3,34 @@ package app
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/metalgrid/drift/internal/audit"
 	"github.com/metalgrid/drift/internal/config"
+	"github.com/metalgrid/drift/internal/keyring"
 	"github.com/metalgrid/drift/internal/platform"
 	"github.com/metalgrid/drift/internal/secret"
 	"github.com/metalgrid/drift/internal/server"
+	"github.com/metalgrid/drift/internal/transfer"
 	"github.com/metalgrid/drift/internal/transport"
+	"github.com/metalgrid/drift/internal/trust"
 	"github.com/metalgrid/drift/internal/zeroconf"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	// discoveryGrace is how long an inbound connection from an unknown key waits for
+	// the peer's advertisement, polling every discoveryPoll.
+	discoveryGrace = 5 * time.Second
+	discoveryPoll  = 250 * time.Millisecond
+)
+
 func Run(ctx context.Context, identity string) error {
 	cfg, err := config.Load(config.DefaultPath())
 	if err != nil {
@@ -27,14 +41,31 @@ func Run(ctx context.Context, identity string) error {
 		identity = cfg.Identity
 	}
 
-	var opts *zeroconf.ZeroconfOptions
-	if identity != "" {
-		opts = &zeroconf.ZeroconfOptions{Identity: identity}
+	store := keyring.IdentityStore(cfg.IdentityKey)
+	keys, created, err := store.LoadOrCreate()
+	if err != nil {
+		return fmt.Errorf("failed loading identity key: %w", err)
 	}
+	if created {
+		log.Info().Str("path", cfg.IdentityKey).Bool("keyring", store.Keyring != nil).Msg("created a new identity key")
+	}
+	secure := &secret.Config{Identity: keys, RekeyBytes: cfg.RekeyBytes, RekeyRecords: cfg.RekeyRecords}
 
-	privkey, pubkey, err := secret.GenerateX25519KeyPair()
+	auditLog, err := audit.Open(cfg.AuditLog, cfg.AuditLogMaxSize)
 	if err != nil {
-		return fmt.Errorf("failed creating encryption keys: %w", err)
+		log.Error().Err(err).Str("path", cfg.AuditLog).Msg("failed opening audit log, security events will not be recorded")
+	} else {
+		audit.SetDefault(auditLog)
+		defer func() {
+			audit.SetDefault(nil)
+			_ = auditLog.Close()
+		}()
+	}
+
+	opts := &zeroconf.ZeroconfOptions{
+		Identity:     identity,
+		Version:      strconv.Itoa(transport.ProtocolVersion),
+		KeyExchanges: secure.AdvertisedKeyExchanges(),
 	}
 
 	wg := &sync.WaitGroup{}
@@ -44,7 +75,7 @@ func Run(ctx context.Context, identity string) error {
 		return fmt.Errorf("failed listening for connections: %w", err)
 	}
 
-	zcSvc, err := zeroconf.NewZeroconfService(servicePort, fmt.Sprintf("%x", *pubkey), opts)
+	zcSvc, err := zeroconf.NewZeroconfService(servicePort, fmt.Sprintf("%x", *keys.PublicKey), opts)
 	if err != nil {
 		return fmt.Errorf("failed creating zeroconf service: %w", err)
 	}
@@ -54,8 +85,21 @@ func Run(ctx context.Context, identity string) error {
 	}
 	defer zcSvc.Shutdown()
 
+	// Partials left by transfers that were abandoned while drift was not running.
+	go transport.RemoveStalePartials()
+
+	transfers := transfer.NewManager()
+	known := trust.NewStore(cfg.KnownPeers)
+	blocked := trust.NewBlocklist(cfg.BlockedPeers)
+	limiter := transport.NewLimiter(transport.Limits{
+		ConnectionsPerAddress: cfg.MaxConnectionsPerAddress,
+		PendingHandshakes:     cfg.MaxPendingHandshakes,
+		ConnectionsPerPeer:    cfg.MaxConnectionsPerPeer,
+		OffersPerMinute:       cfg.MaxOffersPerMinute,
+		PendingPrompts:        cfg.MaxPendingPrompts,
+	})
 	transferRequests := make(chan platform.Request)
-	platformGateway := platform.NewGateway(zcSvc.Peers(), transferRequests)
+	platformGateway := platform.NewGateway(zcSvc.Peers(), transferRequests, transfers, known, blocked, keys.PublicKey)
 	if err != nil {
 		return fmt.Errorf("failed starting transfer gateway: %w", err)
 	}
@@ -83,37 +127,67 @@ func Run(ctx context.Context, identity string) error {
 				log.Info().Str("system", "inbound_connection_processor").Msg("stopping")
 				return
 			case conn := <-connections:
-				peer := zcSvc.Peers().GetByAddr(conn.RemoteAddr())
-				if peer == nil {
-					log.Warn().Stringer("address", conn.RemoteAddr()).Msg("unknown peer")
-					_ = conn.Close()
-					continue
-				}
-
-				pk := peer.GetRecord("pk")
-				if pk == "" {
-					log.Warn().Str("peer", peer.Instance).Msg("public key not found")
-					_ = conn.Close()
-					continue
-				}
-
-				decodedKey, err := hex.DecodeString(pk)
+				handshaken, release, err := limiter.Accept(conn.RemoteAddr())
 				if err != nil {
-					log.Warn().Str("peer", peer.Instance).Str("pk", pk).Err(err).Msg("invalid public key")
+					log.Warn().Stringer("address", conn.RemoteAddr()).Err(err).Msg("refused connection")
+					audit.Record(audit.Event{Type: audit.Refused, Address: conn.RemoteAddr().String(), Result: "busy", Detail: err.Error()})
 					_ = conn.Close()
 					continue
 				}
+				go func() {
+					defer release()
+					if legacy := legacyPeer(zcSvc.Peers(), conn.RemoteAddr()); legacy != nil {
+						refuseLegacy(conn, keys, blocked, legacy, platformGateway)
+						return
+					}
+					sc, remote, err := secret.ServerHandshake(conn, secure)
+					if err != nil {
+						log.Warn().Stringer("address", conn.RemoteAddr()).Err(err).Msg("failed securing connection")
+						audit.Record(audit.Event{Type: audit.Handshake, Address: conn.RemoteAddr().String(), Result: "failed", Detail: err.Error()})
+						_ = conn.Close()
+						return
+					}
+					audit.Record(audit.Event{Type: audit.Handshake, Key: hex.EncodeToString(remote[:]), Address: conn.RemoteAddr().String(), Result: "ok", Detail: "inbound"})
+					if isBlocked(blocked, "", remote) {
+						_ = sc.Close()
+						return
+					}
+					instance, err := inboundInstance(ctx, zcSvc.Peers(), known, remote)
+					if err != nil {
+						log.Warn().Stringer("address", conn.RemoteAddr()).Hex("key", remote[:]).Err(err).Msg("unknown peer")
+						audit.Record(audit.Event{Type: audit.Refused, Key: hex.EncodeToString(remote[:]), Address: conn.RemoteAddr().String(), Result: "unknown peer", Detail: err.Error()})
+						_ = sc.Close()
+						return
+					}
+					if isBlocked(blocked, instance, remote) {
+						_ = sc.Close()
+						return
+					}
 
-				var peerPublicKey [32]byte
-				copy(peerPublicKey[:], decodedKey)
-
-				sc, err := secret.SecureConnection(conn, &peerPublicKey, privkey)
-				if err != nil {
-					log.Warn().Err(err).Msg("failed securing connection")
-					_ = conn.Close()
-					continue
-				}
-				go transport.HandleConnection(ctx, sc, platformGateway, nil)
+					tc, err := transport.AcceptHandshake(sc)
+					handshaken()
+					if err != nil {
+						log.Warn().Str("peer", instance).Err(err).Msg("handshake failed")
+						audit.Record(audit.Event{Type: audit.Handshake, Peer: instance, Key: hex.EncodeToString(remote[:]), Address: conn.RemoteAddr().String(), Result: "failed", Detail: err.Error()})
+						if errors.Is(err, transport.ErrIncompatiblePeer) {
+							platformGateway.Notify(fmt.Sprintf("Rejected transfer from %s: %s", instance, err))
+						}
+						_ = sc.Close()
+						return
+					}
+					tc.SetPeer(authenticatedPeer(known, sc, instance, remote))
+					tc.SetIdentity(keys)
+					disconnect, ok := limiter.Connect(remote[:])
+					defer disconnect()
+					if !ok {
+						log.Warn().Str("peer", instance).Msg("too many connections, answering busy")
+						audit.Record(audit.Event{Type: audit.Refused, Peer: instance, Key: hex.EncodeToString(remote[:]), Address: conn.RemoteAddr().String(), Result: "busy", Detail: "too many connections"})
+						transport.RefuseBusy(tc)
+						return
+					}
+					tc.SetLimiter(limiter)
+					transport.HandleConnection(ctx, tc, platformGateway, transfers, nil)
+				}()
 			}
 		}
 	}()
@@ -127,51 +201,11 @@ func Run(ctx context.Context, identity string) error {
 				log.Info().Str("system", "outbound_connection_processor").Msg("stopping")
 				return
 			case request := <-transferRequests:
-				peer := zcSvc.Peers().GetByInstance(request.To)
-				if peer == nil {
-					platformGateway.Notify(fmt.Sprintf("User %s not found", request.To))
+				if request.Pair {
+					go pairPeer(ctx, zcSvc.Peers(), platformGateway, known, secure, request.To)
 					continue
 				}
-
-				target := net.JoinHostPort(peer.Addresses[0].String(), strconv.Itoa(peer.Port))
-				conn, err := net.Dial("tcp", target)
-				if err != nil {
-					platformGateway.Notify(fmt.Sprintf("Unable to connect to peer: %s", err))
-					continue
-				}
-
-				pk, err := hex.DecodeString(peer.GetRecord("pk"))
-				if err != nil {
-					platformGateway.Notify(fmt.Sprintf("Unable to retrieve peer's public key: %s", err))
-					_ = conn.Close()
-					continue
-				}
-
-				var peerpk [32]byte
-				copy(peerpk[:], pk)
-
-				sc, err := secret.SecureConnection(conn, &peerpk, privkey)
-				if err != nil {
-					platformGateway.Notify(fmt.Sprintf("Unable to secure connection with peer: %s", err))
-					_ = conn.Close()
-					continue
-				}
-
-				if len(request.Files) > 1 {
-					outbound := transport.NewOutboundTransferState()
-					go transport.HandleConnection(ctx, sc, platformGateway, outbound)
-					if err := transport.SendBatch(request.Files, sc, outbound); err != nil {
-						platformGateway.Notify(fmt.Sprintf("Unable to send batch offer: %s", err))
-						_ = sc.Close()
-					}
-				} else if len(request.Files) == 1 {
-					outbound := transport.NewOutboundTransferState()
-					go transport.HandleConnection(ctx, sc, platformGateway, outbound)
-					if err := transport.SendFile(request.Files[0], sc, outbound); err != nil {
-						platformGateway.Notify(fmt.Sprintf("Unable to send file offer: %s", err))
-						_ = sc.Close()
-					}
-				}
+				go sendRequest(ctx, zcSvc.Peers(), platformGateway, transfers, known, secure, request)
 			}
 		}
 	}()
@@ -183,3 +217,133 @@ func Run(ctx context.Context, identity string) error {
 	wg.Wait()
 	return nil
 }
+
+// legacyPeer returns the peer advertising the address of addr if it predates the secure
+// and HELLO handshakes, as peers advertising protocol version 0.1 do. It returns nil if
+// no peer advertises the address, or if any peer advertising it speaks a current version.
+func legacyPeer(peers *zeroconf.Peers, addr net.Addr) *zeroconf.PeerInfo {
+	advertised := peers.GetByAddr(addr)
+	for _, peer := range advertised {
+		if transport.CheckAdvertisedVersion(peer.GetRecord("v")) == nil {
+			return nil
+		}
+	}
+	if len(advertised) == 0 {
+		return nil
+	}
+	return advertised[0]
+}
+
+// refuseLegacy secures a connection from a peer that predates the secure handshake the
+// way it expects, so that it is told its offer is declined rather than seeing a broken
+// connection. Nothing authenticates such peers, so their events name no peer.
+func refuseLegacy(conn net.Conn, keys *secret.Identity, blocked *trust.Blocklist, peer *zeroconf.PeerInfo, gw platform.Gateway) {
+	defer conn.Close()
+	instance := peer.GetInstance()
+	pk, err := hex.DecodeString(peer.GetRecord("pk"))
+	if refused, blockErr := blocked.Blocks(instance, pk); refused || blockErr != nil {
+		return
+	}
+	if err == nil && len(pk) != 32 {
+		err = fmt.Errorf("public key has %d bytes, want 32", len(pk))
+	}
+	var sc net.Conn
+	if err == nil {
+		sc, err = secret.LegacySecureConnection(conn, (*[32]byte)(pk), keys.PrivateKey)
+	}
+	if err == nil {
+		_, err = transport.AcceptHandshake(sc)
+	}
+	log.Warn().Str("peer", instance).Stringer("address", conn.RemoteAddr()).Err(err).Msg("refused peer of an old protocol version")
+	audit.Record(audit.Event{Type: audit.Refused, Address: conn.RemoteAddr().String(), Result: "incompatible", Detail: fmt.Sprintf("%s: %v", instance, err)})
+	if errors.Is(err, transport.ErrIncompatiblePeer) {
+		gw.Notify(fmt.Sprintf("Rejected transfer from %s: %s", instance, err))
+	}
+}
+
+// isBlocked reports whether connections from a peer are refused, logging the refusal.
+// A blocklist that cannot be read refuses everyone, rather than letting blocked peers in.
+func isBlocked(blocked *trust.Blocklist, instance string, key secret.EncryptionKey) bool {
+	refused, err := blocked.Blocks(instance, key[:])
+	switch {
+	case err != nil:
+		log.Error().Err(err).Msg("failed reading blocklist, refusing connection")
+		audit.Record(audit.Event{Type: audit.Refused, Peer: instance, Key: hex.EncodeToString(key[:]), Result: "blocklist unreadable", Detail: err.Error()})
+		return true
+	case refused:
+		log.Info().Str("peer", instance).Hex("key", key[:]).Msg("refused connection from blocked peer")
+		audit.Record(audit.Event{Type: audit.Blocked, Peer: instance, Key: hex.EncodeToString(key[:]), Result: "refused"})
+	}
+	return refused
+}
+
+// inboundInstance names the peer that authenticated with key on an inbound connection:
+// the known peer the key is pinned for, or else the peer advertising it. Advertisements
+// are not authenticated, so they never take precedence over a pinned name, and a key
+// advertised under several names is refused as ambiguous. A peer that is neither known
+// nor advertised may connect before its advertisement arrives, so it is waited for a
+// little. The address of the connection is not considered, as peers can share one.
+func inboundInstance(ctx context.Context, peers *zeroconf.Peers, known *trust.Store, key secret.EncryptionKey) (string, error) {
+	if peer, err := known.FindByKey(key[:]); err == nil {
+		return peer.Instance, nil
+	} else if !errors.Is(err, trust.ErrUnknownPeer) {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, discoveryGrace)
+	defer cancel()
+	ticker := time.NewTicker(discoveryPoll)
+	defer ticker.Stop()
+	for {
+		switch advertised := peers.GetByKey(key[:]); len(advertised) {
+		case 0:
+		case 1:
+			return advertised[0].GetInstance(), nil
+		default:
+			names := make([]string, len(advertised))
+			for i, peer := range advertised {
+				names[i] = peer.GetInstance()
+			}
+			log.Warn().Strs("peers", names).Hex("key", key[:]).Msg("several peers advertise the same key")
+			return "", fmt.Errorf("key %x is advertised by several peers: %s", key[:], strings.Join(names, ", "))
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("no peer advertises key %x", key[:])
+		case <-ticker.C:
+		}
+	}
+}
+
+// authenticatedPeer describes a peer that authenticated with key over the secured
+// connection sc, checking the key against the known peers and pinning it on first contact.
+func authenticatedPeer(known *trust.Store, sc net.Conn, instance string, key secret.EncryptionKey) platform.Peer {
+	status, err := known.Observe(instance, key[:])
+	switch {
+	case err != nil:
+		log.Error().Err(err).Msg("failed checking known peers")
+	case status == trust.New:
+		log.Info().Str("peer", instance).Hex("key", key[:]).Msg("pinned key of new peer")
+		audit.Record(audit.Event{Type: audit.KeyPinned, Peer: instance, Key: hex.EncodeToString(key[:])})
+	case status == trust.Changed:
+		log.Warn().Str("peer", instance).Hex("key", key[:]).Msg("peer key changed since first contact")
+		audit.Record(audit.Event{Type: audit.KeyChanged, Peer: instance, Key: hex.EncodeToString(key[:])})
+	}
+	peer := platform.Peer{
+		Name:       instance,
+		KeyChanged: status == trust.Changed,
+		Verified:   status == trust.Verified,
+		Pinned:     err == nil && (status == trust.Known || status == trust.Verified),
+		Key:        key[:],
+		SAS:        sc.(*secret.WrappedConnection).SAS(),
+	}
+	if err == nil && (status == trust.Known || status == trust.Verified) {
+		pinned, err := known.Get(instance)
+		if err != nil {
+			log.Error().Err(err).Msg("failed reading peer policy")
+		} else if pinned.Policy != nil {
+			peer.Policy = *pinned.Policy
+		}
+	}
+	return peer
+}
@@ -0,0 +1,299 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Type is what an audit event is about.
+type Type string
+
+const (
+	// Handshake is the result of securing a connection, "ok" or "failed".
+	Handshake Type = "handshake"
+	// KeyPinned is a peer's key pinned on first contact.
+	KeyPinned Type = "key_pinned"
+	// KeyChanged is a peer that authenticated with another key than the pinned one.
+	KeyChanged Type = "key_changed"
+	// Pairing is the result of comparing short authentication strings, "confirmed" or
+	// "declined".
+	Pairing Type = "pairing"
+	// Policy is an offer answered by the peer's policy, "accept" or "decline".
+	Policy Type = "policy"
+	// Blocked is a connection refused because the peer is blocked.
+	Blocked Type = "blocked"
+	// Refused is a connection or offer refused for another reason, such as an unknown
+	// peer, an incompatible version or exceeded limits.
+	Refused Type = "refused"
+	// Integrity is a received file or offer that failed its integrity check.
+	Integrity Type = "integrity"
+)
+
+// Event is a line of the audit log.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    Type      `json:"type"`
+	Peer    string    `json:"peer,omitempty"`
+	Key     string    `json:"key,omitempty"`
+	Address string    `json:"address,omitempty"`
+	Result  string    `json:"result,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// DefaultMaxSize is the size at which the log is rotated unless configured otherwise,
+// and rotations how many rotated files are kept, as path.1 (the latest) to path.5.
+const (
+	DefaultMaxSize = 10 << 20
+	rotations      = 5
+)
+
+// Events that name no peer come from connections that are not tied to one yet, which
+// anyone on the network can open. At most anonymousPerWindow of them are recorded per
+// anonymousWindow; the others are counted, and recorded as a single event per type with
+// the result "suppressed" once the window is over, so that a flood of them cannot rotate
+// the events about known peers out of the log.
+const (
+	anonymousPerWindow = 10
+	anonymousWindow    = time.Minute
+)
+
+// Log appends events to a file as JSON lines. Lines are only ever appended; when the
+// file reaches its maximum size, it is renamed with a .1 suffix, shifting older ones
+// up to the number kept, and a new one is started.
+type Log struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+
+	now func() time.Time
+	// windowEnd is when the current window for events that name no peer is over,
+	// anonymous how many of them it recorded, and suppressed how many it dropped by type.
+	windowEnd  time.Time
+	anonymous  int
+	suppressed map[Type]int
+}
+
+// Open opens the log at path for appending, creating it readable by its owner only.
+// A maxSize of zero uses DefaultMaxSize.
+func Open(path string, maxSize int64) (*Log, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	l := &Log{path: path, maxSize: maxSize, now: time.Now, suppressed: make(map[Type]int)}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return fmt.Errorf("failed creating audit log directory: %w", err)
+	}
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	l.f, l.size = f, fi.Size()
+	if l.size > 0 {
+		// End a line cut short by a crash, so that it does not swallow the next event.
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, l.size-1); err == nil && last[0] != '\n' {
+			n, _ := f.Write([]byte{'\n'})
+			l.size += int64(n)
+		}
+	}
+	return nil
+}
+
+// rotate moves the full log aside and starts a new one.
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	_ = os.Remove(rotated(l.path, rotations))
+	for i := rotations - 1; i >= 1; i-- {
+		if err := os.Rename(rotated(l.path, i), rotated(l.path, i+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(l.path, rotated(l.path, 1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func rotated(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// Record appends an event, stamping it with the current time unless it has one. Events
+// that name no peer are limited as described for anonymousPerWindow.
+func (l *Log) Record(e Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return fs.ErrClosed
+	}
+	now := l.now()
+	if e.Time.IsZero() {
+		e.Time = now
+	}
+	if !now.Before(l.windowEnd) {
+		if err := l.recordSuppressed(now); err != nil {
+			return err
+		}
+		l.windowEnd, l.anonymous = now.Add(anonymousWindow), 0
+	}
+	if e.Peer == "" {
+		if l.anonymous >= anonymousPerWindow {
+			l.suppressed[e.Type]++
+			return nil
+		}
+		l.anonymous++
+	}
+	return l.write(e)
+}
+
+// recordSuppressed records how many events of each type the window that is over dropped.
+func (l *Log) recordSuppressed(now time.Time) error {
+	types := make([]Type, 0, len(l.suppressed))
+	for t := range l.suppressed {
+		types = append(types, t)
+	}
+	slices.Sort(types)
+	for _, t := range types {
+		err := l.write(Event{Time: now, Type: t, Result: "suppressed",
+			Detail: fmt.Sprintf("%d more events of connections not tied to a peer", l.suppressed[t])})
+		if err != nil {
+			return err
+		}
+		delete(l.suppressed, t)
+	}
+	return nil
+}
+
+// write appends e, rotating the log first if it would grow past its maximum size.
+func (l *Log) write(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("failed rotating audit log: %w", err)
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// Close closes the log. Events recorded after it are dropped with an error.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.recordSuppressed(l.now())
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	l.f = nil
+	return err
+}
+
+// defaultLog is where Record appends events, if anywhere.
+var defaultLog atomic.Pointer[Log]
+
+// SetDefault makes Record append events to l, or drop them if l is nil.
+func SetDefault(l *Log) {
+	defaultLog.Store(l)
+}
+
+// Record appends an event to the default log. Failures are logged, since the events
+// come from places that cannot do more about them.
+func Record(e Event) {
+	l := defaultLog.Load()
+	if l == nil {
+		return
+	}
+	if err := l.Record(e); err != nil {
+		log.Error().Err(err).Str("type", string(e.Type)).Msg("failed recording audit event")
+	}
+}
+
+// Filter selects events: those of a peer, of a type and since a time, where zero
+// values select all.
+type Filter struct {
+	Peer  string
+	Type  Type
+	Since time.Time
+}
+
+// Match reports whether the filter selects e.
+func (f Filter) Match(e Event) bool {
+	return (f.Peer == "" || e.Peer == f.Peer) &&
+		(f.Type == "" || e.Type == f.Type) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since))
+}
+
+// Read returns the events of the log at path selected by filter, oldest first, including
+// those of rotated files. Lines that are not events, such as one cut short by a crash,
+// are skipped.
+func Read(path string, filter Filter) ([]Event, error) {
+	var events []Event
+	for i := rotations; i >= 0; i-- {
+		name := path
+		if i > 0 {
+			name = rotated(path, i)
+		}
+		f, err := os.Open(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			var e Event
+			if line == "" || json.Unmarshal([]byte(line), &e) != nil {
+				continue
+			}
+			if filter.Match(e) {
+				events = append(events, e)
+			}
+		}
+		err = scanner.Err()
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed reading %s: %w", name, err)
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,172 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openLog(t *testing.T, maxSize int64) (*Log, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "drift", "audit.jsonl")
+	l, err := Open(path, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	return l, path
+}
+
+// TestRecordAndRead tests that recorded events read back, filtered, from a file only the owner can read
+func TestRecordAndRead(t *testing.T) {
+	l, path := openLog(t, 0)
+	start := time.Now().Add(-time.Minute)
+	for _, e := range []Event{
+		{Time: start.Add(-time.Hour), Type: Handshake, Peer: "alice", Result: "ok"},
+		{Type: Blocked, Peer: "mallory", Key: "00ff"},
+		{Type: Policy, Peer: "alice", Result: "accept", Detail: "notes.txt"},
+	} {
+		if err := l.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("audit log mode = %o, want 600", fi.Mode().Perm())
+	}
+
+	for _, tc := range []struct {
+		filter Filter
+		want   int
+	}{
+		{Filter{}, 3},
+		{Filter{Peer: "alice"}, 2},
+		{Filter{Type: Blocked}, 1},
+		{Filter{Peer: "alice", Since: start}, 1},
+	} {
+		events, err := Read(path, tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != tc.want {
+			t.Errorf("Read(%+v) = %d events, want %d", tc.filter, len(events), tc.want)
+		}
+	}
+	events, _ := Read(path, Filter{Type: Blocked})
+	if len(events) == 1 && (events[0].Key != "00ff" || events[0].Time.IsZero()) {
+		t.Errorf("Read() = %+v, want the recorded key and a time", events[0])
+	}
+}
+
+// TestRotation tests that a full log is rotated, keeping a bounded number of files that Read still covers
+func TestRotation(t *testing.T) {
+	l, path := openLog(t, 200)
+	for i := range 40 {
+		if err := l.Record(Event{Type: Refused, Peer: "mallory", Detail: string(rune('a' + i%26))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(rotated(path, rotations)); err != nil {
+		t.Errorf("oldest rotation is missing: %v", err)
+	}
+	if _, err := os.Stat(rotated(path, rotations+1)); err == nil {
+		t.Error("more rotations were kept than configured")
+	}
+	for _, name := range []string{path, rotated(path, 1)} {
+		if fi, err := os.Stat(name); err != nil || fi.Size() > 200 {
+			t.Errorf("%s exceeds the maximum size: %v", filepath.Base(name), err)
+		}
+	}
+
+	events, err := Read(path, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 || len(events) >= 40 {
+		t.Fatalf("Read() = %d events, want the latest few of 40", len(events))
+	}
+	if last := events[len(events)-1]; last.Detail != string(rune('a'+39%26)) {
+		t.Errorf("last event = %+v, want the last recorded", last)
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].Time.Before(events[i-1].Time) {
+			t.Fatal("Read() did not return events oldest first")
+		}
+	}
+}
+
+// TestReadSkipsTruncatedLine tests that a line cut short by a crash does not hide other events
+func TestReadSkipsTruncatedLine(t *testing.T) {
+	l, path := openLog(t, 0)
+	if err := l.Record(Event{Type: Integrity, Peer: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`{"time":"2026-01-01T00:00:00Z","type":"hands`)
+	_ = f.Close()
+
+	events, err := Read(path, Filter{})
+	if err != nil || len(events) != 1 {
+		t.Errorf("Read() = %d events, %v; want the complete one", len(events), err)
+	}
+
+	// Reopened after the crash, the log records on a line of its own.
+	_ = l.Close()
+	l, err = Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.Record(Event{Type: Integrity, Peer: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if events, _ := Read(path, Filter{Peer: "bob"}); len(events) != 1 {
+		t.Error("event recorded after a truncated line was lost")
+	}
+}
+
+// TestAnonymousEventsAreLimited tests that events naming no peer are limited per window and summed up once it is over
+func TestAnonymousEventsAreLimited(t *testing.T) {
+	l, path := openLog(t, 0)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	for range anonymousPerWindow + 5 {
+		if err := l.Record(Event{Type: Handshake, Address: "192.168.1.66:40000", Result: "failed"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Record(Event{Type: KeyChanged, Peer: "alice", Key: "00ff"}); err != nil {
+		t.Fatal(err)
+	}
+	if events, _ := Read(path, Filter{}); len(events) != anonymousPerWindow+1 {
+		t.Errorf("Read() = %d events during the flood, want %d", len(events), anonymousPerWindow+1)
+	}
+
+	now = now.Add(anonymousWindow)
+	if err := l.Record(Event{Type: Refused, Address: "192.168.1.66:40000", Result: "busy"}); err != nil {
+		t.Fatal(err)
+	}
+	events, err := Read(path, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != anonymousPerWindow+3 {
+		t.Fatalf("Read() = %d events after the window, want %d", len(events), anonymousPerWindow+3)
+	}
+	summary := events[anonymousPerWindow+1]
+	if summary.Type != Handshake || summary.Result != "suppressed" || !strings.HasPrefix(summary.Detail, "5 more") {
+		t.Errorf("summary = %+v, want 5 suppressed handshakes", summary)
+	}
+	if events[len(events)-1].Result != "busy" {
+		t.Errorf("last event = %+v, want the one of the new window", events[len(events)-1])
+	}
+}
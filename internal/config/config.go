@@ -15,6 +15,33 @@ type Config struct {
 	DownloadDir   string
 	AcceptTimeout time.Duration
 	Identity      string
+	// IdentityKey is the file holding this device's long-term key pair.
+	IdentityKey string
+	// KnownPeers is the file pinning the keys of the peers seen so far.
+	KnownPeers string
+	// BlockedPeers is the file listing the peers whose connections are refused.
+	BlockedPeers string
+	// RekeyBytes and RekeyRecords bound how much plaintext, and how many records, a
+	// connection sends under one key before switching to the next. Zero leaves the
+	// choice to the secure connection.
+	RekeyBytes   uint64
+	RekeyRecords uint64
+	// MaxConnectionsPerAddress bounds the connections open at once from an IP address, and
+	// MaxPendingHandshakes the connections from all addresses whose peer has not completed
+	// the handshake yet. Connections beyond them are closed right away.
+	MaxConnectionsPerAddress int
+	MaxPendingHandshakes     int
+	// MaxConnectionsPerPeer and MaxOffersPerMinute bound the connections a peer holds
+	// open at once and the offers it makes per minute, and MaxPendingPrompts the offers
+	// from all peers waiting for an answer. Offers beyond them are answered BUSY.
+	// A zero limit is no limit.
+	MaxConnectionsPerPeer int
+	MaxOffersPerMinute    int
+	MaxPendingPrompts     int
+	// AuditLog is the file recording handshakes, trust decisions and rejections, which is
+	// rotated when it reaches AuditLogMaxSize bytes.
+	AuditLog        string
+	AuditLogMaxSize int64
 }
 
 // rawConfig is the TOML-decoded structure.
@@ -22,6 +49,21 @@ type rawConfig struct {
 	DownloadDir   string `toml:"download_dir"`
 	AcceptTimeout string `toml:"accept_timeout"`
 	Identity      string `toml:"identity"`
+	IdentityKey   string `toml:"identity_key"`
+	KnownPeers    string `toml:"known_peers"`
+	BlockedPeers  string `toml:"blocked_peers"`
+	RekeyBytes    uint64 `toml:"rekey_bytes"`
+	RekeyRecords  uint64 `toml:"rekey_records"`
+
+	// The limits are pointers to tell zero, which is no limit, from a missing setting.
+	MaxConnectionsPerAddress *int `toml:"max_connections_per_address"`
+	MaxPendingHandshakes     *int `toml:"max_pending_handshakes"`
+	MaxConnectionsPerPeer    *int `toml:"max_connections_per_peer"`
+	MaxOffersPerMinute       *int `toml:"max_offers_per_minute"`
+	MaxPendingPrompts        *int `toml:"max_pending_prompts"`
+
+	AuditLog        string `toml:"audit_log"`
+	AuditLogMaxSize int64  `toml:"audit_log_max_size"`
 }
 
 // DefaultConfig returns a Config with default values.
@@ -30,6 +72,18 @@ func DefaultConfig() *Config {
 		DownloadDir:   filepath.Join(xdg.UserDirs.Download, "Drift"),
 		AcceptTimeout: 30 * time.Second,
 		Identity:      "",
+		IdentityKey:   DefaultIdentityKeyPath(),
+		KnownPeers:    DefaultKnownPeersPath(),
+		BlockedPeers:  DefaultBlockedPeersPath(),
+
+		MaxConnectionsPerAddress: 8,
+		MaxPendingHandshakes:     16,
+		MaxConnectionsPerPeer:    4,
+		MaxOffersPerMinute:       10,
+		MaxPendingPrompts:        5,
+
+		AuditLog:        DefaultAuditLogPath(),
+		AuditLogMaxSize: 10 << 20,
 	}
 }
 
@@ -38,6 +92,26 @@ func DefaultPath() string {
 	return filepath.Join(xdg.ConfigHome, "drift", "config.toml")
 }
 
+// DefaultIdentityKeyPath returns where the identity key is kept unless configured otherwise.
+func DefaultIdentityKeyPath() string {
+	return filepath.Join(xdg.DataHome, "drift", "identity.key")
+}
+
+// DefaultKnownPeersPath returns where the keys of known peers are kept unless configured otherwise.
+func DefaultKnownPeersPath() string {
+	return filepath.Join(xdg.DataHome, "drift", "known_peers.json")
+}
+
+// DefaultBlockedPeersPath returns where the blocklist is kept unless configured otherwise.
+func DefaultBlockedPeersPath() string {
+	return filepath.Join(xdg.DataHome, "drift", "blocked_peers.json")
+}
+
+// DefaultAuditLogPath returns where the audit log is kept unless configured otherwise.
+func DefaultAuditLogPath() string {
+	return filepath.Join(xdg.StateHome, "drift", "audit.jsonl")
+}
+
 // Load reads a TOML config file and merges with defaults.
 // If the file doesn't exist or is corrupt, returns defaults without error.
 func Load(path string) (*Config, error) {
@@ -74,9 +148,51 @@ func Load(path string) (*Config, error) {
 		cfg.Identity = raw.Identity
 	}
 
+	if raw.IdentityKey != "" {
+		cfg.IdentityKey = raw.IdentityKey
+	}
+
+	if raw.KnownPeers != "" {
+		cfg.KnownPeers = raw.KnownPeers
+	}
+
+	if raw.BlockedPeers != "" {
+		cfg.BlockedPeers = raw.BlockedPeers
+	}
+
+	if raw.RekeyBytes != 0 {
+		cfg.RekeyBytes = raw.RekeyBytes
+	}
+
+	if raw.RekeyRecords != 0 {
+		cfg.RekeyRecords = raw.RekeyRecords
+	}
+
+	setLimit(&cfg.MaxConnectionsPerAddress, raw.MaxConnectionsPerAddress)
+	setLimit(&cfg.MaxPendingHandshakes, raw.MaxPendingHandshakes)
+	setLimit(&cfg.MaxConnectionsPerPeer, raw.MaxConnectionsPerPeer)
+	setLimit(&cfg.MaxOffersPerMinute, raw.MaxOffersPerMinute)
+	setLimit(&cfg.MaxPendingPrompts, raw.MaxPendingPrompts)
+
+	if raw.AuditLog != "" {
+		cfg.AuditLog = raw.AuditLog
+	}
+
+	if raw.AuditLogMaxSize > 0 {
+		cfg.AuditLogMaxSize = raw.AuditLogMaxSize
+	}
+
 	return cfg, nil
 }
 
+// setLimit overrides a limit with the configured one, where zero turns it off. Negative
+// limits are ignored, keeping the default.
+func setLimit(limit, configured *int) {
+	if configured != nil && *configured >= 0 {
+		*limit = *configured
+	}
+}
+
 // EnsureConfigDir creates the config directory with 0700 permissions if it doesn't exist.
 func EnsureConfigDir(dir string) error {
 	if err := os.MkdirAll(dir, 0700); err != nil {
@@ -28,6 +28,30 @@ func TestDefaultConfig(t *testing.T) {
 	if cfg.Identity != "" {
 		t.Errorf("Identity should be empty string by default, got: %s", cfg.Identity)
 	}
+
+	if cfg.IdentityKey != DefaultIdentityKeyPath() {
+		t.Errorf("IdentityKey should default to %s, got: %s", DefaultIdentityKeyPath(), cfg.IdentityKey)
+	}
+
+	if cfg.KnownPeers != DefaultKnownPeersPath() {
+		t.Errorf("KnownPeers should default to %s, got: %s", DefaultKnownPeersPath(), cfg.KnownPeers)
+	}
+
+	if cfg.BlockedPeers != DefaultBlockedPeersPath() {
+		t.Errorf("BlockedPeers should default to %s, got: %s", DefaultBlockedPeersPath(), cfg.BlockedPeers)
+	}
+
+	if cfg.MaxConnectionsPerPeer != 4 || cfg.MaxOffersPerMinute != 10 || cfg.MaxPendingPrompts != 5 {
+		t.Errorf("limits should default to 4, 10 and 5, got: %d, %d and %d", cfg.MaxConnectionsPerPeer, cfg.MaxOffersPerMinute, cfg.MaxPendingPrompts)
+	}
+
+	if cfg.MaxConnectionsPerAddress != 8 || cfg.MaxPendingHandshakes != 16 {
+		t.Errorf("connection limits should default to 8 and 16, got: %d and %d", cfg.MaxConnectionsPerAddress, cfg.MaxPendingHandshakes)
+	}
+
+	if cfg.AuditLog != DefaultAuditLogPath() || cfg.AuditLogMaxSize != 10<<20 {
+		t.Errorf("AuditLog should default to %s rotated at 10 MiB, got: %s at %d bytes", DefaultAuditLogPath(), cfg.AuditLog, cfg.AuditLogMaxSize)
+	}
 }
 
 func TestDefaultPath(t *testing.T) {
@@ -70,6 +94,18 @@ func TestLoadValidFile(t *testing.T) {
 	content := `download_dir = "/tmp/MyDrift"
 accept_timeout = "45s"
 identity = "TestDevice"
+identity_key = "/tmp/MyDrift/identity.key"
+known_peers = "/tmp/MyDrift/known_peers.json"
+blocked_peers = "/tmp/MyDrift/blocked_peers.json"
+rekey_bytes = 1073741824
+rekey_records = 65536
+max_connections_per_address = 3
+max_pending_handshakes = 0
+max_connections_per_peer = 2
+max_offers_per_minute = 30
+max_pending_prompts = 1
+audit_log = "/tmp/MyDrift/audit.jsonl"
+audit_log_max_size = 1048576
 `
 	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
 		t.Fatalf("Failed to write test config: %v", err)
@@ -93,6 +129,30 @@ identity = "TestDevice"
 	if cfg.Identity != "TestDevice" {
 		t.Errorf("Identity should be 'TestDevice', got: %s", cfg.Identity)
 	}
+	if cfg.IdentityKey != "/tmp/MyDrift/identity.key" {
+		t.Errorf("IdentityKey should be '/tmp/MyDrift/identity.key', got: %s", cfg.IdentityKey)
+	}
+	if cfg.KnownPeers != "/tmp/MyDrift/known_peers.json" {
+		t.Errorf("KnownPeers should be '/tmp/MyDrift/known_peers.json', got: %s", cfg.KnownPeers)
+	}
+	if cfg.BlockedPeers != "/tmp/MyDrift/blocked_peers.json" {
+		t.Errorf("BlockedPeers should be '/tmp/MyDrift/blocked_peers.json', got: %s", cfg.BlockedPeers)
+	}
+	if cfg.RekeyBytes != 1<<30 {
+		t.Errorf("RekeyBytes should be %d, got: %d", 1<<30, cfg.RekeyBytes)
+	}
+	if cfg.RekeyRecords != 65536 {
+		t.Errorf("RekeyRecords should be 65536, got: %d", cfg.RekeyRecords)
+	}
+	if cfg.MaxConnectionsPerPeer != 2 || cfg.MaxOffersPerMinute != 30 || cfg.MaxPendingPrompts != 1 {
+		t.Errorf("limits should be 2, 30 and 1, got: %d, %d and %d", cfg.MaxConnectionsPerPeer, cfg.MaxOffersPerMinute, cfg.MaxPendingPrompts)
+	}
+	if cfg.MaxConnectionsPerAddress != 3 || cfg.MaxPendingHandshakes != 0 {
+		t.Errorf("connection limits should be 3 and 0 (no limit), got: %d and %d", cfg.MaxConnectionsPerAddress, cfg.MaxPendingHandshakes)
+	}
+	if cfg.AuditLog != "/tmp/MyDrift/audit.jsonl" || cfg.AuditLogMaxSize != 1<<20 {
+		t.Errorf("AuditLog should be '/tmp/MyDrift/audit.jsonl' rotated at 1 MiB, got: %s at %d bytes", cfg.AuditLog, cfg.AuditLogMaxSize)
+	}
 }
 
 func TestLoadPartialFile(t *testing.T) {
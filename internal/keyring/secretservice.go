@@ -0,0 +1,215 @@
+package keyring
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/rs/zerolog/log"
+
+	"github.com/metalgrid/drift/internal/secret"
+)
+
+// The names of the Secret Service API, as implemented by GNOME Keyring and KWallet.
+const (
+	serviceName      = "org.freedesktop.secrets"
+	servicePath      = dbus.ObjectPath("/org/freedesktop/secrets")
+	serviceIface     = "org.freedesktop.Secret.Service"
+	collectionIface  = "org.freedesktop.Secret.Collection"
+	itemIface        = "org.freedesktop.Secret.Item"
+	sessionIface     = "org.freedesktop.Secret.Session"
+	promptIface      = "org.freedesktop.Secret.Prompt"
+	defaultAlias     = "default"
+	noPrompt         = dbus.ObjectPath("/")
+	plainAlgorithm   = "plain"
+	plainContentType = "text/plain"
+)
+
+// promptTimeout is how long to wait for the user to unlock the keyring.
+const promptTimeout = 2 * time.Minute
+
+var (
+	// ErrUnavailable is reported when no Secret Service runs on the bus.
+	ErrUnavailable = errors.New("no Secret Service on the session bus")
+	// ErrNotFound is reported for secrets that are not in the keyring.
+	ErrNotFound = fmt.Errorf("secret not found: %w", fs.ErrNotExist)
+	// ErrDismissed is reported when the user dismisses the prompt to unlock the keyring.
+	ErrDismissed = errors.New("keyring prompt dismissed")
+)
+
+// secretValue is a secret as the Secret Service transfers it, encoded for a session.
+// Sessions with the plain algorithm transfer secrets as they are, which is only
+// readable to the bus and the two ends.
+type secretValue struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+// SecretService stores secrets in the keyring of the desktop through the Secret
+// Service API on the session bus.
+type SecretService struct {
+	conn *dbus.Conn
+}
+
+// Open returns the Secret Service on the bus conn, which it does not take over. It
+// returns ErrUnavailable if none runs and none can be started.
+func Open(conn *dbus.Conn) (*SecretService, error) {
+	var names []string
+	if err := conn.BusObject().Call("org.freedesktop.DBus.ListActivatableNames", 0).Store(&names); err != nil {
+		return nil, err
+	}
+	if !slices.Contains(names, serviceName) {
+		var running bool
+		if err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, serviceName).Store(&running); err != nil {
+			return nil, err
+		}
+		if !running {
+			return nil, ErrUnavailable
+		}
+	}
+	return &SecretService{conn: conn}, nil
+}
+
+func (s *SecretService) service() dbus.BusObject {
+	return s.conn.Object(serviceName, servicePath)
+}
+
+// openSession opens a session to transfer secrets in, which the caller closes.
+func (s *SecretService) openSession() (dbus.ObjectPath, func(), error) {
+	var output dbus.Variant
+	var session dbus.ObjectPath
+	err := s.service().Call(serviceIface+".OpenSession", 0, plainAlgorithm, dbus.MakeVariant("")).Store(&output, &session)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed opening a Secret Service session: %w", err)
+	}
+	return session, func() { _ = s.conn.Object(serviceName, session).Call(sessionIface+".Close", 0).Err }, nil
+}
+
+// unlock unlocks objects, asking the user if the Secret Service needs to.
+func (s *SecretService) unlock(objects ...dbus.ObjectPath) error {
+	var unlocked []dbus.ObjectPath
+	var prompt dbus.ObjectPath
+	if err := s.service().Call(serviceIface+".Unlock", 0, objects).Store(&unlocked, &prompt); err != nil {
+		return fmt.Errorf("failed unlocking the keyring: %w", err)
+	}
+	return s.prompt(prompt)
+}
+
+// prompt shows a prompt of the Secret Service and waits for the user to complete it.
+func (s *SecretService) prompt(prompt dbus.ObjectPath) error {
+	if prompt == noPrompt || prompt == "" {
+		return nil
+	}
+	match := []dbus.MatchOption{
+		dbus.WithMatchObjectPath(prompt),
+		dbus.WithMatchInterface(promptIface),
+		dbus.WithMatchMember("Completed"),
+	}
+	if err := s.conn.AddMatchSignal(match...); err != nil {
+		return err
+	}
+	defer func() { _ = s.conn.RemoveMatchSignal(match...) }()
+	signals := make(chan *dbus.Signal, 1)
+	s.conn.Signal(signals)
+	defer s.conn.RemoveSignal(signals)
+
+	if err := s.conn.Object(serviceName, prompt).Call(promptIface+".Prompt", 0, "").Err; err != nil {
+		return fmt.Errorf("failed prompting to unlock the keyring: %w", err)
+	}
+	timeout := time.After(promptTimeout)
+	for {
+		select {
+		case signal := <-signals:
+			if signal.Path != prompt || signal.Name != promptIface+".Completed" || len(signal.Body) == 0 {
+				continue
+			}
+			if dismissed, _ := signal.Body[0].(bool); dismissed {
+				return ErrDismissed
+			}
+			return nil
+		case <-timeout:
+			return ErrDismissed
+		}
+	}
+}
+
+// Lookup returns the secret stored under the given attributes, or ErrNotFound.
+func (s *SecretService) Lookup(attributes map[string]string) ([]byte, error) {
+	var unlocked, locked []dbus.ObjectPath
+	if err := s.service().Call(serviceIface+".SearchItems", 0, attributes).Store(&unlocked, &locked); err != nil {
+		return nil, fmt.Errorf("failed searching the keyring: %w", err)
+	}
+	if len(unlocked) == 0 && len(locked) == 0 {
+		return nil, ErrNotFound
+	}
+	item := slices.Concat(unlocked, locked)[0]
+	if len(unlocked) == 0 {
+		if err := s.unlock(item); err != nil {
+			return nil, err
+		}
+	}
+
+	session, closeSession, err := s.openSession()
+	if err != nil {
+		return nil, err
+	}
+	defer closeSession()
+	var value secretValue
+	if err := s.conn.Object(serviceName, item).Call(itemIface+".GetSecret", 0, session).Store(&value); err != nil {
+		return nil, fmt.Errorf("failed reading from the keyring: %w", err)
+	}
+	return value.Value, nil
+}
+
+// Store stores a secret in the default collection under the given attributes,
+// replacing the one stored under them before.
+func (s *SecretService) Store(label string, attributes map[string]string, data []byte) error {
+	var collection dbus.ObjectPath
+	if err := s.service().Call(serviceIface+".ReadAlias", 0, defaultAlias).Store(&collection); err != nil {
+		return fmt.Errorf("failed finding the default keyring: %w", err)
+	}
+	if collection == noPrompt {
+		return errors.New("there is no default keyring")
+	}
+	if err := s.unlock(collection); err != nil {
+		return err
+	}
+
+	session, closeSession, err := s.openSession()
+	if err != nil {
+		return err
+	}
+	defer closeSession()
+	properties := map[string]dbus.Variant{
+		itemIface + ".Label":      dbus.MakeVariant(label),
+		itemIface + ".Attributes": dbus.MakeVariant(attributes),
+	}
+	value := secretValue{Session: session, Value: data, ContentType: plainContentType}
+	var item, prompt dbus.ObjectPath
+	err = s.conn.Object(serviceName, collection).Call(collectionIface+".CreateItem", 0, properties, value, true).Store(&item, &prompt)
+	if err != nil {
+		return fmt.Errorf("failed writing to the keyring: %w", err)
+	}
+	return s.prompt(prompt)
+}
+
+// IdentityStore returns the store of the identity key at path, which keeps the key in
+// the Secret Service if one runs on the session bus, and in the key file otherwise.
+func IdentityStore(path string) *secret.IdentityStore {
+	store := &secret.IdentityStore{Path: path}
+	conn, err := dbus.SessionBus()
+	if err == nil {
+		var s *SecretService
+		if s, err = Open(conn); err == nil {
+			store.Keyring = s
+			return store
+		}
+	}
+	log.Debug().Err(err).Msg("keeping the identity key in a file, without the Secret Service")
+	return store
+}
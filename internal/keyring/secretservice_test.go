@@ -0,0 +1,271 @@
+package keyring
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+
+	"github.com/metalgrid/drift/internal/secret"
+)
+
+// busConfig configures a private bus that anyone may own names on and talk to.
+const busConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:dir=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// privateBus starts a bus of its own for the test and returns its address.
+func privateBus(t *testing.T) string {
+	t.Helper()
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon is not installed")
+	}
+	dir := t.TempDir()
+	config := filepath.Join(dir, "bus.conf")
+	if err := os.WriteFile(config, []byte(fmt.Sprintf(busConfig, dir)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(daemon, "--config-file="+config, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed reading the bus address: %v", err)
+	}
+	return strings.TrimSpace(address)
+}
+
+func connect(t *testing.T, address string) *dbus.Conn {
+	t.Helper()
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+type fakeItem struct {
+	attributes map[string]string
+	secret     []byte
+}
+
+// fakeSecretService is a stand-in for the Secret Service with a single collection,
+// which stays locked until the user completes a prompt, or dismisses it if dismiss is set.
+type fakeSecretService struct {
+	conn    *dbus.Conn
+	dismiss bool
+
+	mu     sync.Mutex
+	locked bool
+	items  map[dbus.ObjectPath]*fakeItem
+	next   int
+}
+
+const (
+	fakeCollection = dbus.ObjectPath("/org/freedesktop/secrets/collection/login")
+	fakeSession    = dbus.ObjectPath("/org/freedesktop/secrets/session/1")
+	fakePrompt     = dbus.ObjectPath("/org/freedesktop/secrets/prompt/1")
+)
+
+// exportSecretService runs a fakeSecretService on the bus at address.
+func exportSecretService(t *testing.T, address string, dismiss bool) *fakeSecretService {
+	t.Helper()
+	f := &fakeSecretService{conn: connect(t, address), dismiss: dismiss, locked: true, items: make(map[dbus.ObjectPath]*fakeItem)}
+	exports := []struct {
+		path    dbus.ObjectPath
+		iface   string
+		methods map[string]any
+	}{
+		{servicePath, serviceIface, map[string]any{
+			"OpenSession": f.openSession,
+			"SearchItems": f.searchItems,
+			"Unlock":      f.unlock,
+			"ReadAlias":   f.readAlias,
+		}},
+		{fakeCollection, collectionIface, map[string]any{"CreateItem": f.createItem}},
+		{fakeSession, sessionIface, map[string]any{"Close": func() *dbus.Error { return nil }}},
+		{fakePrompt, promptIface, map[string]any{"Prompt": f.prompt}},
+	}
+	for _, e := range exports {
+		if err := f.conn.ExportMethodTable(e.methods, e.path, e.iface); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reply, err := f.conn.RequestName(serviceName, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("failed owning %s: %v", serviceName, err)
+	}
+	return f
+}
+
+func (f *fakeSecretService) openSession(algorithm string, _ dbus.Variant) (dbus.Variant, dbus.ObjectPath, *dbus.Error) {
+	if algorithm != plainAlgorithm {
+		return dbus.Variant{}, "", dbus.NewError("org.freedesktop.DBus.Error.NotSupported", nil)
+	}
+	return dbus.MakeVariant(""), fakeSession, nil
+}
+
+func (f *fakeSecretService) searchItems(attributes map[string]string) ([]dbus.ObjectPath, []dbus.ObjectPath, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var found []dbus.ObjectPath
+	for path, item := range f.items {
+		if maps.Equal(item.attributes, attributes) {
+			found = append(found, path)
+		}
+	}
+	if f.locked {
+		return nil, found, nil
+	}
+	return found, nil, nil
+}
+
+func (f *fakeSecretService) unlock(objects []dbus.ObjectPath) ([]dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.locked {
+		return nil, fakePrompt, nil
+	}
+	return objects, noPrompt, nil
+}
+
+func (f *fakeSecretService) prompt(string) *dbus.Error {
+	f.mu.Lock()
+	f.locked = f.dismiss
+	f.mu.Unlock()
+	go func() { _ = f.conn.Emit(fakePrompt, promptIface+".Completed", f.dismiss, dbus.MakeVariant("")) }()
+	return nil
+}
+
+func (f *fakeSecretService) readAlias(name string) (dbus.ObjectPath, *dbus.Error) {
+	if name != defaultAlias {
+		return noPrompt, nil
+	}
+	return fakeCollection, nil
+}
+
+func (f *fakeSecretService) createItem(properties map[string]dbus.Variant, value secretValue, replace bool) (dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.locked {
+		return "", "", dbus.NewError("org.freedesktop.Secret.Error.IsLocked", nil)
+	}
+	attributes, _ := properties[itemIface+".Attributes"].Value().(map[string]string)
+	if replace {
+		for path, item := range f.items {
+			if maps.Equal(item.attributes, attributes) {
+				delete(f.items, path)
+			}
+		}
+	}
+	f.next++
+	path := dbus.ObjectPath(fmt.Sprintf("%s/%d", fakeCollection, f.next))
+	item := &fakeItem{attributes: attributes, secret: value.Value}
+	f.items[path] = item
+	getSecret := func(session dbus.ObjectPath) (secretValue, *dbus.Error) {
+		return secretValue{Session: session, Value: item.secret, ContentType: plainContentType}, nil
+	}
+	if err := f.conn.ExportMethodTable(map[string]any{"GetSecret": getSecret}, path, itemIface); err != nil {
+		return "", "", dbus.MakeFailedError(err)
+	}
+	return path, noPrompt, nil
+}
+
+// TestSecretServiceStoresSecrets tests storing and looking up secrets, unlocking the keyring on the way
+func TestSecretServiceStoresSecrets(t *testing.T) {
+	address := privateBus(t)
+	fake := exportSecretService(t, address, false)
+	s, err := Open(connect(t, address))
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	attributes := map[string]string{"application": "drift", "type": "test"}
+	if _, err := s.Lookup(attributes); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Lookup() of a missing secret = %v, want fs.ErrNotExist", err)
+	}
+	for _, value := range []string{"first", "second"} {
+		if err := s.Store("Test", attributes, []byte(value)); err != nil {
+			t.Fatalf("Store(%q) failed: %v", value, err)
+		}
+		got, err := s.Lookup(attributes)
+		if err != nil || string(got) != value {
+			t.Errorf("Lookup() = %q, %v; want %q", got, err, value)
+		}
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.items) != 1 {
+		t.Errorf("keyring holds %d items, want the second one to replace the first", len(fake.items))
+	}
+}
+
+// TestSecretServiceDismissedPrompt tests that a dismissed prompt to unlock the keyring fails the call
+func TestSecretServiceDismissedPrompt(t *testing.T) {
+	address := privateBus(t)
+	exportSecretService(t, address, true)
+	s, err := Open(connect(t, address))
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	if err := s.Store("Test", map[string]string{"type": "test"}, []byte("secret")); !errors.Is(err, ErrDismissed) {
+		t.Errorf("Store() = %v, want ErrDismissed", err)
+	}
+}
+
+// TestOpenWithoutSecretService tests that a bus without the Secret Service is reported as such
+func TestOpenWithoutSecretService(t *testing.T) {
+	if _, err := Open(connect(t, privateBus(t))); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Open() = %v, want ErrUnavailable", err)
+	}
+}
+
+// TestIdentityStoreInSecretService tests that the identity survives a restart in the Secret Service
+func TestIdentityStoreInSecretService(t *testing.T) {
+	address := privateBus(t)
+	exportSecretService(t, address, false)
+	s, err := Open(connect(t, address))
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "identity.key")
+	id, created, err := (&secret.IdentityStore{Path: path, Keyring: s}).LoadOrCreate()
+	if err != nil || !created {
+		t.Fatalf("LoadOrCreate() = %v, created %v; want a new identity", err, created)
+	}
+	loaded, created, err := (&secret.IdentityStore{Path: path, Keyring: s}).LoadOrCreate()
+	if err != nil || created || *loaded.PrivateKey != *id.PrivateKey {
+		t.Errorf("LoadOrCreate() = %v, created %v; want the stored identity", err, created)
+	}
+}
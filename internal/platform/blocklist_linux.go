@@ -0,0 +1,108 @@
+//go:build linux
+
+package platform
+
+import (
+	"fmt"
+	"html"
+	"time"
+
+	gtk "github.com/diamondburned/gotk4/pkg/gtk/v4"
+)
+
+// block blocks a peer by name and the keys it is known by, and hides it from the
+// peer popover. It must run on the GTK thread.
+func (g *linuxGateway) block(name string) {
+	if err := blockPeer(g.peers, g.known, g.blocked, name); err != nil {
+		g.Notify(fmt.Sprintf("Failed blocking %s: %s", name, err))
+		return
+	}
+	g.Notify(fmt.Sprintf("Blocked %s", name))
+	g.refreshPeers()
+}
+
+// refreshPeers rebuilds the peer popover and the blocked peers window, if they are open.
+func (g *linuxGateway) refreshPeers() {
+	if g.peerWindow != nil {
+		g.rebuildPeerList(g.peerWindow)
+	}
+	if g.blockedWindow != nil {
+		g.rebuildBlockedList(g.blockedWindow)
+	}
+}
+
+// showBlockedPeers opens (or focuses) the window listing the blocklist, where entries
+// can be unblocked.
+func (g *linuxGateway) showBlockedPeers() {
+	if g.blockedWindow != nil {
+		g.blockedWindow.Present()
+		return
+	}
+	win := gtk.NewWindow()
+	win.SetTitle("Drift - Blocked Peers")
+	win.SetDefaultSize(420, 300)
+	win.ConnectCloseRequest(func() bool {
+		g.blockedWindow = nil
+		return false
+	})
+	g.blockedWindow = win
+	g.rebuildBlockedList(win)
+	win.Present()
+}
+
+func (g *linuxGateway) rebuildBlockedList(win *gtk.Window) {
+	listBox := gtk.NewListBox()
+	listBox.SetSelectionMode(gtk.SelectionNone)
+
+	blocked, err := g.blocked.List()
+	if err != nil {
+		errorLabel := gtk.NewLabel(err.Error())
+		errorLabel.SetWrap(true)
+		listBox.Append(errorLabel)
+	}
+	for _, entry := range blocked {
+		row := gtk.NewBox(gtk.OrientationHorizontal, 10)
+		row.SetMarginTop(8)
+		row.SetMarginBottom(8)
+		row.SetMarginStart(12)
+		row.SetMarginEnd(12)
+
+		name, markup := entry.Instance, "<b>"+html.EscapeString(entry.Instance)+"</b>"
+		if name == "" {
+			name, markup = entry.Key, "<tt>"+html.EscapeString(entry.Key[:min(16, len(entry.Key))])+"…</tt>"
+		}
+		nameLabel := gtk.NewLabel("")
+		nameLabel.SetMarkup(markup)
+		nameLabel.SetHExpand(true)
+		nameLabel.SetXAlign(0)
+		nameLabel.SetTooltipText(entry.Key)
+		row.Append(nameLabel)
+
+		sinceLabel := gtk.NewLabel(entry.Since.Local().Format(time.DateOnly))
+		sinceLabel.AddCSSClass("dim-label")
+		row.Append(sinceLabel)
+
+		unblockBtn := gtk.NewButtonWithLabel("Unblock")
+		unblockBtn.ConnectClicked(func() {
+			if err := g.blocked.Unblock(name); err != nil {
+				g.Notify(fmt.Sprintf("Failed unblocking %s: %s", name, err))
+			}
+			g.refreshPeers()
+		})
+		row.Append(unblockBtn)
+
+		listBox.Append(row)
+	}
+	if err == nil && len(blocked) == 0 {
+		emptyLabel := gtk.NewLabel("No blocked peers")
+		emptyLabel.SetMarginTop(20)
+		emptyLabel.SetMarginBottom(20)
+		listBox.Append(emptyLabel)
+	}
+
+	scrolled := gtk.NewScrolledWindow()
+	scrolled.SetPolicy(gtk.PolicyNever, gtk.PolicyAutomatic)
+	scrolled.SetVExpand(true)
+	scrolled.SetChild(listBox)
+	win.SetChild(scrolled)
+}
@@ -3,11 +3,14 @@
 package platform
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/godbus/dbus/v5/introspect"
+	"github.com/metalgrid/drift/internal/transfer"
+	"github.com/metalgrid/drift/internal/trust"
 	"github.com/metalgrid/drift/internal/zeroconf"
 )
 
@@ -17,6 +20,7 @@ const (
 	iface       = "com.github.metalgrid.Drift"
 	SigQuestion = iface + ".Question"
 	SigNotify   = iface + ".Notify"
+	SigTransfer = iface + ".TransferChanged"
 )
 
 type dbusService struct {
@@ -25,13 +29,19 @@ type dbusService struct {
 	conversations map[string]chan string
 	peers         *zeroconf.Peers
 	reqch         chan<- Request
+	transfers     *transfer.Manager
+	known         *trust.Store
+	blocked       *trust.Blocklist
 }
 
-func newDBusService(peers *zeroconf.Peers, reqch chan<- Request) *dbusService {
+func newDBusService(peers *zeroconf.Peers, reqch chan<- Request, transfers *transfer.Manager, known *trust.Store, blocked *trust.Blocklist) *dbusService {
 	return &dbusService{
 		conversations: make(map[string]chan string),
 		peers:         peers,
 		reqch:         reqch,
+		transfers:     transfers,
+		known:         known,
+		blocked:       blocked,
 	}
 }
 
@@ -72,6 +82,13 @@ func (d *dbusService) Start(conn *dbus.Conn) error {
 							{Name: "message", Type: "s"},
 						},
 					},
+					{
+						Name: "TransferChanged",
+						Args: []introspect.Arg{
+							{Name: "id", Type: "s"},
+							{Name: "state", Type: "s"},
+						},
+					},
 				},
 			},
 		},
@@ -121,6 +138,11 @@ func (d *dbusService) EmitNotify(message string) error {
 	return d.bus.Emit(dbus.ObjectPath(objPath), SigNotify, message)
 }
 
+// EmitTransferChanged emits a TransferChanged signal on the bus.
+func (d *dbusService) EmitTransferChanged(id, state string) error {
+	return d.bus.Emit(dbus.ObjectPath(objPath), SigTransfer, id, state)
+}
+
 // DBus-exported methods
 
 func (d *dbusService) Request(to, file string) *dbus.Error {
@@ -128,6 +150,8 @@ func (d *dbusService) Request(to, file string) *dbus.Error {
 	return nil
 }
 
+// Respond answers a question. The answer is "ACCEPT" or "DECLINE"; a batch can also be
+// accepted in part by listing the indices of the wanted files, as in "ACCEPT:0,2,5".
 func (d *dbusService) Respond(id, answer string) *dbus.Error {
 	d.mu.Lock()
 	ch, ok := d.conversations[id]
@@ -142,11 +166,146 @@ func (d *dbusService) Respond(id, answer string) *dbus.Error {
 	return nil
 }
 
+// ListPeers returns the instance names of the discovered peers that are not blocked.
 func (d *dbusService) ListPeers() ([]string, *dbus.Error) {
-	peers := d.peers.All()
+	peers := visiblePeers(d.peers, d.blocked)
 	res := make([]string, len(peers))
 	for i, peer := range peers {
 		res[i] = peer.Instance
 	}
 	return res, nil
 }
+
+// dbusTransfer is a transfer as exposed on the bus, with the signature (ssssssxx).
+type dbusTransfer struct {
+	ID          string
+	Direction   string
+	Peer        string
+	Description string
+	State       string
+	Error       string
+	Bytes       int64
+	TotalBytes  int64
+}
+
+func toDBusTransfer(t transfer.Transfer) dbusTransfer {
+	return dbusTransfer{
+		ID:          t.ID,
+		Direction:   string(t.Direction),
+		Peer:        t.Peer,
+		Description: t.Description,
+		State:       string(t.State),
+		Error:       t.Error,
+		Bytes:       t.Progress.Bytes,
+		TotalBytes:  t.Progress.TotalBytes,
+	}
+}
+
+// ListTransfers returns the transfers in flight and recently finished, oldest first.
+func (d *dbusService) ListTransfers() ([]dbusTransfer, *dbus.Error) {
+	list := d.transfers.List()
+	transfers := make([]dbusTransfer, len(list))
+	for i, t := range list {
+		transfers[i] = toDBusTransfer(t)
+	}
+	return transfers, nil
+}
+
+// GetTransfer returns the transfer with an ID from ListTransfers.
+func (d *dbusService) GetTransfer(id string) (dbusTransfer, *dbus.Error) {
+	t, ok := d.transfers.Get(id)
+	if !ok {
+		return dbusTransfer{}, dbus.NewError(iface+".NoSuchTransfer", []any{id})
+	}
+	return toDBusTransfer(t), nil
+}
+
+// Cancel stops a transfer in flight, identified by an ID from ListTransfers.
+func (d *dbusService) Cancel(id string) *dbus.Error {
+	err := d.transfers.Cancel(id)
+	switch {
+	case errors.Is(err, transfer.ErrNotFound):
+		return dbus.NewError(iface+".NoSuchTransfer", []any{id})
+	case err != nil:
+		return dbus.NewError(iface+".TransferFinished", []any{id})
+	}
+	return nil
+}
+
+// dbusKnownPeer is a peer of the known peers store as exposed on the bus, with the
+// signature (ssxxb). The times are Unix timestamps.
+type dbusKnownPeer struct {
+	Instance  string
+	Key       string
+	FirstSeen int64
+	LastSeen  int64
+	Verified  bool
+}
+
+// ListKnownPeers returns the peers whose keys were pinned on first contact.
+func (d *dbusService) ListKnownPeers() ([]dbusKnownPeer, *dbus.Error) {
+	list, err := d.known.List()
+	if err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+	peers := make([]dbusKnownPeer, len(list))
+	for i, p := range list {
+		peers[i] = dbusKnownPeer{p.Instance, p.Key, p.FirstSeen.Unix(), p.LastSeen.Unix(), p.Verified}
+	}
+	return peers, nil
+}
+
+// ForgetPeer removes the pinned key of a peer, so that its next key is trusted on first use.
+func (d *dbusService) ForgetPeer(instance string) *dbus.Error {
+	err := d.known.Forget(instance)
+	switch {
+	case errors.Is(err, trust.ErrUnknownPeer):
+		return dbus.NewError(iface+".NoSuchPeer", []any{instance})
+	case err != nil:
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+// dbusBlockedPeer is an entry of the blocklist as exposed on the bus, with the signature
+// (ssx). Either the instance name or the key is empty if the entry only blocks the other.
+// The time is a Unix timestamp.
+type dbusBlockedPeer struct {
+	Instance string
+	Key      string
+	Since    int64
+}
+
+// ListBlockedPeers returns the entries of the blocklist, oldest first.
+func (d *dbusService) ListBlockedPeers() ([]dbusBlockedPeer, *dbus.Error) {
+	list, err := d.blocked.List()
+	if err != nil {
+		return nil, dbus.MakeFailedError(err)
+	}
+	blocked := make([]dbusBlockedPeer, len(list))
+	for i, b := range list {
+		blocked[i] = dbusBlockedPeer{b.Instance, b.Key, b.Since.Unix()}
+	}
+	return blocked, nil
+}
+
+// BlockPeer refuses connections from a peer, by its instance name and the keys it is
+// known by, and hides it from ListPeers.
+func (d *dbusService) BlockPeer(instance string) *dbus.Error {
+	if err := blockPeer(d.peers, d.known, d.blocked, instance); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+// UnblockPeer removes the entries blocking an instance name or hex-encoded key.
+func (d *dbusService) UnblockPeer(name string) *dbus.Error {
+	err := d.blocked.Unblock(name)
+	switch {
+	case errors.Is(err, trust.ErrNotBlocked):
+		return dbus.NewError(iface+".NotBlocked", []any{name})
+	case err != nil:
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
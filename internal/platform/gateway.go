@@ -1,14 +1,25 @@
 package platform
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 
+	"github.com/metalgrid/drift/internal/secret"
+	"github.com/metalgrid/drift/internal/transfer"
+	"github.com/metalgrid/drift/internal/trust"
 	"github.com/metalgrid/drift/internal/zeroconf"
 )
 
 type Request struct {
 	To    string
 	Files []string
+	// Pair asks to verify the peer's key with its user instead of sending files.
+	Pair bool
 }
 
 type FileInfo struct {
@@ -27,11 +38,160 @@ type Gateway interface {
 	Notify(string)
 }
 
+// Peer is who an incoming offer comes from.
+type Peer struct {
+	// Name is the peer's instance name, or its address if it is not known.
+	Name string
+	// KeyChanged is set when the peer authenticated with another key than the one
+	// pinned for its name on first contact. The user must be warned about its offers,
+	// which are never accepted without asking.
+	KeyChanged bool
+	// Verified is set when the user confirmed the peer's key in person.
+	Verified bool
+	// Pinned is set when the key the peer authenticated with was pinned for it before this
+	// connection, so that it is known to be the key of the peer seen before. It is not
+	// set on first contact, when the key was only just pinned.
+	Pinned bool
+	// Key is the public key the peer authenticated with, and SAS the short authentication
+	// string of the connection's handshake that both users compare to verify it.
+	Key []byte
+	SAS secret.SAS
+	// Policy is the user's standing answer to the peer's offers. It belongs to the key
+	// pinned for the peer, so it is never set when KeyChanged.
+	Policy trust.Policy
+	// SignedOffer is set when the offer being asked about is signed by the identity key
+	// that was pinned for the peer before this connection. Older peers do not sign their
+	// offers.
+	SignedOffer bool
+}
+
+// SenderStatus describes to the user how far the sender of an offer is known to be the
+// peer seen before. A peer seen for the first time is never, whatever it signed: its
+// signature is made by the same key that it just authenticated with.
+func (p Peer) SenderStatus() string {
+	switch {
+	case !p.Pinned:
+		return "new, unverified sender"
+	case p.SignedOffer:
+		return "signed by pinned key"
+	}
+	return "unsigned offer"
+}
+
+// KeyChangedWarning is shown with the offers of a peer whose key changed.
+func (p Peer) KeyChangedWarning() string {
+	return fmt.Sprintf("The identity key of %s has changed since you first received from it. "+
+		"It may have been reinstalled, or someone may be impersonating it. "+
+		"Only accept if you expected this. To trust the new key, run: drift peers forget %q", p.Name, p.Name)
+}
+
+type PairingGateway interface {
+	Gateway
+	// ConfirmPairing shows the short authentication string of a peer and asks whether
+	// the peer's user sees the same one. Confirming marks the peer as verified in the
+	// known peers store. It reports whether the user confirmed.
+	ConfirmPairing(peer Peer) bool
+}
+
 type BatchGateway interface {
 	Gateway
-	AskBatch(peerName string, files []FileInfo) string
+	// AskBatch asks which files of an incoming offer to accept and returns their indices
+	// in ascending order. An empty result declines the whole offer.
+	AskBatch(peer Peer, files []FileInfo) []int
+}
+
+// ParseSelection interprets the answer to a batch prompt. Besides "ACCEPT" and "DECLINE",
+// an answer can accept some of the files by listing their indices, as in "ACCEPT:0,2,5".
+// It returns the accepted indices in ascending order, or nil if nothing was accepted.
+func ParseSelection(answer string, count int) ([]int, error) {
+	kind, list, selective := strings.Cut(answer, ":")
+	switch {
+	case kind == "DECLINE" || kind == "":
+		return nil, nil
+	case kind != "ACCEPT":
+		return nil, fmt.Errorf("unknown answer %q", answer)
+	case !selective:
+		all := make([]int, count)
+		for i := range all {
+			all[i] = i
+		}
+		return all, nil
+	}
+
+	var selected []int
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		index, err := strconv.Atoi(item)
+		if err != nil || index < 0 || index >= count {
+			return nil, fmt.Errorf("invalid file index %q", item)
+		}
+		selected = append(selected, index)
+	}
+	slices.Sort(selected)
+	return slices.Compact(selected), nil
+}
+
+// FormatSelection is the inverse of ParseSelection.
+func FormatSelection(selected []int, count int) string {
+	if len(selected) == 0 {
+		return "DECLINE"
+	}
+	if len(selected) == count {
+		return "ACCEPT"
+	}
+	items := make([]string, len(selected))
+	for i, index := range selected {
+		items[i] = strconv.Itoa(index)
+	}
+	return "ACCEPT:" + strings.Join(items, ",")
+}
+
+// visiblePeers returns the discovered peers that are not blocked, to list to the user.
+func visiblePeers(peers *zeroconf.Peers, blocked *trust.Blocklist) []*zeroconf.PeerInfo {
+	all := peers.All()
+	list, err := blocked.List()
+	if err != nil {
+		return all
+	}
+	return slices.DeleteFunc(all, func(pi *zeroconf.PeerInfo) bool {
+		key, _ := hex.DecodeString(pi.GetRecord("pk"))
+		return slices.ContainsFunc(list, func(b trust.BlockedPeer) bool { return b.Matches(pi.GetInstance(), key) })
+	})
+}
+
+// blockPeer blocks a peer by its name and by the keys it is known by: the one it
+// advertises, if it is discovered, and the one pinned for it, if that differs.
+func blockPeer(peers *zeroconf.Peers, known *trust.Store, blocked *trust.Blocklist, name string) error {
+	var keys [][]byte
+	for _, pi := range peers.All() {
+		if pi.GetInstance() == name {
+			if key, err := hex.DecodeString(pi.GetRecord("pk")); err == nil && len(key) > 0 {
+				keys = append(keys, key)
+			}
+		}
+	}
+	if pinned, err := known.Get(name); err == nil {
+		if key, err := hex.DecodeString(pinned.Key); err == nil && !slices.ContainsFunc(keys, func(k []byte) bool { return bytes.Equal(k, key) }) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return blocked.Block(name, nil)
+	}
+	for _, key := range keys {
+		if err := blocked.Block(name, key); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func NewGateway(peers *zeroconf.Peers, requests chan<- Request) Gateway {
-	return newGateway(peers, requests)
+// NewGateway creates the gateway of the current platform. It shows and cancels the
+// transfers of the given manager, lets the user manage the known and blocked peers, and
+// shows the fingerprint of this device's identity key for peers to verify.
+func NewGateway(peers *zeroconf.Peers, requests chan<- Request, transfers *transfer.Manager, known *trust.Store, blocked *trust.Blocklist, identity secret.EncryptionKey) Gateway {
+	return newGateway(peers, requests, transfers, known, blocked, identity)
 }
@@ -16,6 +16,9 @@ import (
 	gtk "github.com/diamondburned/gotk4/pkg/gtk/v4"
 	"github.com/godbus/dbus/v5"
 
+	"github.com/metalgrid/drift/internal/secret"
+	"github.com/metalgrid/drift/internal/transfer"
+	"github.com/metalgrid/drift/internal/trust"
 	"github.com/metalgrid/drift/internal/zeroconf"
 )
 
@@ -24,7 +27,7 @@ const responseTimeout = 30 * time.Second
 type promptRequest struct {
 	question string
 	files    []FileInfo
-	peerName string
+	peer     Peer
 	response chan string
 }
 
@@ -39,29 +42,46 @@ type linuxGateway struct {
 	notif   *notifier
 	prompts chan promptRequest
 
-	peerWindow  *gtk.Window
-	dropWindows map[string]*gtk.Window
+	transfers *transfer.Manager
+	notices   map[string]*transferNotice
+	known     *trust.Store
+	blocked   *trust.Blocklist
+	identity  secret.EncryptionKey
+
+	peerWindow      *gtk.Window
+	blockedWindow   *gtk.Window
+	identityWindow  *gtk.Window
+	dropWindows     map[string]*gtk.Window
+	transferWindows map[string]*transferWindow
 }
 
-func newGateway(peers *zeroconf.Peers, requests chan<- Request) Gateway {
+func newGateway(peers *zeroconf.Peers, requests chan<- Request, transfers *transfer.Manager, known *trust.Store, blocked *trust.Blocklist, identity secret.EncryptionKey) Gateway {
 	return &linuxGateway{
-		peers:       peers,
-		reqch:       requests,
-		prompts:     make(chan promptRequest),
-		dropWindows: make(map[string]*gtk.Window),
+		peers:           peers,
+		reqch:           requests,
+		prompts:         make(chan promptRequest),
+		transfers:       transfers,
+		notices:         make(map[string]*transferNotice),
+		known:           known,
+		blocked:         blocked,
+		identity:        identity,
+		dropWindows:     make(map[string]*gtk.Window),
+		transferWindows: make(map[string]*transferWindow),
 	}
 }
 
 func (g *linuxGateway) Run(ctx context.Context) error {
 	runtime.LockOSThread()
 
-	conn, err := dbus.ConnectSessionBus()
+	// The shared connection, which the identity store already opened to reach the
+	// Secret Service.
+	conn, err := dbus.SessionBus()
 	if err != nil {
 		return fmt.Errorf("failed to connect to session bus: %w", err)
 	}
 	g.busConn = conn
 
-	g.dbus = newDBusService(g.peers, g.reqch)
+	g.dbus = newDBusService(g.peers, g.reqch, g.transfers, g.known, g.blocked)
 	g.notif = newNotifier()
 
 	g.app = gtk.NewApplication("com.github.metalgrid.drift", gio.ApplicationFlagsNone)
@@ -105,6 +125,9 @@ func (g *linuxGateway) Run(ctx context.Context) error {
 			g.tray = tray
 		}
 
+		// Follow transfers -> windows, notifications and bus signals
+		g.transfers.Subscribe(g.transferChanged)
+
 		// Observe peer changes -> rebuild popover
 		g.peers.OnChange(func() {
 			glib.IdleAdd(func() {
@@ -201,7 +224,7 @@ func (g *linuxGateway) Ask(question string) string {
 	}
 }
 
-func (g *linuxGateway) AskBatch(peerName string, files []FileInfo) string {
+func (g *linuxGateway) AskBatch(peer Peer, files []FileInfo) []int {
 	id := g.generateID()
 
 	ch := g.dbus.RegisterConversation(id)
@@ -212,8 +235,15 @@ func (g *linuxGateway) AskBatch(peerName string, files []FileInfo) string {
 	for _, f := range files {
 		totalSize += f.Size
 	}
+	sender := peer.Name + " (" + peer.SenderStatus() + ")"
 	question := fmt.Sprintf("Incoming transfer from %s: %d files (%s)",
-		peerName, len(files), formatSize(totalSize))
+		sender, len(files), formatSize(totalSize))
+	if len(files) == 1 {
+		question = fmt.Sprintf("Incoming transfer from %s: %s (%s)", sender, files[0].Filename, formatSize(totalSize))
+	}
+	if peer.KeyChanged {
+		question = "WARNING: " + peer.KeyChangedWarning() + "\n\n" + question
+	}
 
 	if err := g.dbus.EmitQuestion(id, question); err != nil {
 		fmt.Printf("failed to emit question signal: %v\n", err)
@@ -232,19 +262,25 @@ func (g *linuxGateway) AskBatch(peerName string, files []FileInfo) string {
 	// Show detail window on GTK thread
 	responseCh := make(chan string, 1)
 	g.prompts <- promptRequest{
-		peerName: peerName,
+		peer:     peer,
 		files:    files,
 		response: responseCh,
 	}
 
+	var answer string
 	select {
-	case answer := <-responseCh:
-		return answer
-	case answer := <-ch:
-		return answer
+	case answer = <-responseCh:
+	case answer = <-ch:
 	case <-time.After(responseTimeout):
-		return "DECLINE"
+		return nil
+	}
+
+	selected, err := ParseSelection(answer, len(files))
+	if err != nil {
+		fmt.Printf("invalid answer to batch prompt: %v\n", err)
+		return nil
 	}
+	return selected
 }
 
 func (g *linuxGateway) Notify(message string) {
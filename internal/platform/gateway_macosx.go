@@ -12,6 +12,9 @@ import (
 	"github.com/progrium/darwinkit/macos/foundation"
 	"github.com/progrium/darwinkit/objc"
 
+	"github.com/metalgrid/drift/internal/secret"
+	"github.com/metalgrid/drift/internal/transfer"
+	"github.com/metalgrid/drift/internal/trust"
 	"github.com/metalgrid/drift/internal/zeroconf"
 )
 
@@ -37,7 +40,7 @@ func (m *macGateway) Ask(question string) string {
 func (m *macGateway) Notify(msg string) {
 }
 
-func newGateway(peers *zeroconf.Peers, requests chan<- Request) Gateway {
+func newGateway(peers *zeroconf.Peers, requests chan<- Request, transfers *transfer.Manager, known *trust.Store, blocked *trust.Blocklist, identity secret.EncryptionKey) Gateway {
 	return &macGateway{}
 }
 
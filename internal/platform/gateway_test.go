@@ -0,0 +1,73 @@
+package platform
+
+import (
+	"slices"
+	"testing"
+)
+
+// TestParseSelection tests interpretation of answers to batch prompts
+func TestParseSelection(t *testing.T) {
+	tests := []struct {
+		answer string
+		want   []int
+	}{
+		{"ACCEPT", []int{0, 1, 2, 3}},
+		{"DECLINE", nil},
+		{"", nil},
+		{"ACCEPT:2", []int{2}},
+		{"ACCEPT:3, 0,3", []int{0, 3}},
+		{"ACCEPT:", nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseSelection(tt.answer, 4)
+		if err != nil {
+			t.Errorf("ParseSelection(%q) failed: %v", tt.answer, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ParseSelection(%q) = %v, want %v", tt.answer, got, tt.want)
+		}
+	}
+}
+
+// TestParseSelectionInvalid tests that malformed answers are rejected
+func TestParseSelectionInvalid(t *testing.T) {
+	for _, answer := range []string{"MAYBE", "ACCEPT:4", "ACCEPT:-1", "ACCEPT:one"} {
+		if _, err := ParseSelection(answer, 4); err == nil {
+			t.Errorf("ParseSelection(%q) succeeded, want an error", answer)
+		}
+	}
+}
+
+// TestFormatSelectionRoundTrip tests that formatted selections parse back to the same indices
+func TestFormatSelectionRoundTrip(t *testing.T) {
+	for _, selected := range [][]int{nil, {1}, {0, 2}, {0, 1, 2}} {
+		answer := FormatSelection(selected, 3)
+		got, err := ParseSelection(answer, 3)
+		if err != nil {
+			t.Errorf("ParseSelection(%q) failed: %v", answer, err)
+			continue
+		}
+		if !slices.Equal(got, selected) {
+			t.Errorf("round trip of %v via %q = %v", selected, answer, got)
+		}
+	}
+}
+
+// TestSenderStatus tests that only offers signed by a key pinned before are described as signed
+func TestSenderStatus(t *testing.T) {
+	tests := []struct {
+		peer Peer
+		want string
+	}{
+		{Peer{SignedOffer: true}, "new, unverified sender"},
+		{Peer{}, "new, unverified sender"},
+		{Peer{Pinned: true, SignedOffer: true}, "signed by pinned key"},
+		{Peer{Pinned: true}, "unsigned offer"},
+	}
+	for _, tt := range tests {
+		if got := tt.peer.SenderStatus(); got != tt.want {
+			t.Errorf("SenderStatus() of %+v = %q, want %q", tt.peer, got, tt.want)
+		}
+	}
+}
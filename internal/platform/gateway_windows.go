@@ -12,6 +12,9 @@ import (
 	"github.com/tailscale/walk"
 	// . "github.com/tailscale/walk/declarative"
 
+	"github.com/metalgrid/drift/internal/secret"
+	"github.com/metalgrid/drift/internal/transfer"
+	"github.com/metalgrid/drift/internal/trust"
 	"github.com/metalgrid/drift/internal/zeroconf"
 )
 
@@ -20,6 +23,7 @@ type Win32Gateway struct {
 	trayIcon *walk.NotifyIcon
 	peers    *zeroconf.Peers
 	reqch    chan<- Request
+	blocked  *trust.Blocklist
 }
 
 func (g *Win32Gateway) Run(ctx context.Context) error {
@@ -45,7 +49,7 @@ func (g *Win32Gateway) Run(ctx context.Context) error {
 
 	tray.SetToolTip("Drift - pain free, secure file transfer")
 	tray.MouseDown().Attach(func(x, y int, button walk.MouseButton) {
-		for _, peer := range g.peers.All() {
+		for _, peer := range visiblePeers(g.peers, g.blocked) {
 			action := walk.NewAction()
 			action.SetText(peer.Instance)
 			action.Triggered().Attach(func() {
@@ -80,10 +84,11 @@ func (g *Win32Gateway) Notify(msg string) {
 	fmt.Println(msg)
 }
 
-func newGateway(peers *zeroconf.Peers, requests chan<- Request) Gateway {
+func newGateway(peers *zeroconf.Peers, requests chan<- Request, transfers *transfer.Manager, known *trust.Store, blocked *trust.Blocklist, identity secret.EncryptionKey) Gateway {
 	_ = peers
 	return &Win32Gateway{
-		peers: peers,
-		reqch: requests,
+		peers:   peers,
+		reqch:   requests,
+		blocked: blocked,
 	}
 }
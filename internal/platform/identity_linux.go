@@ -0,0 +1,95 @@
+//go:build linux
+
+package platform
+
+import (
+	"html"
+
+	"github.com/diamondburned/gotk4/pkg/cairo"
+	gtk "github.com/diamondburned/gotk4/pkg/gtk/v4"
+	"rsc.io/qr"
+
+	"github.com/metalgrid/drift/internal/secret"
+)
+
+// qrModuleSize is the size of a QR code module in pixels, and qrQuietZone the margin
+// around the code in modules, which scanners need to find it.
+const (
+	qrModuleSize = 6
+	qrQuietZone  = 4
+)
+
+// showIdentity opens (or focuses) the window with the fingerprint of this device's
+// identity key, as text and as a QR code, for a peer to compare or scan before
+// trusting this device.
+func (g *linuxGateway) showIdentity() {
+	if g.identityWindow != nil {
+		g.identityWindow.Present()
+		return
+	}
+	win := gtk.NewWindow()
+	win.SetTitle("Drift - Fingerprint")
+	win.SetResizable(false)
+	win.ConnectCloseRequest(func() bool {
+		g.identityWindow = nil
+		return false
+	})
+	g.identityWindow = win
+
+	box := gtk.NewBox(gtk.OrientationVertical, 12)
+	box.SetMarginTop(16)
+	box.SetMarginBottom(16)
+	box.SetMarginStart(16)
+	box.SetMarginEnd(16)
+
+	intro := gtk.NewLabel("Peers can verify this device by scanning the code, or by comparing " +
+		"the fingerprint with the one they see.")
+	intro.SetWrap(true)
+	intro.SetMaxWidthChars(40)
+	box.Append(intro)
+
+	fingerprint := secret.Fingerprint(g.identity)
+	if code := newQRCode(fingerprint); code != nil {
+		box.Append(code)
+	}
+
+	label := gtk.NewLabel("")
+	label.SetMarkup("<tt><b>" + html.EscapeString(fingerprint) + "</b></tt>")
+	label.SetSelectable(true)
+	label.SetWrap(true)
+	box.Append(label)
+
+	win.SetChild(box)
+	win.Present()
+}
+
+// newQRCode draws text as a QR code, black on white whatever the theme. It returns nil
+// if the text does not fit in one.
+func newQRCode(text string) *gtk.DrawingArea {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return nil
+	}
+	size := (code.Size + 2*qrQuietZone) * qrModuleSize
+
+	area := gtk.NewDrawingArea()
+	area.SetContentWidth(size)
+	area.SetContentHeight(size)
+	area.SetHAlign(gtk.AlignCenter)
+	area.SetDrawFunc(func(_ *gtk.DrawingArea, cr *cairo.Context, width, height int) {
+		cr.SetSourceRGB(1, 1, 1)
+		cr.Rectangle(0, 0, float64(size), float64(size))
+		cr.Fill()
+		cr.SetSourceRGB(0, 0, 0)
+		for y := range code.Size {
+			for x := range code.Size {
+				if code.Black(x, y) {
+					cr.Rectangle(float64((x+qrQuietZone)*qrModuleSize), float64((y+qrQuietZone)*qrModuleSize),
+						qrModuleSize, qrModuleSize)
+				}
+			}
+		}
+		cr.Fill()
+	})
+	return area
+}
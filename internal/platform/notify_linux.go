@@ -99,16 +99,48 @@ func (n *notifier) Send(summary, body, icon string, actions map[string]string, o
 		actionList = append(actionList, key, label)
 	}
 
+	id, err := n.notify(0, summary, body, icon, actionList, map[string]dbus.Variant{})
+	if err != nil {
+		return 0, err
+	}
+
+	if onAction != nil && len(actions) > 0 {
+		n.mu.Lock()
+		n.pending[id] = onAction
+		n.mu.Unlock()
+	}
+
+	return id, nil
+}
+
+// Update shows a progress notification, replacing the one with the given ID if it is
+// nonzero, and returns the ID to replace next time. percent is shown as a gauge by
+// notification servers that support it.
+func (n *notifier) Update(replaces uint32, summary, body, icon string, percent int) (uint32, error) {
+	hints := map[string]dbus.Variant{
+		"value":     dbus.MakeVariant(int32(percent)),
+		"transient": dbus.MakeVariant(true),
+	}
+	return n.notify(replaces, summary, body, icon, []string{}, hints)
+}
+
+// Dismiss closes a notification that is no longer relevant.
+func (n *notifier) Dismiss(id uint32) {
+	obj := n.bus.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
+	_ = obj.Call("org.freedesktop.Notifications.CloseNotification", 0, id).Err
+}
+
+func (n *notifier) notify(replaces uint32, summary, body, icon string, actions []string, hints map[string]dbus.Variant) (uint32, error) {
 	obj := n.bus.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
 	call := obj.Call("org.freedesktop.Notifications.Notify", 0,
-		"Drift",                   // app_name
-		uint32(0),                 // replaces_id
-		icon,                      // app_icon
-		summary,                   // summary
-		body,                      // body
-		actionList,                // actions
-		map[string]dbus.Variant{}, // hints
-		int32(10000),              // expire_timeout
+		"Drift",      // app_name
+		replaces,     // replaces_id
+		icon,         // app_icon
+		summary,      // summary
+		body,         // body
+		actions,      // actions
+		hints,        // hints
+		int32(10000), // expire_timeout
 	)
 	if call.Err != nil {
 		return 0, call.Err
@@ -118,13 +150,6 @@ func (n *notifier) Send(summary, body, icon string, actions map[string]string, o
 	if err := call.Store(&id); err != nil {
 		return 0, err
 	}
-
-	if onAction != nil && len(actions) > 0 {
-		n.mu.Lock()
-		n.pending[id] = onAction
-		n.mu.Unlock()
-	}
-
 	return id, nil
 }
 
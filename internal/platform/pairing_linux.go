@@ -0,0 +1,119 @@
+//go:build linux
+
+package platform
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/diamondburned/gotk4/pkg/core/glib"
+	gtk "github.com/diamondburned/gotk4/pkg/gtk/v4"
+
+	"github.com/metalgrid/drift/internal/secret"
+)
+
+func (g *linuxGateway) ConfirmPairing(peer Peer) bool {
+	response := make(chan bool, 1)
+	glib.IdleAdd(func() {
+		g.showPairing(peer, response)
+	})
+	if !<-response {
+		return false
+	}
+
+	if err := g.known.Verify(peer.Name, peer.Key); err != nil {
+		g.Notify(fmt.Sprintf("Failed verifying %s: %s", peer.Name, err))
+		return false
+	}
+	return true
+}
+
+// showPairing shows the short authentication string of a peer and asks whether the
+// peer's screen shows the same. It answers on response exactly once, declining when
+// the window is closed or left alone for responseTimeout.
+func (g *linuxGateway) showPairing(peer Peer, response chan<- bool) {
+	win := gtk.NewWindow()
+	win.SetTitle("Verify " + peer.Name)
+	win.SetDefaultSize(420, 0)
+	win.SetResizable(false)
+
+	box := gtk.NewBox(gtk.OrientationVertical, 12)
+	box.SetMarginTop(16)
+	box.SetMarginBottom(16)
+	box.SetMarginStart(16)
+	box.SetMarginEnd(16)
+
+	intro := gtk.NewLabel(fmt.Sprintf("Compare this with the screen of %s. "+
+		"Only confirm if it shows the same symbols in the same order.", peer.Name))
+	intro.SetWrap(true)
+	box.Append(intro)
+
+	symbols := gtk.NewLabel("")
+	symbols.SetMarkup(`<span size="xx-large">` + html.EscapeString(peer.SAS.Symbols()) + "</span>")
+	box.Append(symbols)
+
+	names := make([]string, len(peer.SAS.Emoji))
+	for i, e := range peer.SAS.Emoji {
+		names[i] = e.Name
+	}
+	namesLabel := gtk.NewLabel(strings.Join(names, " · "))
+	namesLabel.SetWrap(true)
+	namesLabel.AddCSSClass("dim-label")
+	box.Append(namesLabel)
+
+	digits := gtk.NewLabel("")
+	digits.SetMarkup("Or compare the numbers: <tt><b>" + html.EscapeString(peer.SAS.Digits) + "</b></tt>")
+	box.Append(digits)
+
+	if len(peer.Key) == 32 {
+		fingerprint := gtk.NewLabel("")
+		fingerprint.SetMarkup("The fingerprint of " + html.EscapeString(peer.Name) + " is <tt>" +
+			html.EscapeString(secret.Fingerprint((*[32]byte)(peer.Key))) + "</tt>")
+		fingerprint.SetWrap(true)
+		fingerprint.SetSelectable(true)
+		fingerprint.AddCSSClass("dim-label")
+		box.Append(fingerprint)
+	}
+
+	responded := false
+	respond := func(confirmed bool) {
+		if responded {
+			return
+		}
+		responded = true
+		response <- confirmed
+		win.Destroy()
+	}
+
+	btnBox := gtk.NewBox(gtk.OrientationHorizontal, 8)
+	btnBox.SetHAlign(gtk.AlignEnd)
+	btnBox.SetMarginTop(8)
+
+	mismatchBtn := gtk.NewButtonWithLabel("They Don't Match")
+	mismatchBtn.ConnectClicked(func() { respond(false) })
+	btnBox.Append(mismatchBtn)
+
+	matchBtn := gtk.NewButtonWithLabel("They Match")
+	matchBtn.AddCSSClass("suggested-action")
+	matchBtn.ConnectClicked(func() { respond(true) })
+	btnBox.Append(matchBtn)
+
+	box.Append(btnBox)
+	win.SetChild(box)
+
+	win.ConnectCloseRequest(func() bool {
+		if !responded {
+			responded = true
+			response <- false
+		}
+		return false
+	})
+	glib.TimeoutAdd(uint(responseTimeout/time.Millisecond), func() bool {
+		respond(false)
+		return false
+	})
+
+	win.Present()
+}
@@ -0,0 +1,95 @@
+//go:build linux
+
+package platform
+
+import (
+	"time"
+
+	"github.com/diamondburned/gotk4/pkg/core/glib"
+	gtk "github.com/diamondburned/gotk4/pkg/gtk/v4"
+
+	"github.com/metalgrid/drift/internal/transfer"
+)
+
+// progressNotifyInterval is the minimum time between updates of a progress notification.
+const progressNotifyInterval = 2 * time.Second
+
+// transferWindow shows a transfer in flight with a button to cancel it. Its widgets are
+// only touched on the GTK thread, and are nil once the user closed the window.
+type transferWindow struct {
+	window *gtk.Window
+	bar    *gtk.ProgressBar
+	detail *gtk.Label
+}
+
+// transferNotice is what the gateway last told about a transfer outside its window.
+type transferNotice struct {
+	state        transfer.State
+	notification uint32
+	notified     time.Time
+}
+
+// transferChanged follows the transfers of the manager: it keeps their windows and
+// progress notifications up to date, and signals state changes on the bus.
+func (g *linuxGateway) transferChanged(t transfer.Transfer) {
+	glib.IdleAdd(func() {
+		g.showTransfer(t)
+	})
+
+	g.mu.Lock()
+	n, ok := g.notices[t.ID]
+	if !ok {
+		n = &transferNotice{}
+		g.notices[t.ID] = n
+	}
+	changed := n.state != t.State
+	n.state = t.State
+	replaces := n.notification
+	var dismiss, update bool
+	switch {
+	case t.State.Finished():
+		dismiss = replaces != 0
+		delete(g.notices, t.ID)
+	case t.State == transfer.Transferring && time.Since(n.notified) >= progressNotifyInterval:
+		update = true
+		n.notified = time.Now()
+	}
+	g.mu.Unlock()
+
+	if changed {
+		_ = g.dbus.EmitTransferChanged(t.ID, string(t.State))
+	}
+	if dismiss {
+		g.notif.Dismiss(replaces)
+	}
+	if update {
+		id, err := g.notif.Update(replaces, transferTitle(t), describeProgress(t.Progress), notifyIconPath(), progressPercent(t.Progress))
+		if err == nil {
+			g.mu.Lock()
+			n.notification = id
+			g.mu.Unlock()
+		}
+	}
+}
+
+// showTransfer opens a window for a transfer once it moves data, keeps it up to date and
+// closes it when the transfer is over. It runs on the GTK thread.
+func (g *linuxGateway) showTransfer(t transfer.Transfer) {
+	w, ok := g.transferWindows[t.ID]
+	if t.State.Finished() {
+		if ok && w.window != nil {
+			w.window.Destroy()
+		}
+		delete(g.transferWindows, t.ID)
+		return
+	}
+	if t.State != transfer.Transferring {
+		return
+	}
+	if !ok {
+		// Once closed by the user, the window stays closed.
+		w = g.newTransferWindow(t)
+		g.transferWindows[t.ID] = w
+	}
+	w.update(t.Progress)
+}
@@ -13,6 +13,8 @@ import (
 	"github.com/diamondburned/gotk4/pkg/gdk/v4"
 	gio "github.com/diamondburned/gotk4/pkg/gio/v2"
 	gtk "github.com/diamondburned/gotk4/pkg/gtk/v4"
+
+	"github.com/metalgrid/drift/internal/transfer"
 )
 
 // buildPeerPopover creates a small undecorated window for the peer list.
@@ -49,7 +51,7 @@ func (g *linuxGateway) rebuildPeerList(win *gtk.Window) {
 	listBox := gtk.NewListBox()
 	listBox.SetSelectionMode(gtk.SelectionNone)
 
-	peers := g.peers.All()
+	peers := visiblePeers(g.peers, g.blocked)
 	for _, peer := range peers {
 		row := gtk.NewBox(gtk.OrientationHorizontal, 10)
 		row.SetMarginTop(8)
@@ -91,7 +93,26 @@ func (g *linuxGateway) rebuildPeerList(win *gtk.Window) {
 	}
 
 	scrolled.SetChild(listBox)
-	win.SetChild(scrolled)
+
+	blockedBtn := gtk.NewButtonWithLabel("Blocked Peers...")
+	blockedBtn.AddCSSClass("flat")
+	blockedBtn.ConnectClicked(func() {
+		g.showBlockedPeers()
+		win.SetVisible(false)
+	})
+
+	identityBtn := gtk.NewButtonWithLabel("My Fingerprint...")
+	identityBtn.AddCSSClass("flat")
+	identityBtn.ConnectClicked(func() {
+		g.showIdentity()
+		win.SetVisible(false)
+	})
+
+	content := gtk.NewBox(gtk.OrientationVertical, 0)
+	content.Append(scrolled)
+	content.Append(blockedBtn)
+	content.Append(identityBtn)
+	win.SetChild(content)
 }
 
 // openDropWindow opens (or focuses) a drop target window for a specific peer.
@@ -146,7 +167,7 @@ func (g *linuxGateway) openDropWindow(peerInstance string) {
 		gtk.STYLE_PROVIDER_PRIORITY_APPLICATION,
 	)
 
-	hintLabel := gtk.NewLabel("Drop files here")
+	hintLabel := gtk.NewLabel("Drop files or folders here")
 	hintLabel.SetVAlign(gtk.AlignCenter)
 	hintLabel.SetVExpand(true)
 	dropZone.Append(hintLabel)
@@ -208,6 +229,22 @@ func (g *linuxGateway) openDropWindow(peerInstance string) {
 	})
 	box.Append(chooseBtn)
 
+	// Compare short authentication strings with the peer's user
+	verifyBtn := gtk.NewButtonWithLabel("Verify Identity...")
+	verifyBtn.ConnectClicked(func() {
+		g.reqch <- Request{To: peerInstance, Pair: true}
+	})
+	box.Append(verifyBtn)
+
+	// Refuse the peer's connections and hide it from the peer list
+	blockBtn := gtk.NewButtonWithLabel("Block")
+	blockBtn.AddCSSClass("destructive-action")
+	blockBtn.ConnectClicked(func() {
+		g.block(displayName)
+		win.Close()
+	})
+	box.Append(blockBtn)
+
 	win.SetChild(box)
 
 	// Track and clean up on close
@@ -238,29 +275,90 @@ func (g *linuxGateway) showTransferDetail(req promptRequest) {
 	box.SetMarginEnd(12)
 
 	// Header
-	if req.peerName != "" {
+	if req.peer.KeyChanged {
+		warningLabel := gtk.NewLabel("")
+		warningLabel.SetMarkup("<b>Warning:</b> " + html.EscapeString(req.peer.KeyChangedWarning()))
+		warningLabel.SetWrap(true)
+		warningLabel.AddCSSClass("error")
+		box.Append(warningLabel)
+	}
+	if req.peer.Name != "" {
+		header := "<b>Incoming files from " + html.EscapeString(req.peer.Name) + "</b>"
+		if req.peer.Verified {
+			header += " ✓ verified in person"
+		}
 		headerLabel := gtk.NewLabel("")
-		headerLabel.SetMarkup("<b>Incoming files from " + html.EscapeString(req.peerName) + "</b>")
+		headerLabel.SetMarkup(header)
 		box.Append(headerLabel)
+
+		// How far the sender is authenticated, as described by Peer.SenderStatus
+		badge := gtk.NewLabel("⚠ " + capitalize(req.peer.SenderStatus()))
+		badge.AddCSSClass("warning")
+		switch {
+		case !req.peer.Pinned:
+			badge.SetTooltipText("This is the first time " + req.peer.Name + " connected with this identity key, " +
+				"so nothing shows it is who it claims to be. Compare fingerprints to verify it.")
+		case req.peer.SignedOffer:
+			badge.SetLabel("✔ " + capitalize(req.peer.SenderStatus()))
+			badge.SetTooltipText("The offer is signed by the identity key pinned for " + req.peer.Name + " on first contact.")
+			badge.RemoveCSSClass("warning")
+			badge.AddCSSClass("success")
+		default:
+			badge.SetTooltipText("The offer is not signed by the identity key pinned for " + req.peer.Name +
+				". Older versions of Drift do not sign their offers.")
+		}
+		box.Append(badge)
 	} else if req.question != "" {
 		questionLabel := gtk.NewLabel(req.question)
 		questionLabel.SetWrap(true)
 		box.Append(questionLabel)
 	}
 
-	// File list
+	acceptBtn := gtk.NewButtonWithLabel("Accept")
+
+	// File list, with a checkbox per file so that only part of a batch can be accepted
+	checks := make([]*gtk.CheckButton, len(req.files))
+	selection := func() []int {
+		var selected []int
+		for i, check := range checks {
+			if check.Active() {
+				selected = append(selected, i)
+			}
+		}
+		return selected
+	}
 	if len(req.files) > 0 {
 		listBox := gtk.NewListBox()
 		listBox.SetSelectionMode(gtk.SelectionNone)
-		totalSize := int64(0)
+		totalLabel := gtk.NewLabel("")
+
+		updateTotal := func() {
+			selected := selection()
+			totalSize := int64(0)
+			for _, i := range selected {
+				totalSize += req.files[i].Size
+			}
+			if len(selected) == len(req.files) {
+				totalLabel.SetLabel(fmt.Sprintf("%d files, %s total", len(req.files), formatSize(totalSize)))
+			} else {
+				totalLabel.SetLabel(fmt.Sprintf("%d of %d files selected, %s", len(selected), len(req.files), formatSize(totalSize)))
+			}
+			acceptBtn.SetSensitive(len(selected) > 0)
+		}
 
-		for _, file := range req.files {
+		for i, file := range req.files {
 			row := gtk.NewBox(gtk.OrientationHorizontal, 10)
 			row.SetMarginTop(4)
 			row.SetMarginBottom(4)
 			row.SetMarginStart(8)
 			row.SetMarginEnd(8)
 
+			check := gtk.NewCheckButton()
+			check.SetActive(true)
+			check.ConnectToggled(updateTotal)
+			checks[i] = check
+			row.Append(check)
+
 			nameLabel := gtk.NewLabel(file.Filename)
 			nameLabel.SetHExpand(true)
 			nameLabel.SetXAlign(0)
@@ -270,7 +368,6 @@ func (g *linuxGateway) showTransferDetail(req promptRequest) {
 			row.Append(sizeLabel)
 
 			listBox.Append(row)
-			totalSize += file.Size
 		}
 
 		scrolled := gtk.NewScrolledWindow()
@@ -279,7 +376,7 @@ func (g *linuxGateway) showTransferDetail(req promptRequest) {
 		scrolled.SetChild(listBox)
 		box.Append(scrolled)
 
-		totalLabel := gtk.NewLabel(fmt.Sprintf("%d files, %s total", len(req.files), formatSize(totalSize)))
+		updateTotal()
 		box.Append(totalLabel)
 	}
 
@@ -300,7 +397,6 @@ func (g *linuxGateway) showTransferDetail(req promptRequest) {
 	responded := false
 
 	declineBtn := gtk.NewButtonWithLabel("Decline")
-	acceptBtn := gtk.NewButtonWithLabel("Accept")
 	acceptBtn.AddCSSClass("suggested-action")
 
 	declineBtn.ConnectClicked(func() {
@@ -314,11 +410,35 @@ func (g *linuxGateway) showTransferDetail(req promptRequest) {
 	acceptBtn.ConnectClicked(func() {
 		if !responded {
 			responded = true
-			req.response <- "ACCEPT"
+			if len(req.files) > 0 {
+				req.response <- FormatSelection(selection(), len(req.files))
+			} else {
+				req.response <- "ACCEPT"
+			}
 			win.Destroy()
 		}
 	})
 
+	if req.peer.Name != "" {
+		// Decline and never hear from the peer again
+		blockBtn := gtk.NewButtonWithLabel("Block")
+		blockBtn.AddCSSClass("destructive-action")
+		blockBtn.ConnectClicked(func() {
+			if responded {
+				return
+			}
+			responded = true
+			req.response <- "DECLINE"
+			win.Destroy()
+			if err := g.blocked.Block(req.peer.Name, req.peer.Key); err != nil {
+				g.Notify(fmt.Sprintf("Failed blocking %s: %s", req.peer.Name, err))
+				return
+			}
+			g.Notify(fmt.Sprintf("Blocked %s", req.peer.Name))
+			g.refreshPeers()
+		})
+		btnBox.Append(blockBtn)
+	}
 	btnBox.Append(declineBtn)
 	btnBox.Append(acceptBtn)
 	box.Append(btnBox)
@@ -353,6 +473,102 @@ func (g *linuxGateway) showTransferDetail(req promptRequest) {
 	win.Present()
 }
 
+// newTransferWindow opens the window of a transfer in flight.
+// Closing the window leaves the transfer running.
+func (g *linuxGateway) newTransferWindow(t transfer.Transfer) *transferWindow {
+	win := gtk.NewWindow()
+	win.SetTitle("Drift Transfer")
+	win.SetDefaultSize(320, 100)
+
+	box := gtk.NewBox(gtk.OrientationVertical, 10)
+	box.SetMarginTop(12)
+	box.SetMarginBottom(12)
+	box.SetMarginStart(12)
+	box.SetMarginEnd(12)
+
+	label := gtk.NewLabel(transferTitle(t))
+	label.SetWrap(true)
+	label.SetXAlign(0)
+	box.Append(label)
+
+	bar := gtk.NewProgressBar()
+	box.Append(bar)
+
+	detail := gtk.NewLabel("Starting…")
+	detail.SetWrap(true)
+	detail.SetXAlign(0)
+	detail.AddCSSClass("dim-label")
+	box.Append(detail)
+
+	btnBox := gtk.NewBox(gtk.OrientationHorizontal, 8)
+	btnBox.SetHAlign(gtk.AlignEnd)
+
+	cancelBtn := gtk.NewButtonWithLabel("Cancel")
+	cancelBtn.AddCSSClass("destructive-action")
+	id := t.ID
+	cancelBtn.ConnectClicked(func() {
+		cancelBtn.SetSensitive(false)
+		if err := g.transfers.Cancel(id); err != nil {
+			fmt.Printf("failed cancelling transfer: %v\n", err)
+		}
+	})
+	btnBox.Append(cancelBtn)
+	box.Append(btnBox)
+
+	w := &transferWindow{window: win, bar: bar, detail: detail}
+	win.ConnectCloseRequest(func() bool {
+		w.window, w.bar, w.detail = nil, nil, nil
+		return false
+	})
+
+	win.SetChild(box)
+	win.Present()
+	return w
+}
+
+// update shows the latest progress of a transfer, if the window is still open.
+func (w *transferWindow) update(p transfer.Progress) {
+	if w.bar == nil {
+		return
+	}
+	if p.TotalBytes > 0 {
+		w.bar.SetFraction(float64(p.Bytes) / float64(p.TotalBytes))
+	}
+	w.detail.SetText(describeProgress(p))
+}
+
+// transferTitle says what a transfer moves and with whom.
+func transferTitle(t transfer.Transfer) string {
+	if t.Direction == transfer.Inbound {
+		return fmt.Sprintf("Receiving %s from %s", t.Description, t.Peer)
+	}
+	return fmt.Sprintf("Sending %s to %s", t.Description, t.Peer)
+}
+
+// describeProgress summarizes the progress of a transfer for the window and notifications.
+func describeProgress(p transfer.Progress) string {
+	var b strings.Builder
+	if p.Files > 1 {
+		fmt.Fprintf(&b, "File %d of %d: ", p.File, p.Files)
+	}
+	fmt.Fprintf(&b, "%s\n%s of %s", p.Filename, formatSize(p.Bytes), formatSize(p.TotalBytes))
+	if p.Speed > 0 {
+		fmt.Fprintf(&b, ", %s/s", formatSize(int64(p.Speed)))
+	}
+	if p.ETA > 0 {
+		fmt.Fprintf(&b, ", %s left", p.ETA)
+	}
+	return b.String()
+}
+
+// progressPercent is how much of a transfer is done, from 0 to 100.
+func progressPercent(p transfer.Progress) int {
+	if p.TotalBytes <= 0 {
+		return 0
+	}
+	return int(p.Bytes * 100 / p.TotalBytes)
+}
+
 func droppedPaths(val *glib.Value) []string {
 	v := val.GoValue()
 	switch value := v.(type) {
@@ -412,3 +628,11 @@ func formatSize(bytes int64) string {
 		return fmt.Sprintf("%d B", bytes)
 	}
 }
+
+// capitalize starts a sentence with s, which is ASCII.
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
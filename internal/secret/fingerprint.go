@@ -0,0 +1,28 @@
+package secret
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+)
+
+// fingerprintBytes is how much of the hash a fingerprint shows: 160 bits, which take 32
+// base32 characters.
+const fingerprintBytes = 20
+
+// Fingerprint returns the fingerprint of a public key, for users to compare out of band
+// before trusting a peer: base32 in groups of four characters, such as
+// "MZXW 6YTB OI3D ...". It only uses upper case letters, digits and spaces, which QR
+// codes encode compactly.
+func Fingerprint(key EncryptionKey) string {
+	h := sha256.New()
+	h.Write([]byte("drift fingerprint"))
+	h.Write(key[:])
+	encoded := base32.StdEncoding.EncodeToString(h.Sum(nil)[:fingerprintBytes])
+
+	groups := make([]string, 0, len(encoded)/4)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
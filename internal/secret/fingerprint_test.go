@@ -0,0 +1,21 @@
+package secret
+
+import (
+	"regexp"
+	"testing"
+)
+
+// TestFingerprint tests that fingerprints are stable, grouped base32 and differ between keys
+func TestFingerprint(t *testing.T) {
+	alice, bob := mustGenerateIdentity(t), mustGenerateIdentity(t)
+	fingerprint := Fingerprint(alice.PublicKey)
+	if !regexp.MustCompile(`^[A-Z2-7]{4}( [A-Z2-7]{4}){7}$`).MatchString(fingerprint) {
+		t.Errorf("Fingerprint() = %q, want 8 groups of 4 base32 characters", fingerprint)
+	}
+	if again := Fingerprint(alice.PublicKey); again != fingerprint {
+		t.Errorf("Fingerprint() = %q, then %q", fingerprint, again)
+	}
+	if other := Fingerprint(bob.PublicKey); other == fingerprint {
+		t.Errorf("Fingerprint() = %q for different keys", other)
+	}
+}
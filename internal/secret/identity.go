@@ -0,0 +1,159 @@
+package secret
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// identityPEMType labels the PEM block holding an identity's X25519 private key, as
+// exported. Key files label it encryptedIdentityPEMType once it is encrypted, or hold a
+// keyringIdentityPEMType block when the key is in a keyring.
+const (
+	identityPEMType          = "DRIFT IDENTITY KEY"
+	encryptedIdentityPEMType = "DRIFT ENCRYPTED IDENTITY KEY"
+	keyringIdentityPEMType   = "DRIFT KEYRING IDENTITY KEY"
+)
+
+// ErrInsecureIdentity is reported for identity key files that other users can access.
+var ErrInsecureIdentity = errors.New("identity key is accessible by other users")
+
+// Identity is the long-term X25519 key pair that peers know this device by.
+// Its public key is what the pk TXT record advertises.
+type Identity struct {
+	PrivateKey EncryptionKey
+	PublicKey  EncryptionKey
+}
+
+// GenerateIdentity creates a new random identity.
+func GenerateIdentity() (*Identity, error) {
+	privateKey, publicKey, err := GenerateX25519KeyPair()
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{PrivateKey: privateKey, PublicKey: publicKey}, nil
+}
+
+// MarshalPEM encodes the identity's private key, as stored on disk and exported.
+func (id *Identity) MarshalPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: identityPEMType, Bytes: id.PrivateKey[:]})
+}
+
+// ParseIdentity decodes an identity encoded by MarshalPEM.
+func ParseIdentity(data []byte) (*Identity, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != identityPEMType {
+		return nil, fmt.Errorf("no %s block found", identityPEMType)
+	}
+	return identityFromKey(block.Bytes)
+}
+
+// identityFromKey returns the identity with the given private key.
+func identityFromKey(key []byte) (*Identity, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("identity key has %d bytes, want 32", len(key))
+	}
+	var privateKey, publicKey [32]byte
+	copy(privateKey[:], key)
+	curve25519.ScalarBaseMult(&publicKey, &privateKey)
+	return &Identity{PrivateKey: &privateKey, PublicKey: &publicKey}, nil
+}
+
+// LoadIdentity reads the identity stored at path. Like ssh, it refuses key files
+// that are readable or writable by anyone but their owner.
+func LoadIdentity(path string) (*Identity, error) {
+	id, _, err := loadKeyFile(path)
+	return id, err
+}
+
+// loadKeyFile reads the identity stored at path, and reports whether the key file
+// holds it in the clear, as key files from before encryption do.
+func loadKeyFile(path string) (*Identity, bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, false, fmt.Errorf("%w: %s has mode %o", ErrInsecureIdentity, path, fi.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, false, fmt.Errorf("invalid identity key %s: no PEM block found", path)
+	}
+	var id *Identity
+	switch block.Type {
+	case encryptedIdentityPEMType:
+		id, err = decryptIdentity(block.Bytes)
+	case keyringIdentityPEMType:
+		return nil, false, fmt.Errorf("%w: %s refers to it", errInKeyring, path)
+	default:
+		id, err = ParseIdentity(data)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid identity key %s: %w", path, err)
+	}
+	return id, block.Type == identityPEMType, nil
+}
+
+// LoadOrCreateIdentity reads the identity stored at path, generating and storing a new
+// one on first use. It reports whether the identity was created.
+func LoadOrCreateIdentity(path string) (*Identity, bool, error) {
+	return (&IdentityStore{Path: path}).LoadOrCreate()
+}
+
+// SaveIdentity stores the identity at path, readable by the owner only and encrypted
+// as described for IdentityStore.
+func SaveIdentity(path string, id *Identity) error {
+	data, err := encryptIdentity(id)
+	if err != nil {
+		return fmt.Errorf("failed encrypting identity key: %w", err)
+	}
+	return writeKeyFile(path, data)
+}
+
+// writeKeyFile replaces the key file at path atomically, so a crash never leaves a
+// truncated key behind.
+func writeKeyFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed creating identity directory: %w", err)
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(path)+"*.tmp")
+	if err != nil {
+		return err
+	}
+	// CreateTemp already uses 0600; be explicit about what the key file needs.
+	err = f.Chmod(0600)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("failed storing identity key: %w", err)
+	}
+	return nil
+}
+
+// RotateIdentity replaces the identity stored at path with a new one. The previous key
+// is kept next to it with an .old suffix, so that a mistaken rotation can be undone.
+// Peers that pinned the old public key will see the change.
+func RotateIdentity(path string) (*Identity, error) {
+	return (&IdentityStore{Path: path}).Rotate()
+}
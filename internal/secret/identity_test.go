@@ -0,0 +1,99 @@
+package secret
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestLoadOrCreateIdentityPersists tests that the identity is created once and then loaded
+func TestLoadOrCreateIdentityPersists(t *testing.T) {
+	useKeyFileSecret(t)
+	path := filepath.Join(t.TempDir(), "drift", "identity.key")
+
+	first, created, err := LoadOrCreateIdentity(path)
+	if err != nil || !created {
+		t.Fatalf("LoadOrCreateIdentity() = %v, created %v; want a new identity", err, created)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("identity key was not stored: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("identity key mode = %o, want 600", fi.Mode().Perm())
+	}
+
+	second, created, err := LoadOrCreateIdentity(path)
+	if err != nil || created {
+		t.Fatalf("LoadOrCreateIdentity() = %v, created %v; want the stored identity", err, created)
+	}
+	if *second.PublicKey != *first.PublicKey || *second.PrivateKey != *first.PrivateKey {
+		t.Error("loaded identity differs from the stored one")
+	}
+}
+
+// TestLoadIdentityRejectsInsecureFile tests that a key file readable by others is refused
+func TestLoadIdentityRejectsInsecureFile(t *testing.T) {
+	useKeyFileSecret(t)
+	path := filepath.Join(t.TempDir(), "identity.key")
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveIdentity(path, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadIdentity(path); !errors.Is(err, ErrInsecureIdentity) {
+		t.Errorf("LoadIdentity() = %v, want ErrInsecureIdentity", err)
+	}
+}
+
+// TestParseIdentity tests that an exported identity parses back to the same key pair
+func TestParseIdentity(t *testing.T) {
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseIdentity(id.MarshalPEM())
+	if err != nil {
+		t.Fatalf("ParseIdentity() failed: %v", err)
+	}
+	if *parsed.PublicKey != *id.PublicKey {
+		t.Error("public key was not derived from the exported private key")
+	}
+	for _, data := range []string{"", "garbage", "-----BEGIN DRIFT IDENTITY KEY-----\nAAEC\n-----END DRIFT IDENTITY KEY-----\n"} {
+		if _, err := ParseIdentity([]byte(data)); err == nil {
+			t.Errorf("ParseIdentity(%q) succeeded", data)
+		}
+	}
+}
+
+// TestRotateIdentity tests that rotating keeps the previous key and stores a new one
+func TestRotateIdentity(t *testing.T) {
+	useKeyFileSecret(t)
+	path := filepath.Join(t.TempDir(), "identity.key")
+	old, _, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := RotateIdentity(path)
+	if err != nil {
+		t.Fatalf("RotateIdentity() failed: %v", err)
+	}
+	if *rotated.PublicKey == *old.PublicKey {
+		t.Error("rotated identity has the old public key")
+	}
+	current, err := LoadIdentity(path)
+	if err != nil || *current.PublicKey != *rotated.PublicKey {
+		t.Errorf("stored identity is not the rotated one: %v", err)
+	}
+	backup, err := LoadIdentity(path + ".old")
+	if err != nil || *backup.PublicKey != *old.PublicKey {
+		t.Errorf("previous identity was not kept: %v", err)
+	}
+}
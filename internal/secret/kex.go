@@ -0,0 +1,141 @@
+package secret
+
+import (
+	"crypto/mlkem"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// KeyExchange is how the secure handshake agrees on its secrets.
+type KeyExchange uint8
+
+const (
+	// X25519 is the classic Noise XX handshake, which every peer with a Noise handshake
+	// supports.
+	X25519 KeyExchange = iota
+	// X25519MLKEM768 adds an ML-KEM-768 encapsulation to the X25519 exchanges, so that
+	// recorded traffic stays confidential against a future quantum computer, as long as
+	// either of the two holds.
+	X25519MLKEM768
+)
+
+// hybridProtocol names the hybrid handshake, after the hfs ("hybrid forward secrecy")
+// extension of the Noise Protocol Framework.
+const hybridProtocol = "Noise_XXhfs_25519+MLKEM768_ChaChaPoly_SHA256"
+
+func (k KeyExchange) String() string {
+	switch k {
+	case X25519:
+		return "x25519"
+	case X25519MLKEM768:
+		return "x25519-mlkem768"
+	}
+	return fmt.Sprintf("KeyExchange(%d)", k)
+}
+
+func (k KeyExchange) protocol() string {
+	if k == X25519MLKEM768 {
+		return hybridProtocol
+	}
+	return noiseProtocol
+}
+
+func (c *Config) keyExchanges() []KeyExchange {
+	if c.KeyExchanges == nil {
+		return []KeyExchange{X25519MLKEM768, X25519}
+	}
+	return c.KeyExchanges
+}
+
+// AdvertisedKeyExchanges lists the key exchanges beyond X25519 that this end accepts,
+// as advertised to peers in the "kex" TXT record. It is empty if there are none.
+func (c *Config) AdvertisedKeyExchanges() string {
+	var names []string
+	for _, k := range c.keyExchanges() {
+		if k != X25519 {
+			names = append(names, k.String())
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// KeyExchangeFor picks the key exchange to use with a peer that advertised the given
+// "kex" TXT record: the most preferred one both ends support. Peers that advertise
+// none, which predate the hybrid handshake, get X25519. Peers that predate the Noise
+// handshake altogether advertise protocol version 0.1; they speak neither and are
+// refused before a key exchange is picked, as described for LegacySecureConnection.
+func (c *Config) KeyExchangeFor(advertised string) KeyExchange {
+	offered := strings.Split(advertised, ",")
+	for _, k := range c.keyExchanges() {
+		if k == X25519 || slices.Contains(offered, k.String()) {
+			return k
+		}
+	}
+	return X25519
+}
+
+// isHybridHello tells the first message of a hybrid handshake from a classic one. A
+// classic one carries a handful of cipher suites after the ephemeral key, where a
+// hybrid one carries an ML-KEM encapsulation key, which is much longer.
+func isHybridHello(msg []byte) bool {
+	return len(msg) >= 32+mlkem.EncapsulationKeySize768
+}
+
+// writeKEMKey sends the initiator's ephemeral ML-KEM encapsulation key in the clear,
+// as the first message sends its ephemeral X25519 key.
+func (hs *handshakeState) writeKEMKey(msg []byte) ([]byte, error) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+	hs.kemKey = dk
+	ek := dk.EncapsulationKey().Bytes()
+	hs.mixHash(ek)
+	return append(msg, ek...), nil
+}
+
+func (hs *handshakeState) readKEMKey(msg []byte) ([]byte, error) {
+	if len(msg) < mlkem.EncapsulationKeySize768 {
+		return nil, errors.New("short handshake message")
+	}
+	ek, err := mlkem.NewEncapsulationKey768(msg[:mlkem.EncapsulationKeySize768])
+	if err != nil {
+		return nil, err
+	}
+	hs.remoteKEM = ek
+	hs.mixHash(msg[:mlkem.EncapsulationKeySize768])
+	return msg[mlkem.EncapsulationKeySize768:], nil
+}
+
+// writeKEMCiphertext encapsulates a secret to the initiator's key and mixes it into the
+// handshake. The ciphertext is encrypted under the keys of the X25519 exchanges so far.
+func (hs *handshakeState) writeKEMCiphertext(msg []byte) ([]byte, error) {
+	shared, ciphertext := hs.remoteKEM.Encapsulate()
+	sealed, err := hs.encryptAndHash(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	hs.mixKey(shared)
+	return append(msg, sealed...), nil
+}
+
+func (hs *handshakeState) readKEMCiphertext(msg []byte) ([]byte, error) {
+	size := mlkem.CiphertextSize768 + chacha20poly1305.Overhead
+	if len(msg) < size {
+		return nil, errors.New("short handshake message")
+	}
+	ciphertext, err := hs.decryptAndHash(msg[:size])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := hs.kemKey.Decapsulate(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	hs.mixKey(shared)
+	return msg[size:], nil
+}
@@ -0,0 +1,132 @@
+package secret
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// TestKeyExchangeFor tests that the hybrid key exchange is only used with peers that advertise it
+func TestKeyExchangeFor(t *testing.T) {
+	hybrid := &Config{}
+	classic := &Config{KeyExchanges: []KeyExchange{X25519}}
+	for _, tc := range []struct {
+		config     *Config
+		advertised string
+		want       KeyExchange
+	}{
+		{hybrid, "", X25519},
+		{hybrid, "x25519-mlkem768", X25519MLKEM768},
+		{hybrid, "x448-future,x25519-mlkem768", X25519MLKEM768},
+		{hybrid, "x448-future", X25519},
+		{classic, "x25519-mlkem768", X25519},
+	} {
+		if got := tc.config.KeyExchangeFor(tc.advertised); got != tc.want {
+			t.Errorf("KeyExchangeFor(%q) with %v = %s, want %s", tc.advertised, tc.config.keyExchanges(), got, tc.want)
+		}
+	}
+	if got := hybrid.AdvertisedKeyExchanges(); got != "x25519-mlkem768" {
+		t.Errorf("AdvertisedKeyExchanges() = %q, want x25519-mlkem768", got)
+	}
+	if got := classic.AdvertisedKeyExchanges(); got != "" {
+		t.Errorf("AdvertisedKeyExchanges() without hybrid = %q, want none", got)
+	}
+}
+
+// TestHandshakeNegotiatesKeyExchange tests that both ends agree on the key exchange and can talk
+func TestHandshakeNegotiatesKeyExchange(t *testing.T) {
+	classic := []KeyExchange{X25519}
+	for _, tc := range []struct {
+		name           string
+		client, server []KeyExchange
+		want           KeyExchange
+	}{
+		{"both hybrid", nil, nil, X25519MLKEM768},
+		{"older client", classic, nil, X25519},
+		{"older server", nil, classic, X25519},
+	} {
+		client := &Config{Identity: mustGenerateIdentity(t), KeyExchanges: tc.client}
+		server := &Config{Identity: mustGenerateIdentity(t), KeyExchanges: tc.server}
+		c, s := handshakeConfigs(t, client, server, nil)
+		if c.err != nil || s.err != nil {
+			t.Fatalf("%s: handshake failed: client %v, server %v", tc.name, c.err, s.err)
+		}
+		for _, conn := range []net.Conn{c.conn, s.conn} {
+			if got := conn.(*WrappedConnection).KeyExchange(); got != tc.want {
+				t.Errorf("%s: connection used %s, want %s", tc.name, got, tc.want)
+			}
+		}
+		go func() { _, _ = c.conn.Write([]byte("hello")) }()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(s.conn, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("%s: read %q, %v; want %q", tc.name, buf, err, "hello")
+		}
+	}
+}
+
+// TestServerRefusesDisabledHybrid tests that a server without the hybrid key exchange refuses clients starting one
+func TestServerRefusesDisabledHybrid(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+		_ = serverConn.Close()
+	})
+
+	server := &Config{Identity: mustGenerateIdentity(t), KeyExchanges: []KeyExchange{X25519}}
+	done := make(chan error)
+	go func() {
+		_, _, err := ServerHandshake(serverConn, server)
+		_ = serverConn.Close()
+		done <- err
+	}()
+	client := &Config{Identity: mustGenerateIdentity(t)}
+	if _, _, err := ClientHandshake(clientConn, client, nil, X25519MLKEM768); err == nil {
+		t.Error("client handshake succeeded")
+	}
+	if err := <-done; !errors.Is(err, ErrHandshake) {
+		t.Errorf("server handshake = %v, want ErrHandshake", err)
+	}
+}
+
+// TestHybridHandshakeRejectsTampering tests that a modified KEM key makes the hybrid handshake fail
+func TestHybridHandshakeRejectsTampering(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+		_ = serverConn.Close()
+	})
+	proxyConn, relayConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = proxyConn.Close()
+		_ = relayConn.Close()
+	})
+
+	// Flip a bit of the encapsulation key in the first message, and relay the rest.
+	go func() {
+		defer relayConn.Close()
+		msg, err := readHandshakeMessage(serverConn)
+		if err != nil {
+			return
+		}
+		msg[40] ^= 1
+		_ = writeHandshakeMessage(relayConn, msg)
+		go func() { _, _ = io.Copy(serverConn, relayConn) }()
+		_, _ = io.Copy(relayConn, serverConn)
+	}()
+
+	server := &Config{Identity: mustGenerateIdentity(t)}
+	done := make(chan error)
+	go func() {
+		_, _, err := ServerHandshake(proxyConn, server)
+		_ = proxyConn.Close()
+		done <- err
+	}()
+	client := &Config{Identity: mustGenerateIdentity(t)}
+	_, _, err := ClientHandshake(clientConn, client, nil, X25519MLKEM768)
+	if !errors.Is(err, ErrHandshake) {
+		t.Errorf("client handshake = %v, want ErrHandshake", err)
+	}
+	_ = clientConn.Close()
+	<-done
+}
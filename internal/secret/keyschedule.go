@@ -0,0 +1,91 @@
+package secret
+
+import (
+	"crypto/sha256"
+	"io"
+	"slices"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// DefaultRekeyBytes is how much plaintext one traffic key encrypts by default.
+	DefaultRekeyBytes = 64 << 30
+	// DefaultRekeyRecords is how many records one traffic key encrypts by default. It
+	// keeps well within the limits of AEAD ciphers on a single key.
+	DefaultRekeyRecords = 1 << 24
+)
+
+// Labels keep keys derived for different purposes apart.
+const (
+	initiatorLabel = "drift traffic v1 initiator"
+	responderLabel = "drift traffic v1 responder"
+	rekeyLabel     = "drift rekey v1"
+)
+
+// Config configures one end of secure connections.
+type Config struct {
+	// Identity authenticates this device to its peers.
+	Identity *Identity
+	// RekeyBytes and RekeyRecords bound how much plaintext, and how many records, are
+	// sent under one traffic key before it is replaced by the next. Zero selects
+	// DefaultRekeyBytes and DefaultRekeyRecords.
+	RekeyBytes   uint64
+	RekeyRecords uint64
+	// CipherSuites lists the suites to negotiate, most preferred first. Nil selects
+	// the supported suites, fastest on this machine first.
+	CipherSuites []CipherSuite
+	// KeyExchanges lists the key exchanges to accept and use, most preferred first. Nil
+	// selects the hybrid one, falling back to X25519 with peers that lack it. X25519 is
+	// used with such peers in any case.
+	KeyExchanges []KeyExchange
+}
+
+func (c *Config) cipherSuites() []CipherSuite {
+	if c.CipherSuites == nil {
+		return defaultCipherSuites()
+	}
+	return slices.DeleteFunc(slices.Clone(c.CipherSuites), func(s CipherSuite) bool {
+		return s != ChaCha20Poly1305 && s != AES256GCM
+	})
+}
+
+func (c *Config) rekeyBytes() uint64 {
+	if c.RekeyBytes == 0 {
+		return DefaultRekeyBytes
+	}
+	return c.RekeyBytes
+}
+
+func (c *Config) rekeyRecords() uint64 {
+	if c.RekeyRecords == 0 {
+		return DefaultRekeyRecords
+	}
+	return c.RekeyRecords
+}
+
+// deriveTrafficKey derives the first traffic key of one direction from the key the
+// handshake split off for it. The key is bound to the direction, to both static keys
+// and to the handshake hash, so that it cannot serve another direction or session.
+func deriveTrafficKey(secret []byte, label string, initiatorStatic, responderStatic *[32]byte, handshakeHash []byte) [32]byte {
+	info := make([]byte, 0, len(label)+3*32)
+	info = append(info, label...)
+	info = append(info, initiatorStatic[:]...)
+	info = append(info, responderStatic[:]...)
+	info = append(info, handshakeHash...)
+	return expandKey(secret, info)
+}
+
+func expandKey(secret, info []byte) [32]byte {
+	var key [32]byte
+	_, _ = io.ReadFull(hkdf.Expand(sha256.New, secret, info), key[:])
+	return key
+}
+
+// rekey replaces the key with one derived from it and restarts the nonce counter. The
+// old key cannot be recovered from the new one, so records sent before a rekey stay
+// protected if a later key leaks.
+func (cs *cipherState) rekey() {
+	next := expandKey(cs.key[:], []byte(rekeyLabel))
+	cs.setKey(next[:])
+}
@@ -0,0 +1,301 @@
+package secret
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/adrg/xdg"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	// ErrKeyringUnavailable is reported for identities stored in a keyring when there is
+	// no keyring to read them from.
+	ErrKeyringUnavailable = errors.New("identity key is stored in a keyring, which is not available")
+	// ErrMissingFromKeyring is reported when the key file refers to a keyring that does
+	// not hold the key any more.
+	ErrMissingFromKeyring = errors.New("identity key is missing from the keyring")
+
+	errInKeyring = errors.New("identity key is stored in a keyring")
+)
+
+// machineIDPaths are where systemd and D-Bus keep the ID of this machine.
+var machineIDPaths = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// keyFileSecretPath is where the secret that key files are encrypted with is kept. The
+// state directory holds what belongs to this machine, so unlike the config and data
+// directories, it is not meant to be synced or to roam to other machines.
+var keyFileSecretPath = filepath.Join(xdg.StateHome, "drift", "identity.secret")
+
+// keyFileLabel binds the key encrypting key files to their purpose, keyFileSaltSize is
+// the size of the salt it is derived with, and keyFileSecretSize that of the secret.
+const (
+	keyFileLabel      = "drift identity key file"
+	keyFileSaltSize   = 16
+	keyFileSecretSize = 32
+)
+
+// Keyring keeps secrets on behalf of the user, such as the Secret Service of the
+// desktop, which finds them by their attributes.
+type Keyring interface {
+	// Lookup returns the secret with the given attributes, or an error wrapping
+	// fs.ErrNotExist if there is none.
+	Lookup(attributes map[string]string) ([]byte, error)
+	// Store stores a secret under the given attributes, replacing the one stored under
+	// them before.
+	Store(label string, attributes map[string]string, secret []byte) error
+}
+
+// IdentityStore keeps the identity of this device in Keyring when there is one, and in
+// the key file at Path otherwise.
+//
+// With a keyring, the key file only records that the key is in it, so that drift does
+// not replace the identity with a new one while the keyring is unavailable, and key
+// files written without one move into it when it is first available.
+//
+// Without a keyring, the key is encrypted with a key derived from a random secret of the
+// user and, where there is one, the machine ID. The secret is readable by its owner only
+// and kept in the state directory, apart from the key file, so the key file alone reveals
+// nothing: not to other users of the machine who get hold of it, nor in copies that leave
+// the machine, such as synced dotfiles. Losing the secret loses the identity, which is
+// then rotated like a compromised one.
+type IdentityStore struct {
+	Path    string
+	Keyring Keyring
+}
+
+func (s *IdentityStore) attributes() map[string]string {
+	return map[string]string{"application": "drift", "type": "identity", "path": s.Path}
+}
+
+// Load reads the identity. It returns an error wrapping fs.ErrNotExist if there is none
+// yet, and only then. Key files from before encryption are encrypted, or moved into the
+// keyring, as they are loaded.
+func (s *IdentityStore) Load() (*Identity, error) {
+	id, inClear, err := loadKeyFile(s.Path)
+	if s.Keyring == nil {
+		switch {
+		case errors.Is(err, errInKeyring):
+			return nil, fmt.Errorf("%w: %s refers to it", ErrKeyringUnavailable, s.Path)
+		case err == nil && inClear:
+			if err := SaveIdentity(s.Path, id); err != nil {
+				return nil, err
+			}
+		}
+		return id, err
+	}
+
+	switch {
+	case err == nil:
+		// The key file was written before there was a keyring, so move it in.
+		if err := s.Save(id); err != nil {
+			return nil, err
+		}
+		return id, nil
+	case errors.Is(err, errInKeyring), errors.Is(err, fs.ErrNotExist):
+		data, lookupErr := s.Keyring.Lookup(s.attributes())
+		if errors.Is(lookupErr, fs.ErrNotExist) {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%w: %s refers to it", ErrMissingFromKeyring, s.Path)
+		}
+		if lookupErr != nil {
+			return nil, fmt.Errorf("failed reading identity key from the keyring: %w", lookupErr)
+		}
+		id, err := ParseIdentity(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity key in the keyring: %w", err)
+		}
+		return id, nil
+	}
+	return nil, err
+}
+
+// LoadOrCreate reads the identity, generating and storing a new one on first use. It
+// reports whether the identity was created.
+func (s *IdentityStore) LoadOrCreate() (*Identity, bool, error) {
+	id, err := s.Load()
+	if !errors.Is(err, fs.ErrNotExist) {
+		return id, false, err
+	}
+	id, err = GenerateIdentity()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := s.Save(id); err != nil {
+		return nil, false, err
+	}
+	return id, true, nil
+}
+
+// Save stores the identity, replacing the one stored before.
+func (s *IdentityStore) Save(id *Identity) error {
+	if s.Keyring == nil {
+		return SaveIdentity(s.Path, id)
+	}
+	if err := s.Keyring.Store("Drift identity key", s.attributes(), id.MarshalPEM()); err != nil {
+		return fmt.Errorf("failed storing identity key in the keyring: %w", err)
+	}
+	return writeKeyFile(s.Path, pem.EncodeToMemory(&pem.Block{Type: keyringIdentityPEMType}))
+}
+
+// Rotate replaces the identity with a new one. The previous one is kept as if stored
+// at the path with an .old suffix, so that a mistaken rotation can be undone. Peers
+// that pinned the old public key will see the change.
+func (s *IdentityStore) Rotate() (*Identity, error) {
+	previous, err := s.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if previous != nil {
+		old := &IdentityStore{Path: s.Path + ".old", Keyring: s.Keyring}
+		if err := old.Save(previous); err != nil {
+			return nil, err
+		}
+	}
+	id, err := GenerateIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Save(id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// machineID returns the ID of this machine, or nil where there is none, such as on Windows.
+func machineID() []byte {
+	for _, path := range machineIDPaths {
+		id, err := os.ReadFile(path)
+		if id = bytes.TrimSpace(id); err == nil && len(id) > 0 {
+			return id
+		}
+	}
+	return nil
+}
+
+// keyFileSecret returns the secret of this user that key files are encrypted with. If
+// there is none yet, it creates one when create is set, and fails otherwise.
+func keyFileSecret(create bool) ([]byte, error) {
+	fi, err := os.Stat(keyFileSecretPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		if !create {
+			return nil, fmt.Errorf("the secret it was encrypted with is missing: %w", err)
+		}
+		return createKeyFileSecret()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%w: %s has mode %o", ErrInsecureIdentity, keyFileSecretPath, fi.Mode().Perm())
+	}
+	secret, err := os.ReadFile(keyFileSecretPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) != keyFileSecretSize {
+		return nil, fmt.Errorf("invalid key file secret %s: %d bytes, want %d", keyFileSecretPath, len(secret), keyFileSecretSize)
+	}
+	return secret, nil
+}
+
+// createKeyFileSecret stores a new secret for key files. It is written aside and linked
+// into place, so that a crash never leaves a truncated one behind, and so that a secret
+// that another process created in the meantime is kept and used instead.
+func createKeyFileSecret() ([]byte, error) {
+	secret := make([]byte, keyFileSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(keyFileSecretPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed creating key file secret directory: %w", err)
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(keyFileSecretPath)+"*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	err = f.Chmod(0600)
+	if err == nil {
+		_, err = f.Write(secret)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Link(f.Name(), keyFileSecretPath)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return keyFileSecret(false)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed storing key file secret: %w", err)
+	}
+	return secret, nil
+}
+
+// keyFileAEAD returns the cipher of key files with the given salt for this user on this
+// machine, creating the user's secret first if create is set.
+func keyFileAEAD(salt []byte, create bool) (cipher.AEAD, error) {
+	secret, err := keyFileSecret(create)
+	if err != nil {
+		return nil, err
+	}
+	var key [chacha20poly1305.KeySize]byte
+	if _, err := io.ReadFull(hkdf.New(sha256.New, append(secret, machineID()...), salt, []byte(keyFileLabel)), key[:]); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key[:])
+}
+
+// encryptIdentity encodes the identity as stored in key files: a random salt, then the
+// private key sealed with a random nonce.
+func encryptIdentity(id *Identity) ([]byte, error) {
+	salt := make([]byte, keyFileSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := keyFileAEAD(salt, true)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(append(salt, nonce...), aead.Seal(nil, nonce, id.PrivateKey[:], []byte(encryptedIdentityPEMType))...)
+	return pem.EncodeToMemory(&pem.Block{Type: encryptedIdentityPEMType, Bytes: sealed}), nil
+}
+
+func decryptIdentity(sealed []byte) (*Identity, error) {
+	if len(sealed) < keyFileSaltSize+chacha20poly1305.NonceSizeX {
+		return nil, errors.New("encrypted identity key is too short")
+	}
+	salt, sealed := sealed[:keyFileSaltSize], sealed[keyFileSaltSize:]
+	nonce, ciphertext := sealed[:chacha20poly1305.NonceSizeX], sealed[chacha20poly1305.NonceSizeX:]
+	aead, err := keyFileAEAD(salt, false)
+	if err != nil {
+		return nil, err
+	}
+	key, err := aead.Open(nil, nonce, ciphertext, []byte(encryptedIdentityPEMType))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt the identity key, which was likely encrypted on another machine, by another user, or with a secret other than %s", keyFileSecretPath)
+	}
+	return identityFromKey(key)
+}
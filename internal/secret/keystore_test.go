@@ -0,0 +1,208 @@
+package secret
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// memoryKeyring keeps secrets in memory, as a stand-in for the Secret Service
+type memoryKeyring struct {
+	secrets map[string][]byte
+}
+
+// key identifies secrets by all their attributes; fmt prints maps sorted by key.
+func (k *memoryKeyring) key(attributes map[string]string) string {
+	return fmt.Sprint(attributes)
+}
+
+func (k *memoryKeyring) Lookup(attributes map[string]string) ([]byte, error) {
+	secret, ok := k.secrets[k.key(attributes)]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return secret, nil
+}
+
+func (k *memoryKeyring) Store(_ string, attributes map[string]string, secret []byte) error {
+	k.secrets[k.key(attributes)] = secret
+	return nil
+}
+
+// useMachineID makes key files use a machine ID of its own for the rest of the test
+func useMachineID(t *testing.T, id string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "machine-id")
+	if err := os.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	previous := machineIDPaths
+	machineIDPaths = []string{path}
+	t.Cleanup(func() { machineIDPaths = previous })
+}
+
+// useKeyFileSecret makes key files use a secret of their own for the rest of the test, and returns its path
+func useKeyFileSecret(t *testing.T) string {
+	t.Helper()
+	previous := keyFileSecretPath
+	keyFileSecretPath = filepath.Join(t.TempDir(), "drift", "identity.secret")
+	t.Cleanup(func() { keyFileSecretPath = previous })
+	return keyFileSecretPath
+}
+
+// TestKeyFileIsEncrypted tests that key files hide the key and only open for the user and machine that wrote them
+func TestKeyFileIsEncrypted(t *testing.T) {
+	useMachineID(t, "0123456789abcdef0123456789abcdef")
+	secretPath := useKeyFileSecret(t)
+	path := filepath.Join(t.TempDir(), "identity.key")
+	id := mustGenerateIdentity(t)
+	if err := SaveIdentity(path, id); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(data, id.MarshalPEM()) || bytes.Contains(data, []byte(identityPEMType+"-----")) {
+		t.Errorf("key file holds the key in the clear:\n%s", data)
+	}
+	loaded, err := LoadIdentity(path)
+	if err != nil || *loaded.PrivateKey != *id.PrivateKey {
+		t.Fatalf("LoadIdentity() = %v, want the saved identity", err)
+	}
+
+	fi, err := os.Stat(secretPath)
+	if err != nil {
+		t.Fatalf("key file secret was not stored: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("key file secret mode = %o, want 600", fi.Mode().Perm())
+	}
+
+	if err := os.Chmod(secretPath, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadIdentity(path); !errors.Is(err, ErrInsecureIdentity) {
+		t.Errorf("LoadIdentity() with a secret readable by others = %v, want ErrInsecureIdentity", err)
+	}
+	if err := os.Chmod(secretPath, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	useMachineID(t, "fedcba9876543210fedcba9876543210")
+	if _, err := LoadIdentity(path); err == nil || errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("LoadIdentity() on another machine = %v, want a decryption error", err)
+	}
+
+	useMachineID(t, "0123456789abcdef0123456789abcdef")
+	otherSecret := useKeyFileSecret(t)
+	if _, err := LoadIdentity(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("LoadIdentity() without the secret = %v, want it missing", err)
+	}
+	if _, err := os.Stat(otherSecret); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("loading created a secret: %v", err)
+	}
+	if err := SaveIdentity(filepath.Join(t.TempDir(), "identity.key"), id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadIdentity(path); err == nil || errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("LoadIdentity() with another user's secret = %v, want a decryption error", err)
+	}
+}
+
+// TestLoadIdentityReadsClearKeyFile tests that key files from before encryption still load
+func TestLoadIdentityReadsClearKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	id := mustGenerateIdentity(t)
+	if err := os.WriteFile(path, id.MarshalPEM(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadIdentity(path)
+	if err != nil || *loaded.PrivateKey != *id.PrivateKey {
+		t.Errorf("LoadIdentity() = %v, want the stored identity", err)
+	}
+}
+
+// TestIdentityStoreEncryptsClearKeyFile tests that key files from before encryption are encrypted once loaded without a keyring
+func TestIdentityStoreEncryptsClearKeyFile(t *testing.T) {
+	useKeyFileSecret(t)
+	path := filepath.Join(t.TempDir(), "identity.key")
+	id := mustGenerateIdentity(t)
+	if err := os.WriteFile(path, id.MarshalPEM(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := (&IdentityStore{Path: path}).Load()
+	if err != nil || *loaded.PrivateKey != *id.PrivateKey {
+		t.Fatalf("Load() = %v, want the stored identity", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(encryptedIdentityPEMType)) {
+		t.Errorf("key file was not encrypted:\n%s", data)
+	}
+	again, err := LoadIdentity(path)
+	if err != nil || *again.PrivateKey != *id.PrivateKey {
+		t.Errorf("LoadIdentity() = %v, want the identity from the encrypted key file", err)
+	}
+}
+
+// TestIdentityStoreUsesKeyring tests that the key lives in the keyring, which existing key files move into
+func TestIdentityStoreUsesKeyring(t *testing.T) {
+	useKeyFileSecret(t)
+	path := filepath.Join(t.TempDir(), "identity.key")
+	old := mustGenerateIdentity(t)
+	if err := SaveIdentity(path, old); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := &memoryKeyring{secrets: make(map[string][]byte)}
+	store := &IdentityStore{Path: path, Keyring: keyring}
+	id, created, err := store.LoadOrCreate()
+	if err != nil || created || *id.PrivateKey != *old.PrivateKey {
+		t.Fatalf("LoadOrCreate() = %v, created %v; want the key file's identity", err, created)
+	}
+	if _, err := keyring.Lookup(store.attributes()); err != nil {
+		t.Errorf("identity did not move into the keyring: %v", err)
+	}
+	if _, err := LoadIdentity(path); !errors.Is(err, errInKeyring) {
+		t.Errorf("LoadIdentity() = %v, want the key file to refer to the keyring", err)
+	}
+
+	again, err := store.Load()
+	if err != nil || *again.PrivateKey != *old.PrivateKey {
+		t.Errorf("Load() = %v, want the identity from the keyring", err)
+	}
+
+	rotated, err := store.Rotate()
+	if err != nil || *rotated.PublicKey == *old.PublicKey {
+		t.Fatalf("Rotate() = %v, want a new identity", err)
+	}
+	previous, err := (&IdentityStore{Path: path + ".old", Keyring: keyring}).Load()
+	if err != nil || *previous.PublicKey != *old.PublicKey {
+		t.Errorf("previous identity was not kept in the keyring: %v", err)
+	}
+}
+
+// TestIdentityStoreKeepsKeyringIdentity tests that an identity in an unavailable keyring is not replaced
+func TestIdentityStoreKeepsKeyringIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	keyring := &memoryKeyring{secrets: make(map[string][]byte)}
+	if _, _, err := (&IdentityStore{Path: path, Keyring: keyring}).LoadOrCreate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := (&IdentityStore{Path: path}).LoadOrCreate(); !errors.Is(err, ErrKeyringUnavailable) {
+		t.Errorf("LoadOrCreate() without the keyring = %v, want ErrKeyringUnavailable", err)
+	}
+	empty := &memoryKeyring{secrets: make(map[string][]byte)}
+	if _, _, err := (&IdentityStore{Path: path, Keyring: empty}).LoadOrCreate(); !errors.Is(err, ErrMissingFromKeyring) {
+		t.Errorf("LoadOrCreate() with another keyring = %v, want ErrMissingFromKeyring", err)
+	}
+}
@@ -0,0 +1,143 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// legacyMaxPayload bounds what a legacy record carries. Peers that speak the legacy
+	// scheme write one record per write, and put no bound on it themselves.
+	legacyMaxPayload = 1 << 20
+	// legacyLengthSize is the size of the big-endian length before every legacy record.
+	legacyLengthSize = 4
+)
+
+// LegacySecureConnection secures a connection the way peers that advertise protocol
+// version 0.1, such as the iOS client, do: each side sends an ephemeral X25519 key and
+// encrypts to the static key the other advertises, with AES-256-GCM keyed by the
+// SHA-256 of the shared secret. Both directions start their counter nonce at zero.
+//
+// Nothing in it authenticates the peer, so it must only be used to tell such peers
+// that they are refused, never to receive anything from them.
+func LegacySecureConnection(conn net.Conn, peerPublicKey, localPrivateKey EncryptionKey) (net.Conn, error) {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	ephemeral, err := GenerateIdentity()
+	if err != nil {
+		return nil, err
+	}
+	// Both sides write first, so the write must not wait for the peer to read.
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(ephemeral.PublicKey[:])
+		written <- err
+	}()
+	var remote [32]byte
+	_, readErr := io.ReadFull(conn, remote[:])
+	if err := <-written; err != nil {
+		return nil, err
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	send, err := legacyAEAD(ephemeral.PrivateKey, peerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	receive, err := legacyAEAD(localPrivateKey, &remote)
+	if err != nil {
+		return nil, err
+	}
+	return &legacyConnection{
+		Conn:         conn,
+		send:         send,
+		receive:      receive,
+		sendNonce:    make([]byte, send.NonceSize()),
+		receiveNonce: make([]byte, receive.NonceSize()),
+	}, nil
+}
+
+func legacyAEAD(private EncryptionKey, public *[32]byte) (cipher.AEAD, error) {
+	shared, err := DeriveSharedSecret(private, public)
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256(shared[:])
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// legacyConnection encrypts every write as one record of a length and the AES-GCM
+// ciphertext, and serves records across as many reads as the caller's buffers need.
+// It is not safe for concurrent use.
+type legacyConnection struct {
+	net.Conn
+	send, receive           cipher.AEAD
+	sendNonce, receiveNonce []byte
+	plaintext               []byte
+}
+
+func (c *legacyConnection) Read(p []byte) (int, error) {
+	for len(c.plaintext) == 0 {
+		var length [legacyLengthSize]byte
+		if _, err := io.ReadFull(c.Conn, length[:]); err != nil {
+			return 0, fmt.Errorf("read error: %w", err)
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size > legacyMaxPayload+uint32(c.receive.Overhead()) {
+			return 0, fmt.Errorf("read error: %w: %d bytes", ErrRecordTooLarge, size)
+		}
+		ciphertext := make([]byte, size)
+		if _, err := io.ReadFull(c.Conn, ciphertext); err != nil {
+			return 0, fmt.Errorf("read error: %w", err)
+		}
+		plaintext, err := c.receive.Open(ciphertext[:0], c.receiveNonce, ciphertext, nil)
+		if err != nil {
+			return 0, fmt.Errorf("read error: decryption error: %w", err)
+		}
+		incrementNonce(c.receiveNonce)
+		c.plaintext = plaintext
+	}
+	n := copy(p, c.plaintext)
+	c.plaintext = c.plaintext[n:]
+	return n, nil
+}
+
+func (c *legacyConnection) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), legacyMaxPayload)]
+		record := make([]byte, legacyLengthSize, legacyLengthSize+len(chunk)+c.send.Overhead())
+		record = c.send.Seal(record, c.sendNonce, chunk, nil)
+		binary.BigEndian.PutUint32(record, uint32(len(record)-legacyLengthSize))
+		incrementNonce(c.sendNonce)
+		if _, err := c.Conn.Write(record); err != nil {
+			return written, fmt.Errorf("write error: %w", err)
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// incrementNonce counts a legacy nonce up as a big-endian number.
+func incrementNonce(nonce []byte) {
+	for i := len(nonce) - 1; i >= 0; i-- {
+		nonce[i]++
+		if nonce[i] != 0 {
+			break
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// legacyPeer speaks the scheme of peers that advertise protocol version 0.1, written
+// as they implement it rather than with the helpers under test
+type legacyPeer struct {
+	conn        net.Conn
+	write, read cipher.AEAD
+	// sent and received count the records, which are the big-endian nonce.
+	sent, received uint64
+}
+
+func legacyNonce(n uint64) []byte {
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[4:], n)
+	return nonce[:]
+}
+
+func legacyGCM(t *testing.T, shared *[32]byte) cipher.AEAD {
+	t.Helper()
+	key := sha256.Sum256(shared[:])
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func newLegacyPeer(t *testing.T, conn net.Conn, peerPublicKey, localPrivateKey EncryptionKey) *legacyPeer {
+	t.Helper()
+	ephemeral := mustGenerateIdentity(t)
+	if _, err := conn.Write(ephemeral.PublicKey[:]); err != nil {
+		t.Fatal(err)
+	}
+	sendShared, _ := DeriveSharedSecret(ephemeral.PrivateKey, peerPublicKey)
+	var remote [32]byte
+	if _, err := io.ReadFull(conn, remote[:]); err != nil {
+		t.Fatal(err)
+	}
+	receiveShared, _ := DeriveSharedSecret(localPrivateKey, &remote)
+	return &legacyPeer{conn: conn, write: legacyGCM(t, sendShared), read: legacyGCM(t, receiveShared)}
+}
+
+func (p *legacyPeer) send(data string) error {
+	encrypted := p.write.Seal(nil, legacyNonce(p.sent), []byte(data), nil)
+	p.sent++
+	record := binary.BigEndian.AppendUint32(nil, uint32(len(encrypted)))
+	_, err := p.conn.Write(append(record, encrypted...))
+	return err
+}
+
+func (p *legacyPeer) receive() (string, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(p.conn, length[:]); err != nil {
+		return "", err
+	}
+	encrypted := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(p.conn, encrypted); err != nil {
+		return "", err
+	}
+	decrypted, err := p.read.Open(nil, legacyNonce(p.received), encrypted, nil)
+	p.received++
+	return string(decrypted), err
+}
+
+// TestLegacySecureConnection tests that a peer of protocol version 0.1 can exchange messages over the legacy scheme
+func TestLegacySecureConnection(t *testing.T) {
+	local, remote := mustGenerateIdentity(t), mustGenerateIdentity(t)
+	localConn, remoteConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = localConn.Close()
+		_ = remoteConn.Close()
+	})
+
+	peers := make(chan *legacyPeer, 1)
+	go func() { peers <- newLegacyPeer(t, remoteConn, local.PublicKey, remote.PrivateKey) }()
+	conn, err := LegacySecureConnection(localConn, remote.PublicKey, local.PrivateKey)
+	if err != nil {
+		t.Fatalf("LegacySecureConnection() failed: %v", err)
+	}
+	peer := <-peers
+
+	for _, msg := range []string{"OFFER|old.txt|text/plain|3\n", "and more\n"} {
+		sent := make(chan error, 1)
+		go func() { sent <- peer.send(msg) }()
+		// Read in small pieces, as a buffered reader of lines may.
+		got := make([]byte, len(msg))
+		for i := 0; i < len(got); i += 4 {
+			if _, err := io.ReadFull(conn, got[i:min(i+4, len(got))]); err != nil {
+				t.Fatalf("Read() failed: %v", err)
+			}
+		}
+		if err := <-sent; err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != msg {
+			t.Errorf("Read() = %q, want %q", got, msg)
+		}
+	}
+
+	received := make(chan string, 1)
+	go func() {
+		msg, _ := peer.receive()
+		received <- msg
+	}()
+	if _, err := conn.Write([]byte("ANSWER|DECLINE\n")); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if msg := <-received; msg != "ANSWER|DECLINE\n" {
+		t.Errorf("legacy peer received %q, want the answer", msg)
+	}
+}
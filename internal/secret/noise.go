@@ -0,0 +1,470 @@
+package secret
+
+import (
+	"crypto/cipher"
+	"crypto/mlkem"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// noiseProtocol names the handshake as defined by the Noise Protocol Framework. Both
+// peers mix it into the handshake hash, so any difference makes the handshake fail.
+const noiseProtocol = "Noise_XX_25519_ChaChaPoly_SHA256"
+
+// noisePrologue binds the handshake to this application.
+const noisePrologue = "drift"
+
+// handshakeTimeout bounds the whole secure handshake.
+const handshakeTimeout = 10 * time.Second
+
+var (
+	// ErrHandshake is reported when the secure handshake fails, e.g. because the peer
+	// does not know the private key of the identity it claims.
+	ErrHandshake = errors.New("secure handshake failed")
+	// ErrUnexpectedPeer is reported when the peer authenticated with another identity
+	// than the one it was expected to have.
+	ErrUnexpectedPeer = errors.New("peer authenticated with an unexpected identity")
+)
+
+// cipherState encrypts with a key and a counter nonce, as Noise's CipherState.
+type cipherState struct {
+	suite CipherSuite
+	aead  cipher.AEAD
+	// key is kept to derive the next one when the cipher state is rekeyed.
+	key   [32]byte
+	n     uint64
+	nonce [chacha20poly1305.NonceSize]byte
+}
+
+// newCipherState returns a cipher state for the handshake, which always uses the
+// cipher its protocol name declares.
+func newCipherState(key []byte) *cipherState {
+	return newSuiteCipherState(ChaCha20Poly1305, key)
+}
+
+func newSuiteCipherState(suite CipherSuite, key []byte) *cipherState {
+	cs := &cipherState{suite: suite}
+	cs.setKey(key)
+	return cs
+}
+
+func (cs *cipherState) setKey(key []byte) {
+	cs.aead = cs.suite.newAEAD(key)
+	copy(cs.key[:], key)
+	cs.n = 0
+}
+
+// nextNonce returns the nonce for the next message: 4 zero bytes followed by the
+// little-endian counter. A counter is never reused; a connection that wore out all
+// 2⁶⁴-1 of them cannot send on.
+func (cs *cipherState) nextNonce() ([]byte, error) {
+	if cs.n == math.MaxUint64 {
+		return nil, errors.New("nonce space exhausted")
+	}
+	binary.LittleEndian.PutUint64(cs.nonce[4:], cs.n)
+	cs.n++
+	return cs.nonce[:], nil
+}
+
+func (cs *cipherState) seal(dst, ad, plaintext []byte) ([]byte, error) {
+	nonce, err := cs.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+	return cs.aead.Seal(dst, nonce, plaintext, ad), nil
+}
+
+func (cs *cipherState) open(dst, ad, ciphertext []byte) ([]byte, error) {
+	nonce, err := cs.nextNonce()
+	if err != nil {
+		return nil, err
+	}
+	return cs.aead.Open(dst, nonce, ciphertext, ad)
+}
+
+// symmetricState holds the chaining key and handshake hash of a Noise handshake.
+type symmetricState struct {
+	ck [32]byte
+	h  [32]byte
+	cs *cipherState
+}
+
+func newSymmetricState(protocol string) *symmetricState {
+	s := &symmetricState{}
+	// A protocol name no longer than a hash is used as is, zero padded, and a longer one
+	// is hashed.
+	if len(protocol) <= len(s.h) {
+		copy(s.h[:], protocol)
+	} else {
+		s.h = sha256.Sum256([]byte(protocol))
+	}
+	s.ck = s.h
+	s.mixHash([]byte(noisePrologue))
+	return s
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(s.h[:])
+	h.Write(data)
+	h.Sum(s.h[:0])
+}
+
+// hkdf2 derives two keys from the chaining key and the input key material, as
+// Noise's HKDF function with two outputs.
+func (s *symmetricState) hkdf2(ikm []byte) (k1, k2 [32]byte) {
+	r := hkdf.New(sha256.New, ikm, s.ck[:], nil)
+	_, _ = io.ReadFull(r, k1[:])
+	_, _ = io.ReadFull(r, k2[:])
+	return k1, k2
+}
+
+func (s *symmetricState) mixKey(ikm []byte) {
+	ck, k := s.hkdf2(ikm)
+	s.ck = ck
+	s.cs = newCipherState(k[:])
+}
+
+func (s *symmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	if s.cs == nil {
+		s.mixHash(plaintext)
+		return plaintext, nil
+	}
+	ciphertext, err := s.cs.seal(nil, s.h[:], plaintext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	if s.cs == nil {
+		s.mixHash(ciphertext)
+		return ciphertext, nil
+	}
+	plaintext, err := s.cs.open(nil, s.h[:], ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split derives the cipher states for the initiator's and the responder's messages.
+func (s *symmetricState) split() (initiator, responder *cipherState) {
+	k1, k2 := s.hkdf2(nil)
+	return newCipherState(k1[:]), newCipherState(k2[:])
+}
+
+// trafficKeys derives the cipher states of both directions of a finished handshake,
+// binding the keys Noise splits off to both static keys and the whole transcript.
+func (hs *handshakeState) trafficKeys(suite CipherSuite, initiatorStatic, responderStatic *[32]byte) (initiator, responder *cipherState) {
+	k1, k2 := hs.hkdf2(nil)
+	initiatorKey := deriveTrafficKey(k1[:], initiatorLabel, initiatorStatic, responderStatic, hs.h[:])
+	responderKey := deriveTrafficKey(k2[:], responderLabel, initiatorStatic, responderStatic, hs.h[:])
+	return newSuiteCipherState(suite, initiatorKey[:]), newSuiteCipherState(suite, responderKey[:])
+}
+
+// handshakeState runs one side of the XX pattern:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+//
+// Both sides learn and authenticate each other's static key, and the session keys only
+// depend on ephemeral secrets as well, for forward secrecy. The hybrid key exchange
+// runs XXhfs instead, which adds an ephemeral ML-KEM key and its encapsulation:
+//
+//	-> e, e1
+//	<- e, ee, ekem1, s, es
+//	-> s, se
+type handshakeState struct {
+	*symmetricState
+	local     *Identity
+	ephemeral *Identity
+	remoteE   [32]byte
+	remoteS   [32]byte
+	// kemKey is the initiator's ephemeral ML-KEM key and remoteKEM the responder's view
+	// of it, in a hybrid handshake.
+	kemKey    *mlkem.DecapsulationKey768
+	remoteKEM *mlkem.EncapsulationKey768
+}
+
+func newHandshakeState(kex KeyExchange, local *Identity) *handshakeState {
+	return &handshakeState{symmetricState: newSymmetricState(kex.protocol()), local: local}
+}
+
+func (hs *handshakeState) dh(private EncryptionKey, public *[32]byte) ([]byte, error) {
+	shared, err := DeriveSharedSecret(private, public)
+	if err != nil {
+		return nil, err
+	}
+	var zero [32]byte
+	if subtle.ConstantTimeCompare(shared[:], zero[:]) == 1 {
+		return nil, errors.New("low order public key")
+	}
+	return shared[:], nil
+}
+
+func (hs *handshakeState) writeEphemeral(msg []byte) ([]byte, error) {
+	e, err := GenerateIdentity()
+	if err != nil {
+		return nil, err
+	}
+	hs.ephemeral = e
+	hs.mixHash(e.PublicKey[:])
+	return append(msg, e.PublicKey[:]...), nil
+}
+
+func (hs *handshakeState) readEphemeral(msg []byte) ([]byte, error) {
+	if len(msg) < 32 {
+		return nil, errors.New("short handshake message")
+	}
+	copy(hs.remoteE[:], msg)
+	hs.mixHash(hs.remoteE[:])
+	return msg[32:], nil
+}
+
+func (hs *handshakeState) writeStatic(msg []byte) ([]byte, error) {
+	ciphertext, err := hs.encryptAndHash(hs.local.PublicKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return append(msg, ciphertext...), nil
+}
+
+func (hs *handshakeState) readStatic(msg []byte) ([]byte, error) {
+	size := 32 + chacha20poly1305.Overhead
+	if len(msg) < size {
+		return nil, errors.New("short handshake message")
+	}
+	plaintext, err := hs.decryptAndHash(msg[:size])
+	if err != nil {
+		return nil, err
+	}
+	copy(hs.remoteS[:], plaintext)
+	return msg[size:], nil
+}
+
+func (hs *handshakeState) mixDH(private EncryptionKey, public *[32]byte) error {
+	shared, err := hs.dh(private, public)
+	if err != nil {
+		return err
+	}
+	hs.mixKey(shared)
+	return nil
+}
+
+// writePayload finishes a handshake message with an authenticated payload. Payloads
+// are encrypted once the handshake has a key, and the first one is only authenticated
+// later, by the transcript.
+func (hs *handshakeState) writePayload(msg, payload []byte) ([]byte, error) {
+	ciphertext, err := hs.encryptAndHash(payload)
+	if err != nil {
+		return nil, err
+	}
+	return append(msg, ciphertext...), nil
+}
+
+func (hs *handshakeState) readPayload(msg []byte) ([]byte, error) {
+	return hs.decryptAndHash(msg)
+}
+
+func writeHandshakeMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readHandshakeMessage(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// ClientHandshake secures a connection dialed to a peer and authenticates both sides
+// with the identity of config. If expected is not nil, the handshake fails with
+// ErrUnexpectedPeer unless the peer proves it holds that identity, before the local
+// identity is revealed to it. The client offers its cipher suites in the first message
+// and the server answers with its choice. The key exchange is the one the peer
+// advertised support for, as picked by Config.KeyExchangeFor.
+// It returns the connection, a *WrappedConnection, and the peer's verified public key.
+func ClientHandshake(conn net.Conn, config *Config, expected EncryptionKey, kex KeyExchange) (net.Conn, EncryptionKey, error) {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	local := config.Identity
+	hs := newHandshakeState(kex, local)
+	offered := config.cipherSuites()
+
+	// -> e[, e1]
+	msg, err := hs.writeEphemeral(nil)
+	if err == nil && kex == X25519MLKEM768 {
+		msg, err = hs.writeKEMKey(msg)
+	}
+	if err == nil {
+		msg, err = hs.writePayload(msg, encodeSuites(offered))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeHandshakeMessage(conn, msg); err != nil {
+		return nil, nil, err
+	}
+
+	// <- e, ee[, ekem1], s, es
+	msg, err = readHandshakeMessage(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err = hs.readEphemeral(msg)
+	if err == nil {
+		err = hs.mixDH(hs.ephemeral.PrivateKey, &hs.remoteE)
+	}
+	if err == nil && kex == X25519MLKEM768 {
+		msg, err = hs.readKEMCiphertext(msg)
+	}
+	if err == nil {
+		msg, err = hs.readStatic(msg)
+	}
+	if err == nil {
+		err = hs.mixDH(hs.ephemeral.PrivateKey, &hs.remoteS)
+	}
+	var suite CipherSuite
+	if err == nil {
+		msg, err = hs.readPayload(msg)
+	}
+	if err == nil {
+		suite, err = decodeChosenSuite(msg, offered)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	if expected != nil && subtle.ConstantTimeCompare(hs.remoteS[:], expected[:]) != 1 {
+		return nil, nil, fmt.Errorf("%w: %x", ErrUnexpectedPeer, hs.remoteS)
+	}
+
+	// -> s, se
+	msg, err = hs.writeStatic(nil)
+	if err == nil {
+		err = hs.mixDH(local.PrivateKey, &hs.remoteE)
+	}
+	if err == nil {
+		msg, err = hs.writePayload(msg, nil)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeHandshakeMessage(conn, msg); err != nil {
+		return nil, nil, err
+	}
+
+	send, receive := hs.trafficKeys(suite, local.PublicKey, &hs.remoteS)
+	remote := hs.remoteS
+	return newWrappedConnection(conn, config, kex, hs.h, send, receive), &remote, nil
+}
+
+// ServerHandshake secures an accepted connection and authenticates both sides with
+// the identity of config, choosing a cipher suite from the client's offer. It runs the
+// hybrid key exchange if the client starts one and config allows it, and the classic
+// one otherwise.
+// It returns the connection, a *WrappedConnection, and the peer's verified public key,
+// which the caller decides whether to trust.
+func ServerHandshake(conn net.Conn, config *Config) (net.Conn, EncryptionKey, error) {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	local := config.Identity
+
+	// -> e[, e1]
+	msg, err := readHandshakeMessage(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	kex := X25519
+	if isHybridHello(msg) {
+		kex = X25519MLKEM768
+		if !slices.Contains(config.keyExchanges(), kex) {
+			return nil, nil, fmt.Errorf("%w: %s is not enabled", ErrHandshake, kex)
+		}
+	}
+	hs := newHandshakeState(kex, local)
+	msg, err = hs.readEphemeral(msg)
+	if err == nil && kex == X25519MLKEM768 {
+		msg, err = hs.readKEMKey(msg)
+	}
+	if err == nil {
+		msg, err = hs.readPayload(msg)
+	}
+	var suite CipherSuite
+	if err == nil {
+		suite, err = negotiateSuite(decodeSuites(msg), config.cipherSuites())
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+
+	// <- e, ee[, ekem1], s, es
+	msg, err = hs.writeEphemeral(nil)
+	if err == nil {
+		err = hs.mixDH(hs.ephemeral.PrivateKey, &hs.remoteE)
+	}
+	if err == nil && kex == X25519MLKEM768 {
+		msg, err = hs.writeKEMCiphertext(msg)
+	}
+	if err == nil {
+		msg, err = hs.writeStatic(msg)
+	}
+	if err == nil {
+		err = hs.mixDH(local.PrivateKey, &hs.remoteE)
+	}
+	if err == nil {
+		msg, err = hs.writePayload(msg, encodeSuites([]CipherSuite{suite}))
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	if err := writeHandshakeMessage(conn, msg); err != nil {
+		return nil, nil, err
+	}
+
+	// -> s, se
+	msg, err = readHandshakeMessage(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err = hs.readStatic(msg)
+	if err == nil {
+		err = hs.mixDH(hs.ephemeral.PrivateKey, &hs.remoteS)
+	}
+	if err == nil {
+		_, err = hs.readPayload(msg)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+
+	receive, send := hs.trafficKeys(suite, &hs.remoteS, local.PublicKey)
+	remote := hs.remoteS
+	return newWrappedConnection(conn, config, kex, hs.h, send, receive), &remote, nil
+}
@@ -0,0 +1,155 @@
+package secret
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+type handshakeResult struct {
+	conn   net.Conn
+	remote EncryptionKey
+	err    error
+}
+
+// handshake runs both sides of the secure handshake over a pipe.
+func handshake(t *testing.T, client, server *Identity, expected EncryptionKey) (c, s handshakeResult) {
+	t.Helper()
+	return handshakeConfigs(t, &Config{Identity: client}, &Config{Identity: server}, expected)
+}
+
+func handshakeConfigs(t *testing.T, client, server *Config, expected EncryptionKey) (c, s handshakeResult) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+		_ = serverConn.Close()
+	})
+
+	done := make(chan handshakeResult)
+	go func() {
+		conn, remote, err := ServerHandshake(serverConn, server)
+		if err != nil {
+			// Unblock a client still waiting for a message.
+			_ = serverConn.Close()
+		}
+		done <- handshakeResult{conn, remote, err}
+	}()
+	conn, remote, err := ClientHandshake(clientConn, client, expected, client.KeyExchangeFor(server.AdvertisedKeyExchanges()))
+	if err != nil {
+		_ = clientConn.Close()
+	}
+	return handshakeResult{conn, remote, err}, <-done
+}
+
+func mustGenerateIdentity(t *testing.T) *Identity {
+	t.Helper()
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// TestHandshakeAuthenticatesBothSides tests that each side learns the other's identity and can talk securely
+func TestHandshakeAuthenticatesBothSides(t *testing.T) {
+	client, server := mustGenerateIdentity(t), mustGenerateIdentity(t)
+	c, s := handshake(t, client, server, server.PublicKey)
+	if c.err != nil || s.err != nil {
+		t.Fatalf("handshake failed: client %v, server %v", c.err, s.err)
+	}
+	if *c.remote != *server.PublicKey {
+		t.Error("client did not learn the server's public key")
+	}
+	if *s.remote != *client.PublicKey {
+		t.Error("server did not learn the client's public key")
+	}
+
+	for _, pair := range [][2]net.Conn{{c.conn, s.conn}, {s.conn, c.conn}} {
+		go func() { _, _ = pair[0].Write([]byte("hello")) }()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(pair[1], buf); err != nil || string(buf) != "hello" {
+			t.Errorf("read %q, %v; want %q", buf, err, "hello")
+		}
+	}
+}
+
+// TestHandshakeRejectsUnexpectedServer tests that the client refuses a server holding another identity
+func TestHandshakeRejectsUnexpectedServer(t *testing.T) {
+	client, server, impostor := mustGenerateIdentity(t), mustGenerateIdentity(t), mustGenerateIdentity(t)
+	c, s := handshake(t, client, impostor, server.PublicKey)
+	if !errors.Is(c.err, ErrUnexpectedPeer) {
+		t.Errorf("client handshake = %v, want ErrUnexpectedPeer", c.err)
+	}
+	if s.err == nil {
+		t.Error("server handshake succeeded without learning the client's identity")
+	}
+}
+
+// TestHandshakeRejectsForgedIdentity tests that claiming a public key without its private key fails
+func TestHandshakeRejectsForgedIdentity(t *testing.T) {
+	client, server := mustGenerateIdentity(t), mustGenerateIdentity(t)
+	forged := &Identity{PrivateKey: mustGenerateIdentity(t).PrivateKey, PublicKey: server.PublicKey}
+	c, _ := handshake(t, client, forged, server.PublicKey)
+	if !errors.Is(c.err, ErrHandshake) {
+		t.Errorf("client handshake = %v, want ErrHandshake", c.err)
+	}
+}
+
+// TestHandshakeKeysPerDirection tests that each direction has its own traffic key, shared by both ends
+func TestHandshakeKeysPerDirection(t *testing.T) {
+	client, server := mustGenerateIdentity(t), mustGenerateIdentity(t)
+	c, s := handshake(t, client, server, nil)
+	if c.err != nil || s.err != nil {
+		t.Fatalf("handshake failed: client %v, server %v", c.err, s.err)
+	}
+	cw, sw := c.conn.(*WrappedConnection), s.conn.(*WrappedConnection)
+	if cw.writer.cs.key != sw.reader.cs.key || sw.writer.cs.key != cw.reader.cs.key {
+		t.Error("the ends of a direction do not share its key")
+	}
+	if cw.writer.cs.key == cw.reader.cs.key {
+		t.Error("both directions use the same key")
+	}
+	if cw.writer.rekeyBytes != DefaultRekeyBytes || cw.writer.rekeyRecords != DefaultRekeyRecords {
+		t.Errorf("rekey limits = %d bytes, %d records; want the defaults", cw.writer.rekeyBytes, cw.writer.rekeyRecords)
+	}
+}
+
+// TestTrafficKeysAreBound tests that traffic keys depend on the direction and on both static keys
+func TestTrafficKeysAreBound(t *testing.T) {
+	secret, hash := make([]byte, 32), make([]byte, 32)
+	a, b := mustGenerateIdentity(t).PublicKey, mustGenerateIdentity(t).PublicKey
+	base := deriveTrafficKey(secret, initiatorLabel, a, b, hash)
+	for name, key := range map[string][32]byte{
+		"direction": deriveTrafficKey(secret, responderLabel, a, b, hash),
+		"initiator": deriveTrafficKey(secret, initiatorLabel, b, b, hash),
+		"responder": deriveTrafficKey(secret, initiatorLabel, a, a, hash),
+		"hash":      deriveTrafficKey(secret, initiatorLabel, a, b, bytes.Repeat([]byte{1}, 32)),
+	} {
+		if key == base {
+			t.Errorf("traffic key does not depend on the %s", name)
+		}
+	}
+}
+
+// TestSecureConnectionDetectsTampering tests that a modified record fails to decrypt
+func TestSecureConnectionDetectsTampering(t *testing.T) {
+	// Splitting the same state twice gives both ends of one direction.
+	send, _ := newSymmetricState(noiseProtocol).split()
+	receive, _ := newSymmetricState(noiseProtocol).split()
+
+	var buf bytes.Buffer
+	writer := &EncryptWriter{writer: &buf, cs: send}
+	if _, err := writer.Write([]byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	record := buf.Bytes()
+	record[len(record)-1] ^= 1
+
+	reader := &DecryptReader{reader: &buf, cs: receive}
+	if _, err := reader.Read(make([]byte, 16)); err == nil {
+		t.Error("tampered record was decrypted")
+	}
+}
@@ -0,0 +1,231 @@
+package secret
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// MaxRecordPayload is the largest plaintext a single record carries. Writes are
+	// split into records of at most this size.
+	MaxRecordPayload = 64 << 10
+	// recordHeaderSize is the size of the header before every record: the big-endian
+	// ciphertext length, with recordRekey in its top bit. The header is authenticated
+	// along with the record.
+	recordHeaderSize = 4
+	// recordRekey marks an empty record after which the sender encrypts with its next
+	// traffic key.
+	recordRekey = 1 << 31
+	// maxRecordCiphertext bounds what a reader accepts from the wire.
+	maxRecordCiphertext = MaxRecordPayload + chacha20poly1305.Overhead
+)
+
+var (
+	// ErrRecordTooLarge is reported for a record longer than any writer produces. The
+	// stream cannot be trusted afterwards.
+	ErrRecordTooLarge = errors.New("record exceeds maximum size")
+	// ErrRecordTooShort is reported for a record too short to hold an authentication tag.
+	ErrRecordTooShort = errors.New("record shorter than its authentication tag")
+	// errRekeyPayload is reported for a rekey record that carries data.
+	errRekeyPayload = errors.New("rekey record carries data")
+)
+
+// recordPool holds buffers large enough for the header and ciphertext of any record.
+// Buffers are only held while a record is being written, or read and not yet consumed,
+// so that idle connections do not pin them.
+var recordPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, recordHeaderSize+maxRecordCiphertext)
+		return &b
+	},
+}
+
+// EncryptWriter encrypts data with the session keys of a secure connection and writes
+// it to the underlying writer as length-prefixed records. It is safe for concurrent use;
+// every record is written with a single call to the underlying writer.
+//
+// Once a traffic key has encrypted rekeyBytes of plaintext or rekeyRecords records, the
+// writer sends a rekey record and carries on with the next key. A zero limit disables
+// rekeying.
+type EncryptWriter struct {
+	mu     sync.Mutex
+	writer io.Writer
+	cs     *cipherState
+
+	rekeyBytes   uint64
+	rekeyRecords uint64
+	// sent and records count what the current key encrypted so far.
+	sent    uint64
+	records uint64
+}
+
+// Write encrypts data in records of at most MaxRecordPayload bytes. It returns how much
+// of data was written in complete records.
+func (ew *EncryptWriter) Write(data []byte) (int, error) {
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+
+	bp := recordPool.Get().(*[]byte)
+	defer recordPool.Put(bp)
+	buf := *bp
+
+	written := 0
+	for len(data) > 0 {
+		chunk := data[:min(len(data), MaxRecordPayload)]
+		copy(buf[recordHeaderSize:], chunk)
+		if err := ew.writeRecord(buf, len(chunk)); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		data = data[len(chunk):]
+	}
+	return written, nil
+}
+
+// writeRecord encrypts the n bytes of plaintext following the header space of buf in
+// place, and writes the record, rekeying first if the current key is used up.
+func (ew *EncryptWriter) writeRecord(buf []byte, n int) error {
+	if ew.keyUsedUp() {
+		if err := ew.writeRekey(); err != nil {
+			return err
+		}
+	}
+	if err := ew.seal(buf, n, 0); err != nil {
+		return err
+	}
+	ew.sent += uint64(n)
+	ew.records++
+	return nil
+}
+
+func (ew *EncryptWriter) keyUsedUp() bool {
+	return (ew.rekeyBytes > 0 && ew.sent >= ew.rekeyBytes) ||
+		(ew.rekeyRecords > 0 && ew.records >= ew.rekeyRecords)
+}
+
+// writeRekey tells the reader that the following records are encrypted with the next
+// key, and switches to it.
+func (ew *EncryptWriter) writeRekey() error {
+	var buf [recordHeaderSize + chacha20poly1305.Overhead]byte
+	if err := ew.seal(buf[:], 0, recordRekey); err != nil {
+		return err
+	}
+	ew.cs.rekey()
+	ew.sent, ew.records = 0, 0
+	return nil
+}
+
+// seal encrypts and writes a record of the n bytes of plaintext following the header
+// space of buf, with flags set in its header.
+func (ew *EncryptWriter) seal(buf []byte, n int, flags uint32) error {
+	header := buf[:recordHeaderSize]
+	binary.BigEndian.PutUint32(header, uint32(n+chacha20poly1305.Overhead)|flags)
+	plaintext := buf[recordHeaderSize : recordHeaderSize+n]
+	ciphertext, err := ew.cs.seal(plaintext[:0], header, plaintext)
+	if err != nil {
+		return err
+	}
+	record := buf[:recordHeaderSize+len(ciphertext)]
+	written, err := ew.writer.Write(record)
+	if err == nil && written < len(record) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// DecryptReader reads length-prefixed records from the underlying reader and decrypts
+// them with the session keys of a secure connection, following the writer's rekey
+// records. Records are served across as many reads as the caller's buffers need. It is
+// not safe for concurrent use.
+type DecryptReader struct {
+	reader io.Reader
+	cs     *cipherState
+	// plaintext is what is left of the last record, in the pooled buffer bp.
+	plaintext []byte
+	bp        *[]byte
+	header    [recordHeaderSize]byte
+}
+
+func (dr *DecryptReader) Read(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	// Records can be empty; read on until there is something to return.
+	for len(dr.plaintext) == 0 {
+		if err := dr.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(buf, dr.plaintext)
+	dr.consume(n)
+	return n, nil
+}
+
+// readRecord reads and decrypts the next record into a pooled buffer. A rekey record
+// switches to the next key and leaves no plaintext.
+func (dr *DecryptReader) readRecord() error {
+	if _, err := io.ReadFull(dr.reader, dr.header[:]); err != nil {
+		return err
+	}
+	header := binary.BigEndian.Uint32(dr.header[:])
+	length := header &^ recordRekey
+	switch {
+	case length > maxRecordCiphertext:
+		return fmt.Errorf("%w: %d bytes", ErrRecordTooLarge, length)
+	case length < chacha20poly1305.Overhead:
+		return fmt.Errorf("%w: %d bytes", ErrRecordTooShort, length)
+	}
+
+	if dr.bp == nil {
+		dr.bp = recordPool.Get().(*[]byte)
+	}
+	ciphertext := (*dr.bp)[:length]
+	if _, err := io.ReadFull(dr.reader, ciphertext); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		dr.release()
+		return err
+	}
+
+	plaintext, err := dr.cs.open(ciphertext[:0], dr.header[:], ciphertext)
+	if err != nil {
+		dr.release()
+		return fmt.Errorf("decryption error: %w", err)
+	}
+	if header&recordRekey != 0 {
+		dr.release()
+		if len(plaintext) > 0 {
+			return errRekeyPayload
+		}
+		dr.cs.rekey()
+		return nil
+	}
+	dr.plaintext = plaintext
+	if len(plaintext) == 0 {
+		dr.release()
+	}
+	return nil
+}
+
+// consume drops n bytes of buffered plaintext, returning the buffer to the pool once
+// the record is used up.
+func (dr *DecryptReader) consume(n int) {
+	dr.plaintext = dr.plaintext[n:]
+	if len(dr.plaintext) == 0 {
+		dr.release()
+	}
+}
+
+func (dr *DecryptReader) release() {
+	dr.plaintext = nil
+	if dr.bp != nil {
+		recordPool.Put(dr.bp)
+		dr.bp = nil
+	}
+}
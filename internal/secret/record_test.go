@@ -0,0 +1,280 @@
+package secret
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+)
+
+// newRecordPair returns a writer and a reader sharing keys, connected through buf
+func newRecordPair(buf *bytes.Buffer) (*EncryptWriter, *DecryptReader) {
+	// Splitting the same state twice gives both ends of one direction.
+	send, _ := newSymmetricState(noiseProtocol).split()
+	receive, _ := newSymmetricState(noiseProtocol).split()
+	return &EncryptWriter{writer: buf, cs: send}, &DecryptReader{reader: buf, cs: receive}
+}
+
+func testPayload(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+// TestEncryptWriterChunks tests that large writes are split into records of bounded size
+func TestEncryptWriterChunks(t *testing.T) {
+	var buf bytes.Buffer
+	writer, _ := newRecordPair(&buf)
+	data := testPayload(2*MaxRecordPayload + 10)
+	if n, err := writer.Write(data); err != nil || n != len(data) {
+		t.Fatalf("Write() = %d, %v; want %d", n, err, len(data))
+	}
+
+	var sizes []int
+	stream := buf.Bytes()
+	for len(stream) > 0 {
+		length := int(binary.BigEndian.Uint32(stream))
+		sizes = append(sizes, length-16)
+		stream = stream[recordHeaderSize+length:]
+	}
+	if len(sizes) != 3 || sizes[0] != MaxRecordPayload || sizes[1] != MaxRecordPayload || sizes[2] != 10 {
+		t.Errorf("record payloads = %v, want [%d %d 10]", sizes, MaxRecordPayload, MaxRecordPayload)
+	}
+}
+
+// TestDecryptReaderPartialReads tests that a record is served across reads with small buffers
+func TestDecryptReaderPartialReads(t *testing.T) {
+	var buf bytes.Buffer
+	writer, reader := newRecordPair(&buf)
+	data := testPayload(1000)
+	_, _ = writer.Write(data[:600])
+	_, _ = writer.Write(nil)
+	_, _ = writer.Write(data[600:])
+
+	var got []byte
+	small := make([]byte, 7)
+	for {
+		n, err := reader.Read(small)
+		got = append(got, small[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read() failed: %v", err)
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("read data differs from written data")
+	}
+}
+
+// TestDecryptReaderRejectsBadLengths tests that lengths out of bounds fail before anything is allocated or read
+func TestDecryptReaderRejectsBadLengths(t *testing.T) {
+	for _, tc := range []struct {
+		length uint32
+		want   error
+	}{
+		{maxRecordCiphertext + 1, ErrRecordTooLarge},
+		{1 << 30, ErrRecordTooLarge},
+		{recordRekey | (maxRecordCiphertext + 1), ErrRecordTooLarge},
+		{15, ErrRecordTooShort},
+	} {
+		var buf bytes.Buffer
+		_, reader := newRecordPair(&buf)
+		_ = binary.Write(&buf, binary.BigEndian, tc.length)
+		if _, err := reader.Read(make([]byte, 16)); !errors.Is(err, tc.want) {
+			t.Errorf("Read() of a %d byte record = %v, want %v", tc.length, err, tc.want)
+		}
+	}
+}
+
+// TestDecryptReaderTruncatedRecord tests that a stream ending inside a record is an unexpected EOF
+func TestDecryptReaderTruncatedRecord(t *testing.T) {
+	var buf bytes.Buffer
+	writer, reader := newRecordPair(&buf)
+	_, _ = writer.Write([]byte("payload"))
+	buf.Truncate(recordHeaderSize + 3)
+	if _, err := reader.Read(make([]byte, 16)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Read() = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+// rekeyHeaders returns whether each record in stream is a rekey record
+func rekeyHeaders(stream []byte) []bool {
+	var rekeys []bool
+	for len(stream) > 0 {
+		header := binary.BigEndian.Uint32(stream)
+		rekeys = append(rekeys, header&recordRekey != 0)
+		stream = stream[recordHeaderSize+int(header&^recordRekey):]
+	}
+	return rekeys
+}
+
+// TestEncryptWriterRekeys tests that the writer switches keys at its limits and the reader follows
+func TestEncryptWriterRekeys(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		bytes, records uint64
+		want           []bool
+	}{
+		{"records", 0, 2, []bool{false, false, true, false, false, true, false}},
+		{"bytes", 10, 0, []bool{false, false, true, false, false, true, false}},
+		{"disabled", 0, 0, []bool{false, false, false, false, false}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writer, reader := newRecordPair(&buf)
+			writer.rekeyBytes, writer.rekeyRecords = tc.bytes, tc.records
+			data := testPayload(30)
+			for i := 0; i < len(data); i += 6 {
+				if _, err := writer.Write(data[i : i+6]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := rekeyHeaders(buf.Bytes()); !slices.Equal(got, tc.want) {
+				t.Errorf("rekey records = %v, want %v", got, tc.want)
+			}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("ReadAll() failed: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("read data differs from written data")
+			}
+			if (writer.cs.key == newRecordKey()) == (tc.bytes+tc.records > 0) {
+				t.Error("writer key did not change as expected")
+			}
+		})
+	}
+}
+
+func newRecordKey() [32]byte {
+	cs, _ := newSymmetricState(noiseProtocol).split()
+	return cs.key
+}
+
+// TestDecryptReaderAuthenticatesHeader tests that a rekey flag added or stripped on the wire is detected
+func TestDecryptReaderAuthenticatesHeader(t *testing.T) {
+	var buf bytes.Buffer
+	writer, reader := newRecordPair(&buf)
+	writer.rekeyRecords = 1
+	_, _ = writer.Write([]byte("one"))
+	_, _ = writer.Write([]byte("two"))
+
+	stream := buf.Bytes()
+	// Strip the flag of the rekey record following the first record.
+	stream[recordHeaderSize+3+16] &^= recordRekey >> 24
+	if _, err := io.ReadAll(reader); err == nil {
+		t.Error("stripped rekey flag went unnoticed")
+	}
+
+	buf.Reset()
+	writer, reader = newRecordPair(&buf)
+	_, _ = writer.Write([]byte("data"))
+	buf.Bytes()[0] |= recordRekey >> 24
+	if _, err := io.ReadAll(reader); err == nil {
+		t.Error("added rekey flag went unnoticed")
+	}
+}
+
+// TestDecryptReaderRejectsRekeyWithData tests that a rekey record may not carry a payload
+func TestDecryptReaderRejectsRekeyWithData(t *testing.T) {
+	var buf bytes.Buffer
+	writer, reader := newRecordPair(&buf)
+	record := make([]byte, recordHeaderSize+4+16)
+	copy(record[recordHeaderSize:], "data")
+	if err := writer.seal(record, 4, recordRekey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Read(make([]byte, 16)); !errors.Is(err, errRekeyPayload) {
+		t.Errorf("Read() = %v, want errRekeyPayload", err)
+	}
+}
+
+// FuzzDecryptReader tests that arbitrary input never panics, and is never mistaken for valid records
+func FuzzDecryptReader(f *testing.F) {
+	var valid bytes.Buffer
+	writer, _ := newRecordPair(&valid)
+	_, _ = writer.Write([]byte("hello"))
+	f.Add(valid.Bytes())
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0, 0, 0, 16})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, reader := newRecordPair(bytes.NewBuffer(data))
+		// The only record that decrypts under these keys is the one written above.
+		got, _ := io.ReadAll(reader)
+		if len(got) > 0 && !bytes.HasPrefix(data, valid.Bytes()) {
+			t.Errorf("decrypted %q from forged input", got)
+		}
+	})
+}
+
+// FuzzRecordRoundTrip tests that any data survives encryption whatever sizes it is read with
+func FuzzRecordRoundTrip(f *testing.F) {
+	f.Add([]byte("hello"), uint16(1))
+	f.Add(testPayload(MaxRecordPayload+1), uint16(4096))
+
+	f.Fuzz(func(t *testing.T, data []byte, readSize uint16) {
+		var buf bytes.Buffer
+		writer, reader := newRecordPair(&buf)
+		if _, err := writer.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		var got []byte
+		chunk := make([]byte, int(readSize)+1)
+		for {
+			n, err := reader.Read(chunk)
+			got = append(got, chunk[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("round trip changed the data")
+		}
+	})
+}
+
+func benchmarkWrite(b *testing.B, size int) {
+	data := testPayload(size)
+	send, _ := newSymmetricState(noiseProtocol).split()
+	writer := &EncryptWriter{writer: io.Discard, cs: send}
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	for range b.N {
+		if _, err := writer.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncryptWriter4K(b *testing.B)  { benchmarkWrite(b, 4<<10) }
+func BenchmarkEncryptWriter64K(b *testing.B) { benchmarkWrite(b, 64<<10) }
+func BenchmarkEncryptWriter1M(b *testing.B)  { benchmarkWrite(b, 1<<20) }
+
+// BenchmarkRecordCopy measures a file-sized stream through io.Copy on both ends
+func BenchmarkRecordCopy(b *testing.B) {
+	data := testPayload(8 << 20)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for range b.N {
+		var buf bytes.Buffer
+		buf.Grow(len(data) + len(data)/MaxRecordPayload*32 + 64)
+		writer, reader := newRecordPair(&buf)
+		if _, err := io.Copy(writer, bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, reader); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
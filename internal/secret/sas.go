@@ -0,0 +1,86 @@
+package secret
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// sasEmojiCount is how many emoji a short authentication string shows. Each one
+// carries 6 bits, so an impostor has to match 42 bits of the hash.
+const sasEmojiCount = 7
+
+// Emoji is a symbol of a short authentication string, with a name for those who
+// cannot tell the symbols apart.
+type Emoji struct {
+	Symbol string
+	Name   string
+}
+
+// sasEmoji are easy to tell apart and to name across languages.
+var sasEmoji = [64]Emoji{
+	{"🐶", "Dog"}, {"🐱", "Cat"}, {"🦁", "Lion"}, {"🐎", "Horse"},
+	{"🦄", "Unicorn"}, {"🐷", "Pig"}, {"🐘", "Elephant"}, {"🐰", "Rabbit"},
+	{"🐼", "Panda"}, {"🐓", "Rooster"}, {"🐧", "Penguin"}, {"🐢", "Turtle"},
+	{"🐟", "Fish"}, {"🐙", "Octopus"}, {"🦋", "Butterfly"}, {"🌷", "Flower"},
+	{"🌳", "Tree"}, {"🌵", "Cactus"}, {"🍄", "Mushroom"}, {"🌏", "Globe"},
+	{"🌙", "Moon"}, {"☁️", "Cloud"}, {"🔥", "Fire"}, {"🍌", "Banana"},
+	{"🍎", "Apple"}, {"🍓", "Strawberry"}, {"🌽", "Corn"}, {"🍕", "Pizza"},
+	{"🎂", "Cake"}, {"❤️", "Heart"}, {"😀", "Smiley"}, {"🤖", "Robot"},
+	{"🎩", "Hat"}, {"👓", "Glasses"}, {"🔧", "Spanner"}, {"🎅", "Santa"},
+	{"👍", "Thumbs Up"}, {"☂️", "Umbrella"}, {"⌛", "Hourglass"}, {"⏰", "Clock"},
+	{"🎁", "Gift"}, {"💡", "Light Bulb"}, {"📕", "Book"}, {"✏️", "Pencil"},
+	{"📎", "Paperclip"}, {"✂️", "Scissors"}, {"🔒", "Lock"}, {"🔑", "Key"},
+	{"🔨", "Hammer"}, {"☎️", "Telephone"}, {"🏁", "Flag"}, {"🚂", "Train"},
+	{"🚲", "Bicycle"}, {"✈️", "Aeroplane"}, {"🚀", "Rocket"}, {"🏆", "Trophy"},
+	{"⚽", "Ball"}, {"🎸", "Guitar"}, {"🎺", "Trumpet"}, {"🔔", "Bell"},
+	{"⚓", "Anchor"}, {"🎧", "Headphones"}, {"📁", "Folder"}, {"📌", "Pin"},
+}
+
+// SAS is a short authentication string. Two users who see the same one on their
+// screens know that their devices ran one handshake with each other, so each device
+// holds the key the other one authenticated and no one sits between them.
+type SAS struct {
+	Emoji []Emoji
+	// Digits are the same check for those who prefer to read out numbers.
+	Digits string
+}
+
+// ShortAuthString derives the short authentication string of a handshake from its
+// hash, which both peers share once it completes. The hash covers the ephemeral keys
+// of the handshake as well as the static ones, so an impostor cannot search for keys
+// of its own whose string matches ahead of time: every attempt takes a handshake
+// with the user watching.
+func ShortAuthString(handshakeHash []byte) SAS {
+	h := sha256.New()
+	h.Write([]byte("drift sas"))
+	h.Write(handshakeHash)
+	sum := h.Sum(nil)
+
+	bits := binary.BigEndian.Uint64(sum)
+	sas := SAS{Emoji: make([]Emoji, sasEmojiCount)}
+	for i := range sas.Emoji {
+		sas.Emoji[i] = sasEmoji[bits>>(64-6*(i+1))&63]
+	}
+	digits := binary.BigEndian.Uint32(sum[8:]) % 1000000
+	sas.Digits = fmt.Sprintf("%03d %03d", digits/1000, digits%1000)
+	return sas
+}
+
+// Symbols returns the emoji of the string separated by spaces.
+func (s SAS) Symbols() string {
+	symbols := make([]string, len(s.Emoji))
+	for i, e := range s.Emoji {
+		symbols[i] = e.Symbol
+	}
+	return strings.Join(symbols, " ")
+}
+
+func (s SAS) String() string {
+	names := make([]string, len(s.Emoji))
+	for i, e := range s.Emoji {
+		names[i] = e.Name
+	}
+	return strings.Join(names, ", ") + " (" + s.Digits + ")"
+}
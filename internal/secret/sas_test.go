@@ -0,0 +1,28 @@
+package secret
+
+import "testing"
+
+// TestShortAuthStringOfHandshake tests that both peers derive the same string, and that another handshake between the same keys derives another one
+func TestShortAuthStringOfHandshake(t *testing.T) {
+	alice, bob := mustGenerateIdentity(t), mustGenerateIdentity(t)
+
+	sas := func() (client, server SAS) {
+		t.Helper()
+		c, s := handshake(t, alice, bob, bob.PublicKey)
+		if c.err != nil || s.err != nil {
+			t.Fatalf("handshake failed: client %v, server %v", c.err, s.err)
+		}
+		return c.conn.(*WrappedConnection).SAS(), s.conn.(*WrappedConnection).SAS()
+	}
+
+	client, server := sas()
+	if client.String() != server.String() {
+		t.Errorf("SAS() = %s on the client and %s on the server", client, server)
+	}
+	if len(client.Emoji) != sasEmojiCount || len(client.Digits) != len("123 456") {
+		t.Errorf("SAS() = %s, want %d emoji and 6 digits", client, sasEmojiCount)
+	}
+	if again, _ := sas(); again.String() == client.String() {
+		t.Errorf("SAS() = %s for another handshake between the same keys", again)
+	}
+}
@@ -1,12 +1,8 @@
 package secret
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"fmt"
-	"io"
 	"net"
 
 	"golang.org/x/crypto/curve25519"
@@ -33,169 +29,24 @@ func DeriveSharedSecret(privateKey, peerPublicKey EncryptionKey) (EncryptionKey,
 	return &sharedSecret, nil
 }
 
-// KeyDerivation derives a 32-byte AES key from the shared secret using SHA-256.
-func KeyDerivation(sharedSecret EncryptionKey) []byte {
-	hash := sha256.Sum256(sharedSecret[:])
-	return hash[:]
-}
-
-// EncryptWriter encrypts data using AES-GCM and writes to the underlying writer.
-type EncryptWriter struct {
-	writer io.Writer
-	aead   cipher.AEAD
-	nonce  []byte
-	pubKey EncryptionKey
-	encBuf []byte
-}
-
-// NewEncryptWriter initializes an EncryptWriter with the recipient's public X25519 key.
-func NewEncryptWriter(w io.Writer, recipientPublicKey EncryptionKey) (*EncryptWriter, error) {
-	// Generate an ephemeral X25519 key pair.
-	privateKey, publicKey, err := GenerateX25519KeyPair()
-	if err != nil {
-		return nil, err
-	}
-
-	// Derive a shared secret using the ephemeral private key and recipient's public key.
-	sharedSecret, err := DeriveSharedSecret(privateKey, recipientPublicKey)
-	if err != nil {
-		return nil, err
-	}
-
-	// Derive an AES key from the shared secret.
-	aesKey := KeyDerivation(sharedSecret)
-
-	// Create AES-GCM cipher.
-	block, err := aes.NewCipher(aesKey)
-	if err != nil {
-		return nil, err
-	}
-	aead, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-
-	// Initialize sequential nonce.
-	nonce := make([]byte, aead.NonceSize())
-
-	// Write the ephemeral public key to the underlying writer.
-	if _, err := w.Write(publicKey[:]); err != nil {
-		return nil, err
-	}
-
-	return &EncryptWriter{
-		writer: w,
-		aead:   aead,
-		nonce:  nonce,
-		pubKey: publicKey,
-	}, nil
-}
-
-func (ew *EncryptWriter) Write(data []byte) (int, error) {
-	// Encrypt the data.
-	encrypted := ew.aead.Seal(nil, ew.nonce, data, nil)
-	incrementNonce(ew.nonce)
-
-	// Write the length of the encrypted data (4 bytes, big-endian).
-	length := uint32(len(encrypted))
-	lengthBuf := make([]byte, 4)
-	lengthBuf[0] = byte(length >> 24)
-	lengthBuf[1] = byte(length >> 16)
-	lengthBuf[2] = byte(length >> 8)
-	lengthBuf[3] = byte(length)
-
-	if _, err := ew.writer.Write(lengthBuf); err != nil {
-		return 0, err
-	}
-
-	// Write the encrypted data.
-	_, err := ew.writer.Write(encrypted)
-
-	// Return the original length of the data not to confuse the caller.
-	return len(data), err
-}
-
-// DecryptReader decrypts data using AES-GCM and reads from the underlying reader.
-type DecryptReader struct {
-	reader io.Reader
-	aead   cipher.AEAD
-	nonce  []byte
-	decBuf []byte
-}
-
-// NewDecryptReader initializes a DecryptReader with the recipient's private X25519 key.
-func NewDecryptReader(r io.Reader, recipientPrivateKey EncryptionKey) (*DecryptReader, error) {
-	// Read the ephemeral public key.
-	var publicKey [32]byte
-	if _, err := io.ReadFull(r, publicKey[:]); err != nil {
-		return nil, err
-	}
-
-	// Derive a shared secret using the recipient's private key and ephemeral public key.
-	sharedSecret, err := DeriveSharedSecret(recipientPrivateKey, &publicKey)
-	if err != nil {
-		return nil, err
-	}
-
-	// Derive an AES key from the shared secret.
-	aesKey := KeyDerivation(sharedSecret)
-
-	// Create AES-GCM cipher.
-	block, err := aes.NewCipher(aesKey)
-	if err != nil {
-		return nil, err
-	}
-	aead, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-
-	// Initialize sequential nonce.
-	nonce := make([]byte, aead.NonceSize())
-
-	return &DecryptReader{
-		reader: r,
-		aead:   aead,
-		nonce:  nonce,
-	}, nil
-}
-
-func (dr *DecryptReader) Read(buf []byte) (int, error) {
-	// Read the length of the encrypted data (4 bytes, big-endian).
-	lengthBuf := make([]byte, 4)
-	if _, err := io.ReadFull(dr.reader, lengthBuf); err != nil {
-		return 0, err
-	}
-	length := (uint32(lengthBuf[0]) << 24) |
-		(uint32(lengthBuf[1]) << 16) |
-		(uint32(lengthBuf[2]) << 8) |
-		uint32(lengthBuf[3])
-
-	// Allocate a buffer to hold the encrypted data.
-	encrypted := make([]byte, length)
-	if _, err := io.ReadFull(dr.reader, encrypted); err != nil {
-		return 0, err
-	}
-
-	// Decrypt the data.
-	decrypted, decryptErr := dr.aead.Open(nil, dr.nonce, encrypted, nil)
-	if decryptErr != nil {
-		return 0, fmt.Errorf("decryption error: %w", decryptErr)
-	}
-
-	// Increment the nonce after each decryption.
-	incrementNonce(dr.nonce)
-
-	// Copy the decrypted data into the provided buffer.
-	copy(buf, decrypted)
-
-	return len(decrypted), nil
-}
-
 type WrappedConnection struct {
 	net.Conn
 	reader *DecryptReader
 	writer *EncryptWriter
+	kex    KeyExchange
+	// handshakeHash is the hash of the handshake that secured the connection.
+	handshakeHash [32]byte
+}
+
+// KeyExchange returns how the handshake of the connection agreed on its keys.
+func (w *WrappedConnection) KeyExchange() KeyExchange {
+	return w.kex
+}
+
+// SAS returns the short authentication string of the handshake that secured the
+// connection, which the peer's user sees too if no one sits between the two.
+func (w *WrappedConnection) SAS() SAS {
+	return ShortAuthString(w.handshakeHash[:])
 }
 
 func (w *WrappedConnection) Read(p []byte) (n int, err error) {
@@ -219,31 +70,12 @@ func (w *WrappedConnection) Close() error {
 	return w.Conn.Close()
 }
 
-// SecureConnection establishes a secure connection with the peer by using the *remote* public key and the *local* private key
-func SecureConnection(conn net.Conn, peerPublicKey, localPrivateKey EncryptionKey) (net.Conn, error) {
-	writer, err := NewEncryptWriter(conn, peerPublicKey)
-	if err != nil {
-		return nil, err
-	}
-
-	reader, err := NewDecryptReader(conn, localPrivateKey)
-	if err != nil {
-		return nil, err
-	}
-
+func newWrappedConnection(conn net.Conn, config *Config, kex KeyExchange, handshakeHash [32]byte, send, receive *cipherState) *WrappedConnection {
 	return &WrappedConnection{
 		conn,
-		reader,
-		writer,
-	}, nil
-
-}
-
-func incrementNonce(nonce []byte) {
-	for i := len(nonce) - 1; i >= 0; i-- {
-		nonce[i]++
-		if nonce[i] != 0 {
-			break
-		}
+		&DecryptReader{reader: conn, cs: receive},
+		&EncryptWriter{writer: conn, cs: send, rekeyBytes: config.rekeyBytes(), rekeyRecords: config.rekeyRecords()},
+		kex,
+		handshakeHash,
 	}
 }
@@ -0,0 +1,113 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"runtime"
+	"slices"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+// CipherSuite is an AEAD cipher protecting the records of a secure connection. The
+// handshake itself always uses ChaCha20-Poly1305. All suites take 32 byte keys and
+// 12 byte nonces and add 16 byte tags, which the record layer relies on.
+type CipherSuite uint8
+
+const (
+	ChaCha20Poly1305 CipherSuite = 1
+	AES256GCM        CipherSuite = 2
+)
+
+// hasAESGCMHardware reports whether AES-GCM runs in hardware here, as crypto/tls
+// decides it. Without it, ChaCha20-Poly1305 is considerably faster.
+var hasAESGCMHardware = (cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ) ||
+	(cpu.ARM64.HasAES && cpu.ARM64.HasPMULL) ||
+	(cpu.S390X.HasAES && cpu.S390X.HasAESCTR && cpu.S390X.HasGHASH) ||
+	runtime.GOARCH == "ppc64" || runtime.GOARCH == "ppc64le"
+
+func (s CipherSuite) String() string {
+	switch s {
+	case ChaCha20Poly1305:
+		return "ChaCha20-Poly1305"
+	case AES256GCM:
+		return "AES-256-GCM"
+	default:
+		return fmt.Sprintf("unknown cipher suite %d", uint8(s))
+	}
+}
+
+func (s CipherSuite) newAEAD(key []byte) cipher.AEAD {
+	var aead cipher.AEAD
+	var err error
+	switch s {
+	case ChaCha20Poly1305:
+		aead, err = chacha20poly1305.New(key)
+	case AES256GCM:
+		var block cipher.Block
+		block, err = aes.NewCipher(key)
+		if err == nil {
+			aead, err = cipher.NewGCM(block)
+		}
+	default:
+		err = fmt.Errorf("no AEAD for %s", s)
+	}
+	if err != nil {
+		// Keys are always 32 bytes long, and only negotiated suites are used.
+		panic(err)
+	}
+	return aead
+}
+
+// defaultCipherSuites lists the supported suites, fastest on this machine first.
+func defaultCipherSuites() []CipherSuite {
+	if hasAESGCMHardware {
+		return []CipherSuite{AES256GCM, ChaCha20Poly1305}
+	}
+	return []CipherSuite{ChaCha20Poly1305, AES256GCM}
+}
+
+// negotiateSuite picks the suite of a connection from the client's offer and the
+// server's preference. A suite both prefer is used; otherwise at least one side lacks
+// hardware for AES-GCM, and ChaCha20-Poly1305 is fast on both.
+func negotiateSuite(offered, preferred []CipherSuite) (CipherSuite, error) {
+	if len(offered) > 0 && len(preferred) > 0 && offered[0] == preferred[0] {
+		return offered[0], nil
+	}
+	if slices.Contains(offered, ChaCha20Poly1305) && slices.Contains(preferred, ChaCha20Poly1305) {
+		return ChaCha20Poly1305, nil
+	}
+	for _, suite := range preferred {
+		if slices.Contains(offered, suite) {
+			return suite, nil
+		}
+	}
+	return 0, fmt.Errorf("no common cipher suite in %v", offered)
+}
+
+// encodeSuites lists suites in a handshake payload, one byte each.
+func encodeSuites(suites []CipherSuite) []byte {
+	payload := make([]byte, len(suites))
+	for i, suite := range suites {
+		payload[i] = byte(suite)
+	}
+	return payload
+}
+
+func decodeSuites(payload []byte) []CipherSuite {
+	suites := make([]CipherSuite, len(payload))
+	for i, b := range payload {
+		suites[i] = CipherSuite(b)
+	}
+	return suites
+}
+
+// decodeChosenSuite reads the server's choice, which must be one of the offered suites.
+func decodeChosenSuite(payload []byte, offered []CipherSuite) (CipherSuite, error) {
+	if len(payload) != 1 || !slices.Contains(offered, CipherSuite(payload[0])) {
+		return 0, fmt.Errorf("server chose a cipher suite that was not offered: %x", payload)
+	}
+	return CipherSuite(payload[0]), nil
+}
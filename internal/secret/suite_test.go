@@ -0,0 +1,110 @@
+package secret
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// TestNegotiateSuite tests that AES-GCM is only chosen when both sides prefer it
+func TestNegotiateSuite(t *testing.T) {
+	hardware := []CipherSuite{AES256GCM, ChaCha20Poly1305}
+	software := []CipherSuite{ChaCha20Poly1305, AES256GCM}
+	for _, tc := range []struct {
+		name               string
+		offered, preferred []CipherSuite
+		want               CipherSuite
+	}{
+		{"both with AES hardware", hardware, hardware, AES256GCM},
+		{"client without", software, hardware, ChaCha20Poly1305},
+		{"server without", hardware, software, ChaCha20Poly1305},
+		{"neither", software, software, ChaCha20Poly1305},
+		{"only AES in common", []CipherSuite{AES256GCM}, software, AES256GCM},
+		{"unknown suites offered", []CipherSuite{99, ChaCha20Poly1305}, hardware, ChaCha20Poly1305},
+	} {
+		got, err := negotiateSuite(tc.offered, tc.preferred)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: negotiateSuite() = %s, %v; want %s", tc.name, got, err, tc.want)
+		}
+	}
+	if _, err := negotiateSuite([]CipherSuite{99}, software); err == nil {
+		t.Error("negotiateSuite() without common suites succeeded")
+	}
+}
+
+// TestHandshakeNegotiatesSuite tests that both ends of a connection use the negotiated suite
+func TestHandshakeNegotiatesSuite(t *testing.T) {
+	for _, tc := range []struct {
+		client, server []CipherSuite
+		want           CipherSuite
+		fails          bool
+	}{
+		{[]CipherSuite{AES256GCM, ChaCha20Poly1305}, []CipherSuite{AES256GCM}, AES256GCM, false},
+		{[]CipherSuite{AES256GCM, ChaCha20Poly1305}, []CipherSuite{ChaCha20Poly1305, AES256GCM}, ChaCha20Poly1305, false},
+		{[]CipherSuite{ChaCha20Poly1305}, []CipherSuite{AES256GCM}, 0, true},
+	} {
+		client := &Config{Identity: mustGenerateIdentity(t), CipherSuites: tc.client}
+		server := &Config{Identity: mustGenerateIdentity(t), CipherSuites: tc.server}
+		c, s := handshakeConfigs(t, client, server, nil)
+		if tc.fails {
+			if !errors.Is(s.err, ErrHandshake) {
+				t.Errorf("%v to %v: server handshake = %v, want ErrHandshake", tc.client, tc.server, s.err)
+			}
+			continue
+		}
+		if c.err != nil || s.err != nil {
+			t.Fatalf("handshake failed: client %v, server %v", c.err, s.err)
+		}
+		for _, conn := range []net.Conn{c.conn, s.conn} {
+			wc := conn.(*WrappedConnection)
+			if wc.writer.cs.suite != tc.want || wc.reader.cs.suite != tc.want {
+				t.Errorf("%v to %v: connection uses %s and %s, want %s", tc.client, tc.server, wc.writer.cs.suite, wc.reader.cs.suite, tc.want)
+			}
+		}
+		go func() { _, _ = c.conn.Write([]byte("hello")) }()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(s.conn, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("read %q, %v; want %q", buf, err, "hello")
+		}
+	}
+}
+
+// TestDecodeChosenSuite tests that the client only accepts a suite it offered
+func TestDecodeChosenSuite(t *testing.T) {
+	offered := []CipherSuite{ChaCha20Poly1305}
+	if got, err := decodeChosenSuite([]byte{byte(ChaCha20Poly1305)}, offered); err != nil || got != ChaCha20Poly1305 {
+		t.Errorf("decodeChosenSuite() = %s, %v", got, err)
+	}
+	for _, payload := range [][]byte{nil, {byte(AES256GCM)}, {1, 1}} {
+		if _, err := decodeChosenSuite(payload, offered); err == nil {
+			t.Errorf("decodeChosenSuite(%x) succeeded", payload)
+		}
+	}
+}
+
+// BenchmarkCipherSuites compares the throughput of the suites through the record layer
+func BenchmarkCipherSuites(b *testing.B) {
+	data := testPayload(8 << 20)
+	key := make([]byte, 32)
+	for _, suite := range []CipherSuite{ChaCha20Poly1305, AES256GCM} {
+		b.Run(fmt.Sprint(suite), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for range b.N {
+				var buf bytes.Buffer
+				buf.Grow(len(data) + len(data)/MaxRecordPayload*32 + 64)
+				writer := &EncryptWriter{writer: &buf, cs: newSuiteCipherState(suite, key)}
+				reader := &DecryptReader{reader: &buf, cs: newSuiteCipherState(suite, key)}
+				if _, err := io.Copy(writer, bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, reader); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package secret
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+
+	"filippo.io/edwards25519"
+	"filippo.io/edwards25519/field"
+)
+
+// Sign signs message with the identity's X25519 private key, following XEdDSA as used
+// by Signal. The result is an ordinary Ed25519 signature, so that peers verify it with
+// the identity's public key, as Verify does, without a signing key of its own to pin.
+func (id *Identity) Sign(message []byte) ([]byte, error) {
+	a, err := edwards25519.NewScalar().SetBytesWithClamping(id.PrivateKey[:])
+	if err != nil {
+		return nil, err
+	}
+	// Of the two Edwards points with the Montgomery u of the public key, Verify uses
+	// the one with the sign bit clear, so the private scalar is negated to match it.
+	A := new(edwards25519.Point).ScalarBaseMult(a).Bytes()
+	if A[31]&0x80 != 0 {
+		a.Negate(a)
+		A[31] &= 0x7f
+	}
+
+	var z [64]byte
+	if _, err := rand.Read(z[:]); err != nil {
+		return nil, err
+	}
+	// The nonce hashes the key, the message and randomness, with a prefix that keeps
+	// it apart from other uses of SHA-512 with the key.
+	h := sha512.New()
+	h.Write([]byte{0xfe})
+	for range 31 {
+		h.Write([]byte{0xff})
+	}
+	h.Write(a.Bytes())
+	h.Write(message)
+	h.Write(z[:])
+	r, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	R := new(edwards25519.Point).ScalarBaseMult(r).Bytes()
+
+	h.Reset()
+	h.Write(R)
+	h.Write(A)
+	h.Write(message)
+	k, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	s := edwards25519.NewScalar().MultiplyAdd(k, a, r)
+	return append(R, s.Bytes()...), nil
+}
+
+// Verify reports whether signature is a valid signature of message by the identity
+// with the given X25519 public key, as made by Identity.Sign.
+func Verify(publicKey EncryptionKey, message, signature []byte) bool {
+	key, err := edwardsPublicKey(publicKey)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(key, message, signature)
+}
+
+// edwardsPublicKey converts an X25519 public key to the Ed25519 public key with the
+// same Montgomery u and a clear sign bit: y = (u - 1) / (u + 1).
+func edwardsPublicKey(publicKey EncryptionKey) (ed25519.PublicKey, error) {
+	u, err := new(field.Element).SetBytes(publicKey[:])
+	if err != nil {
+		return nil, err
+	}
+	one := new(field.Element).One()
+	denominator := new(field.Element).Add(u, one)
+	if denominator.Equal(new(field.Element).Zero()) == 1 {
+		return nil, errors.New("public key has no Edwards form")
+	}
+	y := new(field.Element).Subtract(u, one)
+	y.Multiply(y, denominator.Invert(denominator))
+	return ed25519.PublicKey(y.Bytes()), nil
+}
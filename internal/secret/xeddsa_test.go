@@ -0,0 +1,57 @@
+package secret
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"filippo.io/edwards25519"
+)
+
+// TestSignVerify tests that signatures verify against the signer's public key only, and only for the signed message
+func TestSignVerify(t *testing.T) {
+	for range 20 {
+		signer := mustGenerateIdentity(t)
+		other := mustGenerateIdentity(t)
+		message := []byte("drift offer")
+
+		signature, err := signer.Sign(message)
+		if err != nil {
+			t.Fatalf("Sign() failed: %v", err)
+		}
+		if len(signature) != ed25519.SignatureSize {
+			t.Fatalf("signature has %d bytes, want %d", len(signature), ed25519.SignatureSize)
+		}
+		if !Verify(signer.PublicKey, message, signature) {
+			t.Fatal("Verify() rejected a valid signature")
+		}
+		if Verify(other.PublicKey, message, signature) {
+			t.Error("Verify() accepted a signature by another key")
+		}
+		if Verify(signer.PublicKey, []byte("drift offer!"), signature) {
+			t.Error("Verify() accepted a signature of another message")
+		}
+		signature[10] ^= 1
+		if Verify(signer.PublicKey, message, signature) {
+			t.Error("Verify() accepted a modified signature")
+		}
+	}
+}
+
+// TestEdwardsPublicKey tests that the converted public key has the Montgomery u of the X25519 key
+func TestEdwardsPublicKey(t *testing.T) {
+	id := mustGenerateIdentity(t)
+	key, err := edwardsPublicKey(id.PublicKey)
+	if err != nil {
+		t.Fatalf("edwardsPublicKey() failed: %v", err)
+	}
+	point, err := new(edwards25519.Point).SetBytes(key)
+	if err != nil {
+		t.Fatalf("converted key is not a point: %v", err)
+	}
+	if u := point.BytesMontgomery(); string(u) != string(id.PublicKey[:]) {
+		t.Errorf("converted key has u = %x, want %x", u, id.PublicKey[:])
+	}
+	if key[31]&0x80 != 0 {
+		t.Error("converted key has its sign bit set")
+	}
+}
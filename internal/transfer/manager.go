@@ -0,0 +1,294 @@
+package transfer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// State is where a transfer is in its lifecycle.
+type State string
+
+const (
+	// Pending transfers were requested but not offered yet.
+	Pending State = "pending"
+	// AwaitingAnswer transfers were offered and wait for the receiving user.
+	AwaitingAnswer State = "awaiting-answer"
+	// Transferring transfers were accepted and move file data.
+	Transferring State = "transferring"
+	Completed    State = "completed"
+	Failed       State = "failed"
+	Cancelled    State = "cancelled"
+)
+
+// Finished reports whether a transfer in this state is over.
+func (s State) Finished() bool {
+	return s == Completed || s == Failed || s == Cancelled
+}
+
+// transitions lists the states each unfinished state can move on to. A transfer that
+// was interrupted goes back to AwaitingAnswer when it is offered again to resume.
+var transitions = map[State][]State{
+	Pending:        {AwaitingAnswer, Transferring, Failed, Cancelled},
+	AwaitingAnswer: {Transferring, Failed, Cancelled},
+	Transferring:   {AwaitingAnswer, Completed, Failed, Cancelled},
+}
+
+// Direction tells whether a transfer is sent or received.
+type Direction string
+
+const (
+	Inbound  Direction = "inbound"
+	Outbound Direction = "outbound"
+)
+
+var (
+	ErrNotFound          = errors.New("no such transfer")
+	ErrFinished          = errors.New("transfer already finished")
+	ErrInvalidTransition = errors.New("invalid transfer state transition")
+)
+
+// keepFinished is how many finished transfers are remembered for listing.
+const keepFinished = 50
+
+// Progress describes how far a transfer got.
+type Progress struct {
+	// Filename is the file in flight, the File-th (counting from 1) of the Files
+	// files that carry data.
+	Filename string
+	File     int
+	Files    int
+	// FileBytes of FileSize bytes of the current file and Bytes of TotalBytes bytes of
+	// the whole transfer are done, including what an earlier attempt left to resume from.
+	FileBytes  int64
+	FileSize   int64
+	Bytes      int64
+	TotalBytes int64
+	// Speed is the average rate of this attempt in bytes per second, and ETA the time
+	// it needs for the rest at that rate. Both are zero while unknown.
+	Speed float64
+	ETA   time.Duration
+}
+
+// Transfer is a snapshot of a transfer known to the Manager.
+type Transfer struct {
+	ID          string
+	Direction   Direction
+	Peer        string
+	Description string
+	State       State
+	// Error explains why a transfer failed.
+	Error    string
+	Progress Progress
+	Started  time.Time
+	Updated  time.Time
+}
+
+type entry struct {
+	transfer Transfer
+	cancel   func()
+}
+
+// Manager tracks every inbound and outbound transfer, and is where the UI and other
+// clients list and cancel them. Subscribers are told about every change.
+// All methods of a nil *Manager are no-ops, for callers that track nothing.
+type Manager struct {
+	mu sync.Mutex
+	// published is taken over from mu before subscribers are called and held until they
+	// return, so that they see changes in the order they were made.
+	published   sync.Mutex
+	transfers   map[string]*entry
+	order       []string
+	subscribers map[int]func(Transfer)
+	nextSub     int
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		transfers:   make(map[string]*entry),
+		subscribers: make(map[int]func(Transfer)),
+	}
+}
+
+// Add registers a new Pending transfer and returns its ID. Calling cancel must make
+// whoever runs the transfer stop it and move it to Cancelled.
+func (m *Manager) Add(direction Direction, peer, description string, cancel func()) string {
+	if m == nil {
+		return ""
+	}
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	now := time.Now()
+	t := Transfer{
+		ID:          hex.EncodeToString(b),
+		Direction:   direction,
+		Peer:        peer,
+		Description: description,
+		State:       Pending,
+		Started:     now,
+		Updated:     now,
+	}
+
+	m.mu.Lock()
+	m.transfers[t.ID] = &entry{transfer: t, cancel: cancel}
+	m.order = append(m.order, t.ID)
+	m.prune()
+	m.publish(t)
+	return t.ID
+}
+
+// prune forgets the oldest finished transfers beyond keepFinished.
+func (m *Manager) prune() {
+	finished := 0
+	for _, id := range m.order {
+		if m.transfers[id].transfer.State.Finished() {
+			finished++
+		}
+	}
+	m.order = slices.DeleteFunc(m.order, func(id string) bool {
+		if finished <= keepFinished || !m.transfers[id].transfer.State.Finished() {
+			return false
+		}
+		finished--
+		delete(m.transfers, id)
+		return true
+	})
+}
+
+// SetState moves a transfer to another state. err explains a Failed state.
+func (m *Manager) SetState(id string, state State, err error) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	e, ok := m.transfers[id]
+	if !ok {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	from := e.transfer.State
+	if from != state && !slices.Contains(transitions[from], state) {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, state)
+	}
+	e.transfer.State = state
+	e.transfer.Error = ""
+	if err != nil && state == Failed {
+		e.transfer.Error = err.Error()
+	}
+	e.transfer.Updated = time.Now()
+	if state.Finished() {
+		e.cancel = nil
+		m.prune()
+	}
+	m.publish(e.transfer)
+	return nil
+}
+
+// SetProgress records how far an unfinished transfer got.
+func (m *Manager) SetProgress(id string, p Progress) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	e, ok := m.transfers[id]
+	if !ok || e.transfer.State.Finished() {
+		m.mu.Unlock()
+		return
+	}
+	e.transfer.Progress = p
+	e.transfer.Updated = time.Now()
+	m.publish(e.transfer)
+}
+
+// Get returns the transfer with the given ID.
+func (m *Manager) Get(id string) (Transfer, bool) {
+	if m == nil {
+		return Transfer{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.transfers[id]
+	if !ok {
+		return Transfer{}, false
+	}
+	return e.transfer, true
+}
+
+// List returns all known transfers, oldest first.
+func (m *Manager) List() []Transfer {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]Transfer, 0, len(m.order))
+	for _, id := range m.order {
+		list = append(list, m.transfers[id].transfer)
+	}
+	return list
+}
+
+// Cancel asks whoever runs a transfer to stop it. The transfer moves to Cancelled
+// once it actually stopped.
+func (m *Manager) Cancel(id string) error {
+	if m == nil {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	m.mu.Lock()
+	e, ok := m.transfers[id]
+	if !ok {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if e.transfer.State.Finished() {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrFinished, id)
+	}
+	cancel := e.cancel
+	m.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	return nil
+}
+
+// Subscribe calls fn with a snapshot after every change of any transfer, until the
+// returned function is called. fn runs on the goroutine making the change and must not block
+// or change transfers itself. It sees the changes in the order they were made.
+func (m *Manager) Subscribe(fn func(Transfer)) (unsubscribe func()) {
+	if m == nil {
+		return func() {}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := m.nextSub
+	m.nextSub++
+	m.subscribers[key] = fn
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.subscribers, key)
+	}
+}
+
+// publish tells the subscribers about t, a change made while holding m.mu, which it
+// releases. A snapshot taken before a concurrent change is delivered before the change.
+func (m *Manager) publish(t Transfer) {
+	subscribers := make([]func(Transfer), 0, len(m.subscribers))
+	for _, fn := range m.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	m.published.Lock()
+	defer m.published.Unlock()
+	m.mu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(t)
+	}
+}
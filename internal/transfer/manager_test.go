@@ -0,0 +1,178 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestManagerLifecycle tests that a transfer moves through its states and ends up listed as finished
+func TestManagerLifecycle(t *testing.T) {
+	m := NewManager()
+	id := m.Add(Outbound, "peer", "a.txt", nil)
+
+	for _, state := range []State{AwaitingAnswer, Transferring, AwaitingAnswer, Transferring, Completed} {
+		if err := m.SetState(id, state, nil); err != nil {
+			t.Fatalf("SetState(%s) failed: %v", state, err)
+		}
+	}
+	got, ok := m.Get(id)
+	if !ok {
+		t.Fatal("Get() did not find the transfer")
+	}
+	if got.State != Completed || got.Direction != Outbound || got.Peer != "peer" || got.Description != "a.txt" {
+		t.Errorf("transfer = %+v", got)
+	}
+}
+
+// TestManagerRejectsInvalidTransitions tests that finished transfers stay finished
+func TestManagerRejectsInvalidTransitions(t *testing.T) {
+	m := NewManager()
+	id := m.Add(Inbound, "peer", "a.txt", nil)
+	if err := m.SetState(id, Completed, nil); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("SetState(pending → completed) = %v, want ErrInvalidTransition", err)
+	}
+	if err := m.SetState(id, Failed, errors.New("disk full")); err != nil {
+		t.Fatalf("SetState(failed) failed: %v", err)
+	}
+	if err := m.SetState(id, Transferring, nil); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("SetState(failed → transferring) = %v, want ErrInvalidTransition", err)
+	}
+	if got, _ := m.Get(id); got.Error != "disk full" {
+		t.Errorf("Error = %q, want %q", got.Error, "disk full")
+	}
+	if err := m.SetState("unknown", Failed, nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetState(unknown) = %v, want ErrNotFound", err)
+	}
+}
+
+// TestManagerCancel tests that cancelling reaches whoever runs the transfer, until it is finished
+func TestManagerCancel(t *testing.T) {
+	m := NewManager()
+	cancelled := 0
+	id := m.Add(Outbound, "peer", "a.txt", func() { cancelled++ })
+
+	if err := m.Cancel(id); err != nil {
+		t.Fatalf("Cancel() failed: %v", err)
+	}
+	if cancelled != 1 {
+		t.Errorf("cancel was called %d times, want 1", cancelled)
+	}
+	if got, _ := m.Get(id); got.State != Pending {
+		t.Errorf("State = %s before the transfer stopped, want %s", got.State, Pending)
+	}
+
+	_ = m.SetState(id, Cancelled, nil)
+	if err := m.Cancel(id); !errors.Is(err, ErrFinished) {
+		t.Errorf("Cancel() of a finished transfer = %v, want ErrFinished", err)
+	}
+	if err := m.Cancel("unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Cancel(unknown) = %v, want ErrNotFound", err)
+	}
+	if cancelled != 1 {
+		t.Errorf("cancel was called %d times, want 1", cancelled)
+	}
+}
+
+// TestManagerProgress tests that progress is recorded until the transfer is finished
+func TestManagerProgress(t *testing.T) {
+	m := NewManager()
+	id := m.Add(Inbound, "peer", "a.txt", nil)
+	_ = m.SetState(id, Transferring, nil)
+	m.SetProgress(id, Progress{Bytes: 5, TotalBytes: 10})
+	_ = m.SetState(id, Completed, nil)
+	m.SetProgress(id, Progress{Bytes: 7, TotalBytes: 10})
+
+	if got, _ := m.Get(id); got.Progress.Bytes != 5 {
+		t.Errorf("Bytes = %d, want 5", got.Progress.Bytes)
+	}
+}
+
+// TestManagerSubscribe tests that subscribers see every change until they unsubscribe
+func TestManagerSubscribe(t *testing.T) {
+	m := NewManager()
+	var states []State
+	unsubscribe := m.Subscribe(func(t Transfer) { states = append(states, t.State) })
+
+	id := m.Add(Outbound, "peer", "a.txt", nil)
+	_ = m.SetState(id, AwaitingAnswer, nil)
+	unsubscribe()
+	_ = m.SetState(id, Transferring, nil)
+
+	if len(states) != 2 || states[0] != Pending || states[1] != AwaitingAnswer {
+		t.Errorf("states = %v, want [pending awaiting-answer]", states)
+	}
+}
+
+// TestManagerSubscribeOrder tests that progress delivered slowly is not overtaken by the final state
+func TestManagerSubscribeOrder(t *testing.T) {
+	for range 20 {
+		m := NewManager()
+		delivering := make(chan struct{}, 1)
+		m.Subscribe(func(t Transfer) {
+			if t.Progress.Bytes > 0 {
+				delivering <- struct{}{}
+				time.Sleep(5 * time.Millisecond)
+			}
+		})
+		var finished, late bool
+		m.Subscribe(func(t Transfer) {
+			late = late || finished
+			finished = t.State.Finished()
+		})
+
+		id := m.Add(Inbound, "peer", "a.txt", nil)
+		_ = m.SetState(id, Transferring, nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			m.SetProgress(id, Progress{Bytes: 5})
+		}()
+		<-delivering
+		_ = m.SetState(id, Completed, nil)
+		<-done
+
+		if late {
+			t.Fatal("progress was delivered after the transfer finished")
+		}
+	}
+}
+
+// TestManagerListKeepsRecentFinished tests that List is ordered and forgets old finished transfers
+func TestManagerListKeepsRecentFinished(t *testing.T) {
+	m := NewManager()
+	running := m.Add(Inbound, "peer", "running", nil)
+	for i := range keepFinished + 5 {
+		id := m.Add(Outbound, "peer", fmt.Sprint(i), nil)
+		_ = m.SetState(id, Cancelled, nil)
+	}
+
+	list := m.List()
+	if len(list) != keepFinished+1 {
+		t.Fatalf("List() returned %d transfers, want %d", len(list), keepFinished+1)
+	}
+	if list[0].ID != running {
+		t.Errorf("first transfer = %+v, want the running one", list[0])
+	}
+	if list[1].Description != "5" || list[len(list)-1].Description != fmt.Sprint(keepFinished+4) {
+		t.Errorf("kept %s to %s, want the most recent finished transfers", list[1].Description, list[len(list)-1].Description)
+	}
+}
+
+// TestNilManager tests that a nil manager tracks nothing without failing
+func TestNilManager(t *testing.T) {
+	var m *Manager
+	id := m.Add(Inbound, "peer", "a.txt", nil)
+	if err := m.SetState(id, Transferring, nil); err != nil {
+		t.Errorf("SetState() = %v, want nil", err)
+	}
+	m.SetProgress(id, Progress{})
+	m.Subscribe(func(Transfer) {})()
+	if len(m.List()) != 0 {
+		t.Error("List() is not empty")
+	}
+	if err := m.Cancel(id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Cancel() = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,13 @@
+package transport
+
+import (
+	"encoding/hex"
+
+	"github.com/metalgrid/drift/internal/audit"
+	"github.com/metalgrid/drift/internal/platform"
+)
+
+// recordPeer records an audit event about the peer of a connection.
+func recordPeer(t audit.Type, peer platform.Peer, result, detail string) {
+	audit.Record(audit.Event{Type: t, Peer: peer.Name, Key: hex.EncodeToString(peer.Key), Result: result, Detail: detail})
+}
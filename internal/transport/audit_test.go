@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/metalgrid/drift/internal/audit"
+	"github.com/metalgrid/drift/internal/platform"
+	"github.com/metalgrid/drift/internal/trust"
+)
+
+// useAuditLog records audit events in a log of the test's own, returning its path
+func useAuditLog(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := audit.Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.SetDefault(l)
+	t.Cleanup(func() {
+		audit.SetDefault(nil)
+		_ = l.Close()
+	})
+	return path
+}
+
+// TestPolicyDecisionsAreAudited tests that offers answered by a policy are recorded with the peer's key
+func TestPolicyDecisionsAreAudited(t *testing.T) {
+	path := useAuditLog(t)
+	peer := platform.Peer{Name: "alice", Key: []byte{0xab, 0xcd}, Policy: trust.Policy{Mode: trust.AlwaysDecline}}
+	if offerFrom(t, peer, &mockGateway{}, 10) {
+		t.Fatal("offer was accepted")
+	}
+
+	events, err := audit.Read(path, audit.Filter{Type: audit.Policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("audit log has %d policy events, want 1", len(events))
+	}
+	if e := events[0]; e.Peer != "alice" || e.Key != "abcd" || e.Result != "decline" {
+		t.Errorf("audit event = %+v, want alice's key declined", e)
+	}
+}
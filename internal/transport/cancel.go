@@ -0,0 +1,207 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/metalgrid/drift/internal/secret"
+)
+
+// FeatureCancel sends file data in DATA frames, so that either side can stop a transfer
+// with a CANCEL frame instead of dropping the connection.
+const FeatureCancel Feature = "cancel"
+
+const (
+	// dataChunkSize bounds the payload of a DATA frame, so that a whole frame fills one
+	// record of a secure connection.
+	dataChunkSize = secret.MaxRecordPayload - frameHeaderSize
+	// cancelGrace is how long a blocked read or write may still complete after a transfer
+	// was cancelled, so that it can stop cleanly at a frame boundary.
+	cancelGrace = 2 * time.Second
+	// drainTimeout bounds how long a receiver that cancelled waits for the sender to stop.
+	drainTimeout = 5 * time.Second
+)
+
+// ErrCancelled is reported when a transfer was cancelled on either side.
+var ErrCancelled = errors.New("transfer cancelled")
+
+// errCancelledByPeer is the cause of a transfer cancelled by the other side.
+var errCancelledByPeer = fmt.Errorf("%w by peer", ErrCancelled)
+
+// Data carries a chunk of file data. Payload is the raw frame payload, without fields.
+type Data struct {
+	Message
+	Payload []byte
+}
+
+func (d Data) MarshalMessage() []byte {
+	w := fieldWriter{buf: d.Payload}
+	return w.frame(frameData)
+}
+
+// Cancel stops the transfer in flight. A sender acknowledges a CANCEL from the
+// receiver with its own once it stopped sending.
+type Cancel struct {
+	Message
+}
+
+func (Cancel) MarshalMessage() []byte {
+	var w fieldWriter
+	return w.frame(frameCancel)
+}
+
+// cancelledLocally reports whether err ended a transfer because we cancelled it at a
+// frame boundary, where a CANCEL frame can still be written.
+func cancelledLocally(ctx context.Context, err error) bool {
+	return errors.Is(err, context.Canceled) && !errors.Is(context.Cause(ctx), errCancelledByPeer)
+}
+
+// interruptOnCancel bounds blocking reads and writes on c once ctx is cancelled. With
+// FeatureCancel they get cancelGrace to finish the frame in flight; without it, the raw
+// stream cannot be stopped cleanly anyway. The returned function clears the deadline
+// again and must be called before c is used after ctx was cancelled.
+func interruptOnCancel(ctx context.Context, c *Conn) func() {
+	grace := time.Duration(0)
+	if c.Supports(FeatureCancel) {
+		grace = cancelGrace
+	}
+	done := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(done)
+		_ = c.SetDeadline(time.Now().Add(grace))
+	})
+	return func() {
+		if !stop() {
+			<-done
+			_ = c.SetDeadline(time.Time{})
+		}
+	}
+}
+
+// fileWriter returns where the data of a file is sent to.
+func fileWriter(ctx context.Context, c *Conn) io.Writer {
+	if c.Supports(FeatureCancel) {
+		return &dataWriter{ctx: ctx, w: c}
+	}
+	return c
+}
+
+// fileReader returns where the data of the next file is read from.
+func fileReader(ctx context.Context, c *Conn) io.Reader {
+	if c.Supports(FeatureCancel) {
+		return &dataReader{ctx: ctx, reader: c.reader}
+	}
+	return c.reader
+}
+
+// dataWriter sends everything written to it as DATA frames. Once ctx is cancelled it
+// stops before the next frame, leaving the stream ready for a CANCEL.
+type dataWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (d *dataWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if err := d.ctx.Err(); err != nil {
+			return written, err
+		}
+		chunk := p[:min(len(p), dataChunkSize)]
+		if _, err := d.w.Write(Data{Payload: chunk}.MarshalMessage()); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// dataReader reads file data from DATA frames. It fails with ErrCancelled when the
+// sender cancels, and with ctx's error before the next frame once ctx is cancelled.
+type dataReader struct {
+	ctx    context.Context
+	reader *bufio.Reader
+	buf    []byte
+}
+
+func (d *dataReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if err := d.ctx.Err(); err != nil {
+			return 0, err
+		}
+		msg, err := ReadMessage(d.reader)
+		if err != nil {
+			return 0, err
+		}
+		switch m := msg.(type) {
+		case Data:
+			d.buf = m.Payload
+		case Cancel:
+			return 0, errCancelledByPeer
+		case error:
+			return 0, m
+		default:
+			return 0, fmt.Errorf("unexpected %T in file data", msg)
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+type readResult struct {
+	msg any
+	err error
+}
+
+// watchCancel reads the next message from the peer while we are busy sending, and
+// cancels the transfer if it is a CANCEL. The result is handed back so that
+// HandleConnection carries on with whatever arrived.
+func watchCancel(reader *bufio.Reader, cancel context.CancelCauseFunc) <-chan readResult {
+	results := make(chan readResult, 1)
+	go func() {
+		msg, err := ReadMessage(reader)
+		if _, ok := msg.(Cancel); ok {
+			cancel(errCancelledByPeer)
+		}
+		results <- readResult{msg, err}
+	}()
+	return results
+}
+
+// sendCancel writes a CANCEL frame, giving up if the peer stopped reading.
+func sendCancel(c *Conn) {
+	_ = c.SetWriteDeadline(time.Now().Add(drainTimeout))
+	_, _ = c.Write(Cancel{}.MarshalMessage())
+	_ = c.SetWriteDeadline(time.Time{})
+}
+
+// drainCancelled discards what the sender still had in flight after the receiver
+// cancelled, until the sender acknowledges or hangs up. Closing with unread data
+// could reset the connection before the sender got to read the CANCEL.
+func drainCancelled(c *Conn) {
+	_ = c.SetReadDeadline(time.Now().Add(drainTimeout))
+	for {
+		msg, err := ReadMessage(c.reader)
+		if err != nil {
+			return
+		}
+		switch msg.(type) {
+		case Cancel, error:
+			return
+		}
+	}
+}
+
+// stopped describes who ended a cancelled transfer, for notifications.
+func stopped(ctx context.Context) string {
+	if errors.Is(context.Cause(ctx), errCancelledByPeer) {
+		return "was cancelled by the peer"
+	}
+	return "was cancelled"
+}
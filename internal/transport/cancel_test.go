@@ -0,0 +1,259 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/metalgrid/drift/internal/secret"
+	"github.com/metalgrid/drift/internal/transfer"
+)
+
+// cancelWhenTransferring cancels every transfer of the manager as soon as it moves data
+func cancelWhenTransferring(transfers *transfer.Manager) {
+	transfers.Subscribe(func(t transfer.Transfer) {
+		if t.State == transfer.Transferring {
+			_ = transfers.Cancel(t.ID)
+		}
+	})
+}
+
+// TestCancelRoundTrip tests marshal → unmarshal of DATA and CANCEL frames
+func TestCancelRoundTrip(t *testing.T) {
+	data, ok := UnmarshalFrame(Data{Payload: []byte("chunk")}.MarshalMessage()).(Data)
+	if !ok {
+		t.Fatal("UnmarshalFrame() did not return Data")
+	}
+	if string(data.Payload) != "chunk" {
+		t.Errorf("Payload = %q, want %q", data.Payload, "chunk")
+	}
+	if _, ok := UnmarshalFrame(Cancel{}.MarshalMessage()).(Cancel); !ok {
+		t.Error("UnmarshalFrame() did not return a Cancel")
+	}
+}
+
+// writeSizes records the size of every write to w
+type writeSizes struct {
+	w     io.Writer
+	sizes []int
+}
+
+func (s *writeSizes) Write(p []byte) (int, error) {
+	s.sizes = append(s.sizes, len(p))
+	return s.w.Write(p)
+}
+
+// TestDataWriterChunks tests that file data is split into bounded DATA frames and read back intact
+func TestDataWriterChunks(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), dataChunkSize/4)
+	var stream bytes.Buffer
+	writes := &writeSizes{w: &stream}
+	w := &dataWriter{ctx: context.Background(), w: writes}
+	if n, err := w.Write(payload); err != nil || n != len(payload) {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+	for i, size := range writes.sizes {
+		if size > secret.MaxRecordPayload || (i < len(writes.sizes)-1 && size != secret.MaxRecordPayload) {
+			t.Errorf("frame sizes = %v, want full records of %d bytes", writes.sizes, secret.MaxRecordPayload)
+			break
+		}
+	}
+
+	frames := 0
+	framed := bufio.NewReader(bytes.NewReader(stream.Bytes()))
+	for {
+		msg, err := ReadMessage(framed)
+		if err == io.EOF {
+			break
+		}
+		if data, ok := msg.(Data); !ok || len(data.Payload) > dataChunkSize {
+			t.Fatalf("frame %d = %T, want Data of at most %d bytes", frames, msg, dataChunkSize)
+		}
+		frames++
+	}
+	if frames != 3 {
+		t.Errorf("frames = %d, want 3", frames)
+	}
+
+	r := &dataReader{ctx: context.Background(), reader: bufio.NewReader(&stream)}
+	received, err := io.ReadAll(io.LimitReader(r, int64(len(payload))))
+	if err != nil || !bytes.Equal(received, payload) {
+		t.Errorf("read back %d bytes, %v; want %d bytes", len(received), err, len(payload))
+	}
+}
+
+// TestDataWriterStopsOnCancel tests that nothing is written once the transfer is cancelled
+func TestDataWriterStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var stream bytes.Buffer
+	w := &dataWriter{ctx: ctx, w: &stream}
+	if _, err := w.Write([]byte("data")); !errors.Is(err, context.Canceled) {
+		t.Errorf("Write() = %v, want context.Canceled", err)
+	}
+	if stream.Len() != 0 {
+		t.Errorf("wrote %d bytes after cancellation", stream.Len())
+	}
+}
+
+// TestDataReaderPeerCancel tests that a CANCEL in the data stream is reported as ErrCancelled
+func TestDataReaderPeerCancel(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(Data{Payload: []byte("abc")}.MarshalMessage())
+	stream.Write(Cancel{}.MarshalMessage())
+
+	r := &dataReader{ctx: context.Background(), reader: bufio.NewReader(&stream)}
+	received, err := io.ReadAll(r)
+	if !errors.Is(err, ErrCancelled) {
+		t.Fatalf("ReadAll() = %v, want ErrCancelled", err)
+	}
+	if string(received) != "abc" {
+		t.Errorf("received %q before the cancel, want %q", received, "abc")
+	}
+}
+
+// runCancelledTransfer sends a large file between two managers, one of which is set up to cancel it
+func runCancelledTransfer(t *testing.T, receiverTransfers, senderTransfers *transfer.Manager) (string, *acceptingGateway, *acceptingGateway, error) {
+	t.Helper()
+	dir := useDownloadDir(t)
+	filePath := filepath.Join(t.TempDir(), "big.bin")
+	f, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Larger than what the socket buffers can hold, so the sender is still busy when cancelled.
+	if err := f.Truncate(64 << 20); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+	features := []Feature{FeatureResume, FeatureChecksums, FeatureCancel}
+
+	receiver := &acceptingGateway{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		HandleConnection(context.Background(), withFeatures(serverConn, features...), receiver, receiverTransfers, nil)
+	}()
+
+	// Like the app, cancel an outbound transfer by cancelling its connection.
+	sendCtx, cancelSend := context.WithCancel(context.Background())
+	defer cancelSend()
+	sender := &acceptingGateway{}
+	conn := withFeatures(clientConn, features...)
+	outbound := NewOutboundTransferState()
+	outbound.Track(senderTransfers.Add(transfer.Outbound, "receiver", "big.bin", cancelSend))
+	senderDone := make(chan struct{})
+	go func() {
+		defer close(senderDone)
+		HandleConnection(sendCtx, conn, sender, senderTransfers, outbound)
+	}()
+	if err := SendFile(filePath, conn, outbound); err != nil {
+		t.Fatalf("SendFile() failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = outbound.Wait(ctx)
+	for _, ch := range []chan struct{}{done, senderDone} {
+		select {
+		case <-ch:
+		case <-time.After(10 * time.Second):
+			t.Fatal("HandleConnection did not return")
+		}
+	}
+	return dir, receiver, sender, err
+}
+
+// assertNothingKept checks that a cancelled transfer left no temporary or partial files behind
+func assertNothingKept(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() failed: %v", err)
+	}
+	for _, entry := range entries {
+		t.Errorf("download directory still contains %s", entry.Name())
+	}
+}
+
+// TestSenderCancelsTransfer tests that the receiver cleans up when the sender cancels
+func TestSenderCancelsTransfer(t *testing.T) {
+	receiverTransfers, senderTransfers := transfer.NewManager(), transfer.NewManager()
+	cancelWhenTransferring(senderTransfers)
+
+	dir, receiver, sender, err := runCancelledTransfer(t, receiverTransfers, senderTransfers)
+	if !errors.Is(err, ErrCancelled) {
+		t.Errorf("Wait() = %v, want ErrCancelled", err)
+	}
+	assertNothingKept(t, dir)
+	if !sender.hasNotification("Transfer of big.bin was cancelled") {
+		t.Errorf("sender notifications = %v", sender.notifications)
+	}
+	if !receiver.hasNotification("Transfer of big.bin was cancelled by the peer") {
+		t.Errorf("receiver notifications = %v", receiver.notifications)
+	}
+	assertOnlyState(t, receiverTransfers, transfer.Cancelled)
+}
+
+// TestReceiverCancelsTransfer tests that the sender stops when the receiver cancels
+func TestReceiverCancelsTransfer(t *testing.T) {
+	receiverTransfers, senderTransfers := transfer.NewManager(), transfer.NewManager()
+	cancelWhenTransferring(receiverTransfers)
+
+	dir, receiver, sender, err := runCancelledTransfer(t, receiverTransfers, senderTransfers)
+	if !errors.Is(err, ErrCancelled) {
+		t.Errorf("Wait() = %v, want ErrCancelled", err)
+	}
+	assertNothingKept(t, dir)
+	if !sender.hasNotification("Transfer of big.bin was cancelled by the peer") {
+		t.Errorf("sender notifications = %v", sender.notifications)
+	}
+	if !receiver.hasNotification("Transfer of big.bin was cancelled") {
+		t.Errorf("receiver notifications = %v", receiver.notifications)
+	}
+	assertOnlyState(t, receiverTransfers, transfer.Cancelled)
+}
+
+// assertOnlyState checks that the manager knows a single transfer, in the given state
+func assertOnlyState(t *testing.T, transfers *transfer.Manager, state transfer.State) {
+	t.Helper()
+	list := transfers.List()
+	if len(list) != 1 || list[0].State != state {
+		t.Errorf("transfers = %+v, want one %s", list, state)
+	}
+}
+
+// TestHandleConnectionReturnsOnShutdown tests that cancelling the context ends an idle connection
+func TestHandleConnectionReturnsOnShutdown(t *testing.T) {
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		HandleConnection(ctx, withFeatures(serverConn), &mockGateway{}, nil, nil)
+	}()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("HandleConnection did not return after cancellation")
+	}
+}
@@ -0,0 +1,92 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// FeatureChecksums makes the sender follow every file with a trailer carrying its SHA-256 digest.
+const FeatureChecksums Feature = "checksums"
+
+// ErrChecksumMismatch is returned when a received file does not match the sender's digest.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Trailer follows the data of each file and carries the digest the sender computed while streaming it.
+type Trailer struct {
+	Message
+	Digest []byte
+}
+
+func (t Trailer) MarshalMessage() []byte {
+	var w fieldWriter
+	w.bytes(fieldDigest, t.Digest)
+	return w.frame(frameTrailer)
+}
+
+func unmarshalTrailer(payload []byte) any {
+	trailer := Trailer{Message: Message{"TRAILER"}}
+	err := parseFields(payload, func(tag byte, value []byte) error {
+		if tag == fieldDigest {
+			trailer.Digest = append([]byte(nil), value...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(trailer.Digest) != sha256.Size {
+		return fmt.Errorf("trailer digest must be %d bytes, got %d", sha256.Size, len(trailer.Digest))
+	}
+	return trailer
+}
+
+// checksum hashes a file as it is received and compares the result with the
+// digest in the trailer that follows the file data.
+type checksum struct {
+	hash   hash.Hash
+	reader *bufio.Reader
+}
+
+func newChecksum(reader *bufio.Reader) *checksum {
+	return &checksum{
+		hash:   sha256.New(),
+		reader: reader,
+	}
+}
+
+// verify reads the sender's trailer and compares its digest with the data hashed so far.
+func (c *checksum) verify() error {
+	trailer, err := c.readTrailer()
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(trailer.Digest, c.hash.Sum(nil)) != 1 {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// skip reads the sender's trailer without checking it, for a file that was verified earlier.
+func (c *checksum) skip() error {
+	_, err := c.readTrailer()
+	return err
+}
+
+func (c *checksum) readTrailer() (Trailer, error) {
+	msg, err := ReadMessage(c.reader)
+	if err != nil {
+		return Trailer{}, fmt.Errorf("failed reading trailer: %w", err)
+	}
+	switch m := msg.(type) {
+	case Trailer:
+		return m, nil
+	case Cancel:
+		return Trailer{}, errCancelledByPeer
+	default:
+		return Trailer{}, fmt.Errorf("expected trailer, got %T", msg)
+	}
+}
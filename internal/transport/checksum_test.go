@@ -0,0 +1,237 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// checksumStream returns the data followed by a trailer carrying the digest of want
+func checksumStream(data, want []byte) *bufio.Reader {
+	digest := sha256.Sum256(want)
+	trailer := Trailer{Message: Message{"TRAILER"}, Digest: digest[:]}
+	return bufio.NewReader(io.MultiReader(bytes.NewReader(data), bytes.NewReader(trailer.MarshalMessage())))
+}
+
+// TestTrailerRoundTrip tests marshal → unmarshal of a TRAILER frame
+func TestTrailerRoundTrip(t *testing.T) {
+	digest := sha256.Sum256([]byte("hello"))
+	original := Trailer{Message: Message{"TRAILER"}, Digest: digest[:]}
+	trailer, ok := UnmarshalFrame(original.MarshalMessage()).(Trailer)
+	if !ok {
+		t.Fatal("UnmarshalFrame() did not return a Trailer")
+	}
+	if !bytes.Equal(trailer.Digest, digest[:]) {
+		t.Errorf("Digest = %x, want %x", trailer.Digest, digest)
+	}
+}
+
+// TestTrailerRejectsShortDigest tests that a digest of the wrong length is a malformed frame
+func TestTrailerRejectsShortDigest(t *testing.T) {
+	short := Trailer{Message: Message{"TRAILER"}, Digest: []byte{1, 2, 3}}
+	if _, ok := UnmarshalFrame(short.MarshalMessage()).(error); !ok {
+		t.Error("UnmarshalFrame() accepted a 3-byte digest")
+	}
+}
+
+// TestStoreFileVerifiesChecksum tests that a file matching the sender's digest is stored
+func TestStoreFileVerifiesChecksum(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("integrity matters")
+	stream := checksumStream(data, data)
+
+	if err := storeFile(dir, "good.txt", int64(len(data)), stream, newChecksum(stream), nil); err != nil {
+		t.Fatalf("storeFile() failed: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "good.txt"))
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %v", err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Errorf("content = %q, want %q", content, data)
+	}
+}
+
+// TestStoreFileChecksumMismatch tests that a corrupted file is deleted instead of renamed into place
+func TestStoreFileChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("integrity matters")
+	stream := checksumStream(data, []byte("something else"))
+
+	err := storeFile(dir, "bad.txt", int64(len(data)), stream, newChecksum(stream), nil)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("storeFile() = %v, want ErrChecksumMismatch", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() failed: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("download directory contains %d entries, want none", len(entries))
+	}
+}
+
+// TestStorePartialChecksumCoversResumedPrefix tests that bytes from an earlier attempt are part of the digest
+func TestStorePartialChecksumCoversResumedPrefix(t *testing.T) {
+	dir := t.TempDir()
+	id := newTransferID()
+	if err := os.WriteFile(partialPath(dir, "big.bin", id, 0), []byte("01234"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stream := checksumStream([]byte("56789"), []byte("0123456789"))
+
+	err := storePartial(dir, "big.bin", id, 0, 5, 10, stream, newChecksum(stream), nil)
+	if err != nil {
+		t.Fatalf("storePartial() failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "big.bin")); err != nil {
+		t.Errorf("verified file was not renamed into place: %v", err)
+	}
+}
+
+// TestStorePartialChecksumMismatchDiscardsPartial tests that a corrupted partial is not kept for another resume
+func TestStorePartialChecksumMismatchDiscardsPartial(t *testing.T) {
+	dir := t.TempDir()
+	id := newTransferID()
+	// The prefix on disk differs from what the sender hashed.
+	if err := os.WriteFile(partialPath(dir, "big.bin", id, 0), []byte("XXXXX"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stream := checksumStream([]byte("56789"), []byte("0123456789"))
+
+	err := storePartial(dir, "big.bin", id, 0, 5, 10, stream, newChecksum(stream), nil)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("storePartial() = %v, want ErrChecksumMismatch", err)
+	}
+	if _, err := os.Stat(partialPath(dir, "big.bin", id, 0)); !os.IsNotExist(err) {
+		t.Error("corrupted partial file was kept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "big.bin")); !os.IsNotExist(err) {
+		t.Error("corrupted file was renamed into place")
+	}
+}
+
+// TestStorePartialCompleteWithoutTrailer tests that a complete partial whose trailer was lost is verified on resume
+func TestStorePartialCompleteWithoutTrailer(t *testing.T) {
+	dir := t.TempDir()
+	id := newTransferID()
+	if err := os.WriteFile(partialPath(dir, "big.bin", id, 0), []byte("0123456789"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stream := checksumStream(nil, []byte("0123456789"))
+
+	err := storePartial(dir, "big.bin", id, 0, 10, 10, stream, newChecksum(stream), nil)
+	if err != nil {
+		t.Fatalf("storePartial() failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "big.bin")); err != nil {
+		t.Errorf("verified file was not renamed into place: %v", err)
+	}
+	if _, err := stream.ReadByte(); err != io.EOF {
+		t.Error("trailer was not consumed")
+	}
+}
+
+// TestHandleConnectionSendsTrailer tests that the sender follows the file data with its digest
+func TestHandleConnectionSendsTrailer(t *testing.T) {
+	gw := &mockGateway{}
+	state := NewOutboundTransferState()
+
+	filePath := filepath.Join(t.TempDir(), "movie.mkv")
+	if err := os.WriteFile(filePath, []byte("0123456789"), 0600); err != nil {
+		t.Fatalf("failed creating temp file: %v", err)
+	}
+	state.SetPendingFiles([]string{filePath})
+
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	go HandleConnection(context.Background(), withFeatures(serverConn, FeatureResume, FeatureChecksums), gw, nil, state)
+
+	// Resume from an offset: the digest must still cover the whole file.
+	answer := Accept()
+	answer.Offsets = []int64{7}
+	if _, err := clientConn.Write(answer.MarshalMessage()); err != nil {
+		t.Fatalf("failed writing answer: %v", err)
+	}
+
+	reader := bufio.NewReader(clientConn)
+	received := make([]byte, 3)
+	if _, err := io.ReadFull(reader, received); err != nil {
+		t.Fatalf("failed reading sent bytes: %v", err)
+	}
+	msg, err := ReadMessage(reader)
+	if err != nil {
+		t.Fatalf("failed reading trailer: %v", err)
+	}
+	trailer, ok := msg.(Trailer)
+	if !ok {
+		t.Fatalf("message after file data = %T, want Trailer", msg)
+	}
+	want := sha256.Sum256([]byte("0123456789"))
+	if !bytes.Equal(trailer.Digest, want[:]) {
+		t.Errorf("Digest = %x, want %x", trailer.Digest, want)
+	}
+}
+
+// TestHandleConnectionNotifiesChecksumMismatch tests that the receiver reports and deletes a corrupted file
+func TestHandleConnectionNotifiesChecksumMismatch(t *testing.T) {
+	dir := useDownloadDir(t)
+	id := newTransferID()
+	files := []FileEntry{{Filename: "movie.mkv", Mimetype: mimeType, Size: 4}}
+	// A prepared partial makes the offer a resume, which mockGateway does not get asked about.
+	if err := preparePartials(dir, id, files, []int{0}); err != nil {
+		t.Fatalf("preparePartials() failed: %v", err)
+	}
+
+	gw := &mockGateway{}
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		HandleConnection(context.Background(), withFeatures(serverConn, FeatureResume, FeatureChecksums), gw, nil, nil)
+	}()
+
+	offer := Offer{Message: Message{"OFFER"}, Filename: "movie.mkv", Mimetype: mimeType, Size: 4, TransferID: id}
+	if _, err := clientConn.Write(offer.MarshalMessage()); err != nil {
+		t.Fatalf("failed writing offer: %v", err)
+	}
+	if _, err := ReadMessage(bufio.NewReader(clientConn)); err != nil {
+		t.Fatalf("failed reading answer: %v", err)
+	}
+
+	digest := sha256.Sum256([]byte("good"))
+	trailer := Trailer{Message: Message{"TRAILER"}, Digest: digest[:]}
+	if _, err := clientConn.Write(append([]byte("evil"), trailer.MarshalMessage()...)); err != nil {
+		t.Fatalf("failed writing file data: %v", err)
+	}
+	_ = clientConn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("HandleConnection did not return")
+	}
+
+	if !gw.hasNotification("Integrity check failed for movie.mkv, the file was deleted") {
+		t.Errorf("notifications = %v, want an integrity failure", gw.notifications)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "movie.mkv")); !os.IsNotExist(err) {
+		t.Error("corrupted file was stored")
+	}
+}
@@ -1,17 +1,24 @@
 package transport
 
 import (
-	"bufio"
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
 	"sync"
 
 	"github.com/adrg/xdg"
+	"github.com/metalgrid/drift/internal/audit"
 	"github.com/metalgrid/drift/internal/platform"
+	"github.com/metalgrid/drift/internal/transfer"
+	"github.com/metalgrid/drift/internal/trust"
+	"github.com/rs/zerolog/log"
 )
 
 const (
@@ -20,13 +27,44 @@ const (
 	unsolicitedAnswerIgnoredToken         = "unsolicited_answer_ignored"
 )
 
+// ErrDeclined is reported when the peer declined an offer.
+var ErrDeclined = errors.New("transfer declined")
+
+// errConnectionClosed is reported when the connection ended before the peer answered an offer.
+var errConnectionClosed = errors.New("connection closed before the offer was answered")
+
 type OutboundTransferState struct {
 	mu           sync.Mutex
 	pendingFiles []string
+	transferID   string
+	tracked      string
+	results      chan error
 }
 
 func NewOutboundTransferState() *OutboundTransferState {
-	return &OutboundTransferState{}
+	return &OutboundTransferState{
+		transferID: newTransferID(),
+		results:    make(chan error, 1),
+	}
+}
+
+// TransferID identifies the transfer across reconnects, so that the receiver can resume it.
+func (s *OutboundTransferState) TransferID() string {
+	return s.transferID
+}
+
+// Track ties the state to a transfer of the manager passed to HandleConnection, which
+// then reports when the transfer starts and how far it got.
+func (s *OutboundTransferState) Track(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tracked = id
+}
+
+func (s *OutboundTransferState) trackedID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tracked
 }
 
 func (s *OutboundTransferState) SetPendingFiles(files []string) {
@@ -52,86 +90,94 @@ func (s *OutboundTransferState) ClearPendingFiles() {
 	s.pendingFiles = nil
 }
 
-func HandleConnection(ctx context.Context, conn net.Conn, gw platform.Gateway, outbound *OutboundTransferState) {
+// Wait blocks until the connection carrying the current offer is done with it.
+// It returns nil once all files were sent, ErrDeclined if the peer declined,
+// and an error wrapping ErrInterrupted if the connection broke off mid-transfer.
+func (s *OutboundTransferState) Wait(ctx context.Context) error {
+	select {
+	case err := <-s.results:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *OutboundTransferState) finish(err error) {
+	select {
+	case s.results <- err:
+	default:
+	}
+}
+
+// HandleConnection serves a connection until it ends or ctx is cancelled: it receives
+// what the peer offers, and sends the files of our own offer once the peer answers.
+// Received transfers are added to transfers; our own is tracked there if outbound is.
+func HandleConnection(ctx context.Context, conn net.Conn, gw platform.Gateway, transfers *transfer.Manager, outbound *OutboundTransferState) {
 	fmt.Println("handling connection", conn.LocalAddr().(*net.TCPAddr), conn.RemoteAddr().(*net.TCPAddr))
 	defer conn.Close()
-	reader := bufio.NewReader(conn)
+	c := asConn(conn)
+	reader := c.reader
+	// Stop waiting on the peer once ctx is cancelled.
+	defer interruptOnCancel(ctx, c)()
+
+	// Report the outcome of our own offer exactly once.
+	finished := false
+	finish := func(err error) {
+		if outbound != nil && !finished {
+			finished = true
+			outbound.finish(err)
+		}
+	}
+	defer finish(errConnectionClosed)
+
+	// While we send, a goroutine reads ahead to notice a CANCEL from the peer.
+	var pending <-chan readResult
 
 	for {
-		raw, err := reader.ReadString(byte(endOfMessage))
+		if ctx.Err() != nil {
+			return
+		}
+
+		var msg any
+		var err error
+		if pending != nil {
+			result := <-pending
+			pending = nil
+			msg, err = result.msg, result.err
+		} else {
+			msg, err = ReadMessage(reader)
+		}
 		if err != nil {
 			fmt.Println("error reading from remote:", err)
 			return
 		}
 
-		msg := UnmarshalMessage(raw)
-
 		switch m := msg.(type) {
 		case error:
 			gw.Notify(fmt.Sprintf("Error: %s", m))
 			return
+		case Cancel:
+			// Acknowledges, or arrived too late for, a transfer that is already over.
+			continue
+		case Pair:
+			receivePairing(c, gw)
+			return
 		case BatchOffer:
-			var totalSize int64
-			fileInfos := make([]platform.FileInfo, len(m.Files))
-			for i, file := range m.Files {
-				totalSize += file.Size
-				fileInfos[i] = platform.FileInfo{
-					Filename: file.Filename,
-					Size:     file.Size,
-				}
-			}
-
-			var answer string
-			if bg, ok := gw.(platform.BatchGateway); ok {
-				answer = bg.AskBatch(conn.RemoteAddr().String(), fileInfos)
-			} else {
-				answer = gw.Ask(fmt.Sprintf("Incoming batch: %d files (%s)", len(m.Files), formatSize(totalSize)))
-			}
-
-			if answer == "ACCEPT" {
-				_, err = conn.Write(Accept().MarshalMessage())
-				if err != nil {
-					return
-				}
-			}
-
-			if answer == "DECLINE" || answer == "" {
-				_, _ = conn.Write(Decline().MarshalMessage())
+			if !receiveBatch(ctx, c, gw, transfers, m) {
 				return
 			}
-
-			fp := filepath.Join(xdg.UserDirs.Download, "Drift")
-			for _, file := range m.Files {
-				err = storeFile(fp, file.Filename, file.Size, conn, nil)
-				if err != nil {
-					gw.Notify(fmt.Sprintf("Failed storing file %s: %s", file.Filename, err))
-					return
-				}
-			}
-			gw.Notify(fmt.Sprintf("Batch received: %d files", len(m.Files)))
 		case Offer:
-			answer := gw.Ask(fmt.Sprintf("Incoming file: %s (%s)", m.Filename, formatSize(m.Size)))
-			if answer == "ACCEPT" {
-				_, err = conn.Write(Accept().MarshalMessage())
-				if err != nil {
-					return
-				}
-			}
-
-			// empty string means waiting for an action from the local user has timed out, so we decline by default
-			if answer == "DECLINE" || answer == "" {
-				_, _ = conn.Write(Decline().MarshalMessage())
+			if !receiveOffer(ctx, c, gw, transfers, m) {
 				return
 			}
-
-			fp := filepath.Join(xdg.UserDirs.Download, "Drift")
-			err = storeFile(fp, m.Filename, m.Size, conn, nil)
-			if err != nil {
-				gw.Notify(fmt.Sprintf("Failed storing file: %s", err))
+		case Answer:
+			if m.Kind == "BUSY" {
+				if outbound != nil {
+					outbound.ClearPendingFiles()
+				}
+				finish(ErrBusy)
 				return
 			}
-			gw.Notify(fmt.Sprintf("File received: %s", m.Filename))
-		case Answer:
 			if m.Accepted() {
 				if outbound == nil {
 					gw.Notify(missingOutboundTransferStateToken)
@@ -150,30 +196,495 @@ func HandleConnection(ctx context.Context, conn net.Conn, gw platform.Gateway, o
 					return
 				}
 
-				for _, file := range files {
-					err = sendFile(file, conn, nil)
-					if err != nil {
-						gw.Notify(fmt.Sprintf("Failed sending %s: %s", file, err))
+				indices := allFiles(len(files))
+				if len(m.Selected) > 0 {
+					if err := checkSelection(m.Selected, len(files)); err != nil {
+						gw.Notify(fmt.Sprintf("Error: %s", err))
+						finish(err)
 						return
 					}
+					indices = m.Selected
+				}
+
+				id := outbound.trackedID()
+				_ = transfers.SetState(id, transfer.Transferring, nil)
+				tctx, cancel := context.WithCancelCause(ctx)
+				pending = watchCancel(reader, cancel)
+				err = sendFiles(tctx, c, gw, transfers, id, files, indices, m.Offsets)
+				cancel(nil)
+				if err != nil {
+					finish(err)
+					return
 				}
+				finish(nil)
 
-				if len(files) == 1 {
-					gw.Notify(fmt.Sprintf("File sent: %s", files[0]))
+				if len(indices) == 1 {
+					gw.Notify(fmt.Sprintf("File sent: %s", files[indices[0]]))
 					continue
 				}
-				gw.Notify(fmt.Sprintf("Batch sent: %d files", len(files)))
+				gw.Notify(fmt.Sprintf("Batch sent: %d files", len(indices)))
 				continue
 			}
 			if outbound != nil {
 				outbound.ClearPendingFiles()
 			}
+			finish(ErrDeclined)
 			return
 		}
 	}
 }
 
-func storeFile(incoming, file string, size int64, reader io.Reader, progress ProgressFunc) error {
+// totalSize adds up the sizes of files, saturating at math.MaxInt64, so that a batch
+// whose total does not fit is over any limit rather than wrapping around to a small one.
+func totalSize(files []FileEntry) int64 {
+	var total int64
+	for _, file := range files {
+		if file.Size > math.MaxInt64-total {
+			return math.MaxInt64
+		}
+		total += file.Size
+	}
+	return total
+}
+
+// receiveBatch asks the user about a batch offer and receives the accepted files.
+// It reports whether the connection can carry on.
+func receiveBatch(ctx context.Context, c *Conn, gw platform.Gateway, transfers *transfer.Manager, m BatchOffer) bool {
+	if err := checkEntries(c, m.Files); err != nil {
+		gw.Notify(fmt.Sprintf("Rejected batch: %s", err))
+		_, _ = c.Write(Decline().MarshalMessage())
+		return false
+	}
+	peer := c.Peer()
+	peer.SignedOffer = verifyOffer(c, m.TransferID, m.Files, m.Signature)
+	size := totalSize(m.Files)
+	fileInfos := make([]platform.FileInfo, len(m.Files))
+	for i, file := range m.Files {
+		fileInfos[i] = platform.FileInfo{
+			Filename: file.Filename,
+			Size:     file.Size,
+		}
+		if file.Directory {
+			fileInfos[i].Filename += "/"
+		}
+	}
+	what := fmt.Sprintf("%d files (%s)", len(m.Files), formatSize(size))
+	if !c.limiter.allowOffer(peer.Key) {
+		refuseBusy(c, what, "too many offers")
+		return false
+	}
+
+	fp := filepath.Join(xdg.UserDirs.Download, "Drift")
+	offsets, resuming := acceptedOffsets(c, fp, m.TransferID, m.Files)
+
+	var selected []int
+	ask := false
+	if resuming {
+		selected = allFiles(len(m.Files))
+		gw.Notify(fmt.Sprintf("Resuming batch: %d files", len(m.Files)))
+	} else if accepted, decided := policyAnswer(gw, peer, what, size); decided {
+		if accepted {
+			selected = allFiles(len(m.Files))
+		}
+	} else {
+		ask = true
+	}
+	release, ok := func() {}, true
+	if ask {
+		if release, ok = c.limiter.reservePrompt(); !ok {
+			refuseBusy(c, what, "too many pending prompts")
+			return false
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	id := transfers.Add(transfer.Inbound, peer.Name, fmt.Sprintf("%d files", len(m.Files)), func() { cancel(ErrCancelled) })
+	if ask {
+		_ = transfers.SetState(id, transfer.AwaitingAnswer, nil)
+		if bg, ok := gw.(platform.BatchGateway); ok {
+			selected = bg.AskBatch(peer, fileInfos)
+		} else if gw.Ask(withPeerWarning(peer, "Incoming batch: "+what)) == "ACCEPT" {
+			selected = allFiles(len(m.Files))
+		}
+		release()
+	}
+
+	if err := checkSelection(selected, len(m.Files)); err != nil {
+		gw.Notify(fmt.Sprintf("Failed accepting batch: %s", err))
+		selected = nil
+	}
+	if len(selected) == 0 || ctx.Err() != nil {
+		decline(ctx, c, transfers, id)
+		return false
+	}
+
+	err := acceptOffer(c, fp, m.TransferID, m.Files, selected, offsets, resuming)
+	if err != nil {
+		_ = transfers.SetState(id, transfer.Failed, err)
+		gw.Notify(fmt.Sprintf("Failed accepting batch: %s", err))
+		return false
+	}
+
+	failed, err := receiveFiles(ctx, cancel, c, gw, transfers, id, fp, m.TransferID, m.Files, selected, offsets)
+	if err != nil {
+		return false
+	}
+	if failed > 0 {
+		gw.Notify(fmt.Sprintf("Batch received: %d files, %d failed the integrity check", len(selected)-failed, failed))
+		return true
+	}
+	gw.Notify(fmt.Sprintf("Batch received: %d files", len(selected)))
+	return true
+}
+
+// receiveOffer asks the user about a single file and receives it if accepted.
+// It reports whether the connection can carry on.
+func receiveOffer(ctx context.Context, c *Conn, gw platform.Gateway, transfers *transfer.Manager, m Offer) bool {
+	fp := filepath.Join(xdg.UserDirs.Download, "Drift")
+	files := []FileEntry{{Filename: m.Filename, Mimetype: m.Mimetype, Size: m.Size}}
+	if err := checkEntries(c, files); err != nil {
+		gw.Notify(fmt.Sprintf("Rejected file: %s", err))
+		_, _ = c.Write(Decline().MarshalMessage())
+		return false
+	}
+	peer := c.Peer()
+	peer.SignedOffer = verifyOffer(c, m.TransferID, files, m.Signature)
+	what := fmt.Sprintf("%s (%s)", m.Filename, formatSize(m.Size))
+	if !c.limiter.allowOffer(peer.Key) {
+		refuseBusy(c, what, "too many offers")
+		return false
+	}
+	offsets, resuming := acceptedOffsets(c, fp, m.TransferID, files)
+
+	var answer string
+	ask := false
+	if resuming {
+		answer = "ACCEPT"
+		gw.Notify(fmt.Sprintf("Resuming file: %s", m.Filename))
+	} else if accepted, decided := policyAnswer(gw, peer, what, m.Size); decided {
+		answer = "DECLINE"
+		if accepted {
+			answer = "ACCEPT"
+		}
+	} else {
+		ask = true
+	}
+	release, ok := func() {}, true
+	if ask {
+		if release, ok = c.limiter.reservePrompt(); !ok {
+			refuseBusy(c, what, "too many pending prompts")
+			return false
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	id := transfers.Add(transfer.Inbound, peer.Name, m.Filename, func() { cancel(ErrCancelled) })
+	if ask {
+		_ = transfers.SetState(id, transfer.AwaitingAnswer, nil)
+		// A batch prompt also shows who the file is from, and whether the offer is signed.
+		if bg, ok := gw.(platform.BatchGateway); ok {
+			if len(bg.AskBatch(peer, []platform.FileInfo{{Filename: m.Filename, Size: m.Size}})) == 1 {
+				answer = "ACCEPT"
+			}
+		} else {
+			answer = gw.Ask(withPeerWarning(peer, "Incoming file: "+what))
+		}
+		release()
+	}
+
+	// empty string means waiting for an action from the local user has timed out, so we decline by default
+	if answer != "ACCEPT" || ctx.Err() != nil {
+		decline(ctx, c, transfers, id)
+		return false
+	}
+
+	err := acceptOffer(c, fp, m.TransferID, files, []int{0}, offsets, resuming)
+	if err != nil {
+		_ = transfers.SetState(id, transfer.Failed, err)
+		gw.Notify(fmt.Sprintf("Failed accepting file: %s", err))
+		return false
+	}
+
+	failed, err := receiveFiles(ctx, cancel, c, gw, transfers, id, fp, m.TransferID, files, []int{0}, offsets)
+	if err != nil {
+		return false
+	}
+	if failed == 0 {
+		gw.Notify(fmt.Sprintf("File received: %s", m.Filename))
+	}
+	return true
+}
+
+// decline turns an offer down, recording whether the user declined it or it was
+// cancelled while the user was being asked.
+func decline(ctx context.Context, c *Conn, transfers *transfer.Manager, id string) {
+	_, _ = c.Write(Decline().MarshalMessage())
+	if ctx.Err() != nil {
+		_ = transfers.SetState(id, transfer.Cancelled, nil)
+		return
+	}
+	_ = transfers.SetState(id, transfer.Failed, ErrDeclined)
+}
+
+// policyAnswer applies the peer's policy to an offer of size bytes, described by what.
+// It reports whether the policy decided and, if so, whether it accepted. Every decision
+// is logged and notified. Offers from a peer whose key changed are left to the user.
+func policyAnswer(gw platform.Gateway, peer platform.Peer, what string, size int64) (accepted, decided bool) {
+	if peer.KeyChanged {
+		return false, false
+	}
+	switch peer.Policy.Decide(size) {
+	case trust.Accept:
+		log.Info().Str("peer", peer.Name).Str("offer", what).Stringer("policy", peer.Policy).Msg("accepted offer by policy")
+		recordPeer(audit.Policy, peer, "accept", fmt.Sprintf("%s (policy: %s)", what, peer.Policy))
+		gw.Notify(fmt.Sprintf("Automatically accepted %s from %s (policy: %s)", what, peer.Name, peer.Policy))
+		return true, true
+	case trust.Decline:
+		log.Info().Str("peer", peer.Name).Str("offer", what).Stringer("policy", peer.Policy).Msg("declined offer by policy")
+		recordPeer(audit.Policy, peer, "decline", fmt.Sprintf("%s (policy: %s)", what, peer.Policy))
+		gw.Notify(fmt.Sprintf("Automatically declined %s from %s (policy: %s)", what, peer.Name, peer.Policy))
+		return false, true
+	}
+	return false, false
+}
+
+// withPeerWarning puts the warning about a peer whose key changed before a question.
+func withPeerWarning(peer platform.Peer, question string) string {
+	if !peer.KeyChanged {
+		return question
+	}
+	return "WARNING: " + peer.KeyChangedWarning() + "\n\n" + question
+}
+
+// acceptedOffsets determines whether an offer continues a transfer whose partial files
+// are already on disk. Such a transfer was accepted before and is resumed without asking
+// again, unless the peer's key changed since.
+func acceptedOffsets(c *Conn, dir, transferID string, files []FileEntry) ([]int64, bool) {
+	if !c.Supports(FeatureResume) || !validTransferID(transferID) || c.Peer().KeyChanged {
+		return nil, false
+	}
+	return resumeOffsets(dir, transferID, files)
+}
+
+// acceptOffer prepares storage for the selected files of an accepted offer and answers it.
+// The directory tree is created first. Resumable transfers get their partial files
+// up front; a resumed transfer tells the sender how much of each file it already has,
+// and was set up for the selected files when it was first accepted.
+func acceptOffer(c *Conn, dir, transferID string, files []FileEntry, selected []int, offsets []int64, resuming bool) error {
+	answer := Accept()
+	if resuming {
+		answer.Offsets = offsets
+		_, err := c.Write(answer.MarshalMessage())
+		return err
+	}
+
+	chosen := make([]FileEntry, len(selected))
+	for i, index := range selected {
+		chosen[i] = files[index]
+	}
+	if err := prepareTree(dir, chosen); err != nil {
+		_, _ = c.Write(Decline().MarshalMessage())
+		return err
+	}
+	if c.Supports(FeatureResume) && validTransferID(transferID) {
+		removeStalePartials(dir, PartialMaxAge)
+		if err := preparePartials(dir, transferID, files, selected); err != nil {
+			_, _ = c.Write(Decline().MarshalMessage())
+			return err
+		}
+	}
+	if len(selected) < len(files) && c.Supports(FeatureSelection) {
+		answer.Selected = selected
+	}
+	_, err := c.Write(answer.MarshalMessage())
+	return err
+}
+
+// receiveFiles stores the selected files of an accepted offer, tracked as id, and returns
+// how many of them failed their integrity check. The transfer stops when ctx is cancelled,
+// which cancel does when the user cancels it, or when the peer does. A non-nil error ends
+// the connection and has already been reported to the user.
+func receiveFiles(ctx context.Context, cancel context.CancelCauseFunc, c *Conn, gw platform.Gateway, transfers *transfer.Manager, id, dir, transferID string, files []FileEntry, selected []int, offsets []int64) (int, error) {
+	what := fmt.Sprintf("%d files", len(selected))
+	if len(selected) == 1 {
+		what = files[selected[0]].Filename
+	}
+	_ = transfers.SetState(id, transfer.Transferring, nil)
+	resume := interruptOnCancel(ctx, c)
+	defer resume()
+
+	var count int
+	var total int64
+	for _, i := range selected {
+		if !files[i].Directory {
+			count++
+			total += files[i].Size
+		}
+	}
+	progress := newTransferProgress(transfers, id, count, total)
+
+	wanted := make([]bool, len(files))
+	for _, i := range selected {
+		wanted[i] = true
+	}
+	streamed := selected
+	if !c.Supports(FeatureSelection) {
+		streamed = allFiles(len(files))
+	}
+
+	failed := 0
+	for _, i := range streamed {
+		file := files[i]
+		var err error
+		if wanted[i] {
+			err = receiveFile(ctx, c, dir, transferID, i, file, offsets, progress)
+		} else {
+			// The sender could not be told to skip it.
+			err = discardFile(ctx, c, file)
+		}
+		switch {
+		case err == nil:
+			continue
+		case errors.Is(err, ErrChecksumMismatch):
+			failed++
+			recordPeer(audit.Integrity, c.Peer(), "checksum mismatch", file.Filename)
+			gw.Notify(fmt.Sprintf("Integrity check failed for %s, the file was deleted", file.Filename))
+			continue
+		case errors.Is(err, ErrCancelled) || ctx.Err() != nil:
+			if errors.Is(err, errCancelledByPeer) {
+				cancel(errCancelledByPeer)
+			}
+			if c.Supports(FeatureResume) && validTransferID(transferID) {
+				removePartials(dir, transferID, files, selected)
+			}
+			if cancelledLocally(ctx, err) && c.Supports(FeatureCancel) {
+				resume()
+				sendCancel(c)
+				drainCancelled(c)
+			}
+			progress.finish()
+			_ = transfers.SetState(id, transfer.Cancelled, nil)
+			gw.Notify(fmt.Sprintf("Transfer of %s %s", what, stopped(ctx)))
+			return failed, ErrCancelled
+		default:
+			progress.finish()
+			_ = transfers.SetState(id, transfer.Failed, err)
+			gw.Notify(fmt.Sprintf("Failed storing file %s: %s", file.Filename, err))
+			return failed, err
+		}
+	}
+	progress.finish()
+	if failed > 0 {
+		_ = transfers.SetState(id, transfer.Failed, fmt.Errorf("%d of %d files %w", failed, len(selected), ErrChecksumMismatch))
+		return failed, nil
+	}
+	_ = transfers.SetState(id, transfer.Completed, nil)
+	return failed, nil
+}
+
+// sendFiles streams the selected files after the peer accepted, each followed by its
+// digest when checksums were negotiated, and reports progress on the transfer tracked
+// as id. The transfer stops when ctx is cancelled, or when the peer cancels it, which
+// the caller's watchCancel tells cancel about. The returned error is what the outbound
+// transfer reports: ErrCancelled, or one wrapping ErrInterrupted.
+func sendFiles(ctx context.Context, c *Conn, gw platform.Gateway, transfers *transfer.Manager, id string, files []string, indices []int, offsets []int64) error {
+	what := fmt.Sprintf("%d files", len(indices))
+	if len(indices) == 1 {
+		what = filepath.Base(files[indices[0]])
+	}
+	resume := interruptOnCancel(ctx, c)
+	defer resume()
+
+	var count int
+	var total int64
+	sizes := make([]int64, len(files))
+	for _, i := range indices {
+		if files[i] == "" {
+			continue
+		}
+		count++
+		if fi, err := os.Stat(files[i]); err == nil {
+			sizes[i] = fi.Size()
+			total += sizes[i]
+		}
+	}
+	progress := newTransferProgress(transfers, id, count, total)
+	defer progress.finish()
+
+	for _, i := range indices {
+		file := files[i]
+		if file == "" {
+			// Directory entry, created by the receiver when it accepted.
+			continue
+		}
+		var offset int64
+		if len(offsets) == len(files) {
+			offset = offsets[i]
+		}
+		var digest hash.Hash
+		if c.Supports(FeatureChecksums) {
+			digest = sha256.New()
+		}
+		report := progress.startFile(filepath.Base(file), sizes[i], offset)
+		err := sendFile(file, fileWriter(ctx, c), offset, digest, report)
+		if err == nil && digest != nil {
+			trailer := Trailer{Message: Message{"TRAILER"}, Digest: digest.Sum(nil)}
+			_, err = c.Write(trailer.MarshalMessage())
+		}
+		if err == nil {
+			continue
+		}
+
+		if ctx.Err() != nil {
+			// Stopped between frames: tell the receiver, or acknowledge its CANCEL.
+			if errors.Is(err, context.Canceled) && c.Supports(FeatureCancel) {
+				resume()
+				sendCancel(c)
+			}
+			gw.Notify(fmt.Sprintf("Transfer of %s %s", what, stopped(ctx)))
+			return ErrCancelled
+		}
+		gw.Notify(fmt.Sprintf("Failed sending %s: %s", file, err))
+		return fmt.Errorf("%w: %w", ErrInterrupted, err)
+	}
+	return nil
+}
+
+// receiveFile stores the index-th file of an accepted offer, keeping partial data
+// around for a later resume when the transfer is resumable, and verifying it
+// against the sender's digest when checksums were negotiated.
+// Directory entries carry no data and were created when the offer was accepted.
+func receiveFile(ctx context.Context, c *Conn, dir, transferID string, index int, file FileEntry, offsets []int64, progress *transferProgress) error {
+	if file.Directory {
+		return nil
+	}
+	target, err := safeJoin(dir, file.Filename)
+	if err != nil {
+		return err
+	}
+	parent, name := filepath.Split(target)
+
+	var check *checksum
+	if c.Supports(FeatureChecksums) {
+		check = newChecksum(c.reader)
+	}
+	if !c.Supports(FeatureResume) || !validTransferID(transferID) {
+		report := progress.startFile(file.Filename, file.Size, 0)
+		return storeFile(parent, name, file.Size, fileReader(ctx, c), check, report)
+	}
+	var offset int64
+	if offsets != nil {
+		offset = offsets[index]
+	}
+	report := progress.startFile(file.Filename, file.Size, offset)
+	return storePartial(parent, name, transferID, index, offset, file.Size, fileReader(ctx, c), check, report)
+}
+
+// storeFile receives size bytes into file under incoming. With a non-nil check,
+// the file is only renamed into place once it matches the sender's digest.
+func storeFile(incoming, file string, size int64, reader io.Reader, check *checksum, progress ProgressFunc) error {
 	err := os.MkdirAll(incoming, 0777)
 
 	if err != nil {
@@ -187,10 +698,18 @@ func storeFile(incoming, file string, size int64, reader io.Reader, progress Pro
 		return err
 	}
 
-	lr := io.LimitReader(reader, size)
+	var lr io.Reader = io.LimitReader(reader, size)
+	if check != nil {
+		lr = io.TeeReader(lr, check.hash)
+	}
 	pr := NewProgressReader(lr, size, progress)
 	bytes, err := f.ReadFrom(pr)
-	_ = bytes
+	if err == nil && bytes != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && check != nil {
+		err = check.verify()
+	}
 	_ = f.Close()
 	if err != nil {
 		// if we're able to create the file, we should be able to remove it as well
@@ -200,7 +719,10 @@ func storeFile(incoming, file string, size int64, reader io.Reader, progress Pro
 	return os.Rename(f.Name(), fp)
 }
 
-func sendFile(file string, writer io.Writer, progress ProgressFunc) error {
+// sendFile streams file to writer from offset on. A non-nil digest is fed the
+// whole file, including the part before offset, since that is what the receiver
+// ends up hashing.
+func sendFile(file string, writer io.Writer, offset int64, digest hash.Hash, progress ProgressFunc) error {
 	f, err := os.Open(file)
 	if err != nil {
 		return err
@@ -212,7 +734,22 @@ func sendFile(file string, writer io.Writer, progress ProgressFunc) error {
 		return err
 	}
 
-	pw := NewProgressWriter(writer, fi.Size(), progress)
+	if offset > fi.Size() {
+		return fmt.Errorf("resume offset %d is past the end of %s", offset, file)
+	}
+	if digest != nil {
+		if _, err := io.Copy(digest, io.NewSectionReader(f, 0, offset)); err != nil {
+			return err
+		}
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	var pw io.Writer = NewProgressWriter(writer, fi.Size()-offset, progress)
+	if digest != nil {
+		pw = io.MultiWriter(pw, digest)
+	}
 	bytes, err := f.WriteTo(pw)
 	_ = bytes
 	return err
@@ -223,6 +760,10 @@ func SendFile(filename string, conn net.Conn, outbound *OutboundTransferState) e
 	if outbound == nil {
 		return fmt.Errorf("%s", missingOutboundTransferStateToken)
 	}
+	if fi, err := os.Stat(filename); err == nil && fi.IsDir() {
+		// A directory is offered as the tree of files inside it.
+		return SendBatch([]string{filename}, conn, outbound)
+	}
 	outbound.SetPendingFiles([]string{filename})
 
 	offer, err := MakeOffer(filename)
@@ -231,6 +772,10 @@ func SendFile(filename string, conn net.Conn, outbound *OutboundTransferState) e
 		fmt.Println("failed creating file offer:", err)
 		return err
 	}
+	if asConn(conn).Supports(FeatureResume) {
+		offer.TransferID = outbound.TransferID()
+	}
+	offer.Signature = signOffer(asConn(conn), offer.TransferID, []FileEntry{{Filename: offer.Filename, Mimetype: offer.Mimetype, Size: offer.Size}})
 
 	_, err = conn.Write(offer.MarshalMessage())
 	if err != nil {
@@ -247,14 +792,22 @@ func SendBatch(filenames []string, conn net.Conn, outbound *OutboundTransferStat
 	if outbound == nil {
 		return fmt.Errorf("%s", missingOutboundTransferStateToken)
 	}
-	outbound.SetPendingFiles(filenames)
 
-	batch, err := MakeBatchOffer(filenames)
+	batch, sources, err := makeBatchOffer(filenames)
 	if err != nil {
 		outbound.ClearPendingFiles()
 		fmt.Println("failed creating batch offer:", err)
 		return err
 	}
+	if hasTree(batch.Files) && !asConn(conn).Supports(FeatureDirectories) {
+		outbound.ClearPendingFiles()
+		return fmt.Errorf("peer does not support directory transfers")
+	}
+	outbound.SetPendingFiles(sources)
+	if asConn(conn).Supports(FeatureResume) {
+		batch.TransferID = outbound.TransferID()
+	}
+	batch.Signature = signOffer(asConn(conn), batch.TransferID, batch.Files)
 
 	_, err = conn.Write(batch.MarshalMessage())
 	if err != nil {
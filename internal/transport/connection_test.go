@@ -98,7 +98,7 @@ func TestStoreFileSuccess(t *testing.T) {
 	testData := []byte("test file content")
 	reader := bytes.NewReader(testData)
 
-	err := storeFile(tmpDir, "test.txt", int64(len(testData)), reader, nil)
+	err := storeFile(tmpDir, "test.txt", int64(len(testData)), reader, nil, nil)
 	if err != nil {
 		t.Fatalf("storeFile() failed: %v", err)
 	}
@@ -129,7 +129,7 @@ func TestStoreFileZeroBytes(t *testing.T) {
 	tmpDir := t.TempDir()
 	reader := bytes.NewReader([]byte{})
 
-	err := storeFile(tmpDir, "empty.txt", 0, reader, nil)
+	err := storeFile(tmpDir, "empty.txt", 0, reader, nil, nil)
 	if err != nil {
 		t.Fatalf("storeFile() with zero bytes failed: %v", err)
 	}
@@ -153,7 +153,7 @@ func TestStoreFileDirCreation(t *testing.T) {
 	testData := []byte("nested file content")
 	reader := bytes.NewReader(testData)
 
-	err := storeFile(subDir, "nested.txt", int64(len(testData)), reader, nil)
+	err := storeFile(subDir, "nested.txt", int64(len(testData)), reader, nil, nil)
 	if err != nil {
 		t.Fatalf("storeFile() with nested directory failed: %v", err)
 	}
@@ -181,7 +181,7 @@ func TestHandleConnectionAnswerAcceptWithoutFilenameState(t *testing.T) {
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		HandleConnection(context.Background(), serverConn, gw, nil)
+		HandleConnection(context.Background(), serverConn, gw, nil, nil)
 	}()
 
 	if _, err := clientConn.Write(Accept().MarshalMessage()); err != nil {
@@ -216,7 +216,7 @@ func TestHandleConnectionAnswerAcceptWithoutPendingOffer(t *testing.T) {
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		HandleConnection(context.Background(), serverConn, gw, state)
+		HandleConnection(context.Background(), serverConn, gw, nil, state)
 	}()
 
 	if _, err := clientConn.Write(Accept().MarshalMessage()); err != nil {
@@ -256,7 +256,7 @@ func TestHandleConnectionAnswerAcceptSinglePendingFile(t *testing.T) {
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		HandleConnection(context.Background(), serverConn, gw, state)
+		HandleConnection(context.Background(), serverConn, gw, nil, state)
 	}()
 
 	if _, err := clientConn.Write(Accept().MarshalMessage()); err != nil {
@@ -312,7 +312,7 @@ func TestHandleConnectionAnswerAcceptBatchPendingFiles(t *testing.T) {
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		HandleConnection(context.Background(), serverConn, gw, state)
+		HandleConnection(context.Background(), serverConn, gw, nil, state)
 	}()
 
 	if _, err := clientConn.Write(Accept().MarshalMessage()); err != nil {
@@ -361,7 +361,7 @@ func TestSendFileStateOrderingImmediateAnswer(t *testing.T) {
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		HandleConnection(context.Background(), serverConn, gw, state)
+		HandleConnection(context.Background(), serverConn, gw, nil, state)
 	}()
 
 	if err := SendFile(filePath, serverConn, state); err != nil {
@@ -369,12 +369,12 @@ func TestSendFileStateOrderingImmediateAnswer(t *testing.T) {
 	}
 
 	reader := bufio.NewReader(clientConn)
-	offer, err := reader.ReadString('\n')
+	offer, err := ReadMessage(reader)
 	if err != nil {
 		t.Fatalf("failed reading offer from sender: %v", err)
 	}
-	if len(offer) == 0 {
-		t.Fatal("expected non-empty offer")
+	if _, ok := offer.(Offer); !ok {
+		t.Fatalf("expected offer, got %T", offer)
 	}
 
 	if _, err := clientConn.Write(Accept().MarshalMessage()); err != nil {
@@ -416,7 +416,7 @@ func TestHandleConnectionAnswerDeclineClearsPendingAndStops(t *testing.T) {
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		HandleConnection(context.Background(), serverConn, gw, state)
+		HandleConnection(context.Background(), serverConn, gw, nil, state)
 	}()
 
 	if _, err := clientConn.Write(Decline().MarshalMessage()); err != nil {
@@ -448,7 +448,7 @@ func TestHandleConnectionMalformedAnswerMessage(t *testing.T) {
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		HandleConnection(context.Background(), serverConn, gw, state)
+		HandleConnection(context.Background(), serverConn, gw, nil, state)
 	}()
 
 	if _, err := clientConn.Write([]byte("ANSWER|ACCEPT|EXTRA\n")); err != nil {
@@ -0,0 +1,139 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every message on the wire is a frame:
+//
+//	version (1 byte) | type (1 byte) | payload length (4 bytes, big-endian) | payload
+//
+// The payload is a sequence of fields, each encoded as
+//
+//	tag (1 byte) | value length (uvarint) | value
+//
+// Receivers skip fields with unknown tags, so new fields can be added
+// without bumping the frame version.
+const (
+	frameVersion    = 1
+	frameHeaderSize = 6
+	maxFramePayload = 1 << 20
+)
+
+// errNotFrame is reported for data that does not start with a frame of the known version.
+var errNotFrame = errors.New("not a frame")
+
+// Frame types.
+const (
+	frameOffer      byte = 1
+	frameBatchOffer byte = 2
+	frameAnswer     byte = 3
+	frameHello      byte = 4
+	frameTrailer    byte = 5
+	frameData       byte = 6
+	frameCancel     byte = 7
+	framePair       byte = 8
+)
+
+// fieldWriter accumulates the fields of a frame payload.
+type fieldWriter struct {
+	buf []byte
+}
+
+func (w *fieldWriter) bytes(tag byte, value []byte) {
+	w.buf = append(w.buf, tag)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+func (w *fieldWriter) string(tag byte, value string) {
+	w.bytes(tag, []byte(value))
+}
+
+func (w *fieldWriter) uint(tag byte, value uint64) {
+	w.bytes(tag, binary.AppendUvarint(nil, value))
+}
+
+// frame wraps the accumulated fields into a complete frame of the given type.
+func (w *fieldWriter) frame(frameType byte) []byte {
+	out := make([]byte, frameHeaderSize, frameHeaderSize+len(w.buf))
+	out[0] = frameVersion
+	out[1] = frameType
+	binary.BigEndian.PutUint32(out[2:], uint32(len(w.buf)))
+	return append(out, w.buf...)
+}
+
+// parseFields calls fn for every field in payload, in wire order.
+func parseFields(payload []byte, fn func(tag byte, value []byte) error) error {
+	for len(payload) > 0 {
+		tag := payload[0]
+		length, n := binary.Uvarint(payload[1:])
+		if n <= 0 {
+			return fmt.Errorf("malformed length for field %d", tag)
+		}
+		payload = payload[1+n:]
+		if length > uint64(len(payload)) {
+			return fmt.Errorf("field %d overruns payload", tag)
+		}
+		if err := fn(tag, payload[:length]); err != nil {
+			return err
+		}
+		payload = payload[length:]
+	}
+	return nil
+}
+
+func parseUint(tag byte, value []byte) (uint64, error) {
+	v, n := binary.Uvarint(value)
+	if n <= 0 || n != len(value) {
+		return 0, fmt.Errorf("malformed integer in field %d", tag)
+	}
+	return v, nil
+}
+
+func parseSize(tag byte, value []byte) (int64, error) {
+	v, err := parseUint(tag, value)
+	if err != nil {
+		return 0, err
+	}
+	if v > 1<<63-1 {
+		return 0, fmt.Errorf("size in field %d out of range", tag)
+	}
+	return int64(v), nil
+}
+
+// ReadMessage reads the next frame from r and decodes it with UnmarshalFrame.
+// As with that, a malformed message is returned as an error value in the
+// result, while the returned error is reserved for failures that leave the
+// stream unusable, such as a line of the pipe-delimited protocol: peers that
+// speak it never get past the HELLO exchange, which every connection starts
+// with.
+func ReadMessage(r *bufio.Reader) (any, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != frameVersion {
+		return nil, fmt.Errorf("%w: frame version %d", errNotFrame, first[0])
+	}
+
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[2:])
+	if length > maxFramePayload {
+		return nil, fmt.Errorf("frame payload of %d bytes exceeds limit of %d", length, maxFramePayload)
+	}
+
+	frame := make([]byte, frameHeaderSize+int(length))
+	copy(frame, header[:])
+	if _, err := io.ReadFull(r, frame[frameHeaderSize:]); err != nil {
+		return nil, err
+	}
+	return UnmarshalFrame(frame), nil
+}
@@ -0,0 +1,245 @@
+package transport
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/metalgrid/drift/internal/platform"
+	"github.com/metalgrid/drift/internal/secret"
+)
+
+// ProtocolVersion is the protocol version spoken by this build. Peers that
+// advertise "v=0.1" over mDNS predate the HELLO exchange and speak the
+// pipe-delimited line protocol; they are treated as version 0.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// legacyDecline is the answer understood by peers that speak the line protocol.
+const legacyDecline = "ANSWER|DECLINE\n"
+
+// ErrIncompatiblePeer is returned when the two sides cannot agree on a protocol version.
+var ErrIncompatiblePeer = errors.New("incompatible peer")
+
+// Feature names an optional protocol capability announced in HELLO.
+type Feature string
+
+// supportedFeatures lists the optional features implemented by this build.
+var supportedFeatures = []Feature{FeatureResume, FeatureChecksums, FeatureDirectories, FeatureSelection, FeatureCancel, FeaturePairing}
+
+type Hello struct {
+	Message
+	Version    uint64
+	MinVersion uint64
+	Features   []Feature
+}
+
+func (h Hello) MarshalMessage() []byte {
+	var w fieldWriter
+	w.uint(fieldVersion, h.Version)
+	w.uint(fieldMinVersion, h.MinVersion)
+	for _, feature := range h.Features {
+		w.string(fieldFeature, string(feature))
+	}
+	return w.frame(frameHello)
+}
+
+func unmarshalHello(payload []byte) any {
+	hello := Hello{Message: Message{"HELLO"}}
+	var hasVersion bool
+	err := parseFields(payload, func(tag byte, value []byte) error {
+		var err error
+		switch tag {
+		case fieldVersion:
+			hello.Version, err = parseUint(tag, value)
+			hasVersion = true
+		case fieldMinVersion:
+			hello.MinVersion, err = parseUint(tag, value)
+		case fieldFeature:
+			hello.Features = append(hello.Features, Feature(value))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !hasVersion {
+		return fmt.Errorf("hello is missing its version")
+	}
+	return hello
+}
+
+func localHello() Hello {
+	return Hello{
+		Message:    Message{"HELLO"},
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+		Features:   supportedFeatures,
+	}
+}
+
+// ParseVersion interprets the value of a peer's mDNS "v=" record.
+// Anything that is not a plain integer, including the legacy "0.1", is version 0.
+func ParseVersion(record string) uint64 {
+	version, err := strconv.ParseUint(record, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+// CheckAdvertisedVersion reports whether a peer advertising the given mDNS "v=" record
+// can be talked to at all, so that incompatible peers are rejected before dialing.
+func CheckAdvertisedVersion(record string) error {
+	if version := ParseVersion(record); version < MinProtocolVersion {
+		return fmt.Errorf("%w: peer advertises protocol %q, at least version %d is required", ErrIncompatiblePeer, record, MinProtocolVersion)
+	}
+	return nil
+}
+
+// Conn is a peer connection on which the HELLO exchange has completed.
+// It remembers the negotiated protocol version and the features both sides support.
+type Conn struct {
+	net.Conn
+	reader   *bufio.Reader
+	version  uint64
+	features []Feature
+	peer     *platform.Peer
+	limiter  *Limiter
+	identity *secret.Identity
+}
+
+// asConn returns conn as a *Conn, wrapping it without any negotiated features if needed.
+func asConn(conn net.Conn) *Conn {
+	if c, ok := conn.(*Conn); ok {
+		return c
+	}
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Read reads through the buffered reader that was used for the handshake,
+// so that no bytes following the peer's HELLO are lost.
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Version returns the negotiated protocol version.
+func (c *Conn) Version() uint64 {
+	return c.version
+}
+
+// SetPeer records who the connection comes from, as authenticated by the secure handshake.
+func (c *Conn) SetPeer(peer platform.Peer) {
+	c.peer = &peer
+}
+
+// Peer returns who the connection comes from, named by its address if it was not set.
+func (c *Conn) Peer() platform.Peer {
+	if c.peer == nil {
+		return platform.Peer{Name: c.RemoteAddr().String()}
+	}
+	return *c.peer
+}
+
+// Supports reports whether both sides announced the given feature.
+func (c *Conn) Supports(feature Feature) bool {
+	return slices.Contains(c.features, feature)
+}
+
+// InitiateHandshake performs the HELLO exchange on a connection we dialed.
+// The dialing side speaks first.
+func InitiateHandshake(conn net.Conn) (*Conn, error) {
+	c := asConn(conn)
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(localHello().MarshalMessage()); err != nil {
+		return nil, fmt.Errorf("failed sending hello: %w", err)
+	}
+
+	remote, err := readHello(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.negotiate(remote); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// AcceptHandshake performs the HELLO exchange on a connection we accepted.
+// The accepting side waits for the peer's HELLO before answering with its own,
+// so that peers speaking the legacy line protocol never see a frame.
+func AcceptHandshake(conn net.Conn) (*Conn, error) {
+	c := asConn(conn)
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	remote, err := readHello(c)
+	if err != nil {
+		if errors.Is(err, ErrIncompatiblePeer) {
+			_, _ = conn.Write([]byte(legacyDecline))
+		}
+		return nil, err
+	}
+
+	if _, err := conn.Write(localHello().MarshalMessage()); err != nil {
+		return nil, fmt.Errorf("failed sending hello: %w", err)
+	}
+	if err := c.negotiate(remote); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func readHello(c *Conn) (Hello, error) {
+	first, err := c.reader.Peek(1)
+	if err != nil {
+		return Hello{}, fmt.Errorf("failed reading hello: %w", err)
+	}
+	if first[0] != frameVersion {
+		return Hello{}, fmt.Errorf("%w: peer speaks the legacy line protocol", ErrIncompatiblePeer)
+	}
+
+	msg, err := ReadMessage(c.reader)
+	if err != nil {
+		return Hello{}, fmt.Errorf("failed reading hello: %w", err)
+	}
+
+	switch m := msg.(type) {
+	case Hello:
+		return m, nil
+	case error:
+		return Hello{}, fmt.Errorf("malformed hello: %w", m)
+	}
+	return Hello{}, fmt.Errorf("%w: peer did not start with hello", ErrIncompatiblePeer)
+}
+
+// negotiate settles on the highest version both sides speak and the features both support.
+func (c *Conn) negotiate(remote Hello) error {
+	local := localHello()
+	version := min(local.Version, remote.Version)
+	if version < local.MinVersion || version < remote.MinVersion {
+		return fmt.Errorf(
+			"%w: peer speaks protocol %d-%d, we speak %d-%d",
+			ErrIncompatiblePeer, remote.MinVersion, remote.Version, local.MinVersion, local.Version,
+		)
+	}
+
+	c.version = version
+	c.features = nil
+	for _, feature := range local.Features {
+		if slices.Contains(remote.Features, feature) {
+			c.features = append(c.features, feature)
+		}
+	}
+	return nil
+}
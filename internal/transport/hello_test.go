@@ -0,0 +1,265 @@
+package transport
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/metalgrid/drift/internal/secret"
+)
+
+type handshakeResult struct {
+	conn *Conn
+	err  error
+}
+
+// runHandshake runs InitiateHandshake on one end of a TCP pair and AcceptHandshake on the other
+func runHandshake(t *testing.T) (initiator, responder handshakeResult) {
+	t.Helper()
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	accepted := make(chan handshakeResult, 1)
+	go func() {
+		conn, err := AcceptHandshake(serverConn)
+		accepted <- handshakeResult{conn, err}
+	}()
+
+	conn, err := InitiateHandshake(clientConn)
+	initiator = handshakeResult{conn, err}
+
+	select {
+	case responder = <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("AcceptHandshake did not return")
+	}
+	return initiator, responder
+}
+
+// TestHelloRoundTrip tests marshal → unmarshal of a HELLO frame
+func TestHelloRoundTrip(t *testing.T) {
+	original := Hello{
+		Message:    Message{"HELLO"},
+		Version:    3,
+		MinVersion: 1,
+		Features:   []Feature{"alpha", "beta"},
+	}
+	hello, ok := UnmarshalFrame(original.MarshalMessage()).(Hello)
+	if !ok {
+		t.Fatal("UnmarshalFrame() did not return a Hello")
+	}
+	if hello.Version != original.Version || hello.MinVersion != original.MinVersion {
+		t.Errorf("versions = %d-%d, want %d-%d", hello.MinVersion, hello.Version, original.MinVersion, original.Version)
+	}
+	if !slices.Equal(hello.Features, original.Features) {
+		t.Errorf("Features = %v, want %v", hello.Features, original.Features)
+	}
+}
+
+// TestHandshakeNegotiatesVersion tests that both sides agree on the protocol version
+func TestHandshakeNegotiatesVersion(t *testing.T) {
+	initiator, responder := runHandshake(t)
+	if initiator.err != nil {
+		t.Fatalf("InitiateHandshake() failed: %v", initiator.err)
+	}
+	if responder.err != nil {
+		t.Fatalf("AcceptHandshake() failed: %v", responder.err)
+	}
+	if initiator.conn.Version() != ProtocolVersion || responder.conn.Version() != ProtocolVersion {
+		t.Errorf("versions = %d and %d, want %d", initiator.conn.Version(), responder.conn.Version(), ProtocolVersion)
+	}
+}
+
+// TestNegotiateFeatureIntersection tests that only features announced by both sides are enabled
+func TestNegotiateFeatureIntersection(t *testing.T) {
+	original := supportedFeatures
+	supportedFeatures = []Feature{"alpha", "beta"}
+	t.Cleanup(func() { supportedFeatures = original })
+
+	c := &Conn{}
+	err := c.negotiate(Hello{Version: ProtocolVersion, MinVersion: MinProtocolVersion, Features: []Feature{"beta", "gamma"}})
+	if err != nil {
+		t.Fatalf("negotiate() failed: %v", err)
+	}
+	if c.Supports("alpha") || c.Supports("gamma") {
+		t.Error("feature announced by only one side was enabled")
+	}
+	if !c.Supports("beta") {
+		t.Error("feature announced by both sides was not enabled")
+	}
+}
+
+// TestNegotiateIncompatibleVersions tests that disjoint version ranges are rejected
+func TestNegotiateIncompatibleVersions(t *testing.T) {
+	tests := map[string]Hello{
+		"peer too old": {Version: MinProtocolVersion - 1, MinVersion: 0},
+		"peer too new": {Version: ProtocolVersion + 5, MinVersion: ProtocolVersion + 1},
+	}
+	for name, remote := range tests {
+		c := &Conn{}
+		if err := c.negotiate(remote); !errors.Is(err, ErrIncompatiblePeer) {
+			t.Errorf("%s: negotiate() = %v, want ErrIncompatiblePeer", name, err)
+		}
+	}
+}
+
+// TestAcceptHandshakeLegacyPeer tests that a peer speaking the line protocol is reported as incompatible and declined
+func TestAcceptHandshakeLegacyPeer(t *testing.T) {
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := AcceptHandshake(serverConn)
+		accepted <- err
+	}()
+
+	if _, err := clientConn.Write([]byte("OFFER|old.txt|application/octet-stream|3\n")); err != nil {
+		t.Fatalf("failed writing legacy offer: %v", err)
+	}
+
+	answer, err := bufio.NewReader(clientConn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed reading legacy answer: %v", err)
+	}
+	if a, ok := UnmarshalMessage(answer).(Answer); !ok || a.Accepted() {
+		t.Errorf("legacy peer got %q, want a decline", answer)
+	}
+
+	select {
+	case err := <-accepted:
+		if !errors.Is(err, ErrIncompatiblePeer) {
+			t.Errorf("AcceptHandshake() = %v, want ErrIncompatiblePeer", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("AcceptHandshake did not return")
+	}
+}
+
+// TestAcceptHandshakeLegacySecurePeer tests that a peer of protocol version 0.1 is declined over its own secure connection
+func TestAcceptHandshakeLegacySecurePeer(t *testing.T) {
+	local, err := secret.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := secret.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	accepted := make(chan error, 1)
+	go func() {
+		sc, err := secret.LegacySecureConnection(serverConn, legacy.PublicKey, local.PrivateKey)
+		if err == nil {
+			_, err = AcceptHandshake(sc)
+		}
+		accepted <- err
+	}()
+
+	cc, err := secret.LegacySecureConnection(clientConn, local.PublicKey, legacy.PrivateKey)
+	if err != nil {
+		t.Fatalf("LegacySecureConnection() failed: %v", err)
+	}
+	if _, err := cc.Write([]byte("OFFER|old.txt|application/octet-stream|3\n")); err != nil {
+		t.Fatalf("failed writing legacy offer: %v", err)
+	}
+	answer, err := bufio.NewReader(cc).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed reading legacy answer: %v", err)
+	}
+	if a, ok := UnmarshalMessage(answer).(Answer); !ok || a.Accepted() {
+		t.Errorf("legacy peer got %q, want a decline", answer)
+	}
+
+	select {
+	case err := <-accepted:
+		if !errors.Is(err, ErrIncompatiblePeer) {
+			t.Errorf("AcceptHandshake() = %v, want ErrIncompatiblePeer", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("AcceptHandshake did not return")
+	}
+}
+
+// TestInitiateHandshakeUnexpectedMessage tests that a peer answering with something other than HELLO is rejected
+func TestInitiateHandshakeUnexpectedMessage(t *testing.T) {
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	go func() {
+		_, _ = ReadMessage(bufio.NewReader(serverConn))
+		_, _ = serverConn.Write(Decline().MarshalMessage())
+	}()
+
+	if _, err := InitiateHandshake(clientConn); !errors.Is(err, ErrIncompatiblePeer) {
+		t.Errorf("InitiateHandshake() = %v, want ErrIncompatiblePeer", err)
+	}
+}
+
+// TestHandshakeKeepsBufferedMessages tests that a message sent right after HELLO is not lost
+func TestHandshakeKeepsBufferedMessages(t *testing.T) {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = client.Close()
+	})
+
+	go func() {
+		// Initiator's HELLO and its offer arrive back to back.
+		_, _ = client.Write(append(localHello().MarshalMessage(), Accept().MarshalMessage()...))
+		_, _ = io.Copy(io.Discard, client)
+	}()
+
+	conn, err := AcceptHandshake(server)
+	if err != nil {
+		t.Fatalf("AcceptHandshake() failed: %v", err)
+	}
+	msg, err := ReadMessage(conn.reader)
+	if err != nil {
+		t.Fatalf("ReadMessage() failed: %v", err)
+	}
+	if answer, ok := msg.(Answer); !ok || !answer.Accepted() {
+		t.Errorf("message after hello = %v, want accepting Answer", msg)
+	}
+}
+
+// TestCheckAdvertisedVersion tests interpretation of the mDNS v= record
+func TestCheckAdvertisedVersion(t *testing.T) {
+	tests := []struct {
+		record     string
+		compatible bool
+	}{
+		{"0.1", false},
+		{"", false},
+		{"garbage", false},
+		{"1", true},
+		{"7", true},
+	}
+	for _, tt := range tests {
+		err := CheckAdvertisedVersion(tt.record)
+		if tt.compatible && err != nil {
+			t.Errorf("CheckAdvertisedVersion(%q) = %v, want nil", tt.record, err)
+		}
+		if !tt.compatible && !errors.Is(err, ErrIncompatiblePeer) {
+			t.Errorf("CheckAdvertisedVersion(%q) = %v, want ErrIncompatiblePeer", tt.record, err)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package transport
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/metalgrid/drift/internal/audit"
+	"github.com/rs/zerolog/log"
+)
+
+// offerWindow is the period over which Limits.OffersPerMinute is counted.
+const offerWindow = time.Minute
+
+// ErrBusy is reported when the peer refused an offer because it is handling too many
+// already. Trying again later may succeed.
+var ErrBusy = errors.New("peer is busy")
+
+var (
+	errAddressBusy    = errors.New("too many connections from the address")
+	errHandshakesBusy = errors.New("too many handshakes in progress")
+)
+
+// Busy answers an offer or pairing request that exceeds the receiver's limits. Peers
+// that do not know it take it for a DECLINE.
+func Busy() Answer {
+	return Answer{
+		Message: Message{"ANSWER"},
+		Kind:    "BUSY",
+	}
+}
+
+// Limits bound what peers can ask of us. A zero limit is no limit.
+type Limits struct {
+	// ConnectionsPerAddress bounds the connections open at once from an IP address,
+	// counted from when they are accepted, before the peer proves its identity.
+	ConnectionsPerAddress int
+	// PendingHandshakes bounds the connections, from all addresses, that are accepted
+	// but whose peer has not completed the handshake yet.
+	PendingHandshakes int
+	// ConnectionsPerPeer bounds the connections a peer holds open at once.
+	ConnectionsPerPeer int
+	// OffersPerMinute bounds the offers and pairing requests a peer makes per minute.
+	OffersPerMinute int
+	// PendingPrompts bounds the questions waiting for the user's answer, from all peers.
+	PendingPrompts int
+}
+
+// Limiter enforces Limits on inbound connections. Until their handshake completes,
+// connections are told apart by their address only, and peers are told apart by the key
+// they authenticated with afterwards. A nil *Limiter allows everything.
+type Limiter struct {
+	limits Limits
+	now    func() time.Time
+
+	mu          sync.Mutex
+	addresses   map[netip.Addr]int
+	handshakes  int
+	connections map[string]int
+	offers      map[string][]time.Time
+	prompts     int
+}
+
+func NewLimiter(limits Limits) *Limiter {
+	return &Limiter{
+		limits:      limits,
+		now:         time.Now,
+		addresses:   make(map[netip.Addr]int),
+		connections: make(map[string]int),
+		offers:      make(map[string][]time.Time),
+	}
+}
+
+// Accept counts a connection from addr as soon as it is accepted, and reports an error
+// if the address holds as many connections as allowed already, or if as many handshakes
+// are in progress as allowed. Such a connection should be closed without a handshake.
+// Otherwise, handshaken must be called once the peer completed the handshake or failed
+// it, and release once the connection is closed.
+func (l *Limiter) Accept(addr net.Addr) (handshaken, release func(), err error) {
+	if l == nil {
+		return func() {}, func() {}, nil
+	}
+	source := addressOf(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limits.ConnectionsPerAddress > 0 && l.addresses[source] >= l.limits.ConnectionsPerAddress {
+		return nil, nil, errAddressBusy
+	}
+	if l.limits.PendingHandshakes > 0 && l.handshakes >= l.limits.PendingHandshakes {
+		return nil, nil, errHandshakesBusy
+	}
+	l.addresses[source]++
+	l.handshakes++
+
+	var handshakeOnce, releaseOnce sync.Once
+	handshaken = func() {
+		handshakeOnce.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.handshakes--
+		})
+	}
+	release = func() {
+		handshaken()
+		releaseOnce.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.addresses[source]--; l.addresses[source] <= 0 {
+				delete(l.addresses, source)
+			}
+		})
+	}
+	return handshaken, release, nil
+}
+
+// addressOf returns the IP address of addr, which is the zero address for other
+// kinds of addresses, so that they share one count.
+func addressOf(addr net.Addr) netip.Addr {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		ip, _ := netip.AddrFromSlice(tcp.IP)
+		return ip.Unmap()
+	}
+	return netip.Addr{}
+}
+
+// Connect counts a connection from the peer with the given key. It reports false if the
+// peer already holds as many connections as allowed; such a connection should only be
+// answered with BUSY, by RefuseBusy. Either way, release must be called once the
+// connection is closed.
+func (l *Limiter) Connect(key []byte) (release func(), ok bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	source := hex.EncodeToString(key)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limits.ConnectionsPerPeer > 0 && l.connections[source] >= l.limits.ConnectionsPerPeer {
+		return func() {}, false
+	}
+	l.connections[source]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.connections[source]--; l.connections[source] <= 0 {
+				delete(l.connections, source)
+			}
+		})
+	}, true
+}
+
+// allowOffer counts an offer from the peer with the given key, and reports whether it
+// is within the peer's offers per minute. Refused offers count too, so that a peer has
+// to stop for a while before it is heard again.
+func (l *Limiter) allowOffer(key []byte) bool {
+	if l == nil || l.limits.OffersPerMinute <= 0 {
+		return true
+	}
+	source := hex.EncodeToString(key)
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	recent := l.offers[source][:0]
+	for _, t := range l.offers[source] {
+		if now.Sub(t) < offerWindow {
+			recent = append(recent, t)
+		}
+	}
+	l.offers[source] = append(recent, now)
+	l.pruneOffers(now)
+	return len(recent) < l.limits.OffersPerMinute
+}
+
+// pruneOffers forgets the peers that made no offer within the window.
+func (l *Limiter) pruneOffers(now time.Time) {
+	for source, times := range l.offers {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) >= offerWindow {
+			delete(l.offers, source)
+		}
+	}
+}
+
+// reservePrompt takes one of the pending prompts, and reports false if none is left.
+// The prompt is given back by calling release once the user answered.
+func (l *Limiter) reservePrompt() (release func(), ok bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limits.PendingPrompts > 0 && l.prompts >= l.limits.PendingPrompts {
+		return func() {}, false
+	}
+	l.prompts++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.prompts--
+		})
+	}, true
+}
+
+// SetLimiter applies the limits of l to what the peer offers on the connection.
+func (c *Conn) SetLimiter(l *Limiter) {
+	c.limiter = l
+}
+
+// RefuseBusy serves a connection over the peer's limits: it answers the peer's first
+// offer or pairing request with BUSY, and closes the connection.
+func RefuseBusy(conn *Conn) {
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	msg, err := ReadMessage(conn.reader)
+	if err != nil {
+		return
+	}
+	switch msg.(type) {
+	case Offer, BatchOffer, Pair:
+		_, _ = conn.Write(Busy().MarshalMessage())
+	}
+}
+
+// refuseBusy answers an offer with BUSY. The refusal is only logged, since notifying
+// the user about every one would be the flood the limits are there to prevent.
+func refuseBusy(c *Conn, what, reason string) {
+	_, _ = c.Write(Busy().MarshalMessage())
+	peer := c.Peer()
+	log.Warn().Str("peer", peer.Name).Hex("key", peer.Key).Str("offer", what).Msg("refused offer: " + reason)
+	recordPeer(audit.Refused, peer, "busy", what+": "+reason)
+}
@@ -0,0 +1,224 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/metalgrid/drift/internal/platform"
+)
+
+// TestLimiterConnect tests that a peer holds at most the allowed connections at once
+func TestLimiterConnect(t *testing.T) {
+	l := NewLimiter(Limits{ConnectionsPerPeer: 2})
+	first, ok := l.Connect([]byte("alice"))
+	if !ok {
+		t.Fatal("first connection refused")
+	}
+	if _, ok := l.Connect([]byte("alice")); !ok {
+		t.Fatal("second connection refused")
+	}
+	if _, ok := l.Connect([]byte("alice")); ok {
+		t.Fatal("third connection allowed")
+	}
+	if _, ok := l.Connect([]byte("bob")); !ok {
+		t.Fatal("connection from another peer refused")
+	}
+
+	first()
+	first()
+	if _, ok := l.Connect([]byte("alice")); !ok {
+		t.Fatal("connection refused after one was released")
+	}
+	if _, ok := l.Connect([]byte("alice")); ok {
+		t.Fatal("releasing twice freed two connections")
+	}
+}
+
+// TestLimiterAccept tests that connections are bounded per address, and handshakes in progress overall
+func TestLimiterAccept(t *testing.T) {
+	alice := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 40000}
+	aliceAgain := &net.TCPAddr{IP: net.ParseIP("::ffff:192.168.1.10"), Port: 40001}
+	bob := &net.TCPAddr{IP: net.ParseIP("192.168.1.11"), Port: 40000}
+	carol := &net.TCPAddr{IP: net.ParseIP("192.168.1.12"), Port: 40000}
+	l := NewLimiter(Limits{ConnectionsPerAddress: 2, PendingHandshakes: 3})
+
+	handshaken, release, err := l.Accept(alice)
+	if err != nil {
+		t.Fatalf("first connection refused: %v", err)
+	}
+	if _, _, err := l.Accept(aliceAgain); err != nil {
+		t.Fatalf("second connection refused: %v", err)
+	}
+	if _, _, err := l.Accept(alice); !errors.Is(err, errAddressBusy) {
+		t.Fatalf("third connection from the address = %v, want errAddressBusy", err)
+	}
+	if _, _, err := l.Accept(bob); err != nil {
+		t.Fatalf("connection from another address refused: %v", err)
+	}
+	if _, _, err := l.Accept(carol); !errors.Is(err, errHandshakesBusy) {
+		t.Fatalf("fourth handshake = %v, want errHandshakesBusy", err)
+	}
+
+	handshaken()
+	handshaken()
+	if _, _, err := l.Accept(carol); err != nil {
+		t.Fatalf("connection refused after a handshake completed: %v", err)
+	}
+	if _, _, err := l.Accept(alice); !errors.Is(err, errAddressBusy) {
+		t.Fatalf("connection from the address = %v before one was closed, want errAddressBusy", err)
+	}
+	release()
+	release()
+	if n := l.addresses[addressOf(alice)]; n != 1 {
+		t.Errorf("address holds %d connections after one was released twice, want 1", n)
+	}
+	if l.handshakes != 3 {
+		t.Errorf("%d handshakes in progress, want closing a connection after its handshake to leave 3", l.handshakes)
+	}
+}
+
+// TestLimiterOffersPerMinute tests that offers beyond the limit are refused until the minute is over
+func TestLimiterOffersPerMinute(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(Limits{OffersPerMinute: 2})
+	l.now = func() time.Time { return now }
+
+	for i, want := range []bool{true, true, false} {
+		if got := l.allowOffer([]byte("alice")); got != want {
+			t.Errorf("offer %d allowed = %v, want %v", i, got, want)
+		}
+	}
+	if !l.allowOffer([]byte("bob")) {
+		t.Error("offer from another peer refused")
+	}
+
+	now = now.Add(offerWindow)
+	if !l.allowOffer([]byte("alice")) {
+		t.Error("offer refused after a minute")
+	}
+	if len(l.offers) != 1 {
+		t.Errorf("limiter remembers %d peers, want 1", len(l.offers))
+	}
+}
+
+// TestLimiterPendingPrompts tests that prompts beyond the limit are refused until one is answered
+func TestLimiterPendingPrompts(t *testing.T) {
+	l := NewLimiter(Limits{PendingPrompts: 1})
+	release, ok := l.reservePrompt()
+	if !ok {
+		t.Fatal("first prompt refused")
+	}
+	if _, ok := l.reservePrompt(); ok {
+		t.Fatal("second prompt allowed")
+	}
+	release()
+	if _, ok := l.reservePrompt(); !ok {
+		t.Fatal("prompt refused after the first was answered")
+	}
+}
+
+// TestNilLimiter tests that a nil limiter and zero limits allow everything
+func TestNilLimiter(t *testing.T) {
+	for _, l := range []*Limiter{nil, NewLimiter(Limits{})} {
+		for range 100 {
+			if _, _, err := l.Accept(&net.TCPAddr{IP: net.IPv4(192, 168, 1, 10)}); err != nil {
+				t.Fatalf("connection refused before its handshake: %v", err)
+			}
+			if _, ok := l.Connect([]byte("alice")); !ok {
+				t.Fatal("connection refused")
+			}
+			if !l.allowOffer([]byte("alice")) {
+				t.Fatal("offer refused")
+			}
+			if _, ok := l.reservePrompt(); !ok {
+				t.Fatal("prompt refused")
+			}
+		}
+	}
+}
+
+// TestHandleConnectionAnswersBusy tests that offers over the limits are answered BUSY without asking
+func TestHandleConnectionAnswersBusy(t *testing.T) {
+	peer := platform.Peer{Name: "alice", Key: []byte("alice")}
+
+	l := NewLimiter(Limits{OffersPerMinute: 1})
+	gw := &askingGateway{questions: make(chan string, 2)}
+	if answer := answerTo(t, peer, l, gw, 10); answer.Kind != "DECLINE" {
+		t.Errorf("first answer = %s, want DECLINE", answer.Kind)
+	}
+	if answer := answerTo(t, peer, l, gw, 10); answer.Kind != "BUSY" {
+		t.Errorf("second answer = %s, want BUSY", answer.Kind)
+	}
+	if len(gw.questions) != 1 {
+		t.Errorf("the user was asked %d times, want once", len(gw.questions))
+	}
+
+	l = NewLimiter(Limits{PendingPrompts: 1})
+	release, _ := l.reservePrompt()
+	defer release()
+	gw = &askingGateway{questions: make(chan string, 1)}
+	if answer := answerTo(t, peer, l, gw, 10); answer.Kind != "BUSY" {
+		t.Errorf("answer with no prompt left = %s, want BUSY", answer.Kind)
+	}
+	if len(gw.questions) != 0 {
+		t.Errorf("the user was asked %q", <-gw.questions)
+	}
+}
+
+// TestRefuseBusy tests that a connection over the limits answers its first offer BUSY and closes
+func TestRefuseBusy(t *testing.T) {
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+	go RefuseBusy(withFeatures(serverConn))
+
+	offer := Offer{Message: Message{"OFFER"}, Filename: "notes.txt", Mimetype: mimeType, Size: 10}
+	if _, err := clientConn.Write(offer.MarshalMessage()); err != nil {
+		t.Fatalf("failed writing offer: %v", err)
+	}
+	reader := bufio.NewReader(clientConn)
+	msg, err := ReadMessage(reader)
+	if err != nil {
+		t.Fatalf("failed reading answer: %v", err)
+	}
+	if answer, ok := msg.(Answer); !ok || answer.Kind != "BUSY" {
+		t.Fatalf("answer = %v, want BUSY", msg)
+	}
+	if _, err := ReadMessage(reader); err == nil {
+		t.Error("connection still open after the BUSY answer")
+	}
+}
+
+// TestOutboundWaitReportsBusy tests that a BUSY answer ends the offer with ErrBusy
+func TestOutboundWaitReportsBusy(t *testing.T) {
+	gw := &mockGateway{}
+	state := NewOutboundTransferState()
+	state.SetPendingFiles([]string{"/tmp/busy.txt"})
+
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	go HandleConnection(context.Background(), serverConn, gw, nil, state)
+
+	if _, err := clientConn.Write(Busy().MarshalMessage()); err != nil {
+		t.Fatalf("failed writing busy answer: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := state.Wait(ctx); !errors.Is(err, ErrBusy) {
+		t.Errorf("Wait() = %v, want ErrBusy", err)
+	}
+	if _, ok := state.ConsumePendingFiles(); ok {
+		t.Error("pending files kept after BUSY")
+	}
+}
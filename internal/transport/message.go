@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"encoding/binary"
 	"fmt"
 	"os"
 	"strconv"
@@ -22,44 +23,95 @@ type Offer struct {
 	Filename string
 	Mimetype string
 	Size     int64
+	// TransferID is set when both sides support resuming.
+	TransferID string
+	// Signature signs the offered file and the transfer ID with the sender's identity
+	// key, if the sender signs its offers.
+	Signature []byte
 }
 
 type FileEntry struct {
+	// Filename is a slash-separated path relative to the download directory.
 	Filename string
 	Mimetype string
 	Size     int64
+	// Directory marks an entry that only creates a directory and carries no data.
+	Directory bool
 }
 
 type BatchOffer struct {
 	Message
 	Files []FileEntry
+	// TransferID is set when both sides support resuming.
+	TransferID string
+	// Signature signs the offered files and the transfer ID with the sender's identity
+	// key, if the sender signs its offers.
+	Signature []byte
+}
+
+// Field tags used in frame payloads. The namespace is shared by all frame types.
+const (
+	fieldFilename   byte = 1
+	fieldMimetype   byte = 2
+	fieldSize       byte = 3
+	fieldFile       byte = 4
+	fieldKind       byte = 5
+	fieldVersion    byte = 6
+	fieldMinVersion byte = 7
+	fieldFeature    byte = 8
+	fieldTransferID byte = 9
+	fieldOffset     byte = 10
+	fieldDigest     byte = 11
+	fieldDirectory  byte = 12
+	fieldSelected   byte = 13
+	fieldSignature  byte = 14
+)
+
+func (f FileEntry) marshalFields() []byte {
+	var w fieldWriter
+	w.string(fieldFilename, f.Filename)
+	w.string(fieldMimetype, f.Mimetype)
+	w.uint(fieldSize, uint64(f.Size))
+	if f.Directory {
+		w.uint(fieldDirectory, 1)
+	}
+	return w.buf
 }
 
 func (o Offer) MarshalMessage() []byte {
-	return []byte(
-		strings.Join(
-			[]string{
-				o.Type,
-				o.Filename,
-				o.Mimetype,
-				strconv.FormatInt(o.Size, 10),
-			},
-			fieldSeparator,
-		) + string(endOfMessage),
-	)
+	w := fieldWriter{buf: FileEntry{Filename: o.Filename, Mimetype: o.Mimetype, Size: o.Size}.marshalFields()}
+	if o.TransferID != "" {
+		w.string(fieldTransferID, o.TransferID)
+	}
+	if len(o.Signature) > 0 {
+		w.bytes(fieldSignature, o.Signature)
+	}
+	return w.frame(frameOffer)
 }
 
 func (b BatchOffer) MarshalMessage() []byte {
-	parts := []string{b.Type, strconv.Itoa(len(b.Files))}
+	var w fieldWriter
 	for _, file := range b.Files {
-		parts = append(parts, file.Filename, file.Mimetype, strconv.FormatInt(file.Size, 10))
+		w.bytes(fieldFile, file.marshalFields())
+	}
+	if b.TransferID != "" {
+		w.string(fieldTransferID, b.TransferID)
 	}
-	return []byte(strings.Join(parts, fieldSeparator) + string(endOfMessage))
+	if len(b.Signature) > 0 {
+		w.bytes(fieldSignature, b.Signature)
+	}
+	return w.frame(frameBatchOffer)
 }
 
 type Answer struct {
 	Message
 	Kind string
+	// Offsets holds, for each offered file, how many bytes the receiver already has
+	// when it resumes a transfer. It is empty for a transfer that starts from scratch.
+	Offsets []int64
+	// Selected lists, in ascending order, the indices of the files the receiver wants
+	// when it accepted only part of a batch. It is empty when all files were accepted.
+	Selected []int
 }
 
 func (a Answer) Accepted() bool {
@@ -67,17 +119,177 @@ func (a Answer) Accepted() bool {
 }
 
 func (a Answer) MarshalMessage() []byte {
-	return []byte(
-		strings.Join(
-			[]string{
-				a.Type,
-				a.Kind,
-			},
-			fieldSeparator,
-		) + string(endOfMessage),
-	)
+	var w fieldWriter
+	w.string(fieldKind, a.Kind)
+	for _, offset := range a.Offsets {
+		w.uint(fieldOffset, uint64(offset))
+	}
+	for _, index := range a.Selected {
+		w.uint(fieldSelected, uint64(index))
+	}
+	return w.frame(frameAnswer)
+}
+
+func unmarshalFileEntry(payload []byte) (FileEntry, error) {
+	var entry FileEntry
+	var hasSize bool
+	err := parseFields(payload, func(tag byte, value []byte) error {
+		var err error
+		switch tag {
+		case fieldFilename:
+			entry.Filename = string(value)
+		case fieldMimetype:
+			entry.Mimetype = string(value)
+		case fieldSize:
+			entry.Size, err = parseSize(tag, value)
+			hasSize = true
+		case fieldDirectory:
+			var v uint64
+			v, err = parseUint(tag, value)
+			entry.Directory = v != 0
+		}
+		return err
+	})
+	if err != nil {
+		return FileEntry{}, err
+	}
+	if entry.Filename == "" {
+		return FileEntry{}, fmt.Errorf("file entry is missing a filename")
+	}
+	if !hasSize {
+		return FileEntry{}, fmt.Errorf("file entry %q is missing a size", entry.Filename)
+	}
+	if entry.Directory && entry.Size != 0 {
+		return FileEntry{}, fmt.Errorf("directory entry %q has a size", entry.Filename)
+	}
+	return entry, nil
 }
 
+// UnmarshalFrame decodes a single frame produced by MarshalMessage.
+// It returns the decoded message, an error for malformed frames,
+// or nil for frame types it does not know about.
+func UnmarshalFrame(frame []byte) any {
+	if len(frame) < frameHeaderSize {
+		return fmt.Errorf("frame too short: %d bytes", len(frame))
+	}
+	if frame[0] != frameVersion {
+		return fmt.Errorf("unsupported frame version %d", frame[0])
+	}
+	payload := frame[frameHeaderSize:]
+	if length := binary.BigEndian.Uint32(frame[2:]); int64(length) != int64(len(payload)) {
+		return fmt.Errorf("frame length mismatch: header says %d bytes, got %d", length, len(payload))
+	}
+
+	switch frame[1] {
+	case frameOffer:
+		entry, err := unmarshalFileEntry(payload)
+		if err != nil {
+			return err
+		}
+		offer := Offer{
+			Message:  Message{"OFFER"},
+			Filename: entry.Filename,
+			Mimetype: entry.Mimetype,
+			Size:     entry.Size,
+		}
+		_ = parseFields(payload, func(tag byte, value []byte) error {
+			switch tag {
+			case fieldTransferID:
+				offer.TransferID = string(value)
+			case fieldSignature:
+				offer.Signature = append([]byte(nil), value...)
+			}
+			return nil
+		})
+		return offer
+
+	case frameBatchOffer:
+		var files []FileEntry
+		var transferID string
+		var signature []byte
+		err := parseFields(payload, func(tag byte, value []byte) error {
+			switch tag {
+			case fieldTransferID:
+				transferID = string(value)
+			case fieldSignature:
+				signature = append([]byte(nil), value...)
+			case fieldFile:
+				entry, err := unmarshalFileEntry(value)
+				if err != nil {
+					return err
+				}
+				files = append(files, entry)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("batch count must be positive")
+		}
+		return BatchOffer{
+			Message:    Message{"BATCH_OFFER"},
+			Files:      files,
+			TransferID: transferID,
+			Signature:  signature,
+		}
+
+	case frameAnswer:
+		answer := Answer{Message: Message{"ANSWER"}}
+		err := parseFields(payload, func(tag byte, value []byte) error {
+			switch tag {
+			case fieldKind:
+				answer.Kind = string(value)
+			case fieldOffset:
+				offset, err := parseSize(tag, value)
+				if err != nil {
+					return err
+				}
+				answer.Offsets = append(answer.Offsets, offset)
+			case fieldSelected:
+				index, err := parseSize(tag, value)
+				if err != nil {
+					return err
+				}
+				answer.Selected = append(answer.Selected, int(index))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if answer.Kind == "" {
+			return fmt.Errorf("answer is missing its kind")
+		}
+		return answer
+
+	case frameHello:
+		return unmarshalHello(payload)
+	case frameTrailer:
+		return unmarshalTrailer(payload)
+	case frameData:
+		return Data{Message: Message{"DATA"}, Payload: payload}
+	case frameCancel:
+		return Cancel{Message: Message{"CANCEL"}}
+	case framePair:
+		return Pair{Message: Message{"PAIR"}}
+	}
+	return nil
+}
+
+// parseLegacySize reads a file size of the line format, which must not be negative.
+func parseLegacySize(s string) (int64, error) {
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err == nil && size < 0 {
+		err = fmt.Errorf("negative size %d", size)
+	}
+	return size, err
+}
+
+// UnmarshalMessage decodes a message in the pipe-delimited line format used
+// before frames were introduced. Connections carry frames only once HELLO is
+// negotiated, so it only serves to recognise what older peers say.
 func UnmarshalMessage(msg string) any {
 	var err error
 	msg, _ = strings.CutSuffix(msg, string(endOfMessage))
@@ -104,7 +316,7 @@ func UnmarshalMessage(msg string) any {
 		files := make([]FileEntry, count)
 		for i := 0; i < count; i++ {
 			idx := 2 + (i * 3)
-			size, parseErr := strconv.ParseInt(parts[idx+2], 10, 64)
+			size, parseErr := parseLegacySize(parts[idx+2])
 			if parseErr != nil {
 				err = parseErr
 				break
@@ -119,8 +331,8 @@ func UnmarshalMessage(msg string) any {
 			break
 		}
 		return BatchOffer{
-			Message{parts[0]},
-			files,
+			Message: Message{parts[0]},
+			Files:   files,
 		}
 
 	case strings.HasPrefix(msg, "OFFER"):
@@ -129,15 +341,15 @@ func UnmarshalMessage(msg string) any {
 			break
 		}
 		var size int64
-		size, err = strconv.ParseInt(parts[3], 10, 64)
+		size, err = parseLegacySize(parts[3])
 		if err != nil {
 			break
 		}
 		return Offer{
-			Message{parts[0]},
-			parts[1],
-			parts[2],
-			size,
+			Message:  Message{parts[0]},
+			Filename: parts[1],
+			Mimetype: parts[2],
+			Size:     size,
 		}
 
 	case strings.HasPrefix(msg, "ANSWER"):
@@ -146,8 +358,8 @@ func UnmarshalMessage(msg string) any {
 			break
 		}
 		return Answer{
-			Message{parts[0]},
-			parts[1],
+			Message: Message{parts[0]},
+			Kind:    parts[1],
 		}
 	}
 	return err
@@ -160,48 +372,48 @@ func MakeOffer(filename string) (Offer, error) {
 	}
 
 	return Offer{
-		Message{"OFFER"},
-		fileInfo.Name(),
-		mimeType,
-		fileInfo.Size(),
+		Message:  Message{"OFFER"},
+		Filename: fileInfo.Name(),
+		Mimetype: mimeType,
+		Size:     fileInfo.Size(),
 	}, nil
 }
 
+// MakeBatchOffer offers the given files, and the full tree of any directory among them.
 func MakeBatchOffer(filenames []string) (BatchOffer, error) {
+	batch, _, err := makeBatchOffer(filenames)
+	return batch, err
+}
+
+// makeBatchOffer is MakeBatchOffer that also returns the local path to send for each
+// entry, or an empty string for directory entries.
+func makeBatchOffer(filenames []string) (BatchOffer, []string, error) {
 	if len(filenames) == 0 {
-		return BatchOffer{}, fmt.Errorf("batch offer requires at least one file")
+		return BatchOffer{}, nil, fmt.Errorf("batch offer requires at least one file")
 	}
 
-	files := make([]FileEntry, 0, len(filenames))
-	for _, filename := range filenames {
-		fileInfo, err := os.Stat(filename)
-		if err != nil {
-			return BatchOffer{}, fmt.Errorf("failed offering file %s: %w", filename, err)
-		}
-		files = append(files, FileEntry{
-			Filename: fileInfo.Name(),
-			Mimetype: mimeType,
-			Size:     fileInfo.Size(),
-		})
+	files, sources, err := expandEntries(filenames)
+	if err != nil {
+		return BatchOffer{}, nil, err
 	}
 
 	return BatchOffer{
-		Message{"BATCH_OFFER"},
-		files,
-	}, nil
+		Message: Message{"BATCH_OFFER"},
+		Files:   files,
+	}, sources, nil
 }
 
 func Accept() Answer {
 	return Answer{
-		Message{"ANSWER"},
-		"ACCEPT",
+		Message: Message{"ANSWER"},
+		Kind:    "ACCEPT",
 	}
 }
 
 func Decline() Answer {
 	return Answer{
-		Message{"ANSWER"},
-		"DECLINE",
+		Message: Message{"ANSWER"},
+		Kind:    "DECLINE",
 	}
 }
 
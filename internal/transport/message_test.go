@@ -1,40 +1,63 @@
 package transport
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
+var update = flag.Bool("update", false, "update golden files")
+
+// checkGolden compares a marshaled frame with the hex dump stored in testdata/<name>.golden
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	dump := hex.Dump(got)
+	if *update {
+		if err := os.WriteFile(path, []byte(dump), 0644); err != nil {
+			t.Fatalf("failed updating golden file: %v", err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed reading golden file: %v", err)
+	}
+	if dump != string(want) {
+		t.Errorf("%s frame mismatch\ngot:\n%swant:\n%s", name, dump, want)
+	}
+}
+
 // TestOfferMarshalMessage tests that Offer.MarshalMessage() produces correct wire format
 func TestOfferMarshalMessage(t *testing.T) {
 	offer := Offer{
-		Message{"OFFER"},
-		"test.txt",
-		"application/octet-stream",
-		1024,
-	}
-	expected := []byte("OFFER|test.txt|application/octet-stream|1024\n")
-	result := offer.MarshalMessage()
-	if !bytes.Equal(result, expected) {
-		t.Errorf("MarshalMessage() = %q, want %q", result, expected)
+		Message:  Message{"OFFER"},
+		Filename: "test.txt",
+		Mimetype: "application/octet-stream",
+		Size:     1024,
 	}
+	checkGolden(t, "offer", offer.MarshalMessage())
 }
 
 // TestOfferMarshalRoundTrip tests marshal → unmarshal → type assert → compare
 func TestOfferMarshalRoundTrip(t *testing.T) {
 	original := Offer{
-		Message{"OFFER"},
-		"document.pdf",
-		"application/pdf",
-		2048,
+		Message:  Message{"OFFER"},
+		Filename: "document.pdf",
+		Mimetype: "application/pdf",
+		Size:     2048,
 	}
 	marshaled := original.MarshalMessage()
-	unmarshaled := UnmarshalMessage(string(marshaled))
+	unmarshaled := UnmarshalFrame(marshaled)
 
 	offer, ok := unmarshaled.(Offer)
 	if !ok {
-		t.Fatalf("UnmarshalMessage() returned %T, want Offer", unmarshaled)
+		t.Fatalf("UnmarshalFrame() returned %T, want Offer", unmarshaled)
 	}
 
 	if offer.Type != original.Type {
@@ -53,22 +76,12 @@ func TestOfferMarshalRoundTrip(t *testing.T) {
 
 // TestAnswerMarshalAccept tests Accept().MarshalMessage() produces correct format
 func TestAnswerMarshalAccept(t *testing.T) {
-	answer := Accept()
-	expected := []byte("ANSWER|ACCEPT\n")
-	result := answer.MarshalMessage()
-	if !bytes.Equal(result, expected) {
-		t.Errorf("Accept().MarshalMessage() = %q, want %q", result, expected)
-	}
+	checkGolden(t, "answer_accept", Accept().MarshalMessage())
 }
 
 // TestAnswerMarshalDecline tests Decline().MarshalMessage() produces correct format
 func TestAnswerMarshalDecline(t *testing.T) {
-	answer := Decline()
-	expected := []byte("ANSWER|DECLINE\n")
-	result := answer.MarshalMessage()
-	if !bytes.Equal(result, expected) {
-		t.Errorf("Decline().MarshalMessage() = %q, want %q", result, expected)
-	}
+	checkGolden(t, "answer_decline", Decline().MarshalMessage())
 }
 
 // TestAnswerAccepted tests Accepted() returns true for ACCEPT, false for DECLINE
@@ -109,6 +122,18 @@ func TestUnmarshalMalformedOfferBadSize(t *testing.T) {
 	}
 }
 
+// TestUnmarshalNegativeSize tests that offers of negative sizes are malformed
+func TestUnmarshalNegativeSize(t *testing.T) {
+	for _, msg := range []string{
+		"OFFER|file|mime|-1\n",
+		"BATCH_OFFER|2|a.txt|text/plain|10|b.txt|text/plain|-9223372036854775808\n",
+	} {
+		if result, ok := UnmarshalMessage(msg).(error); !ok {
+			t.Errorf("UnmarshalMessage(%q) returned %v, want error", msg, result)
+		}
+	}
+}
+
 // TestMakeOffer tests creating an offer from an actual file
 func TestMakeOffer(t *testing.T) {
 	tmpDir := t.TempDir()
@@ -185,11 +210,7 @@ func TestBatchOfferMarshal(t *testing.T) {
 			{Filename: "file2.pdf", Mimetype: "application/octet-stream", Size: 2048},
 		},
 	}
-	expected := []byte("BATCH_OFFER|2|file1.txt|application/octet-stream|1024|file2.pdf|application/octet-stream|2048\n")
-	result := batch.MarshalMessage()
-	if !bytes.Equal(result, expected) {
-		t.Errorf("MarshalMessage() = %q, want %q", result, expected)
-	}
+	checkGolden(t, "batch_offer", batch.MarshalMessage())
 }
 
 // TestBatchOfferUnmarshalRoundTrip tests marshal → unmarshal → type assert → compare
@@ -203,11 +224,11 @@ func TestBatchOfferUnmarshalRoundTrip(t *testing.T) {
 		},
 	}
 	marshaled := original.MarshalMessage()
-	unmarshaled := UnmarshalMessage(string(marshaled))
+	unmarshaled := UnmarshalFrame(marshaled)
 
 	batch, ok := unmarshaled.(BatchOffer)
 	if !ok {
-		t.Fatalf("UnmarshalMessage() returned %T, want BatchOffer", unmarshaled)
+		t.Fatalf("UnmarshalFrame() returned %T, want BatchOffer", unmarshaled)
 	}
 
 	if batch.Type != original.Type {
@@ -237,11 +258,7 @@ func TestBatchOfferSingleFile(t *testing.T) {
 			{Filename: "single.txt", Mimetype: "application/octet-stream", Size: 100},
 		},
 	}
-	expected := []byte("BATCH_OFFER|1|single.txt|application/octet-stream|100\n")
-	result := batch.MarshalMessage()
-	if !bytes.Equal(result, expected) {
-		t.Errorf("MarshalMessage() = %q, want %q", result, expected)
-	}
+	checkGolden(t, "batch_offer_single", batch.MarshalMessage())
 }
 
 // TestBatchOfferInvalidCount tests that BATCH_OFFER with mismatched count returns error
@@ -277,3 +294,121 @@ func TestExistingOfferStillWorks(t *testing.T) {
 		t.Errorf("Size = %d, want %d", offer.Size, 1024)
 	}
 }
+
+// TestOfferRoundTripSeparatorsInFilename tests that pipes and newlines in filenames survive framing
+func TestOfferRoundTripSeparatorsInFilename(t *testing.T) {
+	original := Offer{
+		Message:   Message{"OFFER"},
+		Filename:  "quarterly|report\nfinal.txt",
+		Mimetype:  "application/octet-stream",
+		Size:      4096,
+		Signature: []byte{1, 2, 3},
+	}
+	offer, ok := UnmarshalFrame(original.MarshalMessage()).(Offer)
+	if !ok {
+		t.Fatal("UnmarshalFrame() did not return an Offer")
+	}
+	if !reflect.DeepEqual(offer, original) {
+		t.Errorf("round trip = %+v, want %+v", offer, original)
+	}
+}
+
+// TestBatchOfferRoundTripSeparatorsInFilename tests that pipes and newlines in batch filenames survive framing
+func TestBatchOfferRoundTripSeparatorsInFilename(t *testing.T) {
+	original := BatchOffer{
+		Message: Message{"BATCH_OFFER"},
+		Files: []FileEntry{
+			{Filename: "a|b.txt", Mimetype: "application/octet-stream", Size: 1},
+			{Filename: "c\nd.txt", Mimetype: "application/octet-stream", Size: 2},
+		},
+	}
+	batch, ok := UnmarshalFrame(original.MarshalMessage()).(BatchOffer)
+	if !ok {
+		t.Fatal("UnmarshalFrame() did not return a BatchOffer")
+	}
+	for i := range original.Files {
+		if batch.Files[i] != original.Files[i] {
+			t.Errorf("Files[%d] = %+v, want %+v", i, batch.Files[i], original.Files[i])
+		}
+	}
+}
+
+// TestUnmarshalFrameSkipsUnknownFields tests that fields with unknown tags are ignored
+func TestUnmarshalFrameSkipsUnknownFields(t *testing.T) {
+	var w fieldWriter
+	w.string(200, "from the future")
+	w.string(fieldKind, "ACCEPT")
+	answer, ok := UnmarshalFrame(w.frame(frameAnswer)).(Answer)
+	if !ok {
+		t.Fatal("UnmarshalFrame() did not return an Answer")
+	}
+	if !answer.Accepted() {
+		t.Errorf("Kind = %q, want ACCEPT", answer.Kind)
+	}
+}
+
+// TestUnmarshalFrameUnknownType tests that unknown frame types return nil
+func TestUnmarshalFrameUnknownType(t *testing.T) {
+	var w fieldWriter
+	if result := UnmarshalFrame(w.frame(250)); result != nil {
+		t.Errorf("UnmarshalFrame() with unknown type returned %v, want nil", result)
+	}
+}
+
+// TestUnmarshalFrameMalformed tests that malformed frames are reported as errors
+func TestUnmarshalFrameMalformed(t *testing.T) {
+	valid := Accept().MarshalMessage()
+
+	badVersion := append([]byte(nil), valid...)
+	badVersion[0] = 9
+
+	overrun := append([]byte(nil), valid...)
+	overrun[frameHeaderSize+1] = 100 // field length past end of payload
+
+	var missingSize fieldWriter
+	missingSize.string(fieldFilename, "nosize.txt")
+
+	var emptyBatch fieldWriter
+
+	tests := map[string][]byte{
+		"short":        valid[:3],
+		"bad version":  badVersion,
+		"truncated":    valid[:len(valid)-1],
+		"overrun":      overrun,
+		"missing size": missingSize.frame(frameOffer),
+		"empty batch":  emptyBatch.frame(frameBatchOffer),
+	}
+	for name, frame := range tests {
+		if _, ok := UnmarshalFrame(frame).(error); !ok {
+			t.Errorf("%s: UnmarshalFrame() did not return an error", name)
+		}
+	}
+}
+
+// TestReadMessageRejectsLegacyLines tests that lines of the pipe-delimited protocol are not read as messages
+func TestReadMessageRejectsLegacyLines(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(Accept().MarshalMessage())
+	stream.WriteString("OFFER|legacy.txt|application/octet-stream|-12\n")
+	reader := bufio.NewReader(&stream)
+
+	first, err := ReadMessage(reader)
+	if err != nil {
+		t.Fatalf("ReadMessage() failed: %v", err)
+	}
+	if answer, ok := first.(Answer); !ok || !answer.Accepted() {
+		t.Errorf("first message = %v, want accepting Answer", first)
+	}
+	if msg, err := ReadMessage(reader); !errors.Is(err, errNotFrame) {
+		t.Errorf("ReadMessage() of a legacy line = %v, %v; want errNotFrame", msg, err)
+	}
+}
+
+// TestReadMessageOversizedFrame tests that frames above the payload limit are rejected before allocation
+func TestReadMessageOversizedFrame(t *testing.T) {
+	header := []byte{frameVersion, frameOffer, 0xff, 0xff, 0xff, 0xff}
+	_, err := ReadMessage(bufio.NewReader(bytes.NewReader(header)))
+	if err == nil {
+		t.Error("ReadMessage() with oversized frame returned nil error")
+	}
+}
@@ -0,0 +1,85 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/metalgrid/drift/internal/audit"
+	"github.com/metalgrid/drift/internal/platform"
+)
+
+// FeaturePairing lets a peer ask the other side's user to verify its key by comparing
+// short authentication strings.
+const FeaturePairing Feature = "pairing"
+
+// pairingTimeout bounds how long the initiator waits for the peer's user to answer.
+const pairingTimeout = 2 * time.Minute
+
+// ErrPairingUnsupported is reported when the peer cannot verify keys with its user.
+var ErrPairingUnsupported = errors.New("peer does not support pairing")
+
+// Pair asks the peer's user to compare the short authentication string of the
+// connection. The peer answers with ACCEPT if its user confirmed that it matches,
+// and DECLINE otherwise.
+type Pair struct {
+	Message
+}
+
+func (Pair) MarshalMessage() []byte {
+	var w fieldWriter
+	return w.frame(framePair)
+}
+
+// RequestPairing asks the peer's user to verify the keys of the connection, and waits
+// for the answer. It reports whether the peer's user confirmed them.
+func RequestPairing(c *Conn) (bool, error) {
+	if !c.Supports(FeaturePairing) {
+		return false, ErrPairingUnsupported
+	}
+	if _, err := c.Write(Pair{}.MarshalMessage()); err != nil {
+		return false, err
+	}
+
+	_ = c.SetReadDeadline(time.Now().Add(pairingTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	msg, err := ReadMessage(c.reader)
+	if err != nil {
+		return false, err
+	}
+	switch m := msg.(type) {
+	case error:
+		return false, m
+	case Answer:
+		if m.Kind == "BUSY" {
+			return false, ErrBusy
+		}
+		return m.Accepted(), nil
+	}
+	return false, fmt.Errorf("unexpected answer to pairing request: %T", msg)
+}
+
+// receivePairing lets the user verify the keys of the connection, and tells the peer
+// whether the user confirmed them. Requests over the peer's limits are answered BUSY.
+func receivePairing(c *Conn, gw platform.Gateway) {
+	if !c.limiter.allowOffer(c.Peer().Key) {
+		refuseBusy(c, "pairing request", "too many offers")
+		return
+	}
+	release, ok := c.limiter.reservePrompt()
+	if !ok {
+		refuseBusy(c, "pairing request", "too many pending prompts")
+		return
+	}
+	defer release()
+	answer := Decline()
+	if pg, ok := gw.(platform.PairingGateway); ok {
+		if pg.ConfirmPairing(c.Peer()) {
+			answer = Accept()
+			recordPeer(audit.Pairing, c.Peer(), "confirmed", "requested by the peer")
+		} else {
+			recordPeer(audit.Pairing, c.Peer(), "declined", "requested by the peer")
+		}
+	}
+	_, _ = c.Write(answer.MarshalMessage())
+}
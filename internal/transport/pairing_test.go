@@ -0,0 +1,81 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/metalgrid/drift/internal/platform"
+)
+
+// pairingGateway confirms or rejects every pairing request and records the peer it was shown
+type pairingGateway struct {
+	mockGateway
+	confirm bool
+	shown   chan platform.Peer
+}
+
+func (g *pairingGateway) ConfirmPairing(peer platform.Peer) bool {
+	g.shown <- peer
+	return g.confirm
+}
+
+// requestPairing runs a pairing request against HandleConnection with the given gateway
+func requestPairing(t *testing.T, gw platform.Gateway) (bool, error) {
+	t.Helper()
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	server := withFeatures(serverConn, FeaturePairing)
+	server.SetPeer(platform.Peer{Name: "alice"})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		HandleConnection(context.Background(), server, gw, nil, nil)
+	}()
+	t.Cleanup(func() { <-done })
+
+	return RequestPairing(withFeatures(clientConn, FeaturePairing))
+}
+
+// TestPairRoundTrip tests that PAIR frames survive encoding
+func TestPairRoundTrip(t *testing.T) {
+	if _, ok := UnmarshalFrame(Pair{}.MarshalMessage()).(Pair); !ok {
+		t.Error("PAIR frame did not decode to Pair")
+	}
+}
+
+// TestRequestPairingConfirmed tests that the peer's user is shown the connection and their confirmation is returned
+func TestRequestPairingConfirmed(t *testing.T) {
+	gw := &pairingGateway{confirm: true, shown: make(chan platform.Peer, 1)}
+	confirmed, err := requestPairing(t, gw)
+	if err != nil || !confirmed {
+		t.Fatalf("RequestPairing() = %v, %v; want confirmed", confirmed, err)
+	}
+	if peer := <-gw.shown; peer.Name != "alice" {
+		t.Errorf("pairing was shown for %q, want alice", peer.Name)
+	}
+}
+
+// TestRequestPairingWithoutPairingGateway tests that a gateway unable to show pairings declines them
+func TestRequestPairingWithoutPairingGateway(t *testing.T) {
+	confirmed, err := requestPairing(t, &mockGateway{})
+	if err != nil || confirmed {
+		t.Errorf("RequestPairing() = %v, %v; want declined", confirmed, err)
+	}
+}
+
+// TestRequestPairingUnsupported tests that peers without the pairing feature are not asked
+func TestRequestPairingUnsupported(t *testing.T) {
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+	if _, err := RequestPairing(withFeatures(clientConn)); !errors.Is(err, ErrPairingUnsupported) {
+		t.Errorf("RequestPairing() = %v, want ErrPairingUnsupported", err)
+	}
+}
@@ -0,0 +1,159 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/metalgrid/drift/internal/platform"
+	"github.com/metalgrid/drift/internal/trust"
+)
+
+// offerFrom offers a file from peer to a connection handled with gw, and returns whether it was accepted
+func offerFrom(t *testing.T, peer platform.Peer, gw platform.Gateway, size int64) bool {
+	t.Helper()
+	return answerTo(t, peer, nil, gw, size).Accepted()
+}
+
+// answerTo offers a file from peer to a connection handled with gw under the limits of l, and returns the answer
+func answerTo(t *testing.T, peer platform.Peer, l *Limiter, gw platform.Gateway, size int64) Answer {
+	t.Helper()
+	useDownloadDir(t)
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	conn := withFeatures(serverConn)
+	conn.SetPeer(peer)
+	conn.SetLimiter(l)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		HandleConnection(context.Background(), conn, gw, nil, nil)
+	}()
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+		<-done
+	})
+
+	offer := Offer{Message: Message{"OFFER"}, Filename: "notes.txt", Mimetype: mimeType, Size: size}
+	if _, err := clientConn.Write(offer.MarshalMessage()); err != nil {
+		t.Fatalf("failed writing offer: %v", err)
+	}
+	msg, err := ReadMessage(bufio.NewReader(clientConn))
+	if err != nil {
+		t.Fatalf("failed reading answer: %v", err)
+	}
+	answer, ok := msg.(Answer)
+	if !ok {
+		t.Fatalf("answer = %v, want an answer", msg)
+	}
+	return answer
+}
+
+// TestHandleConnectionDeclinesByPolicy tests that a declining policy answers without asking, and says so
+func TestHandleConnectionDeclinesByPolicy(t *testing.T) {
+	gw := &askingGateway{questions: make(chan string, 1)}
+	peer := platform.Peer{Name: "alice", Policy: trust.Policy{Mode: trust.AlwaysDecline}}
+	if offerFrom(t, peer, gw, 10) {
+		t.Fatal("offer was accepted")
+	}
+	if len(gw.questions) != 0 {
+		t.Errorf("the user was asked %q", <-gw.questions)
+	}
+	if !gw.hasNotification("Automatically declined notes.txt (10 Bytes) from alice (policy: decline)") {
+		t.Errorf("notifications = %q, want the automatic decline", gw.notifications)
+	}
+}
+
+// TestHandleConnectionAsksBeyondPolicy tests that offers a policy does not cover are left to the user
+func TestHandleConnectionAsksBeyondPolicy(t *testing.T) {
+	for _, peer := range []platform.Peer{
+		{Name: "alice", Policy: trust.Policy{Mode: trust.AcceptUnder, Limit: 9}},
+		{Name: "alice", Policy: trust.Policy{Mode: trust.AlwaysAsk}},
+		{Name: "alice", KeyChanged: true, Policy: trust.Policy{Mode: trust.AlwaysAccept}},
+	} {
+		gw := &askingGateway{questions: make(chan string, 1)}
+		if offerFrom(t, peer, gw, 10) {
+			t.Errorf("policy %s: offer was accepted", peer.Policy)
+		}
+		if len(gw.questions) != 1 {
+			t.Errorf("policy %s: the user was not asked", peer.Policy)
+		}
+	}
+}
+
+// TestPolicyAnswer tests which offers a policy decides on
+func TestPolicyAnswer(t *testing.T) {
+	for _, tc := range []struct {
+		peer              platform.Peer
+		size              int64
+		accepted, decided bool
+	}{
+		{platform.Peer{Name: "alice", Policy: trust.Policy{Mode: trust.AlwaysAccept}}, 1 << 40, true, true},
+		{platform.Peer{Name: "alice", Policy: trust.Policy{Mode: trust.AcceptUnder, Limit: 100}}, 100, true, true},
+		{platform.Peer{Name: "alice", Policy: trust.Policy{Mode: trust.AcceptUnder, Limit: 100}}, 101, false, false},
+		{platform.Peer{Name: "alice", Policy: trust.Policy{Mode: trust.AlwaysDecline}}, 1, false, true},
+		{platform.Peer{Name: "alice"}, 1, false, false},
+		{platform.Peer{Name: "alice", KeyChanged: true, Policy: trust.Policy{Mode: trust.AlwaysDecline}}, 1, false, false},
+	} {
+		gw := &mockGateway{}
+		accepted, decided := policyAnswer(gw, tc.peer, "file", tc.size)
+		if accepted != tc.accepted || decided != tc.decided {
+			t.Errorf("policyAnswer(%s, %d) = %v, %v; want %v, %v", tc.peer.Policy, tc.size, accepted, decided, tc.accepted, tc.decided)
+		}
+		if notified := len(gw.notifications) > 0; notified != decided || (decided && !strings.Contains(gw.notifications[0], "alice")) {
+			t.Errorf("policyAnswer(%s, %d) notified %q", tc.peer.Policy, tc.size, gw.notifications)
+		}
+	}
+}
+
+// TestHandleConnectionAsksAboutWrappingBatch tests that a batch whose sizes add up past int64 is not accepted as a small one
+func TestHandleConnectionAsksAboutWrappingBatch(t *testing.T) {
+	files := []FileEntry{{Filename: "small.txt", Mimetype: mimeType, Size: 10}}
+	for i := range 4 {
+		files = append(files, FileEntry{Filename: fmt.Sprintf("huge%d.bin", i), Mimetype: mimeType, Size: 1 << 62})
+	}
+	if size := totalSize(files); size != math.MaxInt64 {
+		t.Errorf("totalSize() = %d, want it saturated at %d", size, int64(math.MaxInt64))
+	}
+
+	useDownloadDir(t)
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+	conn := withFeatures(serverConn)
+	conn.SetPeer(platform.Peer{Name: "alice", Policy: trust.Policy{Mode: trust.AcceptUnder, Limit: 100}})
+	gw := &askingGateway{questions: make(chan string, 1)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		HandleConnection(context.Background(), conn, gw, nil, nil)
+	}()
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+		<-done
+	})
+
+	offer := BatchOffer{Message: Message{"BATCH_OFFER"}, Files: files}
+	if _, err := clientConn.Write(offer.MarshalMessage()); err != nil {
+		t.Fatalf("failed writing batch offer: %v", err)
+	}
+	msg, err := ReadMessage(bufio.NewReader(clientConn))
+	if err != nil {
+		t.Fatalf("failed reading answer: %v", err)
+	}
+	if answer, ok := msg.(Answer); !ok || answer.Accepted() {
+		t.Errorf("answer = %v, want the batch declined by the user", msg)
+	}
+	if len(gw.questions) != 1 {
+		t.Error("the user was not asked")
+	}
+}
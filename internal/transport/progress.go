@@ -1,6 +1,14 @@
 package transport
 
-import "io"
+import (
+	"io"
+	"time"
+
+	"github.com/metalgrid/drift/internal/transfer"
+)
+
+// progressInterval is the minimum time between two progress reports of a transfer.
+const progressInterval = 250 * time.Millisecond
 
 // ProgressFunc is called after each Write/Read operation with cumulative bytes transferred and total bytes
 type ProgressFunc func(bytesTransferred int64, totalBytes int64)
@@ -58,3 +66,88 @@ func (pr *ProgressReader) Read(p []byte) (int, error) {
 	}
 	return n, err
 }
+
+// transferProgress reports how far a transfer got to the manager, throttled to one
+// report per progressInterval. Speed and ETA only count the bytes moved in this attempt,
+// not those a resumed transfer started from. A nil *transferProgress reports nothing.
+type transferProgress struct {
+	transfers *transfer.Manager
+	id        string
+	progress  transfer.Progress
+	// done counts the bytes of the files before the current one, offset where the current
+	// one started and resumed the bytes all files started from.
+	done     int64
+	offset   int64
+	resumed  int64
+	started  time.Time
+	reported time.Time
+	now      func() time.Time
+}
+
+// newTransferProgress starts reporting the transfer tracked as id, which moves files
+// data-carrying files totalling total bytes.
+func newTransferProgress(transfers *transfer.Manager, id string, files int, total int64) *transferProgress {
+	if transfers == nil {
+		return nil
+	}
+	p := &transferProgress{
+		transfers: transfers,
+		id:        id,
+		progress: transfer.Progress{
+			Files:      files,
+			TotalBytes: total,
+		},
+		now: time.Now,
+	}
+	p.started = p.now()
+	return p
+}
+
+// startFile moves on to the next file, of which offset bytes are already there, and
+// returns the callback to report the rest of it with.
+func (p *transferProgress) startFile(name string, size, offset int64) ProgressFunc {
+	if p == nil {
+		return nil
+	}
+	offset = min(offset, size)
+	p.done += p.progress.FileSize
+	p.offset = offset
+	p.resumed += offset
+	p.progress.Filename = name
+	p.progress.File++
+	p.progress.FileSize = size
+	p.update(0, size-offset)
+	return p.update
+}
+
+func (p *transferProgress) update(bytesTransferred, _ int64) {
+	p.progress.FileBytes = p.offset + bytesTransferred
+	p.progress.Bytes = p.done + p.progress.FileBytes
+	p.report(false)
+}
+
+// finish sends the last report, whether the transfer completed or not.
+func (p *transferProgress) finish() {
+	if p == nil {
+		return
+	}
+	p.report(true)
+}
+
+func (p *transferProgress) report(force bool) {
+	now := p.now()
+	if !force && !p.reported.IsZero() && now.Sub(p.reported) < progressInterval {
+		return
+	}
+	p.reported = now
+
+	p.progress.Speed, p.progress.ETA = 0, 0
+	if elapsed := now.Sub(p.started).Seconds(); elapsed > 0 {
+		p.progress.Speed = float64(p.progress.Bytes-p.resumed) / elapsed
+	}
+	if p.progress.Speed > 0 {
+		left := float64(p.progress.TotalBytes - p.progress.Bytes)
+		p.progress.ETA = time.Duration(left / p.progress.Speed * float64(time.Second)).Round(time.Second)
+	}
+	p.transfers.SetProgress(p.id, p.progress)
+}
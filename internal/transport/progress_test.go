@@ -2,9 +2,66 @@ package transport
 
 import (
 	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/metalgrid/drift/internal/transfer"
 )
 
+// progressRecorder records the progress reports of a manager's transfers
+type progressRecorder struct {
+	mu      sync.Mutex
+	reports []transfer.Progress
+}
+
+func recordProgress(transfers *transfer.Manager) *progressRecorder {
+	r := &progressRecorder{}
+	transfers.Subscribe(func(t transfer.Transfer) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if len(r.reports) == 0 || r.reports[len(r.reports)-1] != t.Progress {
+			r.reports = append(r.reports, t.Progress)
+		}
+	})
+	return r
+}
+
+func (r *progressRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.reports)
+}
+
+func (r *progressRecorder) last() transfer.Progress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.reports) == 0 {
+		return transfer.Progress{}
+	}
+	return r.reports[len(r.reports)-1]
+}
+
+// newTrackedProgress starts reporting progress of a new transfer on a fake clock
+func newTrackedProgress(files int, total int64) (*transferProgress, *progressRecorder, func(time.Duration)) {
+	transfers := transfer.NewManager()
+	id := transfers.Add(transfer.Outbound, "peer", "test", nil)
+	recorder := recordProgress(transfers)
+	p := newTransferProgress(transfers, id, files, total)
+	now, advance := fakeClock()
+	p.now, p.started = now, now()
+	return p, recorder, advance
+}
+
+// fakeClock returns a clock for transferProgress that only moves when told to
+func fakeClock() (func() time.Time, func(time.Duration)) {
+	now := time.Unix(0, 0)
+	return func() time.Time { return now }, func(d time.Duration) { now = now.Add(d) }
+}
+
 // TestProgressWriterReportsBytesCorrectly verifies ProgressWriter calls callback with correct byte counts
 func TestProgressWriterReportsBytesCorrectly(t *testing.T) {
 	buf := &bytes.Buffer{}
@@ -142,3 +199,126 @@ func TestProgressReaderTotalBytesParameter(t *testing.T) {
 		t.Errorf("expected totalBytes=42, got %d", totalBytes)
 	}
 }
+
+// TestTransferProgressThrottles verifies reports are limited to one per progressInterval, except the last
+func TestTransferProgressThrottles(t *testing.T) {
+	p, recorder, advance := newTrackedProgress(1, 100)
+
+	report := p.startFile("a.txt", 100, 0)
+	report(10, 100)
+	report(20, 100)
+	if recorder.count() != 1 {
+		t.Fatalf("got %d reports within progressInterval, want 1", recorder.count())
+	}
+	advance(progressInterval)
+	report(30, 100)
+	if recorder.count() != 2 || recorder.last().Bytes != 30 {
+		t.Fatalf("reports = %+v, want a second one at 30 bytes", recorder.reports)
+	}
+	report(100, 100)
+	p.finish()
+	if last := recorder.last(); last.Bytes != 100 {
+		t.Errorf("last report = %+v, want 100 bytes", last)
+	}
+}
+
+// TestTransferProgressSpeedAndETA verifies speed and ETA count only the bytes moved in this attempt
+func TestTransferProgressSpeedAndETA(t *testing.T) {
+	p, recorder, advance := newTrackedProgress(2, 3000)
+
+	p.startFile("a.bin", 1000, 0)(1000, 1000)
+	// Half of the second file was received in an earlier attempt.
+	report := p.startFile("b.bin", 2000, 1000)
+	advance(2 * time.Second)
+	report(500, 1000)
+
+	got := recorder.last()
+	if got.File != 2 || got.FileBytes != 1500 || got.Bytes != 2500 {
+		t.Errorf("report = %+v, want file 2 at 1500 bytes, 2500 in total", got)
+	}
+	if got.Speed != 750 {
+		t.Errorf("Speed = %v, want 750", got.Speed)
+	}
+	if got.ETA != time.Second {
+		t.Errorf("ETA = %v, want 1s", got.ETA)
+	}
+}
+
+// TestTransferProgressWithoutManager verifies that untracked transfers report nothing
+func TestTransferProgressWithoutManager(t *testing.T) {
+	p := newTransferProgress(nil, "", 1, 10)
+	if p != nil {
+		t.Fatal("newTransferProgress() returned a tracker without a manager")
+	}
+	if report := p.startFile("a.txt", 10, 0); report != nil {
+		t.Error("startFile() returned a callback on a nil tracker")
+	}
+	p.finish()
+}
+
+// TestHandleConnectionTracksTransfers verifies both sides report a transfer and its progress through to the end
+func TestHandleConnectionTracksTransfers(t *testing.T) {
+	useDownloadDir(t)
+	filePath := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(filePath, bytes.Repeat([]byte("x"), 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+	features := []Feature{FeatureResume, FeatureChecksums, FeatureCancel}
+
+	receiverTransfers := transfer.NewManager()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		HandleConnection(context.Background(), withFeatures(serverConn, features...), &acceptingGateway{}, receiverTransfers, nil)
+	}()
+
+	senderTransfers := transfer.NewManager()
+	senderProgress := recordProgress(senderTransfers)
+	conn := withFeatures(clientConn, features...)
+	outbound := NewOutboundTransferState()
+	outbound.Track(senderTransfers.Add(transfer.Outbound, "receiver", "a.txt", nil))
+	senderDone := make(chan struct{})
+	go func() {
+		defer close(senderDone)
+		HandleConnection(context.Background(), conn, &mockGateway{}, senderTransfers, outbound)
+	}()
+	if err := SendFile(filePath, conn, outbound); err != nil {
+		t.Fatalf("SendFile() failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := outbound.Wait(ctx); err != nil {
+		t.Fatalf("Wait() = %v, want nil", err)
+	}
+	_ = clientConn.Close()
+	for _, ch := range []chan struct{}{done, senderDone} {
+		select {
+		case <-ch:
+		case <-time.After(2 * time.Second):
+			t.Fatal("HandleConnection did not return")
+		}
+	}
+
+	if last := senderProgress.last(); last.Bytes != 1000 || last.TotalBytes != 1000 || last.Filename != "a.txt" {
+		t.Errorf("sender: last progress = %+v, want a.txt at 1000 bytes", last)
+	}
+	// The sender's app decides when its transfer is over; the receiver is done on its own.
+	sent := senderTransfers.List()
+	if len(sent) != 1 || sent[0].State != transfer.Transferring {
+		t.Errorf("sender transfers = %+v, want one transferring", sent)
+	}
+	received := receiverTransfers.List()
+	if len(received) != 1 || received[0].State != transfer.Completed || received[0].Direction != transfer.Inbound {
+		t.Fatalf("receiver transfers = %+v, want one completed inbound", received)
+	}
+	if p := received[0].Progress; p.Bytes != 1000 || p.Filename != "a.txt" {
+		t.Errorf("receiver progress = %+v, want a.txt at 1000 bytes", p)
+	}
+}
@@ -0,0 +1,213 @@
+package transport
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/adrg/xdg"
+	"github.com/rs/zerolog/log"
+)
+
+// FeatureResume allows an interrupted transfer to continue from the bytes the receiver already has.
+const FeatureResume Feature = "resume"
+
+const transferIDSize = 16
+
+// PartialMaxAge is how long a partial file is kept after it was last written to. Senders
+// give up resuming long before, so older partials belong to abandoned transfers.
+const PartialMaxAge = 7 * 24 * time.Hour
+
+// ErrInterrupted is reported when a transfer broke off after the receiver accepted it.
+var ErrInterrupted = errors.New("transfer interrupted")
+
+// newTransferID returns a random identifier that ties reconnects to the same transfer.
+func newTransferID() string {
+	b := make([]byte, transferIDSize)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validTransferID reports whether id looks like an identifier made by newTransferID.
+// IDs become part of file names, so anything else is rejected.
+func validTransferID(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == transferIDSize
+}
+
+// partialPath returns where the receiver keeps the data of the index-th file of a transfer
+// until the file is complete.
+func partialPath(dir, file, transferID string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.%s-%d.drift", file, transferID, index))
+}
+
+// partialName matches the names partialPath gives partial files.
+var partialName = regexp.MustCompile(fmt.Sprintf(`\.[0-9a-f]{%d}-[0-9]+\.drift$`, 2*transferIDSize))
+
+// removeStalePartials deletes the partial files under dir, including those of directory
+// transfers in its subdirectories, that were last written to before maxAge ago, and
+// returns how many it deleted. Anything it cannot read is left alone.
+func removeStalePartials(dir string, maxAge time.Duration) int {
+	cutoff := time.Now().Add(-maxAge)
+	removed := 0
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || !partialName.MatchString(d.Name()) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil || fi.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			log.Warn().Err(err).Str("path", path).Msg("failed removing stale partial file")
+			return nil
+		}
+		removed++
+		return nil
+	})
+	return removed
+}
+
+// RemoveStalePartials deletes the partial files of transfers that were abandoned more
+// than PartialMaxAge ago from the download directory.
+func RemoveStalePartials() {
+	if n := removeStalePartials(filepath.Join(xdg.UserDirs.Download, "Drift"), PartialMaxAge); n > 0 {
+		log.Info().Int("count", n).Msg("removed partial files of abandoned transfers")
+	}
+}
+
+// resumeOffsets reports how many bytes of each file of a transfer are already on disk.
+// Partial files are created for every file when a transfer is accepted and renamed
+// into place once complete, so a missing partial next to existing ones means that
+// file was finished. If no partial exists at all, the transfer is not being resumed.
+func resumeOffsets(dir, transferID string, files []FileEntry) ([]int64, bool) {
+	offsets := make([]int64, len(files))
+	resuming := false
+	for i, file := range files {
+		fi, err := os.Stat(partialPath(dir, file.Filename, transferID, i))
+		if err != nil {
+			offsets[i] = -1
+			continue
+		}
+		resuming = true
+		offsets[i] = min(fi.Size(), file.Size)
+	}
+	if !resuming {
+		return nil, false
+	}
+
+	for i, file := range files {
+		if offsets[i] < 0 {
+			offsets[i] = file.Size
+		}
+	}
+	return offsets, true
+}
+
+// preparePartials creates an empty partial file for every selected file of a newly accepted
+// transfer. Subdirectories of dir that they go into must already exist, see prepareTree.
+// Files that were not selected get no partial, so a resume treats them as done.
+func preparePartials(dir, transferID string, files []FileEntry, selected []int) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	for _, i := range selected {
+		file := files[i]
+		if file.Directory {
+			continue
+		}
+		f, err := os.OpenFile(partialPath(dir, file.Filename, transferID, i), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err != nil {
+			return err
+		}
+		_ = f.Close()
+	}
+	return nil
+}
+
+// removePartials deletes the partial files of a cancelled transfer, which will not be resumed.
+func removePartials(dir, transferID string, files []FileEntry, selected []int) {
+	for _, i := range selected {
+		if !files[i].Directory {
+			_ = os.Remove(partialPath(dir, files[i].Filename, transferID, i))
+		}
+	}
+}
+
+// storePartial continues receiving the index-th file of a transfer into its partial file
+// from offset on, and renames it into place once all size bytes are there.
+// Unlike storeFile, it keeps whatever was received when the stream fails.
+// Every byte written has passed the record authentication of the secure connection,
+// so the partial file only ever holds verified data. With a non-nil check, the bytes
+// already on disk are hashed first, and a file that does not match the sender's
+// digest is deleted rather than kept for another attempt.
+func storePartial(dir, file, transferID string, index int, offset, size int64, reader io.Reader, check *checksum, progress ProgressFunc) error {
+	partial := partialPath(dir, file, transferID, index)
+	fp := filepath.Join(dir, file)
+	if offset >= size {
+		// Finished in an earlier attempt; nothing of this file is on the wire.
+		if _, err := os.Stat(partial); errors.Is(err, fs.ErrNotExist) {
+			if check != nil {
+				// It was verified before being renamed; only the trailer is left to consume.
+				return check.skip()
+			}
+			return nil
+		}
+		if check == nil {
+			return os.Rename(partial, fp)
+		}
+		// Complete, but the trailer never arrived. Verify it below without reading any data.
+		offset = size
+	}
+
+	f, err := os.OpenFile(partial, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(offset); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if check != nil {
+		if _, err := io.Copy(check.hash, io.NewSectionReader(f, 0, offset)); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	remaining := size - offset
+	var lr io.Reader = io.LimitReader(reader, remaining)
+	if check != nil {
+		lr = io.TeeReader(lr, check.hash)
+	}
+	pr := NewProgressReader(lr, remaining, progress)
+	n, err := f.ReadFrom(pr)
+	if err == nil && n != remaining {
+		err = io.ErrUnexpectedEOF
+	}
+	if syncErr := f.Sync(); err == nil {
+		err = syncErr
+	}
+	if err == nil && check != nil {
+		err = check.verify()
+	}
+	_ = f.Close()
+	if errors.Is(err, ErrChecksumMismatch) {
+		_ = os.Remove(partial)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(partial, fp)
+}
@@ -0,0 +1,372 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrg/xdg"
+	"github.com/metalgrid/drift/internal/platform"
+)
+
+// withFeatures wraps conn as if the HELLO exchange had negotiated the given features
+func withFeatures(conn net.Conn, features ...Feature) *Conn {
+	return &Conn{
+		Conn:     conn,
+		reader:   bufio.NewReader(conn),
+		version:  ProtocolVersion,
+		features: features,
+	}
+}
+
+// useDownloadDir points the receiver's download directory at a temporary directory
+func useDownloadDir(t *testing.T) string {
+	t.Helper()
+	original := xdg.UserDirs.Download
+	xdg.UserDirs.Download = t.TempDir()
+	t.Cleanup(func() { xdg.UserDirs.Download = original })
+	return filepath.Join(xdg.UserDirs.Download, "Drift")
+}
+
+func TestValidTransferID(t *testing.T) {
+	if !validTransferID(newTransferID()) {
+		t.Error("newTransferID() produced an invalid ID")
+	}
+	for _, id := range []string{"", "abc", "../../etc/passwd", "zz" + newTransferID()[2:]} {
+		if validTransferID(id) {
+			t.Errorf("validTransferID(%q) = true, want false", id)
+		}
+	}
+}
+
+func TestResumeOffsetsWithoutPartials(t *testing.T) {
+	files := []FileEntry{{Filename: "a.txt", Size: 10}}
+	if offsets, resuming := resumeOffsets(t.TempDir(), newTransferID(), files); resuming || offsets != nil {
+		t.Errorf("resumeOffsets() = %v, %v, want nil, false", offsets, resuming)
+	}
+}
+
+func TestResumeOffsetsMixedProgress(t *testing.T) {
+	dir := t.TempDir()
+	id := newTransferID()
+	files := []FileEntry{
+		{Filename: "done.txt", Size: 10},
+		{Filename: "half.txt", Size: 10},
+		{Filename: "todo.txt", Size: 10},
+	}
+	// done.txt was renamed into place, half.txt has 4 bytes, todo.txt has not started.
+	if err := os.WriteFile(partialPath(dir, "half.txt", id, 1), []byte("1234"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partialPath(dir, "todo.txt", id, 2), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	offsets, resuming := resumeOffsets(dir, id, files)
+	if !resuming {
+		t.Fatal("resumeOffsets() did not detect the partial transfer")
+	}
+	want := []int64{10, 4, 0}
+	for i := range want {
+		if offsets[i] != want[i] {
+			t.Errorf("offsets[%d] = %d, want %d", i, offsets[i], want[i])
+		}
+	}
+}
+
+func TestStorePartialContinuesFromOffset(t *testing.T) {
+	dir := t.TempDir()
+	id := newTransferID()
+	if err := preparePartials(dir, id, []FileEntry{{Filename: "big.bin", Size: 10}}, []int{0}); err != nil {
+		t.Fatalf("preparePartials() failed: %v", err)
+	}
+	if err := os.WriteFile(partialPath(dir, "big.bin", id, 0), []byte("01234"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := storePartial(dir, "big.bin", id, 0, 5, 10, bytes.NewReader([]byte("56789")), nil, nil)
+	if err != nil {
+		t.Fatalf("storePartial() failed: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "big.bin"))
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %v", err)
+	}
+	if string(content) != "0123456789" {
+		t.Errorf("content = %q, want %q", content, "0123456789")
+	}
+	if _, err := os.Stat(partialPath(dir, "big.bin", id, 0)); !os.IsNotExist(err) {
+		t.Error("partial file was not renamed into place")
+	}
+}
+
+func TestStorePartialKeepsDataWhenInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	id := newTransferID()
+	if err := preparePartials(dir, id, []FileEntry{{Filename: "big.bin", Size: 10}}, []int{0}); err != nil {
+		t.Fatalf("preparePartials() failed: %v", err)
+	}
+
+	err := storePartial(dir, "big.bin", id, 0, 0, 10, bytes.NewReader([]byte("0123")), nil, nil)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("storePartial() = %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	content, err := os.ReadFile(partialPath(dir, "big.bin", id, 0))
+	if err != nil {
+		t.Fatalf("partial file was removed: %v", err)
+	}
+	if string(content) != "0123" {
+		t.Errorf("partial content = %q, want %q", content, "0123")
+	}
+}
+
+// TestRemoveStalePartials tests that only partial files left untouched for too long are deleted
+func TestRemoveStalePartials(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "photos"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * PartialMaxAge)
+	stale := []string{
+		partialPath(dir, "big.bin", newTransferID(), 0),
+		partialPath(dir, "photos/a.jpg", newTransferID(), 3),
+	}
+	kept := []string{
+		partialPath(dir, "recent.bin", newTransferID(), 0),
+		filepath.Join(dir, "old.txt"),
+		filepath.Join(dir, "notes.drift"),
+	}
+	for _, path := range append(stale, kept...) {
+		if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range append(stale, kept[1:]...) {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := removeStalePartials(dir, PartialMaxAge); n != len(stale) {
+		t.Errorf("removeStalePartials() = %d, want %d", n, len(stale))
+	}
+	for _, path := range stale {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was kept", path)
+		}
+	}
+	for _, path := range kept {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was removed: %v", path, err)
+		}
+	}
+	if n := removeStalePartials(filepath.Join(dir, "missing"), PartialMaxAge); n != 0 {
+		t.Errorf("removeStalePartials() of a missing directory = %d", n)
+	}
+}
+
+func TestStoreFileTruncatedStream(t *testing.T) {
+	tmpDir := t.TempDir()
+	err := storeFile(tmpDir, "short.txt", 10, bytes.NewReader([]byte("abc")), nil, nil)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("storeFile() = %v, want io.ErrUnexpectedEOF", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "short.txt")); !os.IsNotExist(err) {
+		t.Error("truncated file was renamed into place")
+	}
+}
+
+func TestHandleConnectionResumesWithoutAsking(t *testing.T) {
+	dir := useDownloadDir(t)
+	id := newTransferID()
+	files := []FileEntry{{Filename: "movie.mkv", Mimetype: mimeType, Size: 10}}
+	if err := preparePartials(dir, id, files, []int{0}); err != nil {
+		t.Fatalf("preparePartials() failed: %v", err)
+	}
+	if err := os.WriteFile(partialPath(dir, "movie.mkv", id, 0), []byte("012345"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	gw := &mockGateway{}
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		HandleConnection(context.Background(), withFeatures(serverConn, FeatureResume), gw, nil, nil)
+	}()
+
+	offer := Offer{Message: Message{"OFFER"}, Filename: "movie.mkv", Mimetype: mimeType, Size: 10, TransferID: id}
+	if _, err := clientConn.Write(offer.MarshalMessage()); err != nil {
+		t.Fatalf("failed writing offer: %v", err)
+	}
+
+	// mockGateway declines every prompt, so an accept can only come from the resume path.
+	msg, err := ReadMessage(bufio.NewReader(clientConn))
+	if err != nil {
+		t.Fatalf("failed reading answer: %v", err)
+	}
+	answer, ok := msg.(Answer)
+	if !ok || !answer.Accepted() {
+		t.Fatalf("answer = %v, want accept", msg)
+	}
+	if len(answer.Offsets) != 1 || answer.Offsets[0] != 6 {
+		t.Fatalf("Offsets = %v, want [6]", answer.Offsets)
+	}
+
+	if _, err := clientConn.Write([]byte("6789")); err != nil {
+		t.Fatalf("failed writing remaining bytes: %v", err)
+	}
+	_ = clientConn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("HandleConnection did not return")
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "movie.mkv"))
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %v", err)
+	}
+	if string(content) != "0123456789" {
+		t.Errorf("content = %q, want %q", content, "0123456789")
+	}
+}
+
+// askingGateway records the questions it is asked and declines them
+type askingGateway struct {
+	mockGateway
+	questions chan string
+}
+
+func (g *askingGateway) Ask(question string) string {
+	g.questions <- question
+	return "DECLINE"
+}
+
+// TestHandleConnectionAsksChangedPeerBeforeResuming tests that a peer whose key changed cannot resume unasked
+func TestHandleConnectionAsksChangedPeerBeforeResuming(t *testing.T) {
+	dir := useDownloadDir(t)
+	id := newTransferID()
+	files := []FileEntry{{Filename: "movie.mkv", Mimetype: mimeType, Size: 10}}
+	if err := preparePartials(dir, id, files, []int{0}); err != nil {
+		t.Fatalf("preparePartials() failed: %v", err)
+	}
+
+	gw := &askingGateway{questions: make(chan string, 1)}
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	conn := withFeatures(serverConn, FeatureResume)
+	conn.SetPeer(platform.Peer{Name: "alice", KeyChanged: true})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		HandleConnection(context.Background(), conn, gw, nil, nil)
+	}()
+
+	offer := Offer{Message: Message{"OFFER"}, Filename: "movie.mkv", Mimetype: mimeType, Size: 10, TransferID: id}
+	if _, err := clientConn.Write(offer.MarshalMessage()); err != nil {
+		t.Fatalf("failed writing offer: %v", err)
+	}
+
+	msg, err := ReadMessage(bufio.NewReader(clientConn))
+	if err != nil {
+		t.Fatalf("failed reading answer: %v", err)
+	}
+	if answer, ok := msg.(Answer); !ok || answer.Accepted() {
+		t.Fatalf("answer = %v, want decline", msg)
+	}
+	select {
+	case question := <-gw.questions:
+		if !strings.HasPrefix(question, "WARNING: ") || !strings.Contains(question, "alice") {
+			t.Errorf("question = %q, want a warning about alice", question)
+		}
+	default:
+		t.Error("the user was not asked")
+	}
+
+	_ = clientConn.Close()
+	<-done
+}
+
+func TestHandleConnectionSendsFromResumeOffset(t *testing.T) {
+	gw := &mockGateway{}
+	state := NewOutboundTransferState()
+
+	filePath := filepath.Join(t.TempDir(), "movie.mkv")
+	if err := os.WriteFile(filePath, []byte("0123456789"), 0600); err != nil {
+		t.Fatalf("failed creating temp file: %v", err)
+	}
+	state.SetPendingFiles([]string{filePath})
+
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	go HandleConnection(context.Background(), withFeatures(serverConn, FeatureResume), gw, nil, state)
+
+	answer := Accept()
+	answer.Offsets = []int64{7}
+	if _, err := clientConn.Write(answer.MarshalMessage()); err != nil {
+		t.Fatalf("failed writing answer: %v", err)
+	}
+
+	received := make([]byte, 3)
+	if _, err := io.ReadFull(clientConn, received); err != nil {
+		t.Fatalf("failed reading sent bytes: %v", err)
+	}
+	if string(received) != "789" {
+		t.Errorf("received = %q, want %q", received, "789")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := state.Wait(ctx); err != nil {
+		t.Errorf("Wait() = %v, want nil", err)
+	}
+}
+
+func TestOutboundWaitReportsDecline(t *testing.T) {
+	gw := &mockGateway{}
+	state := NewOutboundTransferState()
+	state.SetPendingFiles([]string{"/tmp/declined.txt"})
+
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	go HandleConnection(context.Background(), serverConn, gw, nil, state)
+
+	if _, err := clientConn.Write(Decline().MarshalMessage()); err != nil {
+		t.Fatalf("failed writing decline message: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := state.Wait(ctx); !errors.Is(err, ErrDeclined) {
+		t.Errorf("Wait() = %v, want ErrDeclined", err)
+	}
+}
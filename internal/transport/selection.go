@@ -0,0 +1,52 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// FeatureSelection lets the receiver of a batch accept only some of its files.
+const FeatureSelection Feature = "select"
+
+// allFiles returns the indices of all n files of an offer.
+func allFiles(n int) []int {
+	indices := make([]int, n)
+	for i := range indices {
+		indices[i] = i
+	}
+	return indices
+}
+
+// checkSelection validates the indices of accepted files against an offer of n files.
+// Both sides stream files in offer order, so the indices must be strictly ascending.
+func checkSelection(selected []int, n int) error {
+	for i, index := range selected {
+		if index < 0 || index >= n {
+			return fmt.Errorf("selected file %d is not part of the offer", index)
+		}
+		if i > 0 && index <= selected[i-1] {
+			return fmt.Errorf("selected files are not in ascending order")
+		}
+	}
+	return nil
+}
+
+// discardFile reads and drops a file the user did not select, for senders that
+// cannot skip it.
+func discardFile(ctx context.Context, c *Conn, file FileEntry) error {
+	if file.Directory {
+		return nil
+	}
+	n, err := io.CopyN(io.Discard, fileReader(ctx, c), file.Size)
+	if err == io.EOF || (err == nil && n != file.Size) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if c.Supports(FeatureChecksums) {
+		return newChecksum(c.reader).skip()
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package transport
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metalgrid/drift/internal/platform"
+)
+
+// selectingGateway answers batch prompts with a fixed selection
+type selectingGateway struct {
+	mockGateway
+	selected []int
+}
+
+func (g *selectingGateway) AskBatch(platform.Peer, []platform.FileInfo) []int { return g.selected }
+
+var _ platform.BatchGateway = (*selectingGateway)(nil)
+
+// TestAnswerSelectedRoundTrip tests marshal → unmarshal of a selective answer
+func TestAnswerSelectedRoundTrip(t *testing.T) {
+	original := Accept()
+	original.Selected = []int{0, 3, 7}
+	answer, ok := UnmarshalFrame(original.MarshalMessage()).(Answer)
+	if !ok {
+		t.Fatal("UnmarshalFrame() did not return an Answer")
+	}
+	if !answer.Accepted() || !slices.Equal(answer.Selected, original.Selected) {
+		t.Errorf("answer = %+v, want %+v", answer, original)
+	}
+}
+
+// TestCheckSelection tests validation of selected indices
+func TestCheckSelection(t *testing.T) {
+	tests := map[string]struct {
+		selected []int
+		valid    bool
+	}{
+		"ascending":    {[]int{0, 2, 4}, true},
+		"empty":        {nil, true},
+		"out of range": {[]int{0, 5}, false},
+		"negative":     {[]int{-1}, false},
+		"duplicate":    {[]int{1, 1}, false},
+		"descending":   {[]int{3, 1}, false},
+	}
+	for name, tt := range tests {
+		if err := checkSelection(tt.selected, 5); (err == nil) != tt.valid {
+			t.Errorf("%s: checkSelection(%v) = %v", name, tt.selected, err)
+		}
+	}
+}
+
+// runSelectiveTransfer sends three files to a receiver that selects only the second one
+func runSelectiveTransfer(t *testing.T, features ...Feature) (string, *selectingGateway, *mockGateway) {
+	t.Helper()
+	dir := useDownloadDir(t)
+	src := t.TempDir()
+	var filenames []string
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		path := filepath.Join(src, name)
+		if err := os.WriteFile(path, []byte("content of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, path)
+	}
+
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	receiver := &selectingGateway{selected: []int{1}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		HandleConnection(context.Background(), withFeatures(serverConn, features...), receiver, nil, nil)
+	}()
+
+	sender := &mockGateway{}
+	conn := withFeatures(clientConn, features...)
+	outbound := NewOutboundTransferState()
+	senderDone := make(chan struct{})
+	go func() {
+		defer close(senderDone)
+		HandleConnection(context.Background(), conn, sender, nil, outbound)
+	}()
+	if err := SendBatch(filenames, conn, outbound); err != nil {
+		t.Fatalf("SendBatch() failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := outbound.Wait(ctx); err != nil {
+		t.Fatalf("Wait() = %v, want nil", err)
+	}
+	_ = clientConn.Close()
+	for _, ch := range []chan struct{}{done, senderDone} {
+		select {
+		case <-ch:
+		case <-time.After(2 * time.Second):
+			t.Fatal("HandleConnection did not return")
+		}
+	}
+	return dir, receiver, sender
+}
+
+// assertOnlySelected checks that exactly the selected file arrived
+func assertOnlySelected(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "b.txt" {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Fatalf("download directory = %v, want [b.txt]", names)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "b.txt"))
+	if err != nil || string(content) != "content of b.txt" {
+		t.Errorf("b.txt = %q, %v", content, err)
+	}
+}
+
+// TestSelectiveBatchStreamsOnlySelectedFiles tests that the sender skips files the receiver did not select
+func TestSelectiveBatchStreamsOnlySelectedFiles(t *testing.T) {
+	dir, receiver, sender := runSelectiveTransfer(t, FeatureResume, FeatureChecksums, FeatureSelection)
+	assertOnlySelected(t, dir)
+	sentOne := slices.ContainsFunc(sender.notifications, func(n string) bool {
+		return strings.HasPrefix(n, "File sent: ") && strings.HasSuffix(n, "b.txt")
+	})
+	if !sentOne {
+		t.Errorf("sender notifications = %v, want only b.txt sent", sender.notifications)
+	}
+	if !receiver.hasNotification("Batch received: 1 files") {
+		t.Errorf("receiver notifications = %v", receiver.notifications)
+	}
+}
+
+// TestSelectiveBatchWithoutFeatureDiscardsUnselected tests that a sender unable to skip files still works
+func TestSelectiveBatchWithoutFeatureDiscardsUnselected(t *testing.T) {
+	dir, _, sender := runSelectiveTransfer(t, FeatureChecksums)
+	assertOnlySelected(t, dir)
+	if !sender.hasNotification("Batch sent: 3 files") {
+		t.Errorf("sender notifications = %v, want all files sent", sender.notifications)
+	}
+}
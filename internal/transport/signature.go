@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"github.com/metalgrid/drift/internal/audit"
+	"github.com/metalgrid/drift/internal/secret"
+	"github.com/rs/zerolog/log"
+)
+
+// offerLabel keeps the signatures of offers apart from anything else signed with an
+// identity key.
+const offerLabel = "drift offer v1"
+
+// offerManifest is what the signature of an offer covers: the identity keys of its
+// sender and recipient, so that it cannot be replayed between others, the transfer ID
+// and the offered files.
+func offerManifest(sender, recipient []byte, transferID string, files []FileEntry) []byte {
+	var w fieldWriter
+	w.buf = append(w.buf, offerLabel...)
+	w.buf = append(w.buf, sender...)
+	w.buf = append(w.buf, recipient...)
+	w.string(fieldTransferID, transferID)
+	for _, file := range files {
+		w.bytes(fieldFile, file.marshalFields())
+	}
+	return w.buf
+}
+
+// SetIdentity sets the identity that signs our offers on the connection and that the
+// peer's offers are addressed to.
+func (c *Conn) SetIdentity(id *secret.Identity) {
+	c.identity = id
+}
+
+// signOffer signs an offer to the peer. It returns nil if the connection lacks the
+// identities to sign with.
+func signOffer(c *Conn, transferID string, files []FileEntry) []byte {
+	peer := c.Peer()
+	if c.identity == nil || len(peer.Key) != 32 {
+		return nil
+	}
+	signature, err := c.identity.Sign(offerManifest(c.identity.PublicKey[:], peer.Key, transferID, files))
+	if err != nil {
+		log.Warn().Err(err).Msg("failed signing offer")
+		return nil
+	}
+	return signature
+}
+
+// verifyOffer reports whether an offer from the peer is signed by the identity key
+// pinned for it before the connection. Offers of peers whose key changed or was only
+// pinned on this connection are never verified, since the signature then shows no more
+// than the handshake did, and neither are those of older peers, which do not sign them.
+func verifyOffer(c *Conn, transferID string, files []FileEntry, signature []byte) bool {
+	peer := c.Peer()
+	if len(signature) == 0 || c.identity == nil || !peer.Pinned || peer.KeyChanged || len(peer.Key) != 32 {
+		return false
+	}
+	key := [32]byte(peer.Key)
+	if !secret.Verify(&key, offerManifest(peer.Key, c.identity.PublicKey[:], transferID, files), signature) {
+		log.Warn().Str("peer", peer.Name).Msg("offer has an invalid signature")
+		recordPeer(audit.Integrity, peer, "invalid signature", "offer "+transferID)
+		return false
+	}
+	return true
+}
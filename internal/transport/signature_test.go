@@ -0,0 +1,123 @@
+package transport
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/metalgrid/drift/internal/platform"
+	"github.com/metalgrid/drift/internal/secret"
+)
+
+// peerRecordingGateway declines batch prompts and records who they came from
+type peerRecordingGateway struct {
+	mockGateway
+	peers chan platform.Peer
+}
+
+func (g *peerRecordingGateway) AskBatch(peer platform.Peer, _ []platform.FileInfo) []int {
+	g.peers <- peer
+	return nil
+}
+
+// signedConnPair returns the ends of a connection between the identities sender and recipient,
+// which pinned each other's keys before
+func signedConnPair(t *testing.T, sender, recipient *secret.Identity) (*Conn, *Conn) {
+	t.Helper()
+	senderConn, recipientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = senderConn.Close()
+		_ = recipientConn.Close()
+	})
+	s, r := withFeatures(senderConn), withFeatures(recipientConn)
+	s.SetIdentity(sender)
+	s.SetPeer(platform.Peer{Name: "bob", Key: recipient.PublicKey[:], Pinned: true})
+	r.SetIdentity(recipient)
+	r.SetPeer(platform.Peer{Name: "alice", Key: sender.PublicKey[:], Pinned: true})
+	return s, r
+}
+
+func mustIdentity(t *testing.T) *secret.Identity {
+	t.Helper()
+	id, err := secret.GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// TestVerifyOffer tests that only untouched offers signed by the peer for us verify
+func TestVerifyOffer(t *testing.T) {
+	alice, bob, mallory := mustIdentity(t), mustIdentity(t), mustIdentity(t)
+	files := []FileEntry{{Filename: "notes.txt", Mimetype: mimeType, Size: 10}}
+	sender, recipient := signedConnPair(t, alice, bob)
+	signature := signOffer(sender, "id", files)
+	if signature == nil {
+		t.Fatal("signOffer() returned no signature")
+	}
+
+	if !verifyOffer(recipient, "id", files, signature) {
+		t.Error("verifyOffer() rejected a valid signature")
+	}
+	if verifyOffer(recipient, "id", nil, nil) {
+		t.Error("verifyOffer() accepted an unsigned offer")
+	}
+	if verifyOffer(recipient, "other", files, signature) {
+		t.Error("verifyOffer() accepted a signature of another transfer")
+	}
+	if verifyOffer(recipient, "id", []FileEntry{{Filename: "notes.txt", Mimetype: mimeType, Size: 11}}, signature) {
+		t.Error("verifyOffer() accepted a signature of other files")
+	}
+
+	_, elsewhere := signedConnPair(t, alice, mallory)
+	if verifyOffer(elsewhere, "id", files, signature) {
+		t.Error("verifyOffer() accepted a signature addressed to another recipient")
+	}
+
+	peer := recipient.Peer()
+	peer.Pinned = false
+	recipient.SetPeer(peer)
+	if verifyOffer(recipient, "id", files, signature) {
+		t.Error("verifyOffer() accepted an offer from a peer seen for the first time")
+	}
+
+	peer.Pinned, peer.KeyChanged = true, true
+	recipient.SetPeer(peer)
+	if verifyOffer(recipient, "id", files, signature) {
+		t.Error("verifyOffer() accepted an offer from a peer whose key changed")
+	}
+}
+
+// TestHandleConnectionVerifiesSignedOffer tests that the prompt tells signed offers from unsigned ones
+func TestHandleConnectionVerifiesSignedOffer(t *testing.T) {
+	useDownloadDir(t)
+	source := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(source, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, signed := range []bool{true, false} {
+		alice, bob := mustIdentity(t), mustIdentity(t)
+		sender, recipient := signedConnPair(t, alice, bob)
+		if !signed {
+			// An older sender, which does not sign its offers.
+			sender.SetIdentity(nil)
+		}
+		gw := &peerRecordingGateway{peers: make(chan platform.Peer, 1)}
+		go HandleConnection(context.Background(), recipient, gw, nil, nil)
+
+		if err := SendFile(source, sender, NewOutboundTransferState()); err != nil {
+			t.Fatalf("SendFile() failed: %v", err)
+		}
+		select {
+		case peer := <-gw.peers:
+			if peer.SignedOffer != signed {
+				t.Errorf("signed %v: SignedOffer = %v", signed, peer.SignedOffer)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("signed %v: the user was not asked", signed)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FeatureDirectories allows batch offers to carry directory trees: entries with
+// slash-separated relative paths, and entries for (possibly empty) directories.
+const FeatureDirectories Feature = "directories"
+
+// ErrUnsafePath is reported for offered names that could escape the download directory.
+var ErrUnsafePath = errors.New("unsafe path")
+
+// checkEntryPath validates a name received from the wire. Names are slash-separated
+// and relative; nested paths are only allowed when directories were negotiated.
+func checkEntryPath(name string, nested bool) error {
+	if name == "" || name == "." || strings.ContainsAny(name, "\x00\\") {
+		return fmt.Errorf("%w: %q", ErrUnsafePath, name)
+	}
+	if !nested && strings.Contains(name, "/") {
+		return fmt.Errorf("%w: %q contains a directory", ErrUnsafePath, name)
+	}
+	if path.Clean(name) != name || !filepath.IsLocal(filepath.FromSlash(name)) {
+		return fmt.Errorf("%w: %q", ErrUnsafePath, name)
+	}
+	return nil
+}
+
+// checkEntries validates every entry of an offer before anything is written to disk.
+func checkEntries(c *Conn, files []FileEntry) error {
+	nested := c.Supports(FeatureDirectories)
+	for _, file := range files {
+		if file.Directory && !nested {
+			return fmt.Errorf("%w: unexpected directory %q", ErrUnsafePath, file.Filename)
+		}
+		if err := checkEntryPath(file.Filename, nested); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// safeJoin resolves a validated entry name under root. Directories that already
+// exist on the way must not be symlinks, so a link in the download directory
+// cannot redirect writes elsewhere.
+func safeJoin(root, name string) (string, error) {
+	parts := strings.Split(name, "/")
+	current := root
+	for _, part := range parts[:len(parts)-1] {
+		current = filepath.Join(current, part)
+		fi, err := os.Lstat(current)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if !fi.IsDir() {
+			return "", fmt.Errorf("%w: %q is not a directory", ErrUnsafePath, current)
+		}
+	}
+	return filepath.Join(root, filepath.FromSlash(name)), nil
+}
+
+// prepareTree creates the directories of an accepted offer, including empty ones
+// and the parents of every file.
+func prepareTree(root string, files []FileEntry) error {
+	for _, file := range files {
+		target, err := safeJoin(root, file.Filename)
+		if err != nil {
+			return err
+		}
+		if !file.Directory {
+			target = filepath.Dir(target)
+		}
+		if err := os.MkdirAll(target, 0777); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandEntries turns the paths picked by the user into offer entries. Files are offered
+// under their base name and directories as a tree rooted at theirs. It also returns the
+// local path to read for each entry, which is empty for directories.
+// Entries that are neither regular files nor directories, such as symlinks, are skipped.
+func expandEntries(filenames []string) ([]FileEntry, []string, error) {
+	var entries []FileEntry
+	var sources []string
+	for _, filename := range filenames {
+		fileInfo, err := os.Stat(filename)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed offering file %s: %w", filename, err)
+		}
+		if !fileInfo.IsDir() {
+			entries = append(entries, FileEntry{
+				Filename: fileInfo.Name(),
+				Mimetype: mimeType,
+				Size:     fileInfo.Size(),
+			})
+			sources = append(sources, filename)
+			continue
+		}
+
+		root := filepath.Clean(filename)
+		base := filepath.Base(root)
+		if err := checkEntryPath(base, false); err != nil {
+			return nil, nil, fmt.Errorf("failed offering directory %s: %w", filename, err)
+		}
+		err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			name := path.Join(base, filepath.ToSlash(rel))
+			if err := checkEntryPath(name, true); err != nil {
+				// The receiver would reject the whole offer over it.
+				return err
+			}
+			switch {
+			case d.IsDir():
+				entries = append(entries, FileEntry{Filename: name, Directory: true})
+				sources = append(sources, "")
+			case d.Type().IsRegular():
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				entries = append(entries, FileEntry{Filename: name, Mimetype: mimeType, Size: info.Size()})
+				sources = append(sources, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed offering directory %s: %w", filename, err)
+		}
+	}
+	return entries, sources, nil
+}
+
+// hasTree reports whether an offer needs FeatureDirectories on the receiving end.
+func hasTree(files []FileEntry) bool {
+	for _, file := range files {
+		if file.Directory || strings.Contains(file.Filename, "/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// acceptingGateway is a mockGateway whose user accepts every prompt
+type acceptingGateway struct {
+	mockGateway
+}
+
+func (g *acceptingGateway) Ask(string) string { return "ACCEPT" }
+
+// TestCheckEntryPath tests validation of names received from the wire
+func TestCheckEntryPath(t *testing.T) {
+	tests := []struct {
+		name   string
+		nested bool
+		valid  bool
+	}{
+		{"photo.jpg", false, true},
+		{"album/photo.jpg", true, true},
+		{"album/photo.jpg", false, false},
+		{"", true, false},
+		{".", true, false},
+		{"..", true, false},
+		{"../photo.jpg", true, false},
+		{"album/../../photo.jpg", true, false},
+		{"/etc/passwd", true, false},
+		{"album//photo.jpg", true, false},
+		{"./photo.jpg", true, false},
+		{"album/", true, false},
+		{`..\photo.jpg`, true, false},
+		{"photo\x00.jpg", true, false},
+	}
+	for _, tt := range tests {
+		err := checkEntryPath(tt.name, tt.nested)
+		if tt.valid && err != nil {
+			t.Errorf("checkEntryPath(%q, %v) = %v, want nil", tt.name, tt.nested, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("checkEntryPath(%q, %v) = %v, want ErrUnsafePath", tt.name, tt.nested, err)
+		}
+	}
+}
+
+// TestSafeJoinRejectsSymlinkedDirectory tests that a symlink in the download directory cannot redirect writes
+func TestSafeJoinRejectsSymlinkedDirectory(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Symlink(t.TempDir(), filepath.Join(root, "album")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := safeJoin(root, "album/photo.jpg"); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("safeJoin() = %v, want ErrUnsafePath", err)
+	}
+}
+
+// makeTree creates a small directory tree with a nested file and an empty directory
+func makeTree(t *testing.T) string {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "album")
+	for _, dir := range []string{"2024/summer", "empty"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"cover.jpg":             "cover",
+		"2024/summer/beach.jpg": "sand",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// TestMakeBatchOfferDirectory tests that a directory is offered as a tree of relative paths
+func TestMakeBatchOfferDirectory(t *testing.T) {
+	root := makeTree(t)
+	batch, sources, err := makeBatchOffer([]string{root})
+	if err != nil {
+		t.Fatalf("makeBatchOffer() failed: %v", err)
+	}
+
+	var names []string
+	for i, file := range batch.Files {
+		names = append(names, file.Filename)
+		if file.Directory != (sources[i] == "") {
+			t.Errorf("entry %q: Directory = %v with source %q", file.Filename, file.Directory, sources[i])
+		}
+	}
+	want := []string{"album", "album/2024", "album/2024/summer", "album/2024/summer/beach.jpg", "album/cover.jpg", "album/empty"}
+	if !slices.Equal(names, want) {
+		t.Errorf("entries = %v, want %v", names, want)
+	}
+	if i := slices.Index(names, "album/2024/summer/beach.jpg"); batch.Files[i].Size != 4 {
+		t.Errorf("beach.jpg size = %d, want 4", batch.Files[i].Size)
+	}
+}
+
+// TestFileEntryDirectoryRoundTrip tests that directory entries survive marshalling
+func TestFileEntryDirectoryRoundTrip(t *testing.T) {
+	original := BatchOffer{
+		Message: Message{"BATCH_OFFER"},
+		Files: []FileEntry{
+			{Filename: "album", Directory: true},
+			{Filename: "album/cover.jpg", Mimetype: mimeType, Size: 5},
+		},
+	}
+	batch, ok := UnmarshalFrame(original.MarshalMessage()).(BatchOffer)
+	if !ok {
+		t.Fatal("UnmarshalFrame() did not return a BatchOffer")
+	}
+	if !slices.Equal(batch.Files, original.Files) {
+		t.Errorf("Files = %v, want %v", batch.Files, original.Files)
+	}
+}
+
+// TestSendBatchDirectoryRequiresFeature tests that a tree is not offered to a peer that would flatten it
+func TestSendBatchDirectoryRequiresFeature(t *testing.T) {
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	err := SendBatch([]string{makeTree(t)}, withFeatures(clientConn), NewOutboundTransferState())
+	if err == nil {
+		t.Error("SendBatch() offered a directory to a peer without directory support")
+	}
+}
+
+// TestHandleConnectionRejectsTraversal tests that an offer escaping the download directory is declined
+func TestHandleConnectionRejectsTraversal(t *testing.T) {
+	dir := useDownloadDir(t)
+	gw := &acceptingGateway{}
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	go HandleConnection(context.Background(), withFeatures(serverConn, FeatureDirectories), gw, nil, nil)
+
+	batch := BatchOffer{
+		Message: Message{"BATCH_OFFER"},
+		Files:   []FileEntry{{Filename: "../escaped.txt", Mimetype: mimeType, Size: 4}},
+	}
+	if _, err := clientConn.Write(batch.MarshalMessage()); err != nil {
+		t.Fatalf("failed writing batch offer: %v", err)
+	}
+
+	msg, err := ReadMessage(bufio.NewReader(clientConn))
+	if err != nil {
+		t.Fatalf("failed reading answer: %v", err)
+	}
+	if answer, ok := msg.(Answer); !ok || answer.Accepted() {
+		t.Errorf("answer = %v, want decline", msg)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escaped.txt")); !os.IsNotExist(err) {
+		t.Error("file outside the download directory was created")
+	}
+}
+
+// TestDirectoryTransferEndToEnd tests that a directory tree is rebuilt under the download directory
+func TestDirectoryTransferEndToEnd(t *testing.T) {
+	dir := useDownloadDir(t)
+	root := makeTree(t)
+
+	serverConn, clientConn := newTCPConnPair(t)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+		_ = clientConn.Close()
+	})
+
+	features := []Feature{FeatureResume, FeatureChecksums, FeatureDirectories}
+	receiver := &acceptingGateway{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		HandleConnection(context.Background(), withFeatures(serverConn, features...), receiver, nil, nil)
+	}()
+
+	sender := withFeatures(clientConn, features...)
+	outbound := NewOutboundTransferState()
+	go HandleConnection(context.Background(), sender, &mockGateway{}, nil, outbound)
+	if err := SendFile(root, sender, outbound); err != nil {
+		t.Fatalf("SendFile() failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := outbound.Wait(ctx); err != nil {
+		t.Fatalf("Wait() = %v, want nil", err)
+	}
+	_ = clientConn.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("receiver did not return")
+	}
+
+	for name, want := range map[string]string{"album/cover.jpg": "cover", "album/2024/summer/beach.jpg": "sand"} {
+		content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("ReadFile(%s) failed: %v", name, err)
+			continue
+		}
+		if string(content) != want {
+			t.Errorf("%s = %q, want %q", name, content, want)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "album", "empty")); err != nil || !fi.IsDir() {
+		t.Errorf("empty directory was not created: %v", err)
+	}
+	if !receiver.hasNotification("Batch received: 6 files") {
+		t.Errorf("notifications = %v, want a batch receipt", receiver.notifications)
+	}
+}
@@ -0,0 +1,122 @@
+package trust
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotBlocked is reported when unblocking a name or key that is not blocked.
+var ErrNotBlocked = errors.New("not blocked")
+
+// BlockedPeer is an entry of the blocklist. It blocks every peer with its instance name,
+// and every peer with its key, whichever of the two it has.
+type BlockedPeer struct {
+	Instance string    `json:"instance,omitempty"`
+	Key      string    `json:"key,omitempty"`
+	Since    time.Time `json:"since"`
+}
+
+// Matches reports whether the entry blocks a peer with the given instance name or key.
+func (b BlockedPeer) Matches(instance string, key []byte) bool {
+	return b.matches(instance, hex.EncodeToString(key))
+}
+
+func (b BlockedPeer) matches(instance, key string) bool {
+	return (b.Instance != "" && b.Instance == instance) || (b.Key != "" && b.Key == key)
+}
+
+// Blocklist holds the peers the user never wants to hear from again. Blocking a peer by
+// its name as well as its key keeps it out when it comes back with either one changed.
+// Like the known peers store, the file is read on every call.
+type Blocklist struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewBlocklist(path string) *Blocklist {
+	return &Blocklist{path: path}
+}
+
+// Block adds a peer to the blocklist by its instance name and key. Either may be empty,
+// but not both.
+func (b *Blocklist) Block(instance string, key []byte) error {
+	if instance == "" && len(key) == 0 {
+		return errors.New("nothing to block")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	blocked, err := b.load()
+	if err != nil {
+		return err
+	}
+	entry := BlockedPeer{Instance: instance, Key: hex.EncodeToString(key), Since: time.Now().UTC()}
+	if slices.ContainsFunc(blocked, func(e BlockedPeer) bool { return e.Instance == entry.Instance && e.Key == entry.Key }) {
+		return nil
+	}
+	return b.save(append(blocked, entry))
+}
+
+// Unblock removes every entry blocking the given instance name or hex-encoded key.
+func (b *Blocklist) Unblock(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	blocked, err := b.load()
+	if err != nil {
+		return err
+	}
+	kept := slices.DeleteFunc(slices.Clone(blocked), func(e BlockedPeer) bool {
+		return e.matches(name, strings.ToLower(name))
+	})
+	if len(kept) == len(blocked) {
+		return fmt.Errorf("%w: %s", ErrNotBlocked, name)
+	}
+	return b.save(kept)
+}
+
+// Blocks reports whether a peer with the given instance name or key is blocked.
+func (b *Blocklist) Blocks(instance string, key []byte) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	blocked, err := b.load()
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(blocked, func(e BlockedPeer) bool { return e.Matches(instance, key) }), nil
+}
+
+// List returns the blocklist, oldest entry first.
+func (b *Blocklist) List() ([]BlockedPeer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.load()
+}
+
+func (b *Blocklist) load() ([]BlockedPeer, error) {
+	data, err := os.ReadFile(b.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var blocked []BlockedPeer
+	if err := json.Unmarshal(data, &blocked); err != nil {
+		return nil, fmt.Errorf("invalid blocklist file %s: %w", b.path, err)
+	}
+	return blocked, nil
+}
+
+func (b *Blocklist) save(blocked []BlockedPeer) error {
+	if err := writeJSON(b.path, blocked); err != nil {
+		return fmt.Errorf("failed storing blocklist: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package trust
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func newTestBlocklist(t *testing.T) *Blocklist {
+	t.Helper()
+	return NewBlocklist(filepath.Join(t.TempDir(), "drift", "blocked_peers.json"))
+}
+
+// TestBlocklistBlocksByNameOrKey tests that an entry blocks peers with either its name or its key
+func TestBlocklistBlocksByNameOrKey(t *testing.T) {
+	b := newTestBlocklist(t)
+	if err := b.Block("mallory", []byte("m")); err != nil {
+		t.Fatalf("Block() failed: %v", err)
+	}
+
+	tests := []struct {
+		instance string
+		key      string
+		want     bool
+	}{
+		{"mallory", "m", true},
+		{"mallory", "other", true},
+		{"renamed", "m", true},
+		{"alice", "a", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, err := b.Blocks(tt.instance, []byte(tt.key))
+		if err != nil {
+			t.Fatalf("Blocks() failed: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("Blocks(%q, %q) = %v, want %v", tt.instance, tt.key, got, tt.want)
+		}
+	}
+}
+
+// TestBlocklistUnblock tests that unblocking by name or key removes the matching entries
+func TestBlocklistUnblock(t *testing.T) {
+	b := newTestBlocklist(t)
+	_ = b.Block("mallory", []byte("m"))
+	_ = b.Block("mallory", []byte("m"))
+	_ = b.Block("", []byte{0xab})
+
+	list, err := b.List()
+	if err != nil {
+		t.Fatalf("List() failed: %v", err)
+	}
+	if len(list) != 2 || list[0].Instance != "mallory" || list[0].Key != "6d" || list[1].Key != "ab" {
+		t.Errorf("List() = %+v, want mallory and a bare key", list)
+	}
+
+	if err := b.Unblock("mallory"); err != nil {
+		t.Fatalf("Unblock() by name failed: %v", err)
+	}
+	if err := b.Unblock("AB"); err != nil {
+		t.Fatalf("Unblock() by key failed: %v", err)
+	}
+	if err := b.Unblock("mallory"); !errors.Is(err, ErrNotBlocked) {
+		t.Errorf("Unblock() of an unblocked peer = %v, want ErrNotBlocked", err)
+	}
+	if blocked, _ := b.Blocks("renamed", []byte("m")); blocked {
+		t.Error("Blocks() after Unblock() = true, want false")
+	}
+}
+
+// TestBlocklistBlockNothing tests that an entry needs a name or a key
+func TestBlocklistBlockNothing(t *testing.T) {
+	if err := newTestBlocklist(t).Block("", nil); err == nil {
+		t.Error("Block() without name and key succeeded")
+	}
+}
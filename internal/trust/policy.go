@@ -0,0 +1,83 @@
+package trust
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// PolicyMode is the kind of standing answer a user gave for the offers of a peer.
+type PolicyMode string
+
+const (
+	// AlwaysAsk asks the user about every offer, as for peers without a policy.
+	AlwaysAsk PolicyMode = ""
+	// AlwaysAccept accepts every offer.
+	AlwaysAccept PolicyMode = "accept"
+	// AcceptUnder accepts offers up to the policy's limit and asks about larger ones.
+	AcceptUnder PolicyMode = "accept-under"
+	// AlwaysDecline declines every offer.
+	AlwaysDecline PolicyMode = "decline"
+)
+
+// Decision is what a policy makes of an offer.
+type Decision int
+
+const (
+	// Undecided leaves the offer to the user.
+	Undecided Decision = iota
+	Accept
+	Decline
+)
+
+// Policy decides on offers from a known peer without asking the user. It is stored
+// with the key pinned for the peer, and does not apply to any other key.
+type Policy struct {
+	Mode PolicyMode `json:"mode,omitempty"`
+	// Limit is the largest offer, in bytes, that AcceptUnder accepts.
+	Limit int64 `json:"limit,omitempty"`
+}
+
+// Decide applies the policy to an offer of size bytes in total. An offer of a negative
+// size is malformed, and declined whatever the policy.
+func (p Policy) Decide(size int64) Decision {
+	switch {
+	case size < 0:
+		return Decline
+	case p.Mode == AlwaysAccept:
+		return Accept
+	case p.Mode == AcceptUnder && size <= p.Limit:
+		return Accept
+	case p.Mode == AlwaysDecline:
+		return Decline
+	}
+	return Undecided
+}
+
+func (p Policy) String() string {
+	switch p.Mode {
+	case AlwaysAsk:
+		return "ask"
+	case AcceptUnder:
+		return fmt.Sprintf("accept under %d MiB", p.Limit>>20)
+	default:
+		return string(p.Mode)
+	}
+}
+
+// ParsePolicy reads a policy as given on the command line: "ask", "accept", "decline",
+// or "accept-under" followed by a size in MiB.
+func ParsePolicy(args ...string) (Policy, error) {
+	switch {
+	case len(args) == 1 && args[0] == "ask":
+		return Policy{Mode: AlwaysAsk}, nil
+	case len(args) == 1 && (args[0] == string(AlwaysAccept) || args[0] == string(AlwaysDecline)):
+		return Policy{Mode: PolicyMode(args[0])}, nil
+	case len(args) == 2 && args[0] == string(AcceptUnder):
+		mib, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || mib <= 0 || mib > 1<<42 {
+			return Policy{}, fmt.Errorf("invalid size %q, expected a number of MiB", args[1])
+		}
+		return Policy{Mode: AcceptUnder, Limit: mib << 20}, nil
+	}
+	return Policy{}, fmt.Errorf("unknown policy %q", args)
+}
@@ -0,0 +1,52 @@
+package trust
+
+import "testing"
+
+// TestPolicyDecide tests which offers each kind of policy accepts and declines
+func TestPolicyDecide(t *testing.T) {
+	for _, tc := range []struct {
+		policy Policy
+		size   int64
+		want   Decision
+	}{
+		{Policy{}, 1, Undecided},
+		{Policy{Mode: AlwaysAccept}, 1 << 40, Accept},
+		{Policy{Mode: AcceptUnder, Limit: 10 << 20}, 10 << 20, Accept},
+		{Policy{Mode: AcceptUnder, Limit: 10 << 20}, 10<<20 + 1, Undecided},
+		{Policy{Mode: AlwaysDecline}, 0, Decline},
+		{Policy{Mode: "unknown"}, 1, Undecided},
+		{Policy{Mode: AlwaysAccept}, -1, Decline},
+		{Policy{Mode: AcceptUnder, Limit: 10 << 20}, -1 << 62, Decline},
+		{Policy{}, -1, Decline},
+	} {
+		if got := tc.policy.Decide(tc.size); got != tc.want {
+			t.Errorf("%s: Decide(%d) = %d, want %d", tc.policy, tc.size, got, tc.want)
+		}
+	}
+}
+
+// TestParsePolicy tests that policies are read as given on the command line
+func TestParsePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want Policy
+	}{
+		{[]string{"ask"}, Policy{}},
+		{[]string{"accept"}, Policy{Mode: AlwaysAccept}},
+		{[]string{"decline"}, Policy{Mode: AlwaysDecline}},
+		{[]string{"accept-under", "500"}, Policy{Mode: AcceptUnder, Limit: 500 << 20}},
+	} {
+		got, err := ParsePolicy(tc.args...)
+		if err != nil || got != tc.want {
+			t.Errorf("ParsePolicy(%q) = %+v, %v; want %+v", tc.args, got, err, tc.want)
+		}
+		if again, err := ParsePolicy(tc.args...); err != nil || again.String() != got.String() {
+			t.Errorf("ParsePolicy(%q) is not stable", tc.args)
+		}
+	}
+	for _, args := range [][]string{nil, {"always"}, {"accept-under"}, {"accept-under", "-1"}, {"accept-under", "lots"}, {"accept", "5"}} {
+		if _, err := ParsePolicy(args...); err == nil {
+			t.Errorf("ParsePolicy(%q) succeeded", args)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package trust
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status is what the store knows about a key a peer presented.
+type Status int
+
+const (
+	// New peers were never seen before. Their key is pinned from now on.
+	New Status = iota
+	// Known peers presented the key pinned for them.
+	Known
+	// Changed peers presented another key than the one pinned for them. Either the
+	// peer's identity was rotated or reinstalled, or someone else claims its name.
+	Changed
+	// Verified peers presented the key pinned for them, which the user confirmed by
+	// comparing short authentication strings with the peer's user.
+	Verified
+)
+
+func (s Status) String() string {
+	switch s {
+	case New:
+		return "new"
+	case Known:
+		return "known"
+	case Changed:
+		return "changed"
+	case Verified:
+		return "verified"
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+var (
+	ErrUnknownPeer = errors.New("unknown peer")
+	ErrKeyMismatch = errors.New("key differs from the one pinned for the peer")
+)
+
+// Peer is a peer whose key was pinned on first contact.
+type Peer struct {
+	Instance  string    `json:"instance"`
+	Key       string    `json:"key"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Verified  bool      `json:"verified,omitempty"`
+	// Policy decides on the peer's offers, if the user set one.
+	Policy *Policy `json:"policy,omitempty"`
+}
+
+// Store remembers the key of every peer by its instance name, the first time the peer
+// authenticates, much like ssh's known_hosts. The file is read on every call, so that
+// several processes can share it.
+type Store struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// Observe records that the peer with the given instance name authenticated with key.
+// A new peer gets its key pinned. A changed key is reported, but does not replace the
+// pinned one until the peer is forgotten.
+func (s *Store) Observe(instance string, key []byte) (Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers, err := s.load()
+	if err != nil {
+		return New, err
+	}
+
+	now := time.Now().UTC()
+	encoded := hex.EncodeToString(key)
+	i := slices.IndexFunc(peers, func(p Peer) bool { return p.Instance == instance })
+	switch {
+	case i < 0:
+		peers = append(peers, Peer{Instance: instance, Key: encoded, FirstSeen: now, LastSeen: now})
+		return New, s.save(peers)
+	case peers[i].Key != encoded:
+		return Changed, nil
+	}
+	peers[i].LastSeen = now
+	status := Known
+	if peers[i].Verified {
+		status = Verified
+	}
+	return status, s.save(peers)
+}
+
+// Verify marks a peer as verified by its user, provided that key is the one pinned for it.
+func (s *Store) Verify(instance string, key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers, err := s.load()
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(peers, func(p Peer) bool { return p.Instance == instance })
+	switch {
+	case i < 0:
+		return fmt.Errorf("%w: %s", ErrUnknownPeer, instance)
+	case peers[i].Key != hex.EncodeToString(key):
+		return fmt.Errorf("%w: %s", ErrKeyMismatch, instance)
+	}
+	peers[i].Verified = true
+	return s.save(peers)
+}
+
+// SetPolicy sets the policy for offers from a known peer. The policy is forgotten
+// along with the peer's key.
+func (s *Store) SetPolicy(instance string, policy Policy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers, err := s.load()
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(peers, func(p Peer) bool { return p.Instance == instance })
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrUnknownPeer, instance)
+	}
+	peers[i].Policy = nil
+	if policy.Mode != AlwaysAsk {
+		peers[i].Policy = &policy
+	}
+	return s.save(peers)
+}
+
+// Get returns the known peer with the given instance name, or ErrUnknownPeer.
+func (s *Store) Get(instance string) (Peer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers, err := s.load()
+	if err != nil {
+		return Peer{}, err
+	}
+	i := slices.IndexFunc(peers, func(p Peer) bool { return p.Instance == instance })
+	if i < 0 {
+		return Peer{}, fmt.Errorf("%w: %s", ErrUnknownPeer, instance)
+	}
+	return peers[i], nil
+}
+
+// FindByKey returns the known peer whose pinned key is key, or ErrUnknownPeer.
+func (s *Store) FindByKey(key []byte) (Peer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers, err := s.load()
+	if err != nil {
+		return Peer{}, err
+	}
+	encoded := hex.EncodeToString(key)
+	i := slices.IndexFunc(peers, func(p Peer) bool { return p.Key == encoded })
+	if i < 0 {
+		return Peer{}, fmt.Errorf("%w: key %s", ErrUnknownPeer, encoded)
+	}
+	return peers[i], nil
+}
+
+// List returns the known peers ordered by instance name.
+func (s *Store) List() ([]Peer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load()
+}
+
+// Forget removes the pinned key of a peer, so that the next key it presents is trusted
+// on first use again.
+func (s *Store) Forget(instance string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers, err := s.load()
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(peers, func(p Peer) bool { return p.Instance == instance })
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrUnknownPeer, instance)
+	}
+	return s.save(slices.Delete(peers, i, i+1))
+}
+
+func (s *Store) load() ([]Peer, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var peers []Peer
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, fmt.Errorf("invalid known peers file %s: %w", s.path, err)
+	}
+	slices.SortFunc(peers, func(a, b Peer) int { return strings.Compare(a.Instance, b.Instance) })
+	return peers, nil
+}
+
+// save replaces the file atomically, so that a crash never loses the pinned keys.
+func (s *Store) save(peers []Peer) error {
+	if err := writeJSON(s.path, peers); err != nil {
+		return fmt.Errorf("failed storing known peers: %w", err)
+	}
+	return nil
+}
+
+// writeJSON replaces the file at path with v, atomically, creating its directory if needed.
+func writeJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, filepath.Base(path)+"*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,158 @@
+package trust
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	return NewStore(filepath.Join(t.TempDir(), "drift", "known_peers.json"))
+}
+
+// TestStorePinsKeyOnFirstUse tests that the first key of a peer is pinned and later ones are checked against it
+func TestStorePinsKeyOnFirstUse(t *testing.T) {
+	s := newTestStore(t)
+	steps := []struct {
+		key  string
+		want Status
+	}{
+		{"first", New},
+		{"first", Known},
+		{"other", Changed},
+		{"first", Known},
+	}
+	for _, step := range steps {
+		got, err := s.Observe("alice", []byte(step.key))
+		if err != nil {
+			t.Fatalf("Observe(%s) failed: %v", step.key, err)
+		}
+		if got != step.want {
+			t.Errorf("Observe(%s) = %s, want %s", step.key, got, step.want)
+		}
+	}
+	if got, _ := s.Observe("bob", []byte("other")); got != New {
+		t.Errorf("Observe() of another peer = %s, want new", got)
+	}
+}
+
+// TestStoreForget tests that a forgotten peer is trusted on first use again
+func TestStoreForget(t *testing.T) {
+	s := newTestStore(t)
+	_, _ = s.Observe("bob", []byte("b"))
+	_, _ = s.Observe("alice", []byte("a"))
+
+	peers, err := s.List()
+	if err != nil {
+		t.Fatalf("List() failed: %v", err)
+	}
+	if len(peers) != 2 || peers[0].Instance != "alice" || peers[0].Key != "61" || peers[1].Instance != "bob" {
+		t.Errorf("List() = %+v, want alice and bob", peers)
+	}
+
+	if err := s.Forget("alice"); err != nil {
+		t.Fatalf("Forget() failed: %v", err)
+	}
+	if err := s.Forget("alice"); !errors.Is(err, ErrUnknownPeer) {
+		t.Errorf("Forget() of a forgotten peer = %v, want ErrUnknownPeer", err)
+	}
+	if got, _ := s.Observe("alice", []byte("new")); got != New {
+		t.Errorf("Observe() after Forget() = %s, want new", got)
+	}
+}
+
+// TestStoreVerify tests that only the pinned key of a peer can be verified, until the peer is forgotten
+func TestStoreVerify(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.Verify("alice", []byte("a")); !errors.Is(err, ErrUnknownPeer) {
+		t.Errorf("Verify() of an unknown peer = %v, want ErrUnknownPeer", err)
+	}
+	_, _ = s.Observe("alice", []byte("a"))
+	if err := s.Verify("alice", []byte("b")); !errors.Is(err, ErrKeyMismatch) {
+		t.Errorf("Verify() of another key = %v, want ErrKeyMismatch", err)
+	}
+	if err := s.Verify("alice", []byte("a")); err != nil {
+		t.Fatalf("Verify() failed: %v", err)
+	}
+	if got, _ := s.Observe("alice", []byte("a")); got != Verified {
+		t.Errorf("Observe() = %s, want verified", got)
+	}
+	if got, _ := s.Observe("alice", []byte("b")); got != Changed {
+		t.Errorf("Observe() of another key = %s, want changed", got)
+	}
+
+	_ = s.Forget("alice")
+	_, _ = s.Observe("alice", []byte("b"))
+	if got, _ := s.Observe("alice", []byte("b")); got != Known {
+		t.Errorf("Observe() after Forget() = %s, want known", got)
+	}
+}
+
+// TestStoreIsShared tests that stores on the same file see each other's changes
+func TestStoreIsShared(t *testing.T) {
+	s := newTestStore(t)
+	other := NewStore(s.path)
+
+	_, _ = s.Observe("alice", []byte("a"))
+	if got, _ := other.Observe("alice", []byte("b")); got != Changed {
+		t.Errorf("Observe() = %s, want changed", got)
+	}
+	if err := other.Forget("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if peers, _ := s.List(); len(peers) != 0 {
+		t.Errorf("List() = %+v after the peer was forgotten elsewhere", peers)
+	}
+}
+
+// TestStoreFindByKey tests that a peer is found by the key pinned for it
+func TestStoreFindByKey(t *testing.T) {
+	s := newTestStore(t)
+	if _, err := s.FindByKey([]byte("a")); !errors.Is(err, ErrUnknownPeer) {
+		t.Errorf("FindByKey() in an empty store = %v, want ErrUnknownPeer", err)
+	}
+	_, _ = s.Observe("alice", []byte("a"))
+	_, _ = s.Observe("bob", []byte("b"))
+	_, _ = s.Observe("alice", []byte("c"))
+
+	if peer, err := s.FindByKey([]byte("b")); err != nil || peer.Instance != "bob" {
+		t.Errorf("FindByKey() = %+v, %v; want bob", peer, err)
+	}
+	if _, err := s.FindByKey([]byte("c")); !errors.Is(err, ErrUnknownPeer) {
+		t.Errorf("FindByKey() of a changed key = %v, want ErrUnknownPeer", err)
+	}
+}
+
+// TestStoreSetPolicy tests that a policy is kept with the pinned key and forgotten with it
+func TestStoreSetPolicy(t *testing.T) {
+	s := newTestStore(t)
+	policy := Policy{Mode: AcceptUnder, Limit: 1 << 20}
+	if err := s.SetPolicy("alice", policy); !errors.Is(err, ErrUnknownPeer) {
+		t.Errorf("SetPolicy() of an unknown peer = %v, want ErrUnknownPeer", err)
+	}
+	_, _ = s.Observe("alice", []byte("a"))
+	if err := s.SetPolicy("alice", policy); err != nil {
+		t.Fatalf("SetPolicy() failed: %v", err)
+	}
+	if peer, err := s.Get("alice"); err != nil || peer.Policy == nil || *peer.Policy != policy {
+		t.Errorf("Get() = %+v, %v; want policy %s", peer, err, policy)
+	}
+
+	if err := s.SetPolicy("alice", Policy{Mode: AlwaysAsk}); err != nil {
+		t.Fatalf("SetPolicy() failed: %v", err)
+	}
+	if peer, _ := s.Get("alice"); peer.Policy != nil {
+		t.Errorf("policy = %s after setting ask, want none", peer.Policy)
+	}
+
+	_ = s.SetPolicy("alice", policy)
+	_ = s.Forget("alice")
+	_, _ = s.Observe("alice", []byte("b"))
+	if peer, _ := s.Get("alice"); peer.Policy != nil {
+		t.Errorf("policy = %s after forgetting the peer, want none", peer.Policy)
+	}
+	if _, err := s.Get("bob"); !errors.Is(err, ErrUnknownPeer) {
+		t.Errorf("Get() of an unknown peer = %v, want ErrUnknownPeer", err)
+	}
+}
@@ -2,6 +2,7 @@ package zeroconf
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
 	"maps"
 	"net"
@@ -97,19 +98,59 @@ func (p *Peers) GetByInstance(instance string) *PeerInfo {
 	return nil
 }
 
-func (p *Peers) GetByAddr(addr net.Addr) *PeerInfo {
-	remoteIP := netip.MustParseAddrPort(addr.String())
+// GetByKey returns the peers advertising the given public key, ordered by instance name.
+// Advertisements are not authenticated, so when there are several, all but one of them
+// impersonate the peer holding the key and none can be told apart from it.
+func (p *Peers) GetByKey(key []byte) []*PeerInfo {
+	encoded := hex.EncodeToString(key)
 
 	p.mu.RLock()
 	defer p.mu.RUnlock()
+	var found []*PeerInfo
+	for _, pi := range p.peers {
+		if strings.EqualFold(pi.GetRecord("pk"), encoded) {
+			found = append(found, pi)
+		}
+	}
+	slices.SortFunc(found, func(a, b *PeerInfo) int { return strings.Compare(a.Instance, b.Instance) })
+	return found
+}
+
+// GetByAddr returns the peers advertising the IP address of addr, ordered by instance
+// name. Several peers can share an address, so this does not identify a peer; GetByKey
+// does.
+func (p *Peers) GetByAddr(addr net.Addr) []*PeerInfo {
+	remoteIP, ok := ipOf(addr)
+	if !ok {
+		return nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var found []*PeerInfo
 	for _, pi := range p.peers {
 		if slices.ContainsFunc(pi.Addresses, func(ip netip.Addr) bool {
-			return ip == remoteIP.Addr()
+			return ip.WithZone("").Unmap() == remoteIP
 		}) {
-			return pi
+			found = append(found, pi)
 		}
 	}
-	return nil
+	slices.SortFunc(found, func(a, b *PeerInfo) int { return strings.Compare(a.Instance, b.Instance) })
+	return found
+}
+
+// ipOf returns the IP address of addr without its zone, which advertised addresses
+// may or may not carry.
+func ipOf(addr net.Addr) (netip.Addr, bool) {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		ip, ok := netip.AddrFromSlice(tcp.IP)
+		return ip.Unmap(), ok
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().WithZone("").Unmap(), true
 }
 
 func (p *Peers) add(pi *PeerInfo) {
@@ -139,6 +180,8 @@ func (p *Peers) remove(key string) {
 type ZeroconfService struct {
 	servicePort int
 	pubkey      string
+	version     string
+	kex         string
 	instance    string
 	peers       *Peers
 	client      *zc.Client
@@ -152,11 +195,14 @@ func (svc *ZeroconfService) Start(ctx context.Context) error {
 	kind := zc.NewType(serviceType)
 	service := zc.NewService(kind, svc.instance, uint16(svc.servicePort))
 	service.Text = []string{
-		"v=0.1",
+		"v=" + svc.version,
 		"pk=" + svc.pubkey,
 		"os=" + runtime.GOOS,
 		fmt.Sprintf("port=%d", svc.servicePort),
 	}
+	if svc.kex != "" {
+		service.Text = append(service.Text, "kex="+svc.kex)
+	}
 
 	svc.client.Publish(service)
 
@@ -186,6 +232,11 @@ func (svc *ZeroconfService) Peers() *Peers {
 
 type ZeroconfOptions struct {
 	Identity string
+	// Version is the protocol version advertised in the "v=" TXT record.
+	Version string
+	// KeyExchanges lists the key exchanges of the secure handshake supported beyond the
+	// classic one, in the "kex=" TXT record. The record is left out when it is empty.
+	KeyExchanges string
 }
 
 func NewZeroconfService(port int, pubkey string, options *ZeroconfOptions) (*ZeroconfService, error) {
@@ -208,10 +259,16 @@ func NewZeroconfService(port int, pubkey string, options *ZeroconfOptions) (*Zer
 	}
 
 	identity = fmt.Sprintf("%s’s %s", username, hostname)
+	version := "0.1"
+	var kex string
 	if options != nil {
+		kex = options.KeyExchanges
 		if options.Identity != "" {
 			identity = options.Identity
 		}
+		if options.Version != "" {
+			version = options.Version
+		}
 	}
 
 	client := zc.New()
@@ -222,6 +279,8 @@ func NewZeroconfService(port int, pubkey string, options *ZeroconfOptions) (*Zer
 	svc := &ZeroconfService{
 		servicePort: port,
 		pubkey:      pubkey,
+		version:     version,
+		kex:         kex,
 		instance:    identity,
 		peers: &Peers{
 			mu:    &sync.RWMutex{},
@@ -1,6 +1,7 @@
 package zeroconf
 
 import (
+	"net"
 	"net/netip"
 	"sync"
 	"testing"
@@ -154,3 +155,75 @@ func TestPeersAllReturnsCopy(t *testing.T) {
 		t.Errorf("Expected 3 peers in new snapshot, got %d", len(newSnapshot))
 	}
 }
+
+func TestPeersGetByKey(t *testing.T) {
+	peers := &Peers{
+		mu:    &sync.RWMutex{},
+		peers: make(map[string]*PeerInfo),
+	}
+	shared := []netip.Addr{netip.MustParseAddr("192.168.1.100")}
+	peers.add(&PeerInfo{Service: "_drift._tcp", Instance: "alice", Domain: "local.", Records: []string{"pk=0a0b"}, Addresses: shared})
+	peers.add(&PeerInfo{Service: "_drift._tcp", Instance: "bob", Domain: "local.", Records: []string{"pk=0C0D"}, Addresses: shared})
+
+	if found := peers.GetByKey([]byte{0x0a, 0x0b}); len(found) != 1 || found[0].Instance != "alice" {
+		t.Errorf("Expected alice for her key, got %v", found)
+	}
+	if found := peers.GetByKey([]byte{0x0c, 0x0d}); len(found) != 1 || found[0].Instance != "bob" {
+		t.Errorf("Expected bob for his upper case key, got %v", found)
+	}
+	if found := peers.GetByKey([]byte{0x0a}); len(found) != 0 {
+		t.Errorf("Expected no peer for an unknown key, got %v", found)
+	}
+
+	peers.add(&PeerInfo{Service: "_drift._tcp", Instance: "mallory", Domain: "local.", Records: []string{"pk=0a0b"}, Addresses: shared})
+	found := peers.GetByKey([]byte{0x0a, 0x0b})
+	if len(found) != 2 || found[0].Instance != "alice" || found[1].Instance != "mallory" {
+		t.Errorf("Expected alice and mallory advertising her key, got %v", found)
+	}
+}
+
+// fakeAddr is a net.Addr that is only known by its string form
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "fake" }
+func (a fakeAddr) String() string  { return string(a) }
+
+func TestPeersGetByAddr(t *testing.T) {
+	peers := &Peers{
+		mu:    &sync.RWMutex{},
+		peers: make(map[string]*PeerInfo),
+	}
+	peers.add(&PeerInfo{Service: "_drift._tcp", Instance: "alice", Domain: "local.", Addresses: []netip.Addr{
+		netip.MustParseAddr("192.168.1.100"),
+		netip.MustParseAddr("fe80::1"),
+	}})
+	peers.add(&PeerInfo{Service: "_drift._tcp", Instance: "bob", Domain: "local.", Addresses: []netip.Addr{
+		netip.MustParseAddr("192.168.1.102"),
+	}})
+	peers.add(&PeerInfo{Service: "_drift._tcp", Instance: "alice-phone", Domain: "local.", Addresses: []netip.Addr{
+		netip.MustParseAddr("192.168.1.102"),
+	}})
+
+	for _, addr := range []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("192.168.1.100"), Port: 1234},
+		&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 1234, Zone: "eth0"},
+		fakeAddr("[fe80::1%eth0]:1234"),
+		fakeAddr("192.168.1.100:1234"),
+	} {
+		if found := peers.GetByAddr(addr); len(found) != 1 || found[0].Instance != "alice" {
+			t.Errorf("Expected alice for %s, got %v", addr, found)
+		}
+	}
+	found := peers.GetByAddr(&net.TCPAddr{IP: net.ParseIP("192.168.1.102"), Port: 1234})
+	if len(found) != 2 || found[0].Instance != "alice-phone" || found[1].Instance != "bob" {
+		t.Errorf("Expected alice-phone and bob sharing an address, got %v", found)
+	}
+	for _, addr := range []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("192.168.1.101"), Port: 1234},
+		fakeAddr("not an address"),
+	} {
+		if found := peers.GetByAddr(addr); len(found) != 0 {
+			t.Errorf("Expected no peer for %s, got %v", addr, found)
+		}
+	}
+}